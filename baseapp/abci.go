@@ -333,8 +333,17 @@ func (app *BaseApp) DeliverTx(ctx sdk.Context, req abci.RequestDeliverTx, tx sdk
 	return
 }
 
+// workingHashInvalidator is implemented by multistores that cache their working
+// hash, which must be invalidated when their state is written.
+type workingHashInvalidator interface {
+	InvalidateWorkingHash()
+}
+
 func (app *BaseApp) WriteState() sdk.CommitMultiStore {
 	app.stateToCommit.ms.Write()
+	if cms, ok := app.cms.(workingHashInvalidator); ok {
+		cms.InvalidateWorkingHash()
+	}
 	return app.cms
 }
 
@@ -662,6 +671,7 @@ func (app *BaseApp) handleQueryGRPC(handler GRPCQueryHandler, req abci.RequestQu
 	if err != nil {
 		return sdkerrors.QueryResultWithDebug(err, app.trace)
 	}
+	defer closeQueryContext(ctx)
 
 	res, err := handler(ctx, req)
 	if err != nil {
@@ -705,7 +715,9 @@ func checkNegativeHeight(height int64) error {
 }
 
 // CreateQueryContext creates a new sdk.Context for a query, taking as args
-// the block height and whether the query needs a proof or not.
+// the block height and whether the query needs a proof or not. The multistore
+// of the returned context must be released with closeQueryContext once the
+// query is done, as it may hold a historical query slot.
 func (app *BaseApp) CreateQueryContext(height int64, prove bool) (sdk.Context, error) {
 	if err := checkNegativeHeight(height); err != nil {
 		return sdk.Context{}, err
@@ -751,6 +763,14 @@ func (app *BaseApp) CreateQueryContext(height int64, prove bool) (sdk.Context, e
 	return ctx, nil
 }
 
+// closeQueryContext closes the branched multistore of a context created by
+// CreateQueryContext.
+func closeQueryContext(ctx sdk.Context) {
+	if cms, ok := ctx.MultiStore().(sdk.CacheMultiStore); ok {
+		cms.Close()
+	}
+}
+
 // GetBlockRetentionHeight returns the height for which all blocks below this height
 // are pruned from Tendermint. Given a commitment height and a non-zero local
 // minRetainBlocks configuration, the retentionHeight is the smallest height that
@@ -945,6 +965,7 @@ func handleQueryCustom(app *BaseApp, path []string, req abci.RequestQuery) abci.
 	if err != nil {
 		return sdkerrors.QueryResultWithDebug(err, app.trace)
 	}
+	defer closeQueryContext(ctx)
 
 	// Passes the rest of the path as an argument to the querier.
 	//
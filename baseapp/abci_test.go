@@ -10,6 +10,7 @@ import (
 	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
 	dbm "github.com/tendermint/tm-db"
 
+	"github.com/cosmos/cosmos-sdk/store/rootmulti"
 	"github.com/cosmos/cosmos-sdk/testutil"
 	sdk "github.com/cosmos/cosmos-sdk/types"
 )
@@ -164,6 +165,30 @@ func TestBaseAppCreateQueryContext(t *testing.T) {
 	}
 }
 
+func TestBaseAppQueryReleasesHistoricalQuerySlot(t *testing.T) {
+	logger := defaultLogger()
+	db := dbm.NewMemDB()
+	app := NewBaseApp(t.Name(), logger, db, nil, nil, &testutil.TestAppOpts{})
+
+	app.FinalizeBlock(context.Background(), &abci.RequestFinalizeBlock{Height: 1})
+	app.SetDeliverStateToCommit()
+	app.Commit(context.Background())
+
+	rs, ok := app.cms.(*rootmulti.Store)
+	require.True(t, ok)
+	rs.SetHistoricalQueryConcurrency(1)
+	rs.SetHistoricalQueryFailFast(true)
+
+	handler := func(ctx sdk.Context, req abci.RequestQuery) (abci.ResponseQuery, error) {
+		return abci.ResponseQuery{Height: req.Height}, nil
+	}
+	// With a single slot, a leaked branch makes the second query fail.
+	for i := 0; i < 2; i++ {
+		res := app.handleQueryGRPC(handler, abci.RequestQuery{Height: 1})
+		require.True(t, res.IsOK(), res.Log)
+	}
+}
+
 type paramStore struct {
 	db *dbm.MemDB
 }
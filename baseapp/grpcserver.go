@@ -51,6 +51,7 @@ func (app *BaseApp) RegisterGRPCServer(server gogogrpc.Server) {
 		if err != nil {
 			return nil, err
 		}
+		defer closeQueryContext(sdkCtx)
 
 		// Add relevant gRPC headers
 		if height == 0 {
@@ -193,3 +193,18 @@ func (m *hungSnapshotter) Restore(
 ) (snapshottypes.SnapshotItem, error) {
 	panic("not implemented")
 }
+
+// formatSnapshotter is a mockSnapshotter whose snapshots are of another format
+// than CurrentFormat.
+type formatSnapshotter struct {
+	mockSnapshotter
+	format uint32
+}
+
+func (m *formatSnapshotter) SnapshotFormat() uint32 {
+	return m.format
+}
+
+func (m *formatSnapshotter) SupportedSnapshotFormats() []uint32 {
+	return []uint32{types.CurrentFormat, m.format}
+}
@@ -178,7 +178,7 @@ func (m *Manager) Create(height uint64) (*types.Snapshot, error) {
 	ch := make(chan io.ReadCloser)
 	go m.createSnapshot(height, ch)
 
-	return m.store.Save(height, types.CurrentFormat, ch)
+	return m.store.Save(height, m.snapshotFormat(), ch)
 }
 
 // createSnapshot do the heavy work of snapshotting after the validations of request are done
@@ -261,7 +261,7 @@ func (m *Manager) Restore(snapshot types.Snapshot) error {
 	defer m.mtx.Unlock()
 
 	// check multistore supported format preemptive
-	if snapshot.Format != types.CurrentFormat {
+	if !m.isSnapshotFormatSupported(snapshot.Format) {
 		return sdkerrors.Wrapf(types.ErrUnknownFormat, "snapshot format %v", snapshot.Format)
 	}
 	if snapshot.Height == 0 {
@@ -387,6 +387,29 @@ func (m *Manager) RestoreChunk(chunk []byte) (bool, error) {
 	return false, nil
 }
 
+// snapshotFormat returns the format of the snapshots of the multistore.
+func (m *Manager) snapshotFormat() uint32 {
+	if multistore, ok := m.multistore.(types.FormatSnapshotter); ok {
+		return multistore.SnapshotFormat()
+	}
+	return types.CurrentFormat
+}
+
+// isSnapshotFormatSupported returns if the multistore supports restoration from
+// the given format.
+func (m *Manager) isSnapshotFormatSupported(format uint32) bool {
+	multistore, ok := m.multistore.(types.FormatSnapshotter)
+	if !ok {
+		return format == types.CurrentFormat
+	}
+	for _, i := range multistore.SupportedSnapshotFormats() {
+		if i == format {
+			return true
+		}
+	}
+	return false
+}
+
 // IsFormatSupported returns if the snapshotter supports restoration from given format.
 func IsFormatSupported(snapshotter types.ExtensionSnapshotter, format uint32) bool {
 	for _, i := range snapshotter.SupportedFormats() {
@@ -210,3 +210,35 @@ func TestManager_Restore(t *testing.T) {
 	})
 	require.NoError(t, err)
 }
+
+func TestManager_SnapshotFormat(t *testing.T) {
+	store := setupStore(t)
+	snapshotter := &formatSnapshotter{mockSnapshotter: mockSnapshotter{items: [][]byte{{1, 2, 3}}}, format: 257}
+	manager := snapshots.NewManager(store, snapshotter, log.NewNopLogger())
+
+	// snapshots are taken in the format of the multistore
+	snapshot, err := manager.Create(5)
+	require.NoError(t, err)
+	require.EqualValues(t, 257, snapshot.Format)
+
+	// and restored from any of its supported formats
+	target := &formatSnapshotter{format: 257}
+	manager = snapshots.NewManager(store, target, log.NewNopLogger())
+	chunks := snapshotItems([][]byte{{1, 2, 3}})
+	err = manager.Restore(types.Snapshot{
+		Height:   3,
+		Format:   513,
+		Hash:     []byte{1, 2, 3},
+		Chunks:   uint32(len(chunks)),
+		Metadata: types.Metadata{ChunkHashes: checksums(chunks)},
+	})
+	require.ErrorIs(t, err, types.ErrUnknownFormat)
+	err = manager.Restore(types.Snapshot{
+		Height:   3,
+		Format:   257,
+		Hash:     []byte{1, 2, 3},
+		Chunks:   uint32(len(chunks)),
+		Metadata: types.Metadata{ChunkHashes: checksums(chunks)},
+	})
+	require.NoError(t, err)
+}
@@ -17,6 +17,20 @@ type Snapshotter interface {
 	Restore(height uint64, format uint32, protoReader protoio.Reader) (SnapshotItem, error)
 }
 
+// FormatSnapshotter is a Snapshotter whose snapshots can be of another format
+// than CurrentFormat, e.g. when they are compressed. The snapshot manager uses
+// it to record the format of the snapshots it takes and to check the formats it
+// can restore.
+type FormatSnapshotter interface {
+	Snapshotter
+
+	// SnapshotFormat returns the format of the snapshots it takes.
+	SnapshotFormat() uint32
+
+	// SupportedSnapshotFormats returns a list of formats it can restore from.
+	SupportedSnapshotFormats() []uint32
+}
+
 // ExtensionSnapshotter is an extension Snapshotter that is appended to the snapshot stream.
 // ExtensionSnapshotter has an unique name and manages it's own internal formats.
 type ExtensionSnapshotter interface {
@@ -3,6 +3,7 @@ package cache
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/cosmos/cosmos-sdk/store/cachekv"
 	"github.com/cosmos/cosmos-sdk/store/types"
@@ -34,6 +35,10 @@ type (
 		// the same CommitKVStoreCache may be accessed concurrently by multiple
 		// goroutines due to transaction parallelization
 		mtx sync.RWMutex
+
+		// hits and misses count the reads served by the cache and the ones
+		// delegated to the underlying CommitKVStore
+		hits, misses atomic.Uint64
 	}
 
 	// CommitKVStoreCacheManager maintains a mapping from a StoreKey to a
@@ -97,11 +102,33 @@ func (cmgr *CommitKVStoreCacheManager) Reset() {
 	}
 }
 
+// Stats returns the number of cache hits and misses of all the caches managed.
+// Resetting the caches does not reset the counts.
+func (cmgr *CommitKVStoreCacheManager) Stats() (hits, misses uint64) {
+	for _, ckv := range cmgr.caches {
+		h, m := ckv.(*CommitKVStoreCache).Stats()
+		hits += h
+		misses += m
+	}
+	return hits, misses
+}
+
 // CacheWrap implements the CacheWrapper interface
 func (ckv *CommitKVStoreCache) CacheWrap(storeKey types.StoreKey) types.CacheWrap {
 	return cachekv.NewStore(ckv, storeKey, ckv.cacheKVSize)
 }
 
+// KVStoreAtVersion implements types.VersionedKVStore, loading the version from
+// the parent store without going through the cache, which only holds the
+// latest state. It fails if the parent store cannot load versions.
+func (ckv *CommitKVStoreCache) KVStoreAtVersion(version int64) (types.KVStore, error) {
+	parent, ok := ckv.CommitKVStore.(types.VersionedKVStore)
+	if !ok {
+		return nil, fmt.Errorf("store of type %T cannot load versions", ckv.CommitKVStore)
+	}
+	return parent.KVStoreAtVersion(version)
+}
+
 // getFromCache queries the write-through cache for a value by key.
 func (ckv *CommitKVStoreCache) getFromCache(key []byte) ([]byte, bool) {
 	ckv.mtx.RLock()
@@ -125,13 +152,21 @@ func (ckv *CommitKVStoreCache) Get(key []byte) []byte {
 	types.AssertValidKey(key)
 
 	if value, ok := ckv.getFromCache(key); ok {
+		ckv.hits.Add(1)
 		return value
 	}
 
 	// if not found in the cache, query the underlying CommitKVStore and init cache value
+	ckv.misses.Add(1)
 	return ckv.getAndWriteToCache(key)
 }
 
+// Stats returns the number of reads served by the cache and the number of
+// reads delegated to the underlying CommitKVStore since the cache was created.
+func (ckv *CommitKVStoreCache) Stats() (hits, misses uint64) {
+	return ckv.hits.Load(), ckv.misses.Load()
+}
+
 // Set inserts a key/value pair into both the write-through cache and the
 // underlying CommitKVStore.
 func (ckv *CommitKVStoreCache) Set(key, value []byte) {
@@ -67,3 +67,27 @@ func TestStoreCache(t *testing.T) {
 		require.Nil(t, store.Get(key))
 	}
 }
+
+func TestStoreCacheStats(t *testing.T) {
+	mngr := cache.NewCommitKVStoreCacheManager(cache.DefaultCommitKVStoreCacheSize, types.DefaultCacheSizeLimit)
+	for _, name := range []string{"test1", "test2"} {
+		tree, err := iavl.NewMutableTree(dbm.NewMemDB(), 100, false)
+		require.NoError(t, err)
+		kvStore := mngr.GetStoreCache(types.NewKVStoreKey(name), iavlstore.UnsafeNewStore(tree))
+
+		kvStore.Get([]byte("key")) // miss
+		kvStore.Get([]byte("key")) // hit
+		kvStore.Set([]byte("other"), []byte("value"))
+		kvStore.Get([]byte("other")) // hit
+	}
+
+	hits, misses := mngr.Stats()
+	require.Equal(t, uint64(4), hits)
+	require.Equal(t, uint64(2), misses)
+
+	// resetting the caches keeps the counts
+	mngr.Reset()
+	hits, misses = mngr.Stats()
+	require.Equal(t, uint64(4), hits)
+	require.Equal(t, uint64(2), misses)
+}
@@ -364,6 +364,18 @@ func (store *Store) isDeleted(key string) bool {
 	return ok
 }
 
+// CacheByteSize returns an estimate of the memory held by the cache, as the total
+// size of the keys and values of the entries staged in it. Deletions only count
+// their keys.
+func (store *Store) CacheByteSize() int64 {
+	var size int64
+	store.cache.Range(func(key, value any) bool {
+		size += int64(len(key.(string)) + len(value.(*types.CValue).Value()))
+		return true
+	})
+	return size
+}
+
 func (store *Store) GetParent() types.KVStore {
 	return store.parent
 }
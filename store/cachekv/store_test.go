@@ -121,6 +121,33 @@ func TestCacheKVStoreNested(t *testing.T) {
 	require.Equal(t, valFmt(3), mem.Get(keyFmt(1)))
 }
 
+func TestCacheKVStoreCacheByteSize(t *testing.T) {
+	mem := dbadapter.Store{DB: dbm.NewMemDB()}
+	st := cachekv.NewStore(mem, types.NewKVStoreKey("CacheKvTest"), types.DefaultCacheSizeLimit)
+	require.Zero(t, st.CacheByteSize())
+
+	// keys are 11 bytes and values 13 bytes
+	st.Set(keyFmt(1), valFmt(1))
+	st.Set(keyFmt(2), valFmt(2))
+	require.EqualValues(t, 48, st.CacheByteSize())
+
+	// overwriting an entry doesn't count it twice
+	st.Set(keyFmt(1), valFmt(3))
+	require.EqualValues(t, 48, st.CacheByteSize())
+
+	// reads are not staged
+	mem.Set(keyFmt(3), valFmt(3))
+	require.Equal(t, valFmt(3), st.Get(keyFmt(3)))
+	require.EqualValues(t, 48, st.CacheByteSize())
+
+	// deletions only count their key
+	st.Delete(keyFmt(2))
+	require.EqualValues(t, 35, st.CacheByteSize())
+
+	st.Write()
+	require.Zero(t, st.CacheByteSize())
+}
+
 func TestCacheKVIteratorBounds(t *testing.T) {
 	st := newCacheKVStore()
 
@@ -25,12 +25,17 @@ type Store struct {
 	db     types.CacheKVStore
 	stores map[types.StoreKey]types.CacheWrap
 	keys   map[string]types.StoreKey
+	// parents are the stores the multi-store was branched from, before any
+	// branching or wrapping, from which past versions are loaded.
+	parents map[types.StoreKey]types.CacheWrapper
 
 	traceWriter  io.Writer
 	traceContext types.TraceContext
 
 	listeners map[types.StoreKey][]types.WriteListener
-	closers   []io.Closer
+	// closers is shared by pointer so that closers added through the value
+	// receiver of AddCloser are visible to Close.
+	closers *[]io.Closer
 }
 
 var _ types.CacheMultiStore = Store{}
@@ -50,10 +55,11 @@ func NewFromKVStore(
 		db:           cachekv.NewStore(store, nil, types.DefaultCacheSizeLimit),
 		stores:       make(map[types.StoreKey]types.CacheWrap, len(stores)),
 		keys:         keys,
+		parents:      stores,
 		traceWriter:  traceWriter,
 		traceContext: traceContext,
 		listeners:    listeners,
-		closers:      []io.Closer{},
+		closers:      &[]io.Closer{},
 	}
 
 	for key, store := range stores {
@@ -85,7 +91,9 @@ func newCacheMultiStoreFromCMS(cms Store) Store {
 		stores[k] = v
 	}
 
-	return NewFromKVStore(cms.db, stores, nil, cms.traceWriter, cms.traceContext, nil)
+	branch := NewFromKVStore(cms.db, stores, nil, cms.traceWriter, cms.traceContext, nil)
+	branch.parents = cms.parents
+	return branch
 }
 
 // SetTracer sets the tracer for the MultiStore that the underlying
@@ -180,13 +188,39 @@ func (cms Store) CacheMultiStore() types.CacheMultiStore {
 	return newCacheMultiStoreFromCMS(cms)
 }
 
-// CacheMultiStoreWithVersion implements the MultiStore interface. It will panic
-// as an already cached multi-store cannot load previous versions.
-//
-// TODO: The store implementation can possibly be modified to support this as it
-// seems safe to load previous versions (heights).
-func (cms Store) CacheMultiStoreWithVersion(_ int64) (types.CacheMultiStore, error) {
-	panic("cannot branch cached multi-store with a version")
+// CacheMultiStoreWithVersion implements the MultiStore interface. It branches
+// the stores the multi-store was created from at the given version, so the
+// writes pending in the multi-store and the ones it was branched from are not
+// visible. Transient and memory stores have no history and are branched as they
+// are. An error is returned if any other store cannot load the version, see
+// types.VersionedKVStore.
+func (cms Store) CacheMultiStoreWithVersion(version int64) (types.CacheMultiStore, error) {
+	stores := make(map[types.StoreKey]types.CacheWrapper, len(cms.parents))
+	for key, parent := range cms.parents {
+		store, err := storeAtVersion(key, parent, version)
+		if err != nil {
+			return nil, err
+		}
+		stores[key] = store
+	}
+	return NewFromKVStore(cms.db, stores, cms.keys, cms.traceWriter, cms.traceContext, nil), nil
+}
+
+// storeAtVersion returns a read-only view of the store at the given version.
+func storeAtVersion(key types.StoreKey, store types.CacheWrapper, version int64) (types.KVStore, error) {
+	switch s := store.(type) {
+	case types.VersionedKVStore:
+		kvStore, err := s.KVStoreAtVersion(version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load store %s at version %d: %w", key.Name(), version, err)
+		}
+		return kvStore, nil
+	case types.KVStore:
+		if typ := s.GetStoreType(); typ == types.StoreTypeTransient || typ == types.StoreTypeMemory {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("store %s of type %T cannot load versions", key.Name(), store)
 }
 
 // GetStore returns an underlying Store by key.
@@ -207,6 +241,29 @@ func (cms Store) GetKVStore(key types.StoreKey) types.KVStore {
 	return store.(types.KVStore)
 }
 
+// cacheByteSizer is implemented by branched stores that can estimate the size
+// of their pending writes.
+type cacheByteSizer interface {
+	CacheByteSize() int64
+}
+
+// CacheByteSize returns an estimate of the bytes staged in the branch, as the
+// total size of the keys and values cached by the db and all substores.
+// Substores that cannot estimate their size, e.g. ones replaced through
+// SetKVStores, are not counted.
+func (cms Store) CacheByteSize() int64 {
+	var size int64
+	if s, ok := cms.db.(cacheByteSizer); ok {
+		size += s.CacheByteSize()
+	}
+	for _, store := range cms.stores {
+		if s, ok := store.(cacheByteSizer); ok {
+			size += s.CacheByteSize()
+		}
+	}
+	return size
+}
+
 func (cms Store) GetWorkingHash() ([]byte, error) {
 	panic("should never attempt to get working hash from cache multi store")
 }
@@ -233,11 +290,14 @@ func (cms Store) CacheMultiStoreForExport(_ int64) (types.CacheMultiStore, error
 }
 
 func (cms Store) AddCloser(closer io.Closer) {
-	cms.closers = append(cms.closers, closer)
+	*cms.closers = append(*cms.closers, closer)
 }
 
 func (cms Store) Close() {
-	for _, closer := range cms.closers {
+	if cms.closers == nil {
+		return
+	}
+	for _, closer := range *cms.closers {
 		closer.Close()
 	}
 }
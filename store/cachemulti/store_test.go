@@ -1,11 +1,18 @@
 package cachemulti
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 
-	"github.com/cosmos/cosmos-sdk/store/types"
 	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/libs/log"
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/cosmos-sdk/store/dbadapter"
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	"github.com/cosmos/cosmos-sdk/store/transient"
+	"github.com/cosmos/cosmos-sdk/store/types"
 )
 
 func TestStoreGetKVStore(t *testing.T) {
@@ -21,3 +28,171 @@ func TestStoreGetKVStore(t *testing.T) {
 	require.PanicsWithValue(errMsg,
 		func() { s.GetKVStore(key) })
 }
+
+type recordingListener struct {
+	writes int
+}
+
+func (l *recordingListener) OnWrite(_ types.StoreKey, _ []byte, _ []byte, _ bool) error {
+	l.writes++
+	return nil
+}
+
+// readYourWritesSentinel is the key/value pair written by assertReadYourWrites.
+var (
+	readYourWritesSentinelKey   = []byte("__cachemulti_read_your_writes__")
+	readYourWritesSentinelValue = []byte("sentinel")
+)
+
+// assertReadYourWrites writes a sentinel entry into a scratch branch of the
+// given store of cms, stacked on its tracing, listening and caching wrappers,
+// and returns an error if reading it back gives a different value. The scratch
+// branch is discarded, so cms is left untouched and no trace or listener events
+// are emitted.
+func assertReadYourWrites(cms Store, key types.StoreKey) error {
+	if key == nil || cms.stores[key] == nil {
+		return fmt.Errorf("kv store with key %v has not been registered in stores", key)
+	}
+	scratch := cms.GetKVStore(key).CacheWrap(key).(types.KVStore)
+
+	scratch.Set(readYourWritesSentinelKey, readYourWritesSentinelValue)
+	got := scratch.Get(readYourWritesSentinelKey)
+	if !bytes.Equal(got, readYourWritesSentinelValue) {
+		return fmt.Errorf("read-your-writes violated for store %s: wrote %X, read %X",
+			key.Name(), readYourWritesSentinelValue, got)
+	}
+	return nil
+}
+
+func TestAssertReadYourWrites(t *testing.T) {
+	key := types.NewKVStoreKey("store")
+	newParents := func() map[types.StoreKey]types.CacheWrapper {
+		return map[types.StoreKey]types.CacheWrapper{
+			key: dbadapter.Store{DB: dbm.NewMemDB()},
+		}
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		cms := NewStore(dbm.NewMemDB(), newParents(), nil, nil, nil, nil)
+		require.NoError(t, assertReadYourWrites(cms, key))
+	})
+
+	t.Run("traced", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		cms := NewStore(dbm.NewMemDB(), newParents(), nil, buf, nil, nil)
+		require.NoError(t, assertReadYourWrites(cms, key))
+		cms.Write()
+		require.Zero(t, buf.Len())
+	})
+
+	t.Run("listened", func(t *testing.T) {
+		listener := &recordingListener{}
+		listeners := map[types.StoreKey][]types.WriteListener{key: {listener}}
+		cms := NewStore(dbm.NewMemDB(), newParents(), nil, nil, nil, listeners)
+		require.NoError(t, assertReadYourWrites(cms, key))
+		cms.Write()
+		require.Zero(t, listener.writes)
+	})
+
+	t.Run("branch is untouched", func(t *testing.T) {
+		parents := newParents()
+		cms := NewStore(dbm.NewMemDB(), parents, nil, nil, nil, nil)
+		store := cms.GetKVStore(key)
+		store.Set(readYourWritesSentinelKey, []byte("original"))
+		require.NoError(t, assertReadYourWrites(cms, key))
+		require.Equal(t, []byte("original"), store.Get(readYourWritesSentinelKey))
+
+		cms = NewStore(dbm.NewMemDB(), parents, nil, nil, nil, nil)
+		require.NoError(t, assertReadYourWrites(cms, key))
+		require.Nil(t, cms.GetKVStore(key).Get(readYourWritesSentinelKey))
+	})
+
+	t.Run("unknown store", func(t *testing.T) {
+		cms := NewStore(dbm.NewMemDB(), newParents(), nil, nil, nil, nil)
+		require.Error(t, assertReadYourWrites(cms, types.NewKVStoreKey("unknown")))
+	})
+}
+
+func TestStoreCacheByteSize(t *testing.T) {
+	key1, key2 := types.NewKVStoreKey("store1"), types.NewKVStoreKey("store2")
+	parents := map[types.StoreKey]types.CacheWrapper{
+		key1: dbadapter.Store{DB: dbm.NewMemDB()},
+		key2: dbadapter.Store{DB: dbm.NewMemDB()},
+	}
+	cms := NewStore(dbm.NewMemDB(), parents, nil, nil, nil, nil)
+	require.Zero(t, cms.CacheByteSize())
+
+	cms.GetKVStore(key1).Set([]byte("key"), []byte("value"))
+	cms.GetKVStore(key2).Set([]byte("k"), []byte("v"))
+	cms.db.Set([]byte("dbkey"), []byte("dbvalue"))
+	require.EqualValues(t, 8+2+12, cms.CacheByteSize())
+
+	cms.Write()
+	require.Zero(t, cms.CacheByteSize())
+}
+
+type recordingCloser struct {
+	closed int
+}
+
+func (c *recordingCloser) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestStoreAddCloser(t *testing.T) {
+	cms := NewStore(dbm.NewMemDB(), map[types.StoreKey]types.CacheWrapper{}, nil, nil, nil, nil)
+	closer := &recordingCloser{}
+	cms.AddCloser(closer)
+	cms.Close()
+	require.Equal(t, 1, closer.closed)
+
+	// a store without closers can always be closed
+	require.NotPanics(t, func() { Store{}.Close() })
+}
+
+func TestStoreCacheMultiStoreWithVersion(t *testing.T) {
+	iavlKey, transientKey := types.NewKVStoreKey("iavl"), types.NewTransientStoreKey("transient")
+	iavlStore, err := iavl.LoadStore(dbm.NewMemDB(), log.NewNopLogger(), iavlKey, types.CommitID{}, false, 100, false, nil)
+	require.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		iavlStore.(types.KVStore).Set([]byte("key"), []byte{byte(i)})
+		iavlStore.Commit(true)
+	}
+	transientStore := transient.NewStore()
+	transientStore.Set([]byte("key"), []byte("transient"))
+
+	cms := NewStore(dbm.NewMemDB(), map[types.StoreKey]types.CacheWrapper{
+		iavlKey:      iavlStore,
+		transientKey: transientStore,
+	}, nil, nil, nil, nil)
+	cms.GetKVStore(iavlKey).Set([]byte("key"), []byte("pending"))
+
+	// pending writes are not visible in past versions
+	branch, err := cms.CacheMultiStoreWithVersion(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, branch.GetKVStore(iavlKey).Get([]byte("key")))
+	require.Equal(t, []byte("transient"), branch.GetKVStore(transientKey).Get([]byte("key")))
+
+	nested, err := cms.CacheMultiStore().CacheMultiStoreWithVersion(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, nested.GetKVStore(iavlKey).Get([]byte("key")))
+
+	// a branch at a version only has that version
+	again, err := branch.CacheMultiStoreWithVersion(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, again.GetKVStore(iavlKey).Get([]byte("key")))
+	_, err = branch.CacheMultiStoreWithVersion(2)
+	require.ErrorContains(t, err, "failed to load store iavl at version 2")
+
+	_, err = cms.CacheMultiStoreWithVersion(3)
+	require.ErrorContains(t, err, "failed to load store iavl at version 3")
+
+	// stores without history cannot be branched at a version
+	dbKey := types.NewKVStoreKey("db")
+	cms = NewStore(dbm.NewMemDB(), map[types.StoreKey]types.CacheWrapper{
+		dbKey: dbadapter.Store{DB: dbm.NewMemDB()},
+	}, nil, nil, nil, nil)
+	_, err = cms.CacheMultiStoreWithVersion(1)
+	require.EqualError(t, err, "store db of type dbadapter.Store cannot load versions")
+}
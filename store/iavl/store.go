@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ics23 "github.com/confio/ics23/go"
@@ -33,12 +34,16 @@ var (
 	_ types.CommitKVStore           = (*Store)(nil)
 	_ types.Queryable               = (*Store)(nil)
 	_ types.StoreWithInitialVersion = (*Store)(nil)
+	_ types.VersionedKVStore        = (*Store)(nil)
 )
 
 // Store Implements types.KVStore and CommitKVStore.
 type Store struct {
 	tree    Tree
 	treeMtx *sync.RWMutex
+
+	// writes counts the sets and deletes since the last commit.
+	writes atomic.Int64
 }
 
 // LoadStore returns an IAVL Store as a CommitKVStore. Internally, it will load the
@@ -142,6 +147,16 @@ func (st *Store) GetImmutable(version int64) (*Store, error) {
 	}, nil
 }
 
+// KVStoreAtVersion implements types.VersionedKVStore. Unlike GetImmutable, it
+// fails if the version does not exist or has been pruned. An immutable store
+// only has the version it was loaded at.
+func (st *Store) KVStoreAtVersion(version int64) (types.KVStore, error) {
+	if !st.VersionExists(version) {
+		return nil, fmt.Errorf("%w: %d", iavl.ErrVersionDoesNotExist, version)
+	}
+	return st.GetImmutable(version)
+}
+
 func (st *Store) GetWorkingHash() ([]byte, error) {
 	return st.tree.WorkingHash()
 }
@@ -166,6 +181,7 @@ func (st *Store) Commit(bumpVersion bool) types.CommitID {
 	if err != nil {
 		panic(err)
 	}
+	st.writes.Store(0)
 
 	return types.CommitID{
 		Version: version,
@@ -173,6 +189,12 @@ func (st *Store) Commit(bumpVersion bool) types.CommitID {
 	}
 }
 
+// PendingWrites returns the number of sets and deletes made since the last
+// commit.
+func (st *Store) PendingWrites() int64 {
+	return st.writes.Load()
+}
+
 // LastCommitID implements Committer.
 func (st *Store) LastCommitID() types.CommitID {
 	hash, err := st.tree.Hash()
@@ -198,6 +220,20 @@ func (st *Store) GetPruning() types.PruningOptions {
 	panic("cannot get pruning options on an initialized IAVL store")
 }
 
+// LeafCount returns the number of keys in the working tree, i.e. its leaf nodes.
+func (st *Store) LeafCount() int64 {
+	st.treeMtx.RLock()
+	defer st.treeMtx.RUnlock()
+	switch tree := st.tree.(type) {
+	case *immutableTree:
+		return tree.Size()
+	case *iavl.MutableTree:
+		return tree.ImmutableTree().Size()
+	default:
+		panic(fmt.Sprintf("unexpected tree type %T", st.tree))
+	}
+}
+
 // VersionExists returns whether or not a given version is stored.
 func (st *Store) VersionExists(version int64) bool {
 	return st.tree.VersionExists(version)
@@ -233,6 +269,7 @@ func (st *Store) Set(key, value []byte) {
 	types.AssertValidKey(key)
 	types.AssertValidValue(value)
 	st.tree.Set(key, value)
+	st.writes.Add(1)
 }
 
 // Implements types.KVStore.
@@ -259,6 +296,7 @@ func (st *Store) Has(key []byte) (exists bool) {
 func (st *Store) Delete(key []byte) {
 	defer telemetry.MeasureSince(time.Now(), "store", "iavl", "delete")
 	st.tree.Remove(key)
+	st.writes.Add(1)
 }
 
 // DeleteVersions deletes a series of versions from the MutableTree. An error
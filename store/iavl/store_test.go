@@ -146,6 +146,30 @@ func TestGetImmutable(t *testing.T) {
 	require.Panics(t, func() { newStore.Commit(true) })
 }
 
+func TestKVStoreAtVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree, cID := newAlohaTree(t, db)
+	store := UnsafeNewStore(tree)
+
+	_, err := tree.Set([]byte("hello"), []byte("adios"))
+	require.NoError(t, err)
+	_, ver, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	old, err := store.KVStoreAtVersion(cID.Version)
+	require.NoError(t, err)
+	require.Equal(t, []byte("goodbye"), old.Get([]byte("hello")))
+
+	_, err = store.KVStoreAtVersion(ver + 1)
+	require.ErrorIs(t, err, iavl.ErrVersionDoesNotExist)
+
+	// an immutable store only has its own version
+	_, err = old.(*Store).KVStoreAtVersion(cID.Version)
+	require.NoError(t, err)
+	_, err = old.(*Store).KVStoreAtVersion(ver)
+	require.ErrorIs(t, err, iavl.ErrVersionDoesNotExist)
+}
+
 func TestTestGetImmutableIterator(t *testing.T) {
 	db := dbm.NewMemDB()
 	tree, cID := newAlohaTree(t, db)
@@ -194,6 +218,21 @@ func TestIAVLStoreGetSetHasDelete(t *testing.T) {
 	require.False(t, exists)
 }
 
+func TestIAVLStorePendingWrites(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree, _ := newAlohaTree(t, db)
+	iavlStore := UnsafeNewStore(tree)
+	require.Zero(t, iavlStore.PendingWrites())
+
+	iavlStore.Set([]byte("hello"), []byte("world"))
+	iavlStore.Set([]byte("new"), []byte("value"))
+	iavlStore.Delete([]byte("aloha"))
+	require.EqualValues(t, 3, iavlStore.PendingWrites())
+
+	iavlStore.Commit(true)
+	require.Zero(t, iavlStore.PendingWrites())
+}
+
 func TestIAVLStoreNoNilSet(t *testing.T) {
 	db := dbm.NewMemDB()
 	tree, _ := newAlohaTree(t, db)
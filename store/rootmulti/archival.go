@@ -0,0 +1,102 @@
+package rootmulti
+
+import (
+	"fmt"
+	"sort"
+
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+// archivalSegment is an archival DB holding the versions from min to max,
+// both inclusive.
+type archivalSegment struct {
+	min, max int64
+	db       dbm.DB
+}
+
+// AddArchivalSegment adds an archival DB from which the versions from min to
+// max, both inclusive, are loaded rather than from the main DB. Segments must
+// not overlap, and it panics if they do. Stores with their own archival DB, see
+// SetStoreArchivalDB, ignore the segments. It must be called before loading.
+func (rs *Store) AddArchivalSegment(min, max int64, db dbm.DB) {
+	if min < 0 || max < min {
+		panic(fmt.Sprintf("invalid archival segment versions [%d, %d]", min, max))
+	}
+	i := sort.Search(len(rs.archivalSegments), func(i int) bool {
+		return rs.archivalSegments[i].min > min
+	})
+	if i > 0 && rs.archivalSegments[i-1].max >= min {
+		panic(fmt.Sprintf("archival segment [%d, %d] overlaps segment [%d, %d]",
+			min, max, rs.archivalSegments[i-1].min, rs.archivalSegments[i-1].max))
+	}
+	if i < len(rs.archivalSegments) && rs.archivalSegments[i].min <= max {
+		panic(fmt.Sprintf("archival segment [%d, %d] overlaps segment [%d, %d]",
+			min, max, rs.archivalSegments[i].min, rs.archivalSegments[i].max))
+	}
+	rs.archivalSegments = append(rs.archivalSegments, archivalSegment{})
+	copy(rs.archivalSegments[i+1:], rs.archivalSegments[i:])
+	rs.archivalSegments[i] = archivalSegment{min: min, max: max, db: db}
+}
+
+// storeArchival is the archival DB of a single store, and the version below
+// which reads are served from it.
+type storeArchival struct {
+	db      dbm.DB
+	version int64
+}
+
+// SetStoreArchivalDB sets the archival DB of the store with the given key,
+// replacing the global archival segments for that store. Versions of the store below
+// archivalVersion are loaded from db. It must be called before loading.
+func (rs *Store) SetStoreArchivalDB(key types.StoreKey, db dbm.DB, archivalVersion int64) {
+	if rs.storeArchivalDbs == nil {
+		rs.storeArchivalDbs = make(map[types.StoreKey]storeArchival)
+	}
+	rs.storeArchivalDbs[key] = storeArchival{db: db, version: archivalVersion}
+}
+
+// archivalSegmentDb returns the DB of the archival segment holding the given
+// version, or nil if there is none.
+func (rs *Store) archivalSegmentDb(ver int64) dbm.DB {
+	i := sort.Search(len(rs.archivalSegments), func(i int) bool {
+		return rs.archivalSegments[i].max >= ver
+	})
+	if i < len(rs.archivalSegments) && rs.archivalSegments[i].min <= ver {
+		return rs.archivalSegments[i].db
+	}
+	return nil
+}
+
+// archivalDbFor returns the archival DB the given version of the store should
+// be loaded from, or nil if it should be loaded from the main DB.
+func (rs *Store) archivalDbFor(key types.StoreKey, ver int64) dbm.DB {
+	if archival, ok := rs.storeArchivalDbs[key]; ok {
+		if archival.version > ver {
+			return archival.db
+		}
+		return nil
+	}
+	return rs.archivalSegmentDb(ver)
+}
+
+// archivalDbs returns the distinct archival DBs of the segments and of the
+// stores, leaving out the main DB.
+func (rs *Store) archivalDbs() []dbm.DB {
+	var dbs []dbm.DB
+	seen := map[dbm.DB]bool{rs.db: true}
+	add := func(db dbm.DB) {
+		if db != nil && !seen[db] {
+			seen[db] = true
+			dbs = append(dbs, db)
+		}
+	}
+	for _, segment := range rs.archivalSegments {
+		add(segment.db)
+	}
+	for _, key := range keysForStoreKeyMap(rs.storeArchivalDbs) {
+		add(rs.storeArchivalDbs[key].db)
+	}
+	return dbs
+}
@@ -0,0 +1,311 @@
+package rootmulti
+
+import (
+	"bytes"
+	stderrors "errors"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+// CommitPanicHandler is called with the value recovered from a panic during
+// Commit and the version being committed. Returning true swallows the panic.
+type CommitPanicHandler func(recovered interface{}, version int64) (handled bool)
+
+// CommitHasher computes the app hash of a commit info in place of the default
+// simple merkle tree over the store hashes. Version identifies its scheme: it
+// must differ from the default one, and be bumped whenever the hashing changes.
+type CommitHasher interface {
+	Hash(cInfo *types.CommitInfo) []byte
+	Version() uint32
+}
+
+// CommitBarrier is called with the committed version once Commit has flushed
+// its metadata, e.g. to wait for consumers of the version's writes to process
+// them. A returned error is handled according to the CommitBarrierPolicy.
+type CommitBarrier func(version int64) error
+
+// CommitBarrierPolicy decides what happens to the next commit when the commit
+// barrier fails.
+type CommitBarrierPolicy int
+
+const (
+	// CommitBarrierProceed records and logs the error of the barrier, and lets
+	// the next commit proceed.
+	CommitBarrierProceed CommitBarrierPolicy = iota
+	// CommitBarrierBlock blocks the next commit, retrying the barrier for the
+	// failed version until it succeeds.
+	CommitBarrierBlock
+)
+
+// commitBarrierRetryInterval is how long a commit blocked by a failed commit
+// barrier waits between retries of the barrier.
+const commitBarrierRetryInterval = 50 * time.Millisecond
+
+// commitHashVersion identifies the scheme used to hash commit infos into the
+// app hash: a simple merkle tree over the store hashes keyed by store name. It
+// must be bumped whenever that hashing changes.
+const commitHashVersion uint32 = 1
+
+// commitTimingWindow is the number of recent commits used to compute the
+// commit throughput.
+const commitTimingWindow = 100
+
+// commitTiming records when a single Commit started and ended, and how many
+// keys were written in the committed block.
+type commitTiming struct {
+	start time.Time
+	end   time.Time
+	keys  int64
+}
+
+// CommitHashVersion returns the identifier of the commit hash scheme in use,
+// which is the version of the commit hasher if one is set. Nodes reporting
+// different versions compute different app hashes for the same state, so
+// comparing it lets incompatible peers be detected before diverging.
+func (rs *Store) CommitHashVersion() uint32 {
+	if rs.commitHasher != nil {
+		return rs.commitHasher.Version()
+	}
+	return commitHashVersion
+}
+
+// SetCommitHasher sets the hasher computing the app hash of commits, working
+// hashes and read-only views. Proofs are still built against the default
+// scheme, so they do not verify against the hashes of a custom hasher. A nil
+// hasher restores the default one.
+func (rs *Store) SetCommitHasher(hasher CommitHasher) {
+	rs.commitHasher = hasher
+	rs.InvalidateWorkingHash()
+}
+
+// commitHash returns the app hash of a commit info, computed by the commit
+// hasher if one is set.
+func (rs *Store) commitHash(cInfo *types.CommitInfo) []byte {
+	if rs.commitHasher != nil {
+		return rs.commitHasher.Hash(cInfo)
+	}
+	return cInfo.Hash()
+}
+
+// SetCommitPanicRecovery sets a handler invoked when committing the stores
+// panics, e.g. so that operators can capture diagnostics before the node goes
+// down. The panic is re-raised unless the handler returns true, in which case
+// Commit returns the previous commit ID without recording the new version,
+// while CommitWithError also returns an error holding the recovered value.
+// Stores committed before the panic are not rolled back and keep the new
+// version, so the multistore must be reloaded before committing again. The
+// same block can then be replayed, as committing a version a store already has
+// with the same hash is accepted.
+func (rs *Store) SetCommitPanicRecovery(handler CommitPanicHandler) {
+	rs.commitPanicHandler = handler
+}
+
+// SetCommitBarrier sets a barrier called after every commit with the committed
+// version, once the metadata has been flushed and the listeners of its writes
+// have fired. It lets consumers of the writes, e.g. indexers, apply backpressure
+// to the store: the policy set with SetCommitBarrierPolicy decides whether a
+// failure of the barrier blocks the next commit. A nil barrier disables it.
+func (rs *Store) SetCommitBarrier(barrier CommitBarrier) {
+	rs.commitBarrier = barrier
+}
+
+// SetCommitBarrierPolicy sets how failures of the commit barrier are handled. It
+// defaults to CommitBarrierProceed.
+func (rs *Store) SetCommitBarrierPolicy(policy CommitBarrierPolicy) {
+	rs.commitBarrierPolicy = policy
+}
+
+// CommitBarrierError returns the error of the last failed run of the commit
+// barrier and the version it failed for. It is cleared once the barrier
+// succeeds again.
+func (rs *Store) CommitBarrierError() (version int64, err error) {
+	rs.commitBarrierMtx.Lock()
+	defer rs.commitBarrierMtx.Unlock()
+	return rs.commitBarrierVersion, rs.commitBarrierErr
+}
+
+// runCommitBarrier calls the commit barrier for the given version and records
+// its outcome.
+func (rs *Store) runCommitBarrier(version int64) {
+	if rs.commitBarrier == nil {
+		return
+	}
+	err := rs.commitBarrier(version)
+
+	rs.commitBarrierMtx.Lock()
+	defer rs.commitBarrierMtx.Unlock()
+	if err != nil {
+		rs.logger.Error("commit barrier failed", "version", version, "err", err)
+		rs.commitBarrierVersion, rs.commitBarrierErr = version, err
+		return
+	}
+	rs.commitBarrierVersion, rs.commitBarrierErr = 0, nil
+}
+
+// awaitCommitBarrier blocks while the commit barrier has failed under the
+// CommitBarrierBlock policy, retrying it for the failed version until it
+// succeeds.
+func (rs *Store) awaitCommitBarrier() {
+	if rs.commitBarrier == nil || rs.commitBarrierPolicy != CommitBarrierBlock {
+		return
+	}
+	for {
+		version, err := rs.CommitBarrierError()
+		if err == nil {
+			return
+		}
+		time.Sleep(commitBarrierRetryInterval)
+		rs.runCommitBarrier(version)
+	}
+}
+
+// CommitHook is notified of every commit of the stores, e.g. to flush an
+// external write-ahead log in lock-step with them.
+type CommitHook interface {
+	// PreCommit is called before the stores are committed at version. An error
+	// aborts the commit, leaving the stores untouched.
+	PreCommit(version int64) error
+	// PostCommit is called once the commit metadata has been written. Errors
+	// are logged and do not fail the commit.
+	PostCommit(cid types.CommitID) error
+}
+
+// RegisterCommitHook adds a hook notified of every commit. Hooks are called in
+// registration order. It must not be called concurrently with Commit.
+func (rs *Store) RegisterCommitHook(h CommitHook) {
+	rs.commitHooks = append(rs.commitHooks, h)
+}
+
+// runPreCommitHooks calls the PreCommit of the hooks, stopping at the first
+// error.
+func (rs *Store) runPreCommitHooks(version int64) error {
+	for _, h := range rs.commitHooks {
+		if err := h.PreCommit(version); err != nil {
+			return errors.Wrapf(err, "pre-commit hook failed for version %d", version)
+		}
+	}
+	return nil
+}
+
+// runPostCommitHooks calls the PostCommit of the hooks, logging their errors.
+func (rs *Store) runPostCommitHooks(cid types.CommitID) {
+	for _, h := range rs.commitHooks {
+		if err := h.PostCommit(cid); err != nil {
+			rs.logger.Error("post-commit hook failed", "version", cid.Version, "err", err)
+		}
+	}
+}
+
+// SetCommitParallelism sets the number of stores committed concurrently by
+// Commit. Committing the IAVL trees of large stores in parallel shortens the
+// commit, and the commit hash is unaffected. It defaults to 1, which commits
+// the stores one at a time.
+func (rs *Store) SetCommitParallelism(n int) {
+	rs.commitParallelism = n
+}
+
+// errCommitPanicRecovered is wrapped by the error CommitWithError returns when
+// the commit panic handler swallowed a panic.
+var errCommitPanicRecovered = stderrors.New("recovered from panic during commit")
+
+// commitStoresWithRecovery checks the version is monotonic and commits the
+// stores, passing any panic to the commit panic handler if one is set. If the
+// handler swallows the panic, the recovered value is returned as an error
+// wrapping errCommitPanicRecovered.
+func (rs *Store) commitStoresWithRecovery(version int64, bumpVersion bool) (cInfo *types.CommitInfo, err error) {
+	if rs.commitPanicHandler != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				if !rs.commitPanicHandler(r, version) {
+					panic(r)
+				}
+				rs.logger.Error("recovered from panic during commit", "version", version, "panic", r)
+				cInfo, err = nil, fmt.Errorf("%w at version %d: %v", errCommitPanicRecovered, version, r)
+			}
+		}()
+	}
+	if bumpVersion {
+		rs.assertMonotonicVersion(version)
+	}
+	return commitStores(version, rs.stores, bumpVersion, rs.commitParallelism), nil
+}
+
+// assertMonotonicVersion panics if an IAVL store is past the given version, or
+// has it on disk with a hash other than its working hash, which means the
+// latest version metadata does not match the store data, e.g. because it was
+// tampered with. A store having the version with the same hash is replaying a
+// commit that was not recorded, e.g. after a crash before the metadata was
+// written, which IAVL accepts.
+func (rs *Store) assertMonotonicVersion(version int64) {
+	for key := range rs.stores {
+		store, ok := rs.GetCommitKVStore(key).(*iavl.Store)
+		if !ok {
+			continue
+		}
+		last := store.LastCommitID().Version
+		if last > version {
+			panic(fmt.Sprintf("non-monotonic version: cannot commit version %d, store %s is at version %d", version, key.Name(), last))
+		}
+		if last < version && store.VersionExists(version) {
+			existing, err := store.GetImmutable(version)
+			if err != nil {
+				panic(err)
+			}
+			working, err := store.GetWorkingHash()
+			if err != nil {
+				panic(err)
+			}
+			if !bytes.Equal(existing.LastCommitID().Hash, working) {
+				panic(fmt.Sprintf("non-monotonic version: cannot commit version %d, store %s already has it with a different hash", version, key.Name()))
+			}
+		}
+	}
+}
+
+// pendingWrites returns the number of keys written to the IAVL stores since the
+// last commit.
+func (rs *Store) pendingWrites() int64 {
+	var writes int64
+	for key := range rs.stores {
+		if store, ok := rs.GetCommitKVStore(key).(*iavl.Store); ok {
+			writes += store.PendingWrites()
+		}
+	}
+	return writes
+}
+
+func (rs *Store) recordCommitTiming(start time.Time, keys int64) {
+	rs.commitTimingsMtx.Lock()
+	defer rs.commitTimingsMtx.Unlock()
+	rs.commitTimings = append(rs.commitTimings, commitTiming{start: start, end: time.Now(), keys: keys})
+	if len(rs.commitTimings) > commitTimingWindow {
+		rs.commitTimings = rs.commitTimings[len(rs.commitTimings)-commitTimingWindow:]
+	}
+}
+
+// CommitThroughput returns the rate of commits and of written keys per second
+// over the most recent commits, measured from the start of the oldest one to the
+// end of the latest one. Both rates are zero until a commit has been made.
+func (rs *Store) CommitThroughput() (commitsPerSec, keysPerSec float64) {
+	rs.commitTimingsMtx.Lock()
+	defer rs.commitTimingsMtx.Unlock()
+	if len(rs.commitTimings) == 0 {
+		return 0, 0
+	}
+
+	elapsed := rs.commitTimings[len(rs.commitTimings)-1].end.Sub(rs.commitTimings[0].start).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	var keys int64
+	for _, t := range rs.commitTimings {
+		keys += t.keys
+	}
+
+	return float64(len(rs.commitTimings)) / elapsed, float64(keys) / elapsed
+}
@@ -0,0 +1,414 @@
+package rootmulti
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cosmos/cosmos-sdk/telemetry"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/pkg/errors"
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+// commitInfoLayoutMarker starts the commit info values that are not a plain
+// protobuf encoded CommitInfo, followed by a byte identifying the layout. A
+// marshaled CommitInfo never starts with a zero byte.
+const commitInfoLayoutMarker = 0x00
+
+// commitInfoLayoutSplit identifies the layout storing a header listing the
+// stores, with the hash of each store kept under its own key and only written
+// when it changed.
+const commitInfoLayoutSplit = 0x01
+
+// commitInfoLayoutSnappy identifies a snappy compressed protobuf encoded
+// CommitInfo.
+const commitInfoLayoutSnappy = 0x02
+
+// SetCommitInfoCacheSize keeps the commit infos of up to n versions read from
+// disk by queries in an LRU cache, so that proven queries over a range of past
+// heights do not read and unmarshal them on every request. A value of zero or
+// less disables the cache, which is the default. It must not be called while
+// queries are served.
+func (rs *Store) SetCommitInfoCacheSize(n int) {
+	if n <= 0 {
+		rs.commitInfoCache = nil
+		return
+	}
+	cache, err := lru.New[int64, *types.CommitInfo](n)
+	if err != nil {
+		panic(err)
+	}
+	rs.commitInfoCache = cache
+}
+
+// readCommitInfo reads the commit info of a version from disk, going through
+// the commit info cache if set.
+func (rs *Store) readCommitInfo(version int64) (*types.CommitInfo, error) {
+	if rs.commitInfoCache == nil {
+		return getCommitInfo(rs.db, version)
+	}
+	if cInfo, ok := rs.commitInfoCache.Get(version); ok {
+		return cInfo, nil
+	}
+	cInfo, err := getCommitInfo(rs.db, version)
+	if err != nil {
+		return nil, err
+	}
+	rs.commitInfoCache.Add(version, cInfo)
+	return cInfo, nil
+}
+
+// evictCommitInfos removes the given versions from the commit info cache.
+func (rs *Store) evictCommitInfos(versions ...int64) {
+	if rs.commitInfoCache == nil {
+		return
+	}
+	for _, version := range versions {
+		rs.commitInfoCache.Remove(version)
+	}
+}
+
+// GetCommitInfo returns the commit info of a version, with the info and hash of
+// each store. The latest version is served from memory, others are read from
+// disk, or from the batched metadata not yet flushed.
+func (rs *Store) GetCommitInfo(version int64) (*types.CommitInfo, error) {
+	if cInfo := rs.LastCommitInfo(); cInfo != nil && cInfo.Version == version {
+		return cInfo, nil
+	}
+	if cInfo, ok := rs.pendingCommitInfo(version); ok {
+		return cInfo, nil
+	}
+	return rs.readCommitInfo(version)
+}
+
+// queryCommitInfo reads the commit info of a version for a query, retrying DB
+// read errors according to the query retry policy.
+func (rs *Store) queryCommitInfo(version int64) (*types.CommitInfo, error) {
+	if cInfo, ok := rs.pendingCommitInfo(version); ok {
+		return cInfo, nil
+	}
+	for attempt := 0; ; attempt++ {
+		cInfo, err := rs.readCommitInfo(version)
+		if err == nil || !isReadError(err) || attempt >= rs.queryMaxRetries {
+			return cInfo, err
+		}
+		rs.logger.Debug("retrying commit info read", "version", version, "attempt", attempt+1, "err", err)
+		time.Sleep(rs.queryRetryBackoff)
+	}
+}
+
+// SetSplitCommitInfo sets whether commit infos are flushed with the split
+// layout, which writes a small header per version and the hash of a store only
+// when it changed. This reduces the write volume per block for apps with many
+// stores. Commit infos are read back regardless of the layout they were
+// written with.
+func (rs *Store) SetSplitCommitInfo(enabled bool) {
+	rs.splitCommitInfo = enabled
+	rs.lastSplitCommitInfo = nil
+}
+
+// SetCommitInfoCompression sets whether commit infos are flushed compressed with
+// snappy. It is off by default, and applies to the protobuf layout only, the
+// split layout taking precedence when both are enabled. Commit infos are read
+// back regardless of whether they were compressed.
+func (rs *Store) SetCommitInfoCompression(enabled bool) {
+	rs.commitInfoCompression = enabled
+}
+
+// SetMetadataFlushInterval sets the number of commits whose metadata (commit
+// info, latest version and pruning heights) is batched before being written to
+// the DB, reducing the number of synced writes. A value of 1 or less, the
+// default, writes it on every commit. Any batched metadata is flushed first.
+//
+// This weakens durability: on a crash, up to n-1 of the last commits are lost
+// from the metadata even though the stores have them, and the node restarts
+// from the last flushed version and must re-sync the lost blocks. The batched
+// metadata is flushed by FlushMetadata, Close and when loading a version.
+func (rs *Store) SetMetadataFlushInterval(n int) {
+	if err := rs.FlushMetadata(); err != nil {
+		panic(err)
+	}
+	rs.metadataFlushInterval = n
+}
+
+// FlushMetadata writes the metadata batched since the last flush, if any. If
+// the write fails, the batched metadata is kept so that the flush can be
+// retried.
+func (rs *Store) FlushMetadata() error {
+	rs.pendingMetadataMtx.Lock()
+	defer rs.pendingMetadataMtx.Unlock()
+	if rs.pendingMetadata == nil {
+		return nil
+	}
+	if err := rs.pendingMetadata.WriteSync(); err != nil {
+		return errors.Wrap(err, "error on batch write")
+	}
+	rs.pendingMetadata.Close()
+	rs.pendingMetadata, rs.pendingCommits, rs.pendingCommitInfos = nil, 0, nil
+	return nil
+}
+
+// pendingCommitInfo returns the commit info of the given version if it is
+// batched and not yet flushed.
+func (rs *Store) pendingCommitInfo(version int64) (*types.CommitInfo, bool) {
+	rs.pendingMetadataMtx.RLock()
+	defer rs.pendingMetadataMtx.RUnlock()
+	cInfo, ok := rs.pendingCommitInfos[version]
+	return cInfo, ok
+}
+
+// commitInfoAt returns the commit info for the given version, using the in-memory
+// last commit info for the latest version as it may not be flushed to disk yet.
+func (rs *Store) commitInfoAt(version int64) (*types.CommitInfo, error) {
+	if c := rs.LastCommitInfo(); c != nil && c.Version == version {
+		return c, nil
+	}
+	if c, ok := rs.pendingCommitInfo(version); ok {
+		return c, nil
+	}
+	return rs.readCommitInfo(version)
+}
+
+// commitMetadata writes the metadata of a committed version, or batches it if a
+// metadata flush interval is set, flushing the batch once it holds that many
+// commits.
+func (rs *Store) commitMetadata(version int64, cInfo *types.CommitInfo) error {
+	if rs.metadataFlushInterval <= 1 {
+		return rs.flushMetadata(rs.db, version, cInfo)
+	}
+
+	rs.pendingMetadataMtx.Lock()
+	if rs.pendingMetadata == nil {
+		rs.pendingMetadata = rs.db.NewBatch()
+		rs.pendingCommitInfos = make(map[int64]*types.CommitInfo)
+	}
+	rs.lastSplitCommitInfo = rs.writeMetadata(rs.pendingMetadata, version, cInfo)
+	rs.pendingCommitInfos[version] = cInfo
+	rs.pendingCommits++
+	full := rs.pendingCommits >= rs.metadataFlushInterval
+	rs.pendingMetadataMtx.Unlock()
+
+	if full {
+		if err := rs.FlushMetadata(); err != nil {
+			return err
+		}
+		rs.logger.Info("App State Saved height=%d hash=%X\n", cInfo.CommitID().Version, cInfo.CommitID().Hash)
+	}
+	return nil
+}
+
+// writeMetadata writes the metadata of a version to batch, and returns the split
+// commit info written if the split layout is enabled.
+func (rs *Store) writeMetadata(batch dbm.Batch, version int64, cInfo *types.CommitInfo) *splitCommitInfo {
+	// the version may be written again after a rollback
+	rs.evictCommitInfos(version)
+	sized := &sizedBatch{Batch: batch}
+	var split *splitCommitInfo
+	if cInfo != nil {
+		if rs.splitCommitInfo {
+			split = flushSplitCommitInfo(sized, version, cInfo, rs.lastSplitCommitInfo)
+		} else {
+			flushCommitInfo(sized, version, cInfo, rs.commitInfoCompression)
+		}
+	}
+	flushLatestVersion(sized, version)
+	rs.pruneHeightsMtx.Lock()
+	flushPruningHeights(sized, rs.pruneHeights)
+	rs.pruneHeightsMtx.Unlock()
+
+	rs.lastMetadataWriteBytes = sized.size
+	telemetry.SetGauge(float32(sized.size), "store", "metadata", "write_bytes")
+	return split
+}
+
+// LastMetadataWriteBytes returns the number of bytes of keys and values of the
+// metadata written for the latest version, i.e. its commit info, the latest
+// version and the prune heights.
+func (rs *Store) LastMetadataWriteBytes() int {
+	return rs.lastMetadataWriteBytes
+}
+
+// sizedBatch counts the bytes of the keys and values written to a batch.
+type sizedBatch struct {
+	dbm.Batch
+	size int
+}
+
+func (b *sizedBatch) Set(key, value []byte) error {
+	b.size += len(key) + len(value)
+	return b.Batch.Set(key, value)
+}
+
+func (b *sizedBatch) Delete(key []byte) error {
+	b.size += len(key)
+	return b.Batch.Delete(key)
+}
+
+// readError marks an error returned by the DB while reading, which may be
+// transient, as opposed to data being missing or corrupt.
+type readError struct {
+	error
+}
+
+// isReadError returns whether err is a DB read error.
+func isReadError(err error) bool {
+	_, ok := err.(readError)
+	return ok
+}
+
+// splitCommitInfo is a commit info flushed with the split layout. hashVersions
+// holds, for each store, the version under which its hash is stored.
+type splitCommitInfo struct {
+	cInfo        *types.CommitInfo
+	hashVersions []int64
+}
+
+// getSplitCommitInfo reassembles the commit info of version ver from its split
+// layout header and the store hashes it refers to.
+func getSplitCommitInfo(db dbm.DB, ver int64, header []byte) (*types.CommitInfo, error) {
+	split, err := unmarshalSplitCommitInfoHeader(header)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed unmarshal commit info header")
+	}
+	for i := range split.cInfo.StoreInfos {
+		storeInfo := &split.cInfo.StoreInfos[i]
+		hash, err := db.Get([]byte(fmt.Sprintf(storeHashKeyFmt, storeInfo.Name, split.hashVersions[i])))
+		if err != nil {
+			return nil, readError{errors.Wrapf(err, "failed to get hash of store %s", storeInfo.Name)}
+		} else if hash == nil {
+			return nil, fmt.Errorf("no hash found for store %s at version %d", storeInfo.Name, split.hashVersions[i])
+		}
+		if len(hash) > 0 {
+			// an empty hash is stored as an empty value, and decodes to nil
+			// as with the protobuf layout
+			storeInfo.CommitId.Hash = hash
+		}
+	}
+	split.cInfo.Version = ver
+	return split.cInfo, nil
+}
+
+// marshalSplitCommitInfoHeader encodes the name, commit version and hash
+// version of each store, prefixed by the layout bytes.
+func marshalSplitCommitInfoHeader(split *splitCommitInfo) []byte {
+	bz := []byte{commitInfoLayoutMarker, commitInfoLayoutSplit}
+	bz = binary.AppendUvarint(bz, uint64(len(split.cInfo.StoreInfos)))
+	for i, storeInfo := range split.cInfo.StoreInfos {
+		bz = binary.AppendUvarint(bz, uint64(len(storeInfo.Name)))
+		bz = append(bz, storeInfo.Name...)
+		bz = binary.AppendVarint(bz, storeInfo.CommitId.Version)
+		bz = binary.AppendVarint(bz, split.hashVersions[i])
+	}
+	return bz
+}
+
+// unmarshalSplitCommitInfoHeader decodes a header, without the layout bytes,
+// into a commit info missing the store hashes.
+func unmarshalSplitCommitInfoHeader(bz []byte) (*splitCommitInfo, error) {
+	uvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(bz)
+		if n <= 0 {
+			return 0, errors.New("truncated header")
+		}
+		bz = bz[n:]
+		return v, nil
+	}
+	varint := func() (int64, error) {
+		v, n := binary.Varint(bz)
+		if n <= 0 {
+			return 0, errors.New("truncated header")
+		}
+		bz = bz[n:]
+		return v, nil
+	}
+
+	count, err := uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(bz)) {
+		return nil, fmt.Errorf("invalid store count %d", count)
+	}
+	split := &splitCommitInfo{
+		cInfo:        &types.CommitInfo{StoreInfos: make([]types.StoreInfo, count)},
+		hashVersions: make([]int64, count),
+	}
+	for i := range split.cInfo.StoreInfos {
+		nameLen, err := uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if nameLen > uint64(len(bz)) {
+			return nil, errors.New("truncated header")
+		}
+		split.cInfo.StoreInfos[i].Name = string(bz[:nameLen])
+		bz = bz[nameLen:]
+		if split.cInfo.StoreInfos[i].CommitId.Version, err = varint(); err != nil {
+			return nil, err
+		}
+		if split.hashVersions[i], err = varint(); err != nil {
+			return nil, err
+		}
+	}
+	if len(bz) != 0 {
+		return nil, errors.New("trailing bytes after header")
+	}
+	return split, nil
+}
+
+// getCommitInfoVersions returns the sorted versions for which a commit info is
+// persisted. Commit info keys are the only keys under the "s/" prefix that are
+// followed by a digit, so other metadata and store data are skipped.
+func getCommitInfoVersions(db dbm.DB) ([]int64, error) {
+	itr, err := db.Iterator([]byte("s/0"), []byte("s/:"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to iterate commit infos")
+	}
+	defer itr.Close()
+
+	versions := []int64{}
+	for ; itr.Valid(); itr.Next() {
+		var version int64
+		if _, err := fmt.Sscanf(string(itr.Key()), commitInfoKeyFmt, &version); err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	if err := itr.Error(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate commit infos")
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+// flushSplitCommitInfo writes cInfo with the split layout. The hashes of the
+// stores that did not change since prev, the commit info flushed for the
+// previous version, are not written again. It returns the flushed commit info
+// to pass as prev for the next version.
+func flushSplitCommitInfo(batch dbm.Batch, version int64, cInfo *types.CommitInfo, prev *splitCommitInfo) *splitCommitInfo {
+	prevHashes := map[string]int{}
+	if prev != nil && prev.cInfo.Version == version-1 {
+		for i, storeInfo := range prev.cInfo.StoreInfos {
+			prevHashes[storeInfo.Name] = i
+		}
+	}
+
+	split := &splitCommitInfo{cInfo: cInfo, hashVersions: make([]int64, len(cInfo.StoreInfos))}
+	for i, storeInfo := range cInfo.StoreInfos {
+		if j, ok := prevHashes[storeInfo.Name]; ok && bytes.Equal(prev.cInfo.StoreInfos[j].CommitId.Hash, storeInfo.CommitId.Hash) {
+			split.hashVersions[i] = prev.hashVersions[j]
+			continue
+		}
+		split.hashVersions[i] = version
+		batch.Set([]byte(fmt.Sprintf(storeHashKeyFmt, storeInfo.Name, version)), append([]byte{}, storeInfo.CommitId.Hash...))
+	}
+
+	batch.Set([]byte(fmt.Sprintf(commitInfoKeyFmt, version)), marshalSplitCommitInfoHeader(split))
+	return split
+}
@@ -0,0 +1,51 @@
+package rootmulti
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/cosmos/cosmos-sdk/store/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// ExportColumnar iterates the IAVL store of the given key at a version in
+// ascending key order, and calls fn with the keys and values in batches of up
+// to batchSize entries, the i-th value belonging to the i-th key. The column
+// oriented batches can be written as is to a columnar format such as Parquet or
+// Arrow. Only the last batch may be smaller than batchSize, and fn is not called
+// for an empty store. The batches are not reused, so fn may retain them.
+//
+// Exporting stops at the first error returned by fn, which is returned. An
+// error is also returned if the store is not an IAVL store, or if the version
+// was pruned or never committed.
+func (rs *Store) ExportColumnar(key types.StoreKey, version int64, batchSize int, fn func(keys, values [][]byte) error) error {
+	if batchSize <= 0 {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "batch size must be positive, got %d", batchSize)
+	}
+	tree, err := rs.immutableStoreAt(key, version)
+	if err != nil {
+		return err
+	}
+
+	it := tree.Iterator(nil, nil)
+	defer it.Close()
+
+	keys, values := make([][]byte, 0, batchSize), make([][]byte, 0, batchSize)
+	for ; it.Valid(); it.Next() {
+		// the iterator may reuse its buffers
+		keys = append(keys, append([]byte{}, it.Key()...))
+		values = append(values, append([]byte{}, it.Value()...))
+		if len(keys) == batchSize {
+			if err := fn(keys, values); err != nil {
+				return err
+			}
+			keys, values = make([][]byte, 0, batchSize), make([][]byte, 0, batchSize)
+		}
+	}
+	if err := it.Error(); err != nil {
+		return errors.Wrapf(err, "failed to iterate store %s at version %d", key.Name(), version)
+	}
+	if len(keys) > 0 {
+		return fn(keys, values)
+	}
+	return nil
+}
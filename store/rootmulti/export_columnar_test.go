@@ -0,0 +1,103 @@
+package rootmulti
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/cosmos-sdk/store/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+func TestExportColumnar(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	store := ms.GetKVStore(testStoreKey1)
+	for i := 0; i < 7; i++ {
+		store.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	version := ms.Commit(true).Version
+
+	// later writes are not part of the exported version
+	store.Set([]byte("key9"), []byte("value9"))
+	store.Delete([]byte("key0"))
+	ms.Commit(true)
+
+	export := func(batchSize int) (sizes []int, keys, values [][]byte) {
+		err := ms.ExportColumnar(testStoreKey1, version, batchSize, func(k, v [][]byte) error {
+			require.Len(t, v, len(k))
+			sizes = append(sizes, len(k))
+			keys = append(keys, k...)
+			values = append(values, v...)
+			return nil
+		})
+		require.NoError(t, err)
+		return sizes, keys, values
+	}
+
+	for batchSize, expectedSizes := range map[int][]int{
+		1:  {1, 1, 1, 1, 1, 1, 1},
+		3:  {3, 3, 1},
+		7:  {7},
+		10: {7},
+	} {
+		sizes, keys, values := export(batchSize)
+		require.Equal(t, expectedSizes, sizes, "batch size %d", batchSize)
+		require.Len(t, keys, 7)
+		for i := range keys {
+			require.Equal(t, []byte(fmt.Sprintf("key%d", i)), keys[i])
+			require.Equal(t, []byte(fmt.Sprintf("value%d", i)), values[i])
+		}
+	}
+
+	// an empty store yields no batches
+	err := ms.ExportColumnar(testStoreKey3, version, 3, func(_, _ [][]byte) error {
+		t.Fatal("unexpected batch for an empty store")
+		return nil
+	})
+	require.NoError(t, err)
+
+	// the error of fn stops the export
+	fnErr := errors.New("sink is full")
+	calls := 0
+	err = ms.ExportColumnar(testStoreKey1, version, 2, func(_, _ [][]byte) error {
+		calls++
+		return fnErr
+	})
+	require.ErrorIs(t, err, fnErr)
+	require.Equal(t, 1, calls)
+}
+
+func TestExportColumnarErrors(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruningOptions{KeepRecent: 1, Interval: 1})
+	transientKey := types.NewTransientStoreKey("transient")
+	ms.MountStoreWithDB(transientKey, types.StoreTypeTransient, nil)
+	require.NoError(t, ms.LoadLatestVersion())
+	for i := 0; i < 4; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		ms.Commit(true)
+	}
+	noop := func(_, _ [][]byte) error { return nil }
+
+	err := ms.ExportColumnar(testStoreKey1, 1, 10, noop)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidHeight)
+	require.Contains(t, err.Error(), "pruned")
+
+	err = ms.ExportColumnar(testStoreKey1, 10, 10, noop)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidHeight)
+
+	err = ms.ExportColumnar(transientKey, 4, 10, noop)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidRequest)
+	require.Contains(t, err.Error(), "only IAVL stores")
+
+	err = ms.ExportColumnar(types.NewKVStoreKey("unknown"), 4, 10, noop)
+	require.ErrorIs(t, err, sdkerrors.ErrUnknownRequest)
+
+	err = ms.ExportColumnar(testStoreKey1, 4, 0, noop)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidRequest)
+}
@@ -0,0 +1,101 @@
+package rootmulti
+
+import (
+	"sort"
+
+	protoio "github.com/gogo/protobuf/io"
+
+	snapshottypes "github.com/cosmos/cosmos-sdk/snapshots/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// RegisterExtensionSnapshotter registers a snapshotter for state kept outside
+// of the IAVL stores, e.g. by a module with its own blob store. Snapshot writes
+// an extension item for every registered snapshotter after the IAVL stores,
+// sorted by name and followed by the payload items written by the snapshotter,
+// and Restore passes the payload items of the extension items it reads back to
+// the snapshotter of the same name. A mounted store with the same name as a
+// snapshotter is left to it rather than failing Snapshot when it is not an IAVL
+// store.
+//
+// Extension items without a registered snapshotter are returned by Restore, so
+// that the snapshot manager can restore its own extensions.
+func (rs *Store) RegisterExtensionSnapshotter(name string, snapshotter snapshottypes.ExtensionSnapshotter) error {
+	if _, ok := rs.extensionSnapshotters[name]; ok {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "duplicate extension snapshotter %s", name)
+	}
+	if !extensionFormatSupported(snapshotter, snapshotter.SnapshotFormat()) {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+			"extension snapshotter %s does not support its own format %d", name, snapshotter.SnapshotFormat())
+	}
+	if rs.extensionSnapshotters == nil {
+		rs.extensionSnapshotters = make(map[string]snapshottypes.ExtensionSnapshotter)
+	}
+	rs.extensionSnapshotters[name] = snapshotter
+	return nil
+}
+
+// snapshotExtensions writes the items of every registered extension snapshotter
+// to the writer returned by writerFor for its name.
+func (rs *Store) snapshotExtensions(height uint64, writerFor func(name string) protoio.Writer) error {
+	names := make([]string, 0, len(rs.extensionSnapshotters))
+	for name := range rs.extensionSnapshotters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		snapshotter := rs.extensionSnapshotters[name]
+		protoWriter := writerFor(name)
+		err := protoWriter.WriteMsg(&snapshottypes.SnapshotItem{
+			Item: &snapshottypes.SnapshotItem_Extension{
+				Extension: &snapshottypes.SnapshotExtensionMeta{
+					Name:   name,
+					Format: snapshotter.SnapshotFormat(),
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if err := snapshotter.Snapshot(height, protoWriter); err != nil {
+			return sdkerrors.Wrapf(err, "extension %s snapshot", name)
+		}
+	}
+	return nil
+}
+
+// restoreExtensions restores the extensions starting at item with the
+// registered snapshotters, and returns the first item that is not one of
+// their extension items.
+func (rs *Store) restoreExtensions(
+	height uint64, item snapshottypes.SnapshotItem, protoReader protoio.Reader,
+) (snapshottypes.SnapshotItem, error) {
+	for {
+		metadata := item.GetExtension()
+		if metadata == nil {
+			return item, nil
+		}
+		snapshotter, ok := rs.extensionSnapshotters[metadata.Name]
+		if !ok {
+			return item, nil
+		}
+		if !extensionFormatSupported(snapshotter, metadata.Format) {
+			return snapshottypes.SnapshotItem{}, sdkerrors.Wrapf(snapshottypes.ErrUnknownFormat,
+				"format %v for extension %s", metadata.Format, metadata.Name)
+		}
+		var err error
+		if item, err = snapshotter.Restore(height, metadata.Format, protoReader); err != nil {
+			return snapshottypes.SnapshotItem{}, sdkerrors.Wrapf(err, "extension %s restore", metadata.Name)
+		}
+	}
+}
+
+func extensionFormatSupported(snapshotter snapshottypes.ExtensionSnapshotter, format uint32) bool {
+	for _, supported := range snapshotter.SupportedFormats() {
+		if supported == format {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package rootmulti
+
+import (
+	"bytes"
+	"io"
+
+	protoio "github.com/gogo/protobuf/io"
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/cosmos-sdk/store/dbadapter"
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	"github.com/cosmos/cosmos-sdk/store/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// CommitToDB commits the pending state of the stores to an alternate DB instead
+// of the primary one, which is left untouched, creating a divergent fork for
+// testing. The returned commit ID is the one the primary would have produced
+// for the same state.
+//
+// The fork is built by restoring a snapshot of the last committed version into
+// db, applying the uncommitted writes of every IAVL store on top of it and
+// committing. This comes with the following constraints:
+//   - db must be empty, and only holds the last committed version onwards.
+//   - all the persisted stores must be IAVL stores sharing the primary DB,
+//     since stores with their own DB or DB adapter stores write through to it.
+//   - transient and memory stores are not carried over.
+//   - the whole state is read to find the uncommitted writes, so this is only
+//     meant for testing and analysis, not for use on a live node.
+//
+// The fork can then be used by loading a new Store on db with the same mounts.
+func (rs *Store) CommitToDB(db dbm.DB, bumpVersion bool) (types.CommitID, error) {
+	if GetLatestVersion(db) != 0 {
+		return types.CommitID{}, sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "cannot fork into a non-empty DB")
+	}
+
+	fork := NewStore(db, rs.logger)
+	fork.iavlCacheSize = rs.iavlCacheSize
+	fork.iavlCacheSizes = rs.iavlCacheSizes
+	fork.iavlDisableFastNode = rs.iavlDisableFastNode
+	fork.iavlNoFastNodes = rs.iavlNoFastNodes
+	fork.orphanOpts = rs.orphanOpts
+	fork.initialVersion = rs.initialVersion
+	for key, params := range rs.storesParams {
+		switch {
+		case params.typ == types.StoreTypeTransient || params.typ == types.StoreTypeMemory:
+			continue
+		case params.typ != types.StoreTypeIAVL || params.db != nil:
+			return types.CommitID{}, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+				"cannot fork store %s: only IAVL stores in the primary DB are supported", key.Name())
+		}
+		fork.MountStoreWithDB(key, params.typ, nil)
+	}
+
+	if err := fork.LoadLatestVersion(); err != nil {
+		return types.CommitID{}, err
+	}
+	height := rs.LastCommitID().Version
+	if height > 0 {
+		if err := rs.restoreInto(fork, uint64(height)); err != nil {
+			return types.CommitID{}, sdkerrors.Wrap(err, "failed to copy the last committed version")
+		}
+	} else if rs.initialVersion > 0 {
+		// the initial version only applies to the first commit of the fork
+		if err := fork.SetInitialVersion(rs.initialVersion); err != nil {
+			return types.CommitID{}, err
+		}
+	}
+
+	for key := range fork.stores {
+		store, ok := rs.GetCommitKVStore(key).(*iavl.Store)
+		if !ok {
+			continue
+		}
+		// before the first commit, every key of the working state is pending
+		var committed types.KVStore = dbadapter.Store{DB: dbm.NewMemDB()}
+		if height > 0 {
+			var err error
+			if committed, err = store.GetImmutable(height); err != nil {
+				return types.CommitID{}, err
+			}
+		}
+		applyPendingWrites(committed, store, fork.GetCommitKVStore(key).(types.KVStore))
+	}
+
+	return fork.Commit(bumpVersion), nil
+}
+
+// restoreInto restores a snapshot of the given height into target, streaming it
+// through a pipe rather than holding it in memory. The snapshot is restored in
+// the format it is exported in, which depends on the snapshot compression.
+func (rs *Store) restoreInto(target *Store, height uint64) error {
+	format := rs.SnapshotFormat()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(rs.Snapshot(height, protoio.NewDelimitedWriter(pw)))
+	}()
+
+	_, err := target.Restore(height, format, protoio.NewDelimitedReader(pr, snapshotDiffMaxItemSize))
+	return err
+}
+
+// applyPendingWrites writes to target the difference between the committed and
+// the working state of a store, both iterated in ascending order.
+func applyPendingWrites(committed, working, target types.KVStore) {
+	committedIt := committed.Iterator(nil, nil)
+	defer committedIt.Close()
+	workingIt := working.Iterator(nil, nil)
+	defer workingIt.Close()
+
+	for committedIt.Valid() || workingIt.Valid() {
+		cmp := 1
+		if !workingIt.Valid() {
+			cmp = -1
+		} else if committedIt.Valid() {
+			cmp = bytes.Compare(committedIt.Key(), workingIt.Key())
+		}
+
+		switch {
+		case cmp < 0:
+			// deleted since the last commit
+			target.Delete(committedIt.Key())
+			committedIt.Next()
+		case cmp > 0:
+			// added since the last commit
+			target.Set(workingIt.Key(), workingIt.Value())
+			workingIt.Next()
+		default:
+			if !bytes.Equal(committedIt.Value(), workingIt.Value()) {
+				target.Set(workingIt.Key(), workingIt.Value())
+			}
+			committedIt.Next()
+			workingIt.Next()
+		}
+	}
+}
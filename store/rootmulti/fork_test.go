@@ -0,0 +1,96 @@
+package rootmulti
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+func TestCommitToDB(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	store1 := ms.GetKVStore(testStoreKey1)
+	store2 := ms.GetKVStore(testStoreKey2)
+	store1.Set([]byte("a"), []byte("1"))
+	store1.Set([]byte("b"), []byte("2"))
+	store2.Set([]byte("c"), []byte("3"))
+	base := ms.Commit(true)
+
+	// diverge from the committed state, with sets, updates and deletes
+	store1.Set([]byte("a"), []byte("fork"))
+	store1.Delete([]byte("b"))
+	store2.Set([]byte("d"), []byte("4"))
+	forkDB := dbm.NewMemDB()
+	forkID, err := ms.CommitToDB(forkDB, true)
+	require.NoError(t, err)
+	require.Equal(t, base.Version+1, forkID.Version)
+
+	// the fork holds the divergent state
+	fork := newMultiStoreWithMounts(forkDB, types.PruneNothing)
+	require.NoError(t, fork.LoadLatestVersion())
+	require.Equal(t, forkID, fork.LastCommitID())
+	require.Equal(t, []byte("fork"), fork.GetKVStore(testStoreKey1).Get([]byte("a")))
+	require.False(t, fork.GetKVStore(testStoreKey1).Has([]byte("b")))
+	require.Equal(t, []byte("4"), fork.GetKVStore(testStoreKey2).Get([]byte("d")))
+
+	// the primary DB is untouched
+	require.Equal(t, base.Version, GetLatestVersion(db))
+	primary := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, primary.LoadLatestVersion())
+	require.Equal(t, base, primary.LastCommitID())
+	require.Equal(t, []byte("1"), primary.GetKVStore(testStoreKey1).Get([]byte("a")))
+	require.False(t, primary.GetKVStore(testStoreKey2).Has([]byte("d")))
+
+	// committing the same state on the primary gives the same commit ID
+	require.Equal(t, forkID, ms.Commit(true))
+
+	// the fork must go to an empty DB
+	_, err = ms.CommitToDB(forkDB, true)
+	require.Error(t, err)
+
+	// stores with their own DB are not supported
+	other := NewStore(dbm.NewMemDB(), ms.logger)
+	other.MountStoreWithDB(testStoreKey1, types.StoreTypeIAVL, dbm.NewMemDB())
+	require.NoError(t, other.LoadLatestVersion())
+	_, err = other.CommitToDB(dbm.NewMemDB(), true)
+	require.Error(t, err)
+}
+
+func TestCommitToDBBeforeFirstCommit(t *testing.T) {
+	ms := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.GetKVStore(testStoreKey1).Set([]byte("a"), []byte("1"))
+
+	forkDB := dbm.NewMemDB()
+	forkID, err := ms.CommitToDB(forkDB, true)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), forkID.Version)
+
+	fork := newMultiStoreWithMounts(forkDB, types.PruneNothing)
+	require.NoError(t, fork.LoadLatestVersion())
+	require.Equal(t, []byte("1"), fork.GetKVStore(testStoreKey1).Get([]byte("a")))
+	require.Equal(t, forkID, ms.Commit(true))
+}
+
+func TestCommitToDBWithSnapshotCompression(t *testing.T) {
+	ms := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.SetSnapshotCompression(CompressionZstd)
+	ms.GetKVStore(testStoreKey1).Set([]byte("a"), []byte("1"))
+	ms.Commit(true)
+	ms.GetKVStore(testStoreKey1).Set([]byte("b"), []byte("2"))
+
+	forkDB := dbm.NewMemDB()
+	forkID, err := ms.CommitToDB(forkDB, true)
+	require.NoError(t, err)
+
+	fork := newMultiStoreWithMounts(forkDB, types.PruneNothing)
+	require.NoError(t, fork.LoadLatestVersion())
+	require.Equal(t, []byte("1"), fork.GetKVStore(testStoreKey1).Get([]byte("a")))
+	require.Equal(t, []byte("2"), fork.GetKVStore(testStoreKey1).Get([]byte("b")))
+	require.Equal(t, forkID, ms.Commit(true))
+}
@@ -0,0 +1,83 @@
+package rootmulti
+
+import (
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/cosmos/cosmos-sdk/store/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// CacheMultiStoreAtOrBefore is like CacheMultiStoreWithVersion, but loads the
+// greatest version available in the IAVL stores that does not exceed the given
+// one, as given by GetVersions, and returns it. This lets callers query the
+// nearest height that was not pruned. An error is returned if no such version
+// exists.
+func (rs *Store) CacheMultiStoreAtOrBefore(version int64) (types.CacheMultiStore, int64, error) {
+	versions, err := rs.GetVersions()
+	if err != nil {
+		return nil, 0, err
+	}
+	i := sort.Search(len(versions), func(i int) bool { return versions[i] > version })
+	if i == 0 {
+		return nil, 0, sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight, "no version at or before %d is available", version)
+	}
+	cms, err := rs.CacheMultiStoreWithVersion(versions[i-1])
+	if err != nil {
+		return nil, 0, err
+	}
+	return cms, versions[i-1], nil
+}
+
+// SetHistoricalQueryConcurrency bounds the number of branches created by
+// CacheMultiStoreWithVersion that may be open at the same time. A slot is
+// released when the returned CacheMultiStore is closed. A value of zero or less
+// removes the limit. It must not be called while historical branches are open.
+func (rs *Store) SetHistoricalQueryConcurrency(n int) {
+	if n <= 0 {
+		rs.historicalQuerySem = nil
+		return
+	}
+	rs.historicalQuerySem = make(chan struct{}, n)
+}
+
+// SetHistoricalQueryFailFast sets whether CacheMultiStoreWithVersion returns an
+// error instead of blocking when the historical query concurrency limit has
+// been reached.
+func (rs *Store) SetHistoricalQueryFailFast(failFast bool) {
+	rs.historicalQueryFailFast = failFast
+}
+
+func (rs *Store) acquireHistoricalQuerySlot() (io.Closer, error) {
+	sem := rs.historicalQuerySem
+	if sem == nil {
+		return &historicalQuerySlot{}, nil
+	}
+
+	if rs.historicalQueryFailFast {
+		select {
+		case sem <- struct{}{}:
+		default:
+			return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+				"too many concurrent historical queries (limit %d)", cap(sem))
+		}
+	} else {
+		sem <- struct{}{}
+	}
+
+	return &historicalQuerySlot{sem: sem}, nil
+}
+
+// historicalQuerySlot releases a historical query concurrency slot on Close.
+type historicalQuerySlot struct {
+	sem  chan struct{}
+	once sync.Once
+}
+
+func (s *historicalQuerySlot) Close() error {
+	if s.sem != nil {
+		s.once.Do(func() { <-s.sem })
+	}
+	return nil
+}
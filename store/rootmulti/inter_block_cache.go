@@ -0,0 +1,84 @@
+package rootmulti
+
+import (
+	"io"
+
+	"github.com/cosmos/cosmos-sdk/telemetry"
+	"github.com/pkg/errors"
+
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// DumpableInterBlockCache is implemented by inter-block caches whose contents
+// can be dumped and loaded back, e.g. to warm the cache up after a restart.
+type DumpableInterBlockCache interface {
+	Dump(w io.Writer) error
+	Load(r io.Reader) error
+}
+
+// DumpInterBlockCache writes the contents of the inter-block cache to w, so that
+// they can be restored with LoadInterBlockCache. It fails if no cache is set or
+// if the cache does not implement DumpableInterBlockCache.
+func (rs *Store) DumpInterBlockCache(w io.Writer) error {
+	cache, err := rs.dumpableInterBlockCache()
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(cache.Dump(w), "failed to dump inter-block cache")
+}
+
+// LoadInterBlockCache loads contents written by DumpInterBlockCache into the
+// inter-block cache. The contents must match the state of the stores, e.g. be
+// dumped at the version the stores are loaded at, for the cache to be correct.
+// It fails if no cache is set or if the cache does not implement
+// DumpableInterBlockCache.
+func (rs *Store) LoadInterBlockCache(r io.Reader) error {
+	cache, err := rs.dumpableInterBlockCache()
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(cache.Load(r), "failed to load inter-block cache")
+}
+
+func (rs *Store) dumpableInterBlockCache() (DumpableInterBlockCache, error) {
+	if rs.interBlockCache == nil {
+		return nil, sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "no inter-block cache is set")
+	}
+	cache, ok := rs.interBlockCache.(DumpableInterBlockCache)
+	if !ok {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrNotSupported, "inter-block cache %T cannot be dumped", rs.interBlockCache)
+	}
+	return cache, nil
+}
+
+// InterBlockCacheStats is implemented by inter-block caches which count the
+// reads they serve (hits) and the ones they delegate to the stores (misses).
+type InterBlockCacheStats interface {
+	Stats() (hits, misses uint64)
+}
+
+// InterBlockCacheMetrics returns the number of hits and misses of the
+// inter-block cache, aggregated over all the stores. It fails if no cache is
+// set or if the cache does not implement InterBlockCacheStats.
+func (rs *Store) InterBlockCacheMetrics() (hits, misses uint64, err error) {
+	if rs.interBlockCache == nil {
+		return 0, 0, sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "no inter-block cache is set")
+	}
+	cache, ok := rs.interBlockCache.(InterBlockCacheStats)
+	if !ok {
+		return 0, 0, sdkerrors.Wrapf(sdkerrors.ErrNotSupported, "inter-block cache %T does not report stats", rs.interBlockCache)
+	}
+	hits, misses = cache.Stats()
+	return hits, misses, nil
+}
+
+// emitInterBlockCacheMetrics sets the inter-block cache hit and miss gauges, if
+// the cache reports them.
+func (rs *Store) emitInterBlockCacheMetrics() {
+	hits, misses, err := rs.InterBlockCacheMetrics()
+	if err != nil {
+		return
+	}
+	telemetry.SetGauge(float32(hits), "store", "inter_block_cache", "hits")
+	telemetry.SetGauge(float32(misses), "store", "inter_block_cache", "misses")
+}
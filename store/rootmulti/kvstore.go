@@ -0,0 +1,185 @@
+package rootmulti
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/cosmos/cosmos-sdk/store/cachekv"
+	"github.com/cosmos/cosmos-sdk/store/listenkv"
+	"github.com/cosmos/cosmos-sdk/store/tracekv"
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+// sizeLimitedStore rejects writes whose key or value exceed the configured
+// maximum sizes. A zero limit means unlimited.
+type sizeLimitedStore struct {
+	types.KVStore
+	name     string
+	maxKey   int
+	maxValue int
+}
+
+// Set implements types.KVStore. It panics if the key or value is too large.
+func (s sizeLimitedStore) Set(key, value []byte) {
+	if s.maxKey > 0 && len(key) > s.maxKey {
+		panic(fmt.Sprintf("key size %d exceeds maximum of %d bytes in store %s", len(key), s.maxKey, s.name))
+	}
+	if s.maxValue > 0 && len(value) > s.maxValue {
+		panic(fmt.Sprintf("value size %d exceeds maximum of %d bytes in store %s", len(value), s.maxValue, s.name))
+	}
+	s.KVStore.Set(key, value)
+}
+
+// KVStoreAtVersion implements types.VersionedKVStore, applying the size limits
+// to the version of the wrapped store.
+func (s sizeLimitedStore) KVStoreAtVersion(version int64) (types.KVStore, error) {
+	store, err := kvStoreAtVersion(s.KVStore, version)
+	if err != nil {
+		return nil, err
+	}
+	s.KVStore = store
+	return s, nil
+}
+
+// readOnlyStore rejects all writes to the wrapped store, including the writes
+// of its branches when they are written back.
+type readOnlyStore struct {
+	types.KVStore
+	name string
+}
+
+// Set implements types.KVStore. It always panics.
+func (s readOnlyStore) Set(_, _ []byte) {
+	panic(fmt.Sprintf("cannot write to read-only store %s", s.name))
+}
+
+// Delete implements types.KVStore. It always panics.
+func (s readOnlyStore) Delete(_ []byte) {
+	panic(fmt.Sprintf("cannot delete from read-only store %s", s.name))
+}
+
+// KVStoreAtVersion implements types.VersionedKVStore, making the version of the
+// wrapped store read-only.
+func (s readOnlyStore) KVStoreAtVersion(version int64) (types.KVStore, error) {
+	store, err := kvStoreAtVersion(s.KVStore, version)
+	if err != nil {
+		return nil, err
+	}
+	s.KVStore = store
+	return s, nil
+}
+
+// CacheWrap implements types.CacheWrapper, branching the read-only store rather
+// than the wrapped one.
+func (s readOnlyStore) CacheWrap(storeKey types.StoreKey) types.CacheWrap {
+	return cachekv.NewStore(s, storeKey, types.DefaultCacheSizeLimit)
+}
+
+// CacheWrapWithTrace implements types.CacheWrapper.
+func (s readOnlyStore) CacheWrapWithTrace(storeKey types.StoreKey, w io.Writer, tc types.TraceContext) types.CacheWrap {
+	return cachekv.NewStore(tracekv.NewStore(s, w, tc), storeKey, types.DefaultCacheSizeLimit)
+}
+
+// CacheWrapWithListeners implements types.CacheWrapper.
+func (s readOnlyStore) CacheWrapWithListeners(storeKey types.StoreKey, listeners []types.WriteListener) types.CacheWrap {
+	return cachekv.NewStore(listenkv.NewStore(s, storeKey, listeners), storeKey, types.DefaultCacheSizeLimit)
+}
+
+// Store access operations reported to a StoreAccessHook.
+const (
+	StoreAccessGet            = "get"
+	StoreAccessHas            = "has"
+	StoreAccessSet            = "set"
+	StoreAccessDelete         = "delete"
+	StoreAccessIterate        = "iterate"
+	StoreAccessReverseIterate = "reverse_iterate"
+)
+
+// StoreAccessHook is called with the operation and the key of each access to a
+// store. Iterations report their start key.
+type StoreAccessHook func(op string, key []byte)
+
+// accessHookStore reports every access to the wrapped store to a hook,
+// including the accesses of its branches when they read from it or are written
+// back.
+type accessHookStore struct {
+	types.KVStore
+	hook StoreAccessHook
+}
+
+// Get implements types.KVStore.
+func (s accessHookStore) Get(key []byte) []byte {
+	s.hook(StoreAccessGet, key)
+	return s.KVStore.Get(key)
+}
+
+// Has implements types.KVStore.
+func (s accessHookStore) Has(key []byte) bool {
+	s.hook(StoreAccessHas, key)
+	return s.KVStore.Has(key)
+}
+
+// Set implements types.KVStore.
+func (s accessHookStore) Set(key, value []byte) {
+	s.hook(StoreAccessSet, key)
+	s.KVStore.Set(key, value)
+}
+
+// Delete implements types.KVStore.
+func (s accessHookStore) Delete(key []byte) {
+	s.hook(StoreAccessDelete, key)
+	s.KVStore.Delete(key)
+}
+
+// Iterator implements types.KVStore.
+func (s accessHookStore) Iterator(start, end []byte) types.Iterator {
+	s.hook(StoreAccessIterate, start)
+	return s.KVStore.Iterator(start, end)
+}
+
+// ReverseIterator implements types.KVStore.
+func (s accessHookStore) ReverseIterator(start, end []byte) types.Iterator {
+	s.hook(StoreAccessReverseIterate, start)
+	return s.KVStore.ReverseIterator(start, end)
+}
+
+// KVStoreAtVersion implements types.VersionedKVStore, reporting the accesses to
+// the version of the wrapped store.
+func (s accessHookStore) KVStoreAtVersion(version int64) (types.KVStore, error) {
+	store, err := kvStoreAtVersion(s.KVStore, version)
+	if err != nil {
+		return nil, err
+	}
+	s.KVStore = store
+	return s, nil
+}
+
+// CacheWrap implements types.CacheWrapper, branching the hooked store rather
+// than the wrapped one.
+func (s accessHookStore) CacheWrap(storeKey types.StoreKey) types.CacheWrap {
+	return cachekv.NewStore(s, storeKey, types.DefaultCacheSizeLimit)
+}
+
+// CacheWrapWithTrace implements types.CacheWrapper.
+func (s accessHookStore) CacheWrapWithTrace(storeKey types.StoreKey, w io.Writer, tc types.TraceContext) types.CacheWrap {
+	return cachekv.NewStore(tracekv.NewStore(s, w, tc), storeKey, types.DefaultCacheSizeLimit)
+}
+
+// CacheWrapWithListeners implements types.CacheWrapper.
+func (s accessHookStore) CacheWrapWithListeners(storeKey types.StoreKey, listeners []types.WriteListener) types.CacheWrap {
+	return cachekv.NewStore(listenkv.NewStore(s, storeKey, listeners), storeKey, types.DefaultCacheSizeLimit)
+}
+
+// kvStoreAtVersion returns the given version of a store wrapped by one of the
+// stores above, so that branches of the wrapper can load versions like branches
+// of the store itself. Transient and memory stores have no history and are
+// returned as they are.
+func kvStoreAtVersion(store types.KVStore, version int64) (types.KVStore, error) {
+	if versioned, ok := store.(types.VersionedKVStore); ok {
+		return versioned.KVStoreAtVersion(version)
+	}
+	if typ := store.GetStoreType(); typ == types.StoreTypeTransient || typ == types.StoreTypeMemory {
+		return store, nil
+	}
+	return nil, fmt.Errorf("store of type %T cannot load versions", store)
+}
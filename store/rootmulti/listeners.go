@@ -0,0 +1,99 @@
+package rootmulti
+
+import (
+	"github.com/cosmos/cosmos-sdk/store/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// Listeners returns a copy of the write listeners registered for a KVStore,
+// including while listeners are suspended.
+func (rs *Store) Listeners(key types.StoreKey) []types.WriteListener {
+	ls := rs.listeners[key]
+	if len(ls) == 0 {
+		return nil
+	}
+	return append([]types.WriteListener(nil), ls...)
+}
+
+// AllListenerKeys returns the keys of the KVStores with registered write
+// listeners, sorted by name.
+func (rs *Store) AllListenerKeys() []types.StoreKey {
+	keys := make([]types.StoreKey, 0, len(rs.listeners))
+	for _, key := range keysForStoreKeyMap(rs.listeners) {
+		if len(rs.listeners[key]) != 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// SuspendListeners stops write listeners from being attached to the stores
+// returned by GetKVStore and to new branches, e.g. while bulk importing data
+// that consumers are not interested in. Stores obtained before suspending keep
+// firing their listeners. Listeners are re-enabled with ResumeListeners.
+func (rs *Store) SuspendListeners() {
+	rs.listenersSuspended.Store(true)
+}
+
+// ResumeListeners re-enables the write listeners suspended by SuspendListeners.
+func (rs *Store) ResumeListeners() {
+	rs.listenersSuspended.Store(false)
+}
+
+// SetListenerKeyEncoding sets the encoding applied to the keys and values of the
+// write events passed to listeners. It defaults to types.KeyEncodingRaw, which
+// passes them through unchanged. It applies to the stores returned by
+// GetKVStore and to branches created afterwards.
+func (rs *Store) SetListenerKeyEncoding(encoding types.KeyEncoding) {
+	rs.listenerKeyEncoding = encoding
+}
+
+// ReplayState passes every key of the store of the given key at a version to
+// listener as a set, in ascending key order, so that a listener added late can
+// catch up on the state before receiving the writes that follow. The keys are
+// streamed from the store rather than buffered, and encoded with the listener
+// key encoding. An error is returned if the store has no such version, e.g.
+// because it was pruned, or if the listener fails.
+func (rs *Store) ReplayState(key types.StoreKey, listener types.WriteListener, version int64) error {
+	versioned, ok := rs.GetCommitKVStore(key).(types.VersionedKVStore)
+	if !ok {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "store %s cannot load versions", key.Name())
+	}
+	store, err := versioned.KVStoreAtVersion(version)
+	if err != nil {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight, "failed to load store %s at version %d: %v", key.Name(), version, err)
+	}
+	if rs.listenerKeyEncoding != types.KeyEncodingRaw {
+		listener = types.NewEncodingWriteListener(listener, rs.listenerKeyEncoding)
+	}
+
+	it := store.Iterator(nil, nil)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		if err := listener.OnWrite(key, it.Key(), it.Value(), false); err != nil {
+			return sdkerrors.Wrapf(err, "failed to replay key %X of store %s", it.Key(), key.Name())
+		}
+	}
+	return it.Error()
+}
+
+// activeListeners returns the write listeners to attach to new stores and
+// branches, wrapped to apply the listener key encoding.
+func (rs *Store) activeListeners() map[types.StoreKey][]types.WriteListener {
+	if rs.listenersSuspended.Load() {
+		return nil
+	}
+	if rs.listenerKeyEncoding == types.KeyEncodingRaw {
+		return rs.listeners
+	}
+
+	listeners := make(map[types.StoreKey][]types.WriteListener, len(rs.listeners))
+	for key, ls := range rs.listeners {
+		encoded := make([]types.WriteListener, len(ls))
+		for i, l := range ls {
+			encoded[i] = types.NewEncodingWriteListener(l, rs.listenerKeyEncoding)
+		}
+		listeners[key] = encoded
+	}
+	return listeners
+}
@@ -1,9 +1,16 @@
 package rootmulti
 
 import (
+	"bytes"
+	"fmt"
+
+	abci "github.com/tendermint/tendermint/abci/types"
 	"github.com/tendermint/tendermint/crypto/merkle"
+	"github.com/tendermint/tendermint/proto/tendermint/crypto"
 
+	"github.com/cosmos/cosmos-sdk/store/iavl"
 	storetypes "github.com/cosmos/cosmos-sdk/store/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
 )
 
 // RequireProof returns whether proof is required for the subpath.
@@ -25,3 +32,96 @@ func DefaultProofRuntime() (prt *merkle.ProofRuntime) {
 	prt.RegisterOpDecoder(storetypes.ProofOpSimpleMerkleCommitment, storetypes.CommitmentOpDecoder)
 	return
 }
+
+// VerifyMembership verifies that proofOps, as returned by a proven "/key" query
+// of a multistore, prove that key is set to value in the named store of the
+// state committed to by appHash. The store proof is chained with the multistore
+// proof, so the serving node does not need to be trusted.
+func VerifyMembership(appHash []byte, storeName string, key, value []byte, proofOps *crypto.ProofOps) error {
+	if proofOps == nil {
+		return sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "proof cannot be nil")
+	}
+	keyPath := merkle.KeyPath{}.
+		AppendKey([]byte(storeName), merkle.KeyEncodingURL).
+		AppendKey(key, merkle.KeyEncodingHex)
+	if err := DefaultProofRuntime().VerifyValue(proofOps, appHash, keyPath.String(), value); err != nil {
+		return sdkerrors.Wrapf(err, "failed to verify proof of key %X in store %s", key, storeName)
+	}
+	return nil
+}
+
+// ProveUnchanged reports whether the value of reqKey in the given IAVL store is
+// the same at versions v1 and v2. It also returns the proofs of the value at
+// both versions, so that a verifier can check both resolve to the same value:
+// the proof ops for v1 (store proof followed by the multistore proof) come
+// first, followed by the proof ops for v2. Both versions must be available.
+func (rs *Store) ProveUnchanged(key storetypes.StoreKey, reqKey []byte, v1, v2 int64) (bool, []crypto.ProofOp, error) {
+	store, ok := rs.GetCommitKVStore(key).(*iavl.Store)
+	if !ok {
+		return false, nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "store %s is not an IAVL store", key.Name())
+	}
+	for _, version := range []int64{v1, v2} {
+		if !store.VersionExists(version) {
+			return false, nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight, "version %d of store %s is not available", version, key.Name())
+		}
+	}
+
+	var values [2][]byte
+	ops := []crypto.ProofOp{}
+	for i, version := range []int64{v1, v2} {
+		res := rs.Query(abci.RequestQuery{
+			Path:   fmt.Sprintf("/%s/key", key.Name()),
+			Data:   reqKey,
+			Height: version,
+			Prove:  true,
+		})
+		if !res.IsOK() {
+			return false, nil, fmt.Errorf("failed to prove key at version %d: %s", version, res.Log)
+		}
+		values[i] = res.Value
+		ops = append(ops, res.ProofOps.Ops...)
+	}
+
+	return bytes.Equal(values[0], values[1]), ops, nil
+}
+
+// MultiKeyProof proves the values of many keys of one IAVL store at the given
+// height, which defaults to the latest one when zero. It returns one proof op
+// per key, in the order of reqKeys and proving either the value or the absence
+// of the key, followed by the multistore proof op linking the store root to the
+// app hash, and the app hash itself. The proof of a key is verified against the
+// app hash by chaining its op with the multistore op.
+func (rs *Store) MultiKeyProof(key storetypes.StoreKey, reqKeys [][]byte, height int64) ([]crypto.ProofOp, []byte, error) {
+	store, ok := rs.GetCommitKVStore(key).(*iavl.Store)
+	if !ok {
+		return nil, nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "store %s is not an IAVL store", key.Name())
+	}
+	if height == 0 {
+		height = rs.LastCommitID().Version
+	}
+	if !store.VersionExists(height) {
+		return nil, nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight, "version %d of store %s is not available", height, key.Name())
+	}
+
+	ops := make([]crypto.ProofOp, 0, len(reqKeys)+1)
+	for _, reqKey := range reqKeys {
+		res := store.Query(abci.RequestQuery{Path: "/key", Data: reqKey, Height: height, Prove: true})
+		if !res.IsOK() {
+			return nil, nil, fmt.Errorf("failed to prove key %X: %s", reqKey, res.Log)
+		}
+		if res.ProofOps == nil || len(res.ProofOps.Ops) != 1 {
+			return nil, nil, sdkerrors.Wrapf(sdkerrors.ErrLogic, "expected a single proof op for key %X", reqKey)
+		}
+		ops = append(ops, res.ProofOps.Ops[0])
+	}
+
+	commitInfo := rs.LastCommitInfo()
+	if commitInfo.GetVersion() != height {
+		var err error
+		if commitInfo, err = rs.queryCommitInfo(height); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return append(ops, commitInfo.ProofOp(key.Name())), commitInfo.Hash(), nil
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/stretchr/testify/require"
 	abci "github.com/tendermint/tendermint/abci/types"
 	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/proto/tendermint/crypto"
 	dbm "github.com/tendermint/tm-db"
 
 	"github.com/cosmos/cosmos-sdk/store/iavl"
@@ -148,3 +149,147 @@ func TestVerifyMultiStoreQueryProofAbsence(t *testing.T) {
 	err = prt.VerifyValue(res.ProofOps, cid.Hash, "/iavlStoreKey/MYABSENTKEY", []byte(""))
 	require.NotNil(t, err)
 }
+
+func TestProveUnchanged(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewStore(db, log.NewNopLogger())
+	key := types.NewKVStoreKey("iavlStoreKey")
+	store.MountStoreWithDB(key, types.StoreTypeIAVL, nil)
+	transientKey := types.NewTransientStoreKey("transient")
+	store.MountStoreWithDB(transientKey, types.StoreTypeTransient, nil)
+	require.NoError(t, store.LoadVersion(0))
+
+	iavlStore := store.GetCommitStore(key).(*iavl.Store)
+	iavlStore.Set([]byte("stable"), []byte("value"))
+	iavlStore.Set([]byte("changing"), []byte("before"))
+	cid1 := store.Commit(true)
+
+	iavlStore.Set([]byte("other"), []byte("value"))
+	cid2 := store.Commit(true)
+
+	iavlStore.Set([]byte("changing"), []byte("after"))
+	cid3 := store.Commit(true)
+
+	prt := DefaultProofRuntime()
+
+	unchanged, ops, err := store.ProveUnchanged(key, []byte("stable"), cid1.Version, cid3.Version)
+	require.NoError(t, err)
+	require.True(t, unchanged)
+	require.Len(t, ops, 4)
+	require.NoError(t, prt.VerifyValue(&crypto.ProofOps{Ops: ops[:2]}, cid1.Hash, "/iavlStoreKey/stable", []byte("value")))
+	require.NoError(t, prt.VerifyValue(&crypto.ProofOps{Ops: ops[2:]}, cid3.Hash, "/iavlStoreKey/stable", []byte("value")))
+
+	unchanged, _, err = store.ProveUnchanged(key, []byte("changing"), cid1.Version, cid2.Version)
+	require.NoError(t, err)
+	require.True(t, unchanged)
+
+	unchanged, ops, err = store.ProveUnchanged(key, []byte("changing"), cid2.Version, cid3.Version)
+	require.NoError(t, err)
+	require.False(t, unchanged)
+	require.NoError(t, prt.VerifyValue(&crypto.ProofOps{Ops: ops[:2]}, cid2.Hash, "/iavlStoreKey/changing", []byte("before")))
+	require.NoError(t, prt.VerifyValue(&crypto.ProofOps{Ops: ops[2:]}, cid3.Hash, "/iavlStoreKey/changing", []byte("after")))
+	require.Error(t, prt.VerifyValue(&crypto.ProofOps{Ops: ops[2:]}, cid3.Hash, "/iavlStoreKey/changing", []byte("before")))
+
+	// both versions must be available
+	_, _, err = store.ProveUnchanged(key, []byte("stable"), cid1.Version, cid3.Version+1)
+	require.Error(t, err)
+
+	// only IAVL stores are supported
+	_, _, err = store.ProveUnchanged(transientKey, []byte("stable"), cid1.Version, cid2.Version)
+	require.Error(t, err)
+}
+
+func TestMultiKeyProof(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewStore(db, log.NewNopLogger())
+	key := types.NewKVStoreKey("iavlStoreKey")
+	store.MountStoreWithDB(key, types.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(types.NewKVStoreKey("other"), types.StoreTypeIAVL, nil)
+	transientKey := types.NewTransientStoreKey("transient")
+	store.MountStoreWithDB(transientKey, types.StoreTypeTransient, nil)
+	require.NoError(t, store.LoadVersion(0))
+
+	iavlStore := store.GetCommitStore(key).(*iavl.Store)
+	iavlStore.Set([]byte("a"), []byte("1"))
+	iavlStore.Set([]byte("b"), []byte("2"))
+	iavlStore.Set([]byte("c"), []byte("3"))
+	cid1 := store.Commit(true)
+	iavlStore.Set([]byte("a"), []byte("changed"))
+	cid2 := store.Commit(true)
+
+	prt := DefaultProofRuntime()
+	reqKeys := [][]byte{[]byte("c"), []byte("a"), []byte("missing")}
+
+	ops, appHash, err := store.MultiKeyProof(key, reqKeys, cid1.Version)
+	require.NoError(t, err)
+	require.Equal(t, cid1.Hash, appHash)
+	require.Len(t, ops, len(reqKeys)+1)
+	storeOp := ops[len(ops)-1]
+	proof := func(i int) *crypto.ProofOps { return &crypto.ProofOps{Ops: []crypto.ProofOp{ops[i], storeOp}} }
+	require.NoError(t, prt.VerifyValue(proof(0), appHash, "/iavlStoreKey/c", []byte("3")))
+	require.NoError(t, prt.VerifyValue(proof(1), appHash, "/iavlStoreKey/a", []byte("1")))
+	require.NoError(t, prt.VerifyAbsence(proof(2), appHash, "/iavlStoreKey/missing"))
+	require.Error(t, prt.VerifyValue(proof(1), appHash, "/iavlStoreKey/a", []byte("changed")))
+	require.Error(t, prt.VerifyValue(proof(0), cid2.Hash, "/iavlStoreKey/c", []byte("3")))
+
+	// zero proves the latest height
+	ops, appHash, err = store.MultiKeyProof(key, reqKeys[1:2], 0)
+	require.NoError(t, err)
+	require.Equal(t, cid2.Hash, appHash)
+	require.NoError(t, prt.VerifyValue(&crypto.ProofOps{Ops: ops}, appHash, "/iavlStoreKey/a", []byte("changed")))
+
+	_, _, err = store.MultiKeyProof(key, reqKeys, cid2.Version+1)
+	require.Error(t, err)
+	_, _, err = store.MultiKeyProof(transientKey, reqKeys, cid2.Version)
+	require.Error(t, err)
+}
+
+func TestVerifyMembership(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewStore(db, log.NewNopLogger())
+	key := types.NewKVStoreKey("iavlStoreKey")
+	otherKey := types.NewKVStoreKey("otherStoreKey")
+	store.MountStoreWithDB(key, types.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(otherKey, types.StoreTypeIAVL, nil)
+	require.NoError(t, store.LoadVersion(0))
+
+	// keys may contain path separators and arbitrary bytes
+	reqKey := []byte("my/key\x00")
+	store.GetKVStore(key).Set(reqKey, []byte("MYVALUE"))
+	store.GetKVStore(otherKey).Set(reqKey, []byte("OTHERVALUE"))
+	cid := store.Commit(true)
+
+	res := store.Query(abci.RequestQuery{
+		Path:  "/iavlStoreKey/key",
+		Data:  reqKey,
+		Prove: true,
+	})
+	require.True(t, res.IsOK(), res.Log)
+
+	require.NoError(t, VerifyMembership(cid.Hash, "iavlStoreKey", reqKey, []byte("MYVALUE"), res.ProofOps))
+
+	// tampered values, keys, stores and app hashes are rejected
+	require.Error(t, VerifyMembership(cid.Hash, "iavlStoreKey", reqKey, []byte("MYVALUE_NOT"), res.ProofOps))
+	require.Error(t, VerifyMembership(cid.Hash, "iavlStoreKey", []byte("my/key"), []byte("MYVALUE"), res.ProofOps))
+	require.Error(t, VerifyMembership(cid.Hash, "otherStoreKey", reqKey, []byte("MYVALUE"), res.ProofOps))
+	badHash := append([]byte{}, cid.Hash...)
+	badHash[0] ^= 0xff
+	require.Error(t, VerifyMembership(badHash, "iavlStoreKey", reqKey, []byte("MYVALUE"), res.ProofOps))
+
+	// as are tampered proofs
+	tampered := &crypto.ProofOps{Ops: append([]crypto.ProofOp{}, res.ProofOps.Ops...)}
+	tampered.Ops[0].Data = append([]byte{}, tampered.Ops[0].Data...)
+	tampered.Ops[0].Data[len(tampered.Ops[0].Data)-1] ^= 0xff
+	require.Error(t, VerifyMembership(cid.Hash, "iavlStoreKey", reqKey, []byte("MYVALUE"), tampered))
+	require.Error(t, VerifyMembership(cid.Hash, "iavlStoreKey", reqKey, []byte("MYVALUE"), &crypto.ProofOps{Ops: res.ProofOps.Ops[:1]}))
+	require.Error(t, VerifyMembership(cid.Hash, "iavlStoreKey", reqKey, []byte("MYVALUE"), nil))
+
+	// the proof of another store does not verify the value against this one
+	otherRes := store.Query(abci.RequestQuery{
+		Path:  "/otherStoreKey/key",
+		Data:  reqKey,
+		Prove: true,
+	})
+	require.NoError(t, VerifyMembership(cid.Hash, "otherStoreKey", reqKey, []byte("OTHERVALUE"), otherRes.ProofOps))
+	require.Error(t, VerifyMembership(cid.Hash, "iavlStoreKey", reqKey, []byte("OTHERVALUE"), otherRes.ProofOps))
+}
@@ -0,0 +1,365 @@
+package rootmulti
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	iavltree "github.com/cosmos/iavl"
+	"github.com/pkg/errors"
+
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+// pruneTimingWindow is the number of recent PruneStores runs used to estimate
+// how long the pending prune backlog will take to clear.
+const pruneTimingWindow = 10
+
+// pruneTiming records how long a single PruneStores run took and how many
+// heights it deleted.
+type pruneTiming struct {
+	heights  int
+	duration time.Duration
+}
+
+// reconcilePruneHeights drops the queued heights that no longer exist in any
+// IAVL store, e.g. because pruning was interrupted after deleting them but
+// before the queue was flushed, so they are not re-attempted on every run.
+func (rs *Store) reconcilePruneHeights(heights []int64) []int64 {
+	var iavlStores []*iavl.Store
+	for key, store := range rs.stores {
+		if store.GetStoreType() == types.StoreTypeIAVL {
+			iavlStores = append(iavlStores, rs.GetCommitKVStore(key).(*iavl.Store))
+		}
+	}
+	if len(iavlStores) == 0 {
+		return heights
+	}
+
+	pending := make([]int64, 0, len(heights))
+	var dropped []int64
+	for _, height := range heights {
+		exists := false
+		for _, store := range iavlStores {
+			if store.VersionExists(height) {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			pending = append(pending, height)
+		} else {
+			dropped = append(dropped, height)
+		}
+	}
+	if len(dropped) > 0 {
+		rs.logger.Info("dropping already pruned heights from the pruning queue", "heights", dropped)
+	}
+
+	return pending
+}
+
+// deleteVersions deletes the given versions from every IAVL store, stopping
+// before the next store once ctx is done. Versions that do not exist are
+// ignored.
+func (rs *Store) deleteVersions(ctx context.Context, versions []int64) error {
+	rs.evictCommitInfos(versions...)
+	for key, store := range rs.stores {
+		if store.GetStoreType() == types.StoreTypeIAVL {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// If the store is wrapped with an inter-block cache, we must first unwrap
+			// it to get the underlying IAVL store.
+			store = rs.GetCommitKVStore(key)
+
+			if err := store.(*iavl.Store).DeleteVersions(versions...); err != nil {
+				if errCause := errors.Cause(err); errCause != nil && errCause != iavltree.ErrVersionDoesNotExist {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// SetAsyncPruning sets whether Commit prunes with PruneStoresAsync rather than
+// PruneStores at every pruning interval, so that deleting versions does not
+// block the commit. It is off by default.
+func (rs *Store) SetAsyncPruning(enabled bool) {
+	rs.asyncPruning = enabled
+}
+
+// PruneStoresAsync takes the heights queued for pruning, other than the ones
+// being snapshotted, and deletes them from the IAVL stores in a background
+// goroutine. Only one async prune runs at a time: if one is already running,
+// the heights stay queued for the next call. Heights can be queued by Commit
+// while a prune is running. If ctx is done before all the stores are pruned,
+// or pruning fails, the heights are queued again. An error is only returned if
+// ctx is already done.
+func (rs *Store) PruneStoresAsync(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	rs.pruneHeightsMtx.Lock()
+	if rs.asyncPruneDone != nil || len(rs.pruneHeights) == 0 {
+		rs.pruneHeightsMtx.Unlock()
+		return nil
+	}
+	heights, held := rs.excludeSnapshotHeights(rs.pruneHeights)
+	if len(held) > 0 {
+		rs.logger.Info("deferring pruning of heights being snapshotted", "heights", held)
+	}
+	rs.pruneHeights = append(make([]int64, 0, len(held)), held...)
+	done := make(chan struct{})
+	rs.asyncPruneDone = done
+	rs.pruneHeightsMtx.Unlock()
+
+	go func() {
+		defer close(done)
+		defer rs.notifyPruneRun()
+		if rs.asyncPruneHook != nil {
+			rs.asyncPruneHook(heights)
+		}
+
+		start := time.Now()
+		err := rs.deleteVersions(ctx, heights)
+
+		rs.pruneHeightsMtx.Lock()
+		defer rs.pruneHeightsMtx.Unlock()
+		rs.asyncPruneDone = nil
+		if err != nil {
+			rs.logger.Error("async pruning failed, requeuing heights", "heights", heights, "err", err)
+			rs.pruneHeights = append(heights, rs.pruneHeights...)
+			return
+		}
+		rs.updateEarliestVersion(heights, held)
+		rs.recordPruneTiming(len(heights), time.Since(start))
+	}()
+	return nil
+}
+
+// WaitForPruning blocks until the running async prune, if any, is done, e.g. to
+// shut down gracefully.
+func (rs *Store) WaitForPruning() {
+	rs.pruneHeightsMtx.Lock()
+	done := rs.asyncPruneDone
+	rs.pruneHeightsMtx.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// setPruneHeights replaces the heights queued for pruning.
+func (rs *Store) setPruneHeights(heights []int64) {
+	rs.pruneHeightsMtx.Lock()
+	defer rs.pruneHeightsMtx.Unlock()
+	rs.pruneHeights = heights
+}
+
+// appendPruneHeights queues heights for pruning.
+func (rs *Store) appendPruneHeights(heights ...int64) {
+	rs.pruneHeightsMtx.Lock()
+	defer rs.pruneHeightsMtx.Unlock()
+	rs.pruneHeights = append(rs.pruneHeights, heights...)
+}
+
+// drainPruneHeights returns the heights queued for pruning and empties the
+// queue.
+func (rs *Store) drainPruneHeights() []int64 {
+	rs.pruneHeightsMtx.Lock()
+	defer rs.pruneHeightsMtx.Unlock()
+	heights := rs.pruneHeights
+	rs.pruneHeights = make([]int64, 0)
+	return heights
+}
+
+// setEarliestVersion sets the earliest version available, i.e. the lowest
+// version that has not been pruned.
+func (rs *Store) setEarliestVersion(version int64) {
+	rs.pruneHeightsMtx.Lock()
+	defer rs.pruneHeightsMtx.Unlock()
+	rs.earliestVersion = version
+}
+
+// updateEarliestVersion moves the earliest version past the pruned heights,
+// but no further than the lowest height that was held back or is still queued,
+// since those have not been deleted. The caller must hold pruneHeightsMtx.
+func (rs *Store) updateEarliestVersion(pruned, held []int64) {
+	if len(pruned) == 0 {
+		return
+	}
+	earliest := pruned[len(pruned)-1] + 1
+	for _, heights := range [][]int64{held, rs.pruneHeights} {
+		for _, height := range heights {
+			if height < earliest {
+				earliest = height
+			}
+		}
+	}
+	rs.earliestVersion = earliest
+}
+
+// notifyPruneRun wakes up the WaitForPruneBacklog callers after a PruneStores
+// run.
+func (rs *Store) notifyPruneRun() {
+	rs.pruneHeightsMtx.Lock()
+	defer rs.pruneHeightsMtx.Unlock()
+	if rs.pruneRun != nil {
+		close(rs.pruneRun)
+		rs.pruneRun = nil
+	}
+}
+
+// WaitForPruneBacklog blocks until at most maxHeights heights are queued for
+// pruning, checking after each PruneStores run, or until ctx is done in which
+// case the context error is returned.
+func (rs *Store) WaitForPruneBacklog(ctx context.Context, maxHeights int) error {
+	for {
+		rs.pruneHeightsMtx.Lock()
+		backlog := len(rs.pruneHeights)
+		if rs.pruneRun == nil {
+			rs.pruneRun = make(chan struct{})
+		}
+		pruneRun := rs.pruneRun
+		rs.pruneHeightsMtx.Unlock()
+
+		if backlog <= maxHeights {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-pruneRun:
+		}
+	}
+}
+
+// holdSnapshotHeight excludes the given height from pruning until the returned
+// release function is called.
+func (rs *Store) holdSnapshotHeight(height int64) (release func()) {
+	rs.snapshotHeightsMtx.Lock()
+	defer rs.snapshotHeightsMtx.Unlock()
+	rs.snapshotHeights[height]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rs.snapshotHeightsMtx.Lock()
+			defer rs.snapshotHeightsMtx.Unlock()
+			if rs.snapshotHeights[height]--; rs.snapshotHeights[height] <= 0 {
+				delete(rs.snapshotHeights, height)
+			}
+		})
+	}
+}
+
+// excludeSnapshotHeights splits heights into the ones that can be pruned and the
+// ones that have a snapshot in progress.
+func (rs *Store) excludeSnapshotHeights(heights []int64) (prunable, held []int64) {
+	rs.snapshotHeightsMtx.Lock()
+	defer rs.snapshotHeightsMtx.Unlock()
+
+	if len(rs.snapshotHeights) == 0 {
+		return heights, nil
+	}
+	prunable = make([]int64, 0, len(heights))
+	for _, height := range heights {
+		if rs.snapshotHeights[height] > 0 {
+			held = append(held, height)
+		} else {
+			prunable = append(prunable, height)
+		}
+	}
+	return prunable, held
+}
+
+// recordPruneTiming records how long pruning the given number of heights took.
+// The caller must hold pruneHeightsMtx.
+func (rs *Store) recordPruneTiming(heights int, duration time.Duration) {
+	rs.pruneTimings = append(rs.pruneTimings, pruneTiming{heights: heights, duration: duration})
+	if len(rs.pruneTimings) > pruneTimingWindow {
+		rs.pruneTimings = rs.pruneTimings[len(rs.pruneTimings)-pruneTimingWindow:]
+	}
+}
+
+// PendingPruneHeights returns a copy of the heights queued for pruning. It is
+// safe to call concurrently with Commit.
+func (rs *Store) PendingPruneHeights() []int64 {
+	rs.pruneHeightsMtx.Lock()
+	defer rs.pruneHeightsMtx.Unlock()
+	return append([]int64{}, rs.pruneHeights...)
+}
+
+// PendingPruneCount returns the number of heights queued for pruning. It is
+// safe to call concurrently with Commit.
+func (rs *Store) PendingPruneCount() int {
+	rs.pruneHeightsMtx.Lock()
+	defer rs.pruneHeightsMtx.Unlock()
+	return len(rs.pruneHeights)
+}
+
+// EstimatePruneBacklog returns the number of heights queued for pruning and an
+// estimate of how long it will take to prune them, based on the average
+// per-height duration of the most recent PruneStores runs. The estimate is zero
+// until at least one prune has been timed.
+func (rs *Store) EstimatePruneBacklog() (int, time.Duration) {
+	rs.pruneHeightsMtx.Lock()
+	defer rs.pruneHeightsMtx.Unlock()
+	heights := len(rs.pruneHeights)
+
+	var total time.Duration
+	var pruned int
+	for _, t := range rs.pruneTimings {
+		total += t.duration
+		pruned += t.heights
+	}
+	if pruned == 0 {
+		return heights, 0
+	}
+
+	return heights, time.Duration(int64(total) * int64(heights) / int64(pruned))
+}
+
+// PruneReclaimEstimator is implemented by stores that can estimate how many
+// bytes deleting a set of versions would free on disk.
+type PruneReclaimEstimator interface {
+	EstimatePruneReclaim(versions []int64) (int64, error)
+}
+
+// PruneReclaim is a per-store estimate of the disk space pruning would free.
+// Supported is false when the store cannot provide an estimate.
+type PruneReclaim struct {
+	Bytes     int64
+	Supported bool
+}
+
+// EstimatePruneReclaim estimates, without deleting anything, how many bytes each
+// IAVL store would free if the given heights were pruned. Stores that do not
+// implement PruneReclaimEstimator are reported as unsupported.
+func (rs *Store) EstimatePruneReclaim(heights []int64) (map[string]PruneReclaim, error) {
+	res := make(map[string]PruneReclaim)
+	for key, store := range rs.stores {
+		if store.GetStoreType() != types.StoreTypeIAVL {
+			continue
+		}
+		// If the store is wrapped with an inter-block cache, we must first unwrap
+		// it to get the underlying IAVL store.
+		store = rs.GetCommitKVStore(key)
+
+		estimator, ok := store.(PruneReclaimEstimator)
+		if !ok {
+			res[key.Name()] = PruneReclaim{}
+			continue
+		}
+		reclaim, err := estimator.EstimatePruneReclaim(heights)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to estimate prune reclaim for store %s", key.Name())
+		}
+		res[key.Name()] = PruneReclaim{Bytes: reclaim, Supported: true}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,265 @@
+package rootmulti
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/pkg/errors"
+	abci "github.com/tendermint/tendermint/abci/types"
+
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	"github.com/cosmos/cosmos-sdk/store/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// Has returns whether the store of the given name has the key, without the
+// overhead of a Query. Like GetKVStore, it reads the working state of the store,
+// including uncommitted writes. It returns an error if no store of that name is
+// mounted or it failed to load.
+func (rs *Store) Has(storeName string, key []byte) (bool, error) {
+	if err, ok := rs.failedStores[storeName]; ok {
+		return false, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store %s is unavailable, it failed to load: %v", storeName, err)
+	}
+	store, ok := rs.GetStoreByName(storeName).(types.KVStore)
+	if !ok {
+		return false, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "no such store: %s", storeName)
+	}
+	return store.Has(key), nil
+}
+
+// ExportKVStore calls w with each key/value pair of the IAVL store of the given
+// name at a version, in key order, stopping at the first error returned by w.
+// Unlike Snapshot, it exports the logical contents of the store rather than its
+// IAVL nodes. It returns an error if the store does not exist or the version was
+// pruned.
+func (rs *Store) ExportKVStore(storeName string, version int64, w func(key, value []byte) error) error {
+	key, err := rs.storeKeyByName(storeName)
+	if err != nil {
+		return err
+	}
+	immutable, err := rs.immutableStoreAt(key, version)
+	if err != nil {
+		return err
+	}
+
+	it := immutable.Iterator(nil, nil)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		if err := w(it.Key(), it.Value()); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// DiffStore returns the keys of the IAVL store of the given name that were
+// added, changed or removed from fromVersion to toVersion, in key order. Both
+// versions are walked side by side, so only the differing keys are held in
+// memory. It returns an error if the store does not exist or either version was
+// pruned.
+func (rs *Store) DiffStore(storeName string, fromVersion, toVersion int64) (added, changed, removed [][]byte, err error) {
+	key, err := rs.storeKeyByName(storeName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	from, err := rs.immutableStoreAt(key, fromVersion)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	to, err := rs.immutableStoreAt(key, toVersion)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	fromIt := from.Iterator(nil, nil)
+	defer fromIt.Close()
+	toIt := to.Iterator(nil, nil)
+	defer toIt.Close()
+	for fromIt.Valid() || toIt.Valid() {
+		var cmp int
+		switch {
+		case !fromIt.Valid():
+			cmp = 1
+		case !toIt.Valid():
+			cmp = -1
+		default:
+			cmp = bytes.Compare(fromIt.Key(), toIt.Key())
+		}
+
+		switch {
+		case cmp < 0:
+			removed = append(removed, append([]byte{}, fromIt.Key()...))
+			fromIt.Next()
+		case cmp > 0:
+			added = append(added, append([]byte{}, toIt.Key()...))
+			toIt.Next()
+		default:
+			if !bytes.Equal(fromIt.Value(), toIt.Value()) {
+				changed = append(changed, append([]byte{}, toIt.Key()...))
+			}
+			fromIt.Next()
+			toIt.Next()
+		}
+	}
+	if err := fromIt.Error(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := toIt.Error(); err != nil {
+		return nil, nil, nil, err
+	}
+	return added, changed, removed, nil
+}
+
+// storeKeyByName returns the key of the mounted store of the given name, or an
+// error if there is none.
+func (rs *Store) storeKeyByName(storeName string) (types.StoreKey, error) {
+	key := rs.keysByName[storeName]
+	if key == nil {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "no such store: %s", storeName)
+	}
+	return key, nil
+}
+
+// immutableStoreAt returns the given version of the IAVL store of the given
+// key, or an error if the store is not an IAVL store or the version is not
+// available.
+func (rs *Store) immutableStoreAt(key types.StoreKey, version int64) (*iavl.Store, error) {
+	commitStore := rs.GetCommitKVStore(key)
+	if commitStore == nil {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "no such store: %s", key.Name())
+	}
+	store, ok := commitStore.(*iavl.Store)
+	if !ok {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+			"store %s is of type %s, only IAVL stores are supported", key.Name(), commitStore.GetStoreType())
+	}
+	if !store.VersionExists(version) {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight,
+			"version %d of store %s is not available, it was pruned or never committed", version, key.Name())
+	}
+	return store.GetImmutable(version)
+}
+
+// QueryMulti serves a batch of queries like Query, and returns their responses
+// in the order of the requests. The requests are grouped by store so that each
+// store is resolved once, and the commit info of each height is read once for
+// all the proven queries at that height. A failed request, e.g. of an unknown
+// store, gets an error response without failing the others.
+func (rs *Store) QueryMulti(reqs []abci.RequestQuery) []abci.ResponseQuery {
+	responses := make([]abci.ResponseQuery, len(reqs))
+	subpaths := make([]string, len(reqs))
+	var storeNames []string
+	groups := make(map[string][]int)
+	for i, req := range reqs {
+		firstPath, subpath, err := parsePath(req.Path)
+		if err != nil {
+			responses[i] = sdkerrors.QueryResult(err)
+			continue
+		}
+		if _, ok := groups[firstPath]; !ok {
+			storeNames = append(storeNames, firstPath)
+		}
+		groups[firstPath] = append(groups[firstPath], i)
+		subpaths[i] = subpath
+	}
+
+	commitInfos := make(map[int64]*types.CommitInfo)
+	for _, name := range storeNames {
+		var queryable types.Queryable
+		var err error
+		if name != proofsPath {
+			queryable, err = rs.queryableStore(name)
+		}
+		for _, i := range groups[name] {
+			if err != nil {
+				responses[i] = sdkerrors.QueryResult(err)
+				continue
+			}
+			responses[i] = rs.queryStore(reqs[i], name, subpaths[i], queryable, commitInfos)
+		}
+	}
+	return responses
+}
+
+// GenesisCommitInfo returns the commit info of the first version committed by
+// the store, which is the initial version if one was set and 1 otherwise. An
+// error is returned if that version has been pruned or was never committed.
+func (rs *Store) GenesisCommitInfo() (*types.CommitInfo, error) {
+	version := rs.initialVersion
+	if version <= 0 {
+		version = 1
+	}
+
+	if earliest := rs.GetEarliestVersion(); version < earliest {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight,
+			"genesis version %d has been pruned; earliest available is %d", version, earliest)
+	}
+
+	return rs.commitInfoAt(version)
+}
+
+// ChangedStoresBetween returns the sorted names of the stores whose commit
+// hashes differ between versions v1 and v2. Stores present in only one of the
+// two versions are reported as changed. The commit info of both versions must
+// be available.
+func (rs *Store) ChangedStoresBetween(v1, v2 int64) ([]string, error) {
+	c1, err := rs.commitInfoAt(v1)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load commit info for version %d", v1)
+	}
+	c2, err := rs.commitInfoAt(v2)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load commit info for version %d", v2)
+	}
+
+	hashes := make(map[string][]byte, len(c1.StoreInfos))
+	for _, si := range c1.StoreInfos {
+		hashes[si.Name] = si.CommitId.Hash
+	}
+
+	changed := []string{}
+	for _, si := range c2.StoreInfos {
+		hash, ok := hashes[si.Name]
+		if !ok || !bytes.Equal(hash, si.CommitId.Hash) {
+			changed = append(changed, si.Name)
+		}
+		delete(hashes, si.Name)
+	}
+	for name := range hashes {
+		changed = append(changed, name)
+	}
+	sort.Strings(changed)
+
+	return changed, nil
+}
+
+// QueryableStores returns the sorted names of the loaded stores that can be
+// queried with proofs through Query, which are the IAVL stores.
+func (rs *Store) QueryableStores() []string {
+	names := []string{}
+	for key := range rs.stores {
+		if _, ok := rs.GetCommitKVStore(key).(*iavl.Store); ok {
+			names = append(names, key.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StoreChecksums returns the root hash of each committed store at the given
+// version, keyed by store name. These can be compared across replicas as a
+// lightweight integrity check. Transient and memory stores are not committed
+// and hence not included.
+func (rs *Store) StoreChecksums(version int64) (map[string][]byte, error) {
+	cInfo, err := rs.commitInfoAt(version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load commit info for version %d", version)
+	}
+
+	checksums := make(map[string][]byte, len(cInfo.StoreInfos))
+	for _, si := range cInfo.StoreInfos {
+		checksums[si.Name] = si.CommitId.Hash
+	}
+
+	return checksums, nil
+}
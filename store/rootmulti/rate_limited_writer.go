@@ -0,0 +1,61 @@
+package rootmulti
+
+import (
+	"sync"
+	"time"
+
+	protoio "github.com/gogo/protobuf/io"
+	"github.com/gogo/protobuf/proto"
+)
+
+// rateLimiter is a token bucket of a number of bytes per second, holding at
+// most one second worth of bytes. The bucket starts empty. It is safe for
+// concurrent use, so that several writers can share the same rate.
+type rateLimiter struct {
+	mtx         sync.Mutex
+	bytesPerSec float64
+	tokens      float64
+	last        time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	return &rateLimiter{bytesPerSec: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, blocking until they are available.
+func (l *rateLimiter) wait(n int) {
+	l.mtx.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.bytesPerSec
+	if l.tokens > l.bytesPerSec {
+		l.tokens = l.bytesPerSec
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	tokens := l.tokens
+	l.mtx.Unlock()
+
+	if tokens < 0 {
+		time.Sleep(time.Duration(-tokens / l.bytesPerSec * float64(time.Second)))
+	}
+}
+
+// rateLimitedWriter throttles the messages written to a protoio.Writer with a
+// rateLimiter. Messages are written unchanged, only their timing is affected.
+type rateLimitedWriter struct {
+	protoio.Writer
+	limiter *rateLimiter
+}
+
+var _ protoio.Writer = (*rateLimitedWriter)(nil)
+
+func newRateLimitedWriter(w protoio.Writer, limiter *rateLimiter) *rateLimitedWriter {
+	return &rateLimitedWriter{Writer: w, limiter: limiter}
+}
+
+// WriteMsg implements protoio.Writer. It blocks until the bucket holds enough
+// tokens for the message, then writes it.
+func (w *rateLimitedWriter) WriteMsg(msg proto.Message) error {
+	w.limiter.wait(proto.Size(msg))
+	return w.Writer.WriteMsg(msg)
+}
@@ -0,0 +1,185 @@
+package rootmulti
+
+import (
+	"fmt"
+	"io"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/cosmos-sdk/store/cachemulti"
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	"github.com/cosmos/cosmos-sdk/store/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// readOnlyView is a read-only MultiStore over the stores of a Store as of the
+// version that was last committed when the view was created.
+type readOnlyView struct {
+	db              dbm.DB
+	stores          map[types.StoreKey]types.KVStore
+	unpinned        map[types.StoreKey]struct{}
+	keysByName      map[string]types.StoreKey
+	hash            []byte
+	earliestVersion int64
+}
+
+var _ types.MultiStore = (*readOnlyView)(nil)
+
+// ReadOnlyView returns a read-only view of the last committed version of the
+// stores. IAVL stores are served from immutable trees, so the view is stable
+// and safe for concurrent reads while the store keeps committing. Transient and
+// memory stores are not part of the view, and neither are other persisted
+// stores, e.g. DB stores, as they cannot be pinned at a version: getting them
+// from the view panics. Writes through the view, or through branches of it when
+// they are written back, panic, and it cannot be branched at another version.
+func (rs *Store) ReadOnlyView() types.MultiStore {
+	cInfo := rs.LastCommitInfo()
+	view := &readOnlyView{
+		db:              rs.db,
+		stores:          make(map[types.StoreKey]types.KVStore),
+		unpinned:        make(map[types.StoreKey]struct{}),
+		keysByName:      make(map[string]types.StoreKey),
+		hash:            rs.commitHash(cInfo),
+		earliestVersion: rs.GetEarliestVersion(),
+	}
+	for key, store := range rs.stores {
+		var kvStore types.KVStore
+		switch store.GetStoreType() {
+		case types.StoreTypeIAVL:
+			immutable, err := rs.GetCommitKVStore(key).(*iavl.Store).GetImmutable(cInfo.GetVersion())
+			if err != nil {
+				panic(fmt.Sprintf("failed to load store %s at version %d: %v", key.Name(), cInfo.GetVersion(), err))
+			}
+			kvStore = immutable
+		case types.StoreTypeTransient, types.StoreTypeMemory:
+			continue
+		default:
+			view.unpinned[key] = struct{}{}
+			continue
+		}
+		view.stores[key] = readOnlyStore{KVStore: kvStore, name: key.Name()}
+		view.keysByName[key.Name()] = key
+	}
+	return view
+}
+
+// GetStoreType implements types.Store.
+func (v *readOnlyView) GetStoreType() types.StoreType {
+	return types.StoreTypeMulti
+}
+
+// CacheWrap implements types.CacheWrapper.
+func (v *readOnlyView) CacheWrap(_ types.StoreKey) types.CacheWrap {
+	return v.CacheMultiStore().(types.CacheWrap)
+}
+
+// CacheWrapWithTrace implements types.CacheWrapper.
+func (v *readOnlyView) CacheWrapWithTrace(storeKey types.StoreKey, _ io.Writer, _ types.TraceContext) types.CacheWrap {
+	return v.CacheWrap(storeKey)
+}
+
+// CacheWrapWithListeners implements types.CacheWrapper.
+func (v *readOnlyView) CacheWrapWithListeners(storeKey types.StoreKey, _ []types.WriteListener) types.CacheWrap {
+	return v.CacheWrap(storeKey)
+}
+
+// CacheMultiStore implements types.MultiStore. Writing the branch back panics if
+// it has any writes.
+func (v *readOnlyView) CacheMultiStore() types.CacheMultiStore {
+	stores := make(map[types.StoreKey]types.CacheWrapper, len(v.stores))
+	for k, s := range v.stores {
+		stores[k] = s
+	}
+	return cachemulti.NewStore(v.db, stores, v.keysByName, nil, nil, nil)
+}
+
+// CacheMultiStoreWithVersion implements types.MultiStore. It always fails, as
+// the view is bound to a single version.
+func (v *readOnlyView) CacheMultiStoreWithVersion(version int64) (types.CacheMultiStore, error) {
+	return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "cannot branch read-only view at version %d", version)
+}
+
+// CacheMultiStoreForExport implements types.MultiStore. It always fails, as the
+// view is bound to a single version.
+func (v *readOnlyView) CacheMultiStoreForExport(version int64) (types.CacheMultiStore, error) {
+	return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "cannot branch read-only view at version %d", version)
+}
+
+// GetStore implements types.MultiStore.
+func (v *readOnlyView) GetStore(key types.StoreKey) types.Store {
+	return v.GetKVStore(key)
+}
+
+// GetKVStore implements types.MultiStore.
+func (v *readOnlyView) GetKVStore(key types.StoreKey) types.KVStore {
+	store, ok := v.stores[key]
+	if !ok {
+		if _, ok := v.unpinned[key]; ok {
+			panic(fmt.Sprintf("store %s cannot be pinned at a version and is not part of the read-only view", key.Name()))
+		}
+		panic(fmt.Sprintf("store does not exist for key: %s", key.Name()))
+	}
+	return store
+}
+
+// GetEarliestVersion implements types.MultiStore.
+func (v *readOnlyView) GetEarliestVersion() int64 {
+	return v.earliestVersion
+}
+
+// TracingEnabled implements types.MultiStore. The view is never traced.
+func (v *readOnlyView) TracingEnabled() bool {
+	return false
+}
+
+// SetTracer implements types.MultiStore. It is a no-op.
+func (v *readOnlyView) SetTracer(_ io.Writer) types.MultiStore {
+	return v
+}
+
+// SetTracingContext implements types.MultiStore. It is a no-op.
+func (v *readOnlyView) SetTracingContext(_ types.TraceContext) types.MultiStore {
+	return v
+}
+
+// ListeningEnabled implements types.MultiStore. The view has no writes to
+// listen to.
+func (v *readOnlyView) ListeningEnabled(_ types.StoreKey) bool {
+	return false
+}
+
+// AddListeners implements types.MultiStore. It always panics.
+func (v *readOnlyView) AddListeners(_ types.StoreKey, _ []types.WriteListener) {
+	panic("cannot add listeners to a read-only view")
+}
+
+// GetWorkingHash implements types.MultiStore, returning the hash of the version
+// of the view.
+func (v *readOnlyView) GetWorkingHash() ([]byte, error) {
+	return v.hash, nil
+}
+
+// GetEvents implements types.MultiStore.
+func (v *readOnlyView) GetEvents() []abci.Event {
+	panic("getevents should not be called on a read-only view")
+}
+
+// ResetEvents implements types.MultiStore.
+func (v *readOnlyView) ResetEvents() {
+	panic("reset events should not be called on a read-only view")
+}
+
+// SetKVStores implements types.MultiStore.
+func (v *readOnlyView) SetKVStores(_ func(key types.StoreKey, s types.KVStore) types.CacheWrap) types.MultiStore {
+	panic("SetKVStores is not implemented for a read-only view")
+}
+
+// StoreKeys implements types.MultiStore.
+func (v *readOnlyView) StoreKeys() []types.StoreKey {
+	res := make([]types.StoreKey, 0, len(v.keysByName))
+	for _, key := range v.keysByName {
+		res = append(res, key)
+	}
+	return res
+}
@@ -0,0 +1,106 @@
+package rootmulti
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/libs/log"
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+func TestReadOnlyView(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := NewStore(db, log.NewNopLogger())
+	ms.MountStoreWithDB(testStoreKey1, types.StoreTypeIAVL, nil)
+	transientKey := types.NewTransientStoreKey("transient")
+	ms.MountStoreWithDB(transientKey, types.StoreTypeTransient, nil)
+	dbKey := types.NewKVStoreKey("db")
+	ms.MountStoreWithDB(dbKey, types.StoreTypeDB, nil)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	store1 := ms.GetKVStore(testStoreKey1)
+	store1.Set(testKey1, testValue1)
+	cid := ms.Commit(true)
+
+	view := ms.ReadOnlyView()
+	hash, err := view.GetWorkingHash()
+	require.NoError(t, err)
+	require.Equal(t, cid.Hash, hash)
+	require.Equal(t, testValue1, view.GetKVStore(testStoreKey1).Get(testKey1))
+
+	// the view keeps serving the version it was created at
+	store1.Set(testKey1, testValue2)
+	store1.Set(testKey2, testValue2)
+	require.Equal(t, testValue1, view.GetKVStore(testStoreKey1).Get(testKey1))
+	ms.Commit(true)
+	require.Equal(t, testValue1, view.GetKVStore(testStoreKey1).Get(testKey1))
+	require.False(t, view.GetKVStore(testStoreKey1).Has(testKey2))
+
+	// writes are rejected, directly or when written back from a branch
+	require.Panics(t, func() { view.GetKVStore(testStoreKey1).Set(testKey1, testValue2) })
+	require.Panics(t, func() { view.GetKVStore(testStoreKey1).Delete(testKey1) })
+	branch := view.CacheMultiStore()
+	branch.GetKVStore(testStoreKey1).Set(testKey2, testValue1)
+	require.Equal(t, testValue1, branch.GetKVStore(testStoreKey1).Get(testKey2))
+	require.Panics(t, branch.Write)
+
+	// as is branching at another version
+	_, err = view.CacheMultiStoreWithVersion(cid.Version)
+	require.Error(t, err)
+
+	// transient stores are not part of the view, nor are stores that cannot be
+	// pinned at the version of the view
+	require.Panics(t, func() { view.GetKVStore(transientKey) })
+	require.PanicsWithValue(t, "store db cannot be pinned at a version and is not part of the read-only view", func() {
+		view.GetKVStore(dbKey)
+	})
+	require.Len(t, view.StoreKeys(), 1)
+}
+
+func TestReadOnlyViewConcurrentReads(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	store1 := ms.GetKVStore(testStoreKey1)
+	for i := 0; i < 10; i++ {
+		store1.Set([]byte(fmt.Sprintf("key%d", i)), []byte("v0"))
+	}
+	ms.Commit(true)
+
+	view := ms.ReadOnlyView()
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				store := view.GetKVStore(testStoreKey1)
+				require.Equal(t, []byte("v0"), store.Get([]byte(fmt.Sprintf("key%d", n%10))))
+
+				it := store.Iterator(nil, nil)
+				count := 0
+				for ; it.Valid(); it.Next() {
+					require.Equal(t, []byte("v0"), it.Value())
+					count++
+				}
+				require.NoError(t, it.Close())
+				require.Equal(t, 10, count)
+			}
+		}()
+	}
+
+	// the main store keeps writing and committing meanwhile
+	for v := 1; v <= 20; v++ {
+		for i := 0; i < 10; i++ {
+			store1.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("v%d", v)))
+		}
+		store1.Set([]byte(fmt.Sprintf("new%d", v)), []byte("v"))
+		ms.Commit(true)
+	}
+	wg.Wait()
+}
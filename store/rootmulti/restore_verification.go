@@ -0,0 +1,92 @@
+package rootmulti
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	"github.com/cosmos/cosmos-sdk/store/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// SetRestoreVerification enables the strict restore mode, in which Restore
+// verifies the root hash of every restored store against the trusted commit
+// info before the restored height is written. Passing nil disables it.
+func (rs *Store) SetRestoreVerification(trusted *types.CommitInfo) {
+	rs.restoreTrustedCommitInfo = trusted
+}
+
+// VerifyVersion checks that the on-disk state of a version is consistent with
+// its commit info: the root hash of every IAVL store at the version must match
+// the hash of its store info, and for the latest version the commit info hash
+// must match LastCommitID. It returns an error naming the first store that does
+// not match, in the order of the commit info.
+func (rs *Store) VerifyVersion(version int64) error {
+	cInfo, ok := rs.pendingCommitInfo(version)
+	if !ok {
+		var err error
+		if cInfo, err = rs.readCommitInfo(version); err != nil {
+			return err
+		}
+	}
+
+	for _, storeInfo := range cInfo.StoreInfos {
+		key, ok := rs.keysByName[storeInfo.Name]
+		if !ok {
+			continue
+		}
+		store, ok := rs.GetCommitKVStore(key).(*iavl.Store)
+		if !ok {
+			continue
+		}
+		if !store.VersionExists(version) {
+			return sdkerrors.Wrapf(sdkerrors.ErrLogic, "store %s does not have version %d", storeInfo.Name, version)
+		}
+		tree, err := store.GetImmutable(version)
+		if err != nil {
+			return sdkerrors.Wrapf(err, "failed to load store %s at version %d", storeInfo.Name, version)
+		}
+		if hash := tree.LastCommitID().Hash; !bytes.Equal(hash, storeInfo.CommitId.Hash) {
+			return sdkerrors.Wrapf(sdkerrors.ErrLogic, "store %s hash at version %d is %X, commit info has %X",
+				storeInfo.Name, version, hash, storeInfo.CommitId.Hash)
+		}
+	}
+
+	if last := rs.LastCommitID(); last.Version == version && !bytes.Equal(rs.commitHash(cInfo), last.Hash) {
+		return sdkerrors.Wrapf(sdkerrors.ErrLogic, "commit info hash at version %d is %X, last commit ID has %X",
+			version, rs.commitHash(cInfo), last.Hash)
+	}
+	return nil
+}
+
+// verifyRestoredStores checks that the store infos of the restored commit info
+// match the ones of the trusted commit info for the restored height, and
+// returns an error naming the stores that do not.
+func verifyRestoredStores(cInfo, trusted *types.CommitInfo) error {
+	if trusted.Version != cInfo.Version {
+		return sdkerrors.Wrapf(sdkerrors.ErrLogic, "trusted commit info is for height %d, restored height %d", trusted.Version, cInfo.Version)
+	}
+	restored := make(map[string][]byte)
+	for _, storeInfo := range cInfo.StoreInfos {
+		restored[storeInfo.Name] = storeInfo.CommitId.Hash
+	}
+
+	var mismatched []string
+	for _, storeInfo := range trusted.StoreInfos {
+		hash, ok := restored[storeInfo.Name]
+		if !ok || !bytes.Equal(hash, storeInfo.CommitId.Hash) {
+			mismatched = append(mismatched, storeInfo.Name)
+		}
+		delete(restored, storeInfo.Name)
+	}
+	// stores missing from the trusted commit info cannot be verified
+	for name := range restored {
+		mismatched = append(mismatched, name)
+	}
+	if len(mismatched) > 0 {
+		sort.Strings(mismatched)
+		return sdkerrors.Wrapf(sdkerrors.ErrLogic, "restored stores do not match the trusted commit info: %s", strings.Join(mismatched, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package rootmulti
+
+import (
+	"errors"
+
+	protoio "github.com/gogo/protobuf/io"
+	"github.com/gogo/protobuf/proto"
+)
+
+// RewindableReader is a protoio.Reader that can rewind to the start of the
+// message it was reading when ReadMsg failed, so that the read can safely be
+// attempted again.
+type RewindableReader interface {
+	protoio.Reader
+
+	// Rewind resets the reader to the start of the last message it failed to read.
+	Rewind() error
+}
+
+// temporary is implemented by errors that report whether they are transient,
+// such as net.Error.
+type temporary interface {
+	Temporary() bool
+}
+
+// retryingProtoReader retries ReadMsg calls that failed with a transient error.
+type retryingProtoReader struct {
+	inner      protoio.Reader
+	maxRetries int
+}
+
+var _ protoio.ReadCloser = (*retryingProtoReader)(nil)
+
+// RetryingProtoReader wraps a protoio.Reader such that ReadMsg calls failing
+// with a transient error (one implementing Temporary() bool and returning true)
+// are retried up to maxRetries times. This allows Restore to consume snapshots
+// from flaky sources.
+//
+// A failed read may have consumed part of a message, and retrying it would then
+// misalign the stream. Retries are therefore only attempted when the inner
+// reader implements RewindableReader, in which case it is rewound to the start
+// of the message before every retry. Errors from other readers are returned as-is.
+func RetryingProtoReader(inner protoio.Reader, maxRetries int) protoio.ReadCloser {
+	return &retryingProtoReader{inner: inner, maxRetries: maxRetries}
+}
+
+// ReadMsg implements protoio.Reader.
+func (r *retryingProtoReader) ReadMsg(msg proto.Message) error {
+	rewindable, canRewind := r.inner.(RewindableReader)
+
+	err := r.inner.ReadMsg(msg)
+	for attempt := 0; err != nil && attempt < r.maxRetries; attempt++ {
+		if !canRewind || !isTransient(err) {
+			return err
+		}
+		if rerr := rewindable.Rewind(); rerr != nil {
+			return rerr
+		}
+		msg.Reset()
+		err = r.inner.ReadMsg(msg)
+	}
+
+	return err
+}
+
+// Close implements protoio.ReadCloser, closing the inner reader if it supports it.
+func (r *retryingProtoReader) Close() error {
+	if closer, ok := r.inner.(protoio.ReadCloser); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func isTransient(err error) bool {
+	var t temporary
+	return errors.As(err, &t) && t.Temporary()
+}
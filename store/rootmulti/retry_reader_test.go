@@ -0,0 +1,121 @@
+package rootmulti_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+
+	snapshottypes "github.com/cosmos/cosmos-sdk/snapshots/types"
+	"github.com/cosmos/cosmos-sdk/store/rootmulti"
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+type transientError struct{}
+
+func (transientError) Error() string   { return "transient read error" }
+func (transientError) Temporary() bool { return true }
+
+// itemCollector is a protoio.Writer collecting the written snapshot items.
+type itemCollector struct {
+	items []snapshottypes.SnapshotItem
+}
+
+func (c *itemCollector) WriteMsg(msg proto.Message) error {
+	c.items = append(c.items, *msg.(*snapshottypes.SnapshotItem))
+	return nil
+}
+
+// flakyItemReader replays snapshot items, failing with an injected error the
+// configured number of times before each item is read successfully.
+type flakyItemReader struct {
+	items    []snapshottypes.SnapshotItem
+	next     int
+	failures int
+	failed   int
+	err      error
+	rewinds  int
+}
+
+func (r *flakyItemReader) ReadMsg(msg proto.Message) error {
+	if r.next >= len(r.items) {
+		return io.EOF
+	}
+	if r.failed < r.failures {
+		r.failed++
+		// simulate a partially consumed message
+		msg.(*snapshottypes.SnapshotItem).Item = &snapshottypes.SnapshotItem_Store{}
+		return r.err
+	}
+	r.failed = 0
+	item := r.items[r.next]
+	*msg.(*snapshottypes.SnapshotItem) = item
+	r.next++
+	return nil
+}
+
+type rewindableItemReader struct {
+	*flakyItemReader
+}
+
+func (r rewindableItemReader) Rewind() error {
+	r.rewinds++
+	return nil
+}
+
+func TestRetryingProtoReader(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := uint64(source.LastCommitID().Version)
+	collector := &itemCollector{}
+	require.NoError(t, source.Snapshot(version, collector))
+
+	t.Run("retries transient errors on rewindable readers", func(t *testing.T) {
+		flaky := &flakyItemReader{items: collector.items, failures: 2, err: transientError{}}
+		target := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+		_, err := target.Restore(version, snapshottypes.CurrentFormat, rootmulti.RetryingProtoReader(rewindableItemReader{flaky}, 2))
+		require.NoError(t, err)
+		require.Equal(t, 2*len(collector.items), flaky.rewinds)
+
+		for _, name := range []string{"iavl1", "iavl2", "iavl3"} {
+			assertStoresEqual(t,
+				source.GetStoreByName(name).(types.CommitKVStore),
+				target.GetStoreByName(name).(types.CommitKVStore))
+		}
+	})
+
+	t.Run("gives up after max retries", func(t *testing.T) {
+		flaky := &flakyItemReader{items: collector.items, failures: 3, err: transientError{}}
+		reader := rootmulti.RetryingProtoReader(rewindableItemReader{flaky}, 2)
+		item := &snapshottypes.SnapshotItem{}
+		require.ErrorIs(t, reader.ReadMsg(item), transientError{})
+		require.Equal(t, 2, flaky.rewinds)
+	})
+
+	t.Run("does not retry permanent errors", func(t *testing.T) {
+		permanent := errors.New("permanent")
+		flaky := &flakyItemReader{items: collector.items, failures: 1, err: permanent}
+		reader := rootmulti.RetryingProtoReader(rewindableItemReader{flaky}, 2)
+		require.ErrorIs(t, reader.ReadMsg(&snapshottypes.SnapshotItem{}), permanent)
+		require.Zero(t, flaky.rewinds)
+	})
+
+	t.Run("does not retry readers that cannot rewind", func(t *testing.T) {
+		flaky := &flakyItemReader{items: collector.items, failures: 1, err: transientError{}}
+		reader := rootmulti.RetryingProtoReader(flaky, 2)
+		require.ErrorIs(t, reader.ReadMsg(&snapshottypes.SnapshotItem{}), transientError{})
+		require.Equal(t, 0, flaky.next)
+	})
+
+	t.Run("reads cleanly without errors", func(t *testing.T) {
+		flaky := &flakyItemReader{items: collector.items}
+		reader := rootmulti.RetryingProtoReader(flaky, 2)
+		for range collector.items {
+			require.NoError(t, reader.ReadMsg(&snapshottypes.SnapshotItem{}))
+		}
+		require.ErrorIs(t, reader.ReadMsg(&snapshottypes.SnapshotItem{}), io.EOF)
+		require.NoError(t, reader.Close())
+	})
+}
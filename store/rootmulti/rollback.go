@@ -0,0 +1,66 @@
+package rootmulti
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// RollbackPlan describes what RollbackToVersion would do for a target version.
+type RollbackPlan struct {
+	Target int64
+	Stores []RollbackStorePlan
+}
+
+// RollbackStorePlan describes the rollback of a single IAVL store.
+type RollbackStorePlan struct {
+	Name           string
+	CurrentVersion int64
+	// DeletedVersions is the number of versions after the target that would be
+	// deleted.
+	DeletedVersions int
+	// TargetExists is whether the store has the target version. Rolling back a
+	// store without it resets it to its latest version below the target.
+	TargetExists bool
+}
+
+// RollbackToVersionDryRun computes what RollbackToVersion would do for the given
+// target without touching the stores or the DB. The plan lists the IAVL stores
+// sorted by name. An error is returned along with the plan if any store does not
+// have the target version.
+func (rs *Store) RollbackToVersionDryRun(target int64) (RollbackPlan, error) {
+	if target <= 0 {
+		return RollbackPlan{}, fmt.Errorf("invalid rollback height target: %d", target)
+	}
+
+	plan := RollbackPlan{Target: target}
+	var missing []string
+	for _, key := range keysForStoreKeyMap(rs.stores) {
+		store, ok := rs.GetCommitKVStore(key).(*iavl.Store)
+		if !ok {
+			continue
+		}
+		storePlan := RollbackStorePlan{
+			Name:           key.Name(),
+			CurrentVersion: store.LastCommitID().Version,
+			TargetExists:   store.VersionExists(target),
+		}
+		for _, version := range store.GetAllVersions() {
+			if int64(version) > target {
+				storePlan.DeletedVersions++
+			}
+		}
+		if !storePlan.TargetExists {
+			missing = append(missing, key.Name())
+		}
+		plan.Stores = append(plan.Stores, storePlan)
+	}
+
+	if len(missing) > 0 {
+		return plan, sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight,
+			"version %d does not exist in stores: %s", target, strings.Join(missing, ", "))
+	}
+	return plan, nil
+}
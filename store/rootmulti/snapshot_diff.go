@@ -0,0 +1,160 @@
+package rootmulti
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sort"
+
+	iavltree "github.com/cosmos/iavl"
+	protoio "github.com/gogo/protobuf/io"
+	dbm "github.com/tendermint/tm-db"
+
+	snapshottypes "github.com/cosmos/cosmos-sdk/snapshots/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// snapshotDiffMaxItemSize is the maximum size of a snapshot item read by
+// DiffSnapshots, matching the limit of the snapshot manager.
+const snapshotDiffMaxItemSize = int(64e6)
+
+// DiffSnapshots compares two snapshot streams, as written by SnapshotBytes, and
+// returns the sorted names of the stores only present in b, only present in a,
+// and present in both with different contents. The root hash of every store is
+// reconstructed by importing its nodes into an in-memory IAVL tree, so the
+// streams are compared by content rather than byte for byte. The streams must be
+// uncompressed, i.e. of CurrentFormat.
+func DiffSnapshots(a, b io.Reader) (added, removed, changed []string, err error) {
+	rootsA, err := snapshotStoreRoots(a)
+	if err != nil {
+		return nil, nil, nil, sdkerrors.Wrap(err, "failed to read first snapshot")
+	}
+	rootsB, err := snapshotStoreRoots(b)
+	if err != nil {
+		return nil, nil, nil, sdkerrors.Wrap(err, "failed to read second snapshot")
+	}
+
+	for name, rootA := range rootsA {
+		rootB, ok := rootsB[name]
+		switch {
+		case !ok:
+			removed = append(removed, name)
+		case !bytes.Equal(rootA, rootB):
+			changed = append(changed, name)
+		}
+	}
+	for name := range rootsB {
+		if _, ok := rootsA[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed, nil
+}
+
+// snapshotStoreRoots reads the store items of a snapshot stream and returns the
+// root hash of each store. Reading stops at the first item that is neither a
+// store nor an IAVL node, such as an extension item.
+func snapshotStoreRoots(r io.Reader) (map[string][]byte, error) {
+	protoReader := protoio.NewDelimitedReader(r, snapshotDiffMaxItemSize)
+	roots := map[string][]byte{}
+
+	var (
+		name     string
+		tree     *iavltree.MutableTree
+		importer *iavltree.Importer
+	)
+	commit := func() error {
+		if importer == nil {
+			return nil
+		}
+		if err := importer.Commit(); err != nil {
+			return sdkerrors.Wrapf(err, "failed to rebuild store %q", name)
+		}
+		importer = nil
+		hash, err := tree.Hash()
+		if err != nil {
+			return sdkerrors.Wrapf(err, "failed to hash store %q", name)
+		}
+		roots[name] = hash
+		return nil
+	}
+	defer func() {
+		if importer != nil {
+			importer.Close()
+		}
+	}()
+
+loop:
+	for {
+		item := snapshottypes.SnapshotItem{}
+		err := protoReader.ReadMsg(&item)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, sdkerrors.Wrap(err, "invalid protobuf message")
+		}
+
+		switch item := item.Item.(type) {
+		case *snapshottypes.SnapshotItem_Store:
+			if err := commit(); err != nil {
+				return nil, err
+			}
+			if item.Store.Name == snapshotStoreSetItemName {
+				// the store set is compared through the store names
+				if _, err := readSnapshotStoreSetHash(protoReader); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if _, ok := roots[item.Store.Name]; ok {
+				return nil, sdkerrors.Wrapf(sdkerrors.ErrLogic, "duplicate store %q", item.Store.Name)
+			}
+			name = item.Store.Name
+			if tree, err = iavltree.NewMutableTree(dbm.NewMemDB(), 0, true); err != nil {
+				return nil, err
+			}
+			// The height of the snapshot is not part of the stream. Node hashes
+			// do not depend on the imported version, so the highest one accepts
+			// the nodes of any height.
+			if importer, err = tree.Import(math.MaxInt64); err != nil {
+				return nil, err
+			}
+
+		case *snapshottypes.SnapshotItem_IAVL:
+			if importer == nil {
+				return nil, sdkerrors.Wrap(sdkerrors.ErrLogic, "received IAVL node item before store item")
+			}
+			if item.IAVL.Height > math.MaxInt8 {
+				return nil, sdkerrors.Wrapf(sdkerrors.ErrLogic, "node height %v cannot exceed %v",
+					item.IAVL.Height, math.MaxInt8)
+			}
+			node := &iavltree.ExportNode{
+				Key:     item.IAVL.Key,
+				Value:   item.IAVL.Value,
+				Height:  int8(item.IAVL.Height),
+				Version: item.IAVL.Version,
+			}
+			// As in Restore, nil keys and leaf values are sent as empty ones.
+			if node.Key == nil {
+				node.Key = []byte{}
+			}
+			if node.Height == 0 && node.Value == nil {
+				node.Value = []byte{}
+			}
+			if err := importer.Add(node); err != nil {
+				return nil, sdkerrors.Wrapf(err, "failed to rebuild store %q", name)
+			}
+
+		default:
+			break loop
+		}
+	}
+
+	if err := commit(); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
@@ -0,0 +1,206 @@
+package rootmulti
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+
+	iavltree "github.com/cosmos/iavl"
+	"github.com/klauspost/compress/zstd"
+
+	snapshottypes "github.com/cosmos/cosmos-sdk/snapshots/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// CompressionType is the compression of the values of the IAVL items of a
+// snapshot.
+type CompressionType uint8
+
+const (
+	CompressionNone CompressionType = iota
+	CompressionGzip
+	CompressionZstd
+)
+
+// compressionTypes are the supported compression types.
+var compressionTypes = []CompressionType{CompressionNone, CompressionGzip, CompressionZstd}
+
+// snapshotFormatCompressionShift is the bit offset of the compression type in a
+// snapshot format number, whose lower bits hold the format of the items. An
+// uncompressed snapshot has the format of its items, e.g. CurrentFormat.
+const snapshotFormatCompressionShift = 8
+
+// maxDecompressedValueSize bounds the size of a decompressed value, matching
+// the item size limit of the snapshot manager.
+const maxDecompressedValueSize = 64e6
+
+// snapshotFormat returns the format of snapshots of the current item format
+// with the given compression.
+func snapshotFormat(compression CompressionType) uint32 {
+	return snapshottypes.CurrentFormat | uint32(compression)<<snapshotFormatCompressionShift
+}
+
+// snapshotNodeDecoder decodes an IAVL item of a snapshot into the node to
+// import.
+type snapshotNodeDecoder func(item *snapshottypes.SnapshotIAVLItem) (*iavltree.ExportNode, error)
+
+// snapshotNodeDecoders are the node decoders of the item formats Restore
+// supports. A format changing the encoding of the IAVL items adds its own
+// decoder, keeping the previous ones so older snapshots can still be restored.
+var snapshotNodeDecoders = map[uint32]snapshotNodeDecoder{
+	1: decodeSnapshotNodeV1,
+}
+
+// SetSnapshotCompression sets the compression of the values of the IAVL items
+// written by Snapshot, which is part of the snapshot format. The default is
+// CompressionNone, keeping the output of CurrentFormat.
+func (rs *Store) SetSnapshotCompression(compression CompressionType) {
+	if compression > CompressionZstd {
+		panic(fmt.Sprintf("unknown snapshot compression type %d", compression))
+	}
+	rs.snapshotCompression = compression
+}
+
+// SnapshotFormat returns the format of the snapshots written by Snapshot.
+func (rs *Store) SnapshotFormat() uint32 {
+	return snapshotFormat(rs.snapshotCompression)
+}
+
+// SupportedSnapshotFormats returns the snapshot formats Restore supports, in
+// ascending order.
+func (rs *Store) SupportedSnapshotFormats() []uint32 {
+	formats := make([]uint32, 0, len(snapshotNodeDecoders)*len(compressionTypes))
+	for format := range snapshotNodeDecoders {
+		for _, compression := range compressionTypes {
+			formats = append(formats, format|uint32(compression)<<snapshotFormatCompressionShift)
+		}
+	}
+	sort.Slice(formats, func(i, j int) bool { return formats[i] < formats[j] })
+	return formats
+}
+
+// snapshotNodeDecoderFor returns the node decoder of a snapshot format, or an
+// error wrapping ErrUnknownFormat if it is not supported.
+func (rs *Store) snapshotNodeDecoderFor(format uint32) (snapshotNodeDecoder, error) {
+	itemFormat, compression := format&(1<<snapshotFormatCompressionShift-1), format>>snapshotFormatCompressionShift
+	decoder, ok := snapshotNodeDecoders[itemFormat]
+	if !ok || compression > uint32(CompressionZstd) {
+		return nil, sdkerrors.Wrapf(snapshottypes.ErrUnknownFormat,
+			"snapshot format %v, supported formats are %v", format, rs.SupportedSnapshotFormats())
+	}
+	if CompressionType(compression) == CompressionNone {
+		return decoder, nil
+	}
+	return func(item *snapshottypes.SnapshotIAVLItem) (*iavltree.ExportNode, error) {
+		if item.Height == 0 {
+			value, err := CompressionType(compression).decompress(item.Value)
+			if err != nil {
+				return nil, sdkerrors.Wrapf(err, "failed to decompress value of key %X", item.Key)
+			}
+			decompressed := *item
+			decompressed.Value = value
+			item = &decompressed
+		}
+		return decoder(item)
+	}, nil
+}
+
+// decodeSnapshotNodeV1 decodes an IAVL item of format 1, holding the exported
+// node as is.
+func decodeSnapshotNodeV1(item *snapshottypes.SnapshotIAVLItem) (*iavltree.ExportNode, error) {
+	if item.Height > math.MaxInt8 {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrLogic, "node height %v cannot exceed %v",
+			item.Height, math.MaxInt8)
+	}
+	node := &iavltree.ExportNode{
+		Key:     item.Key,
+		Value:   item.Value,
+		Height:  int8(item.Height),
+		Version: item.Version,
+	}
+	// Protobuf does not differentiate between []byte{} as nil, but fortunately IAVL does
+	// not allow nil keys nor nil values for leaf nodes, so we can always set them to empty.
+	if node.Key == nil {
+		node.Key = []byte{}
+	}
+	if node.Height == 0 && node.Value == nil {
+		node.Value = []byte{}
+	}
+	return node, nil
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstdCodec returns the zstd encoder and decoder shared by all snapshots. Both
+// are safe for concurrent use through EncodeAll and DecodeAll.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		var err error
+		if zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+			panic(err)
+		}
+		if zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedValueSize)); err != nil {
+			panic(err)
+		}
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// compress compresses a value of a snapshot.
+func (c CompressionType) compress(value []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return value, nil
+	case CompressionGzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(value); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		encoder, _ := zstdCodec()
+		return encoder.EncodeAll(value, nil), nil
+	default:
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "unknown compression type %d", c)
+	}
+}
+
+// decompress decompresses a value of a snapshot, failing if it exceeds
+// maxDecompressedValueSize.
+func (c CompressionType) decompress(value []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return value, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		decompressed, err := io.ReadAll(io.LimitReader(r, maxDecompressedValueSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(decompressed) > maxDecompressedValueSize {
+			return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "decompressed value exceeds %d bytes", int(maxDecompressedValueSize))
+		}
+		return decompressed, nil
+	case CompressionZstd:
+		_, decoder := zstdCodec()
+		return decoder.DecodeAll(value, nil)
+	default:
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "unknown compression type %d", c)
+	}
+}
@@ -0,0 +1,90 @@
+package rootmulti
+
+import (
+	"bytes"
+	"sort"
+
+	protoio "github.com/gogo/protobuf/io"
+	"github.com/pkg/errors"
+
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// SnapshotMeta describes the snapshot of a height without its data.
+type SnapshotMeta struct {
+	Height uint64
+	Format uint32
+	Stores []SnapshotStoreMeta
+	// Nodes is the total number of IAVL nodes the snapshot would export.
+	Nodes int64
+}
+
+// SnapshotStoreMeta describes a single store of a snapshot. The size of the
+// store is given in nodes, as byte sizes would require reading its data.
+type SnapshotStoreMeta struct {
+	Name     string
+	RootHash []byte
+	// Leaves is the number of keys in the store.
+	Leaves int64
+	// Nodes is the number of IAVL nodes the snapshot would export for the store.
+	Nodes int64
+}
+
+// SnapshotMetadata returns the metadata of a snapshot of the given height, with
+// the stores in snapshot order, without exporting any node data. This lets
+// snapshots be advertised cheaply.
+func (rs *Store) SnapshotMetadata(height uint64) (*SnapshotMeta, error) {
+	if height == 0 {
+		return nil, sdkerrors.Wrap(sdkerrors.ErrLogic, "cannot snapshot height 0")
+	}
+	if height > uint64(rs.LastCommitID().Version) {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrLogic, "cannot snapshot future height %v", height)
+	}
+	cInfo, err := rs.commitInfoAt(int64(height))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load commit info for height %d", height)
+	}
+	hashes := make(map[string][]byte, len(cInfo.StoreInfos))
+	for _, si := range cInfo.StoreInfos {
+		hashes[si.Name] = si.CommitId.Hash
+	}
+
+	meta := &SnapshotMeta{Height: height, Format: rs.SnapshotFormat()}
+	for key := range rs.stores {
+		store, ok := rs.GetCommitKVStore(key).(*iavl.Store)
+		if !ok {
+			continue
+		}
+		if !store.VersionExists(int64(height)) {
+			return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight, "height %d of store %s is not available", height, key.Name())
+		}
+		tree, err := store.GetImmutable(int64(height))
+		if err != nil {
+			return nil, err
+		}
+		storeMeta := SnapshotStoreMeta{Name: key.Name(), RootHash: hashes[key.Name()], Leaves: tree.LeafCount()}
+		if storeMeta.Leaves > 0 {
+			storeMeta.Nodes = 2*storeMeta.Leaves - 1
+		}
+		meta.Stores = append(meta.Stores, storeMeta)
+		meta.Nodes += storeMeta.Nodes
+	}
+	sort.Slice(meta.Stores, func(i, j int) bool {
+		return meta.Stores[i].Name < meta.Stores[j].Name
+	})
+
+	return meta, nil
+}
+
+// SnapshotBytes runs a snapshot of the given height into an in-memory buffer and
+// returns its bytes, as a stream of length-delimited snapshot items. It is meant
+// for comparing snapshot output, e.g. to check determinism across builds, and
+// holds the whole snapshot in memory.
+func (rs *Store) SnapshotBytes(height uint64) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := rs.Snapshot(height, protoio.NewDelimitedWriter(buf)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
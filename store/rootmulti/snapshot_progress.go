@@ -0,0 +1,63 @@
+package rootmulti
+
+// SnapshotProgressFunc is notified of the progress of a store's snapshot export
+// or import, in number of keys. keysTotal is -1 when unknown.
+type SnapshotProgressFunc func(storeName string, keysDone, keysTotal int64)
+
+// snapshotProgressInterval is the number of keys between two progress
+// notifications of a store. The end of each store is always notified.
+const snapshotProgressInterval = 10000
+
+// SetSnapshotProgress sets a callback notified of the progress of Snapshot for
+// each IAVL store. It is called concurrently for different stores by
+// SnapshotParallel. The snapshot output is unaffected.
+func (rs *Store) SetSnapshotProgress(progress SnapshotProgressFunc) {
+	rs.snapshotProgress = progress
+}
+
+// SetRestoreProgress sets a callback notified of the progress of Restore for
+// each IAVL store. The total number of keys is not known while restoring.
+func (rs *Store) SetRestoreProgress(progress SnapshotProgressFunc) {
+	rs.restoreProgress = progress
+}
+
+// newExportProgress returns the progress of exporting a store at the given
+// height, reported to the snapshot progress callback if any.
+func (rs *Store) newExportProgress(height uint64, store namedStore) (*snapshotProgress, error) {
+	if rs.snapshotProgress == nil {
+		return &snapshotProgress{}, nil
+	}
+	tree, err := store.GetImmutable(int64(height))
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotProgress{notify: rs.snapshotProgress, name: store.name, total: tree.LeafCount()}, nil
+}
+
+// snapshotProgress counts the keys exported or imported for a store, and
+// notifies them every snapshotProgressInterval keys. A nil notify disables it.
+type snapshotProgress struct {
+	notify SnapshotProgressFunc
+	name   string
+	keys   int64
+	total  int64
+}
+
+// add counts a key.
+func (p *snapshotProgress) add() {
+	if p.notify == nil {
+		return
+	}
+	p.keys++
+	if p.keys%snapshotProgressInterval == 0 {
+		p.notify(p.name, p.keys, p.total)
+	}
+}
+
+// done notifies the final count, unless it was just notified.
+func (p *snapshotProgress) done() {
+	if p.notify == nil || (p.keys > 0 && p.keys%snapshotProgressInterval == 0) {
+		return
+	}
+	p.notify(p.name, p.keys, p.total)
+}
@@ -0,0 +1,146 @@
+package rootmulti
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	protoio "github.com/gogo/protobuf/io"
+
+	snapshottypes "github.com/cosmos/cosmos-sdk/snapshots/types"
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// snapshotStoreSetItemName is the name of the store item that starts the store
+// set metadata of a snapshot. It contains a path separator, so it can never be
+// the name of a mounted store. It is followed by a single IAVL item holding the
+// hash of the names of the snapshotted stores as its value.
+const snapshotStoreSetItemName = "/store-set"
+
+// SetSnapshotStoreSetHash sets whether Snapshot embeds a hash of the sorted
+// names of the snapshotted stores at the start of the snapshot, which Restore
+// compares to the mounted IAVL stores to catch snapshots of a different chain
+// configuration. It is off by default. Binaries that predate the store set
+// metadata cannot restore snapshots embedding it.
+func (rs *Store) SetSnapshotStoreSetHash(enabled bool) {
+	rs.snapshotStoreSetHash = enabled
+}
+
+// SetStrictStoreSetCheck sets whether Restore fails when the store set hash of
+// a snapshot does not match the mounted IAVL stores, rather than logging the
+// mismatch and restoring the stores of the snapshot.
+func (rs *Store) SetStrictStoreSetCheck(strict bool) {
+	rs.strictStoreSetCheck = strict
+}
+
+// storeSetHash returns the hash of the given store names, independent of their
+// order.
+func storeSetHash(names []string) []byte {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+
+	hasher := sha256.New()
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, name := range sorted {
+		hasher.Write(buf[:binary.PutUvarint(buf, uint64(len(name)))])
+		hasher.Write([]byte(name))
+	}
+	return hasher.Sum(nil)
+}
+
+// mountedIAVLStoreNames returns the names of the mounted IAVL stores.
+func (rs *Store) mountedIAVLStoreNames() []string {
+	names := []string{}
+	for key := range rs.stores {
+		if _, ok := rs.GetCommitKVStore(key).(*iavl.Store); ok {
+			names = append(names, key.Name())
+		}
+	}
+	return names
+}
+
+// writeSnapshotStoreSet writes the store set metadata of a snapshot of the given
+// stores.
+func writeSnapshotStoreSet(protoWriter protoio.Writer, height uint64, names []string) error {
+	err := protoWriter.WriteMsg(&snapshottypes.SnapshotItem{
+		Item: &snapshottypes.SnapshotItem_Store{
+			Store: &snapshottypes.SnapshotStoreItem{Name: snapshotStoreSetItemName},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return protoWriter.WriteMsg(&snapshottypes.SnapshotItem{
+		Item: &snapshottypes.SnapshotItem_IAVL{
+			IAVL: &snapshottypes.SnapshotIAVLItem{
+				Key:     []byte(snapshotStoreSetItemName),
+				Value:   storeSetHash(names),
+				Version: int64(height),
+			},
+		},
+	})
+}
+
+// readSnapshotStoreSetHash reads the hash following a store set item.
+func readSnapshotStoreSetHash(protoReader protoio.Reader) ([]byte, error) {
+	item := snapshottypes.SnapshotItem{}
+	if err := protoReader.ReadMsg(&item); err != nil {
+		return nil, sdkerrors.Wrap(err, "invalid store set item")
+	}
+	node := item.GetIAVL()
+	if node == nil {
+		return nil, sdkerrors.Wrap(sdkerrors.ErrLogic, "store set item is not followed by its hash")
+	}
+	return node.Value, nil
+}
+
+// checkSnapshotStoreSet compares the store set hash of a snapshot to the mounted
+// IAVL stores, failing on mismatch in strict mode.
+func (rs *Store) checkSnapshotStoreSet(hash []byte) error {
+	if bytes.Equal(hash, storeSetHash(rs.mountedIAVLStoreNames())) {
+		return nil
+	}
+	if rs.strictStoreSetCheck {
+		return sdkerrors.Wrap(sdkerrors.ErrLogic, "snapshot store set does not match the mounted stores")
+	}
+	rs.logger.Error("snapshot store set does not match the mounted stores, it may be from a different chain configuration")
+	return nil
+}
+
+// SnapshotStoreNames reads a snapshot stream up to its extension items, and
+// returns the names of the stores it contains in stream order, without
+// restoring anything. This lets callers check a snapshot against their mounted
+// stores before restoring it. The store set metadata is not a store and is
+// skipped. The reader is consumed.
+func SnapshotStoreNames(protoReader protoio.Reader) ([]string, error) {
+	names := []string{}
+	for {
+		item := snapshottypes.SnapshotItem{}
+		err := protoReader.ReadMsg(&item)
+		if err == io.EOF {
+			return names, nil
+		} else if err != nil {
+			return nil, sdkerrors.Wrap(err, "invalid protobuf message")
+		}
+
+		switch item := item.Item.(type) {
+		case *snapshottypes.SnapshotItem_Store:
+			if item.Store.Name == snapshotStoreSetItemName {
+				if _, err := readSnapshotStoreSetHash(protoReader); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			names = append(names, item.Store.Name)
+		case *snapshottypes.SnapshotItem_IAVL:
+			if len(names) == 0 {
+				return nil, sdkerrors.Wrap(sdkerrors.ErrLogic, "received IAVL node item before store item")
+			}
+		default:
+			return names, nil
+		}
+	}
+}
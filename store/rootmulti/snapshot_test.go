@@ -1,6 +1,8 @@
 package rootmulti_test
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -8,8 +10,12 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"sync"
 	"testing"
+	"time"
 
+	protoio "github.com/gogo/protobuf/io"
+	"github.com/gogo/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tendermint/tendermint/libs/log"
@@ -156,6 +162,479 @@ func TestMultistoreSnapshot_Checksum(t *testing.T) {
 	}
 }
 
+func TestMultistoreSnapshotBytes(t *testing.T) {
+	store := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	other := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := uint64(store.LastCommitID().Version)
+
+	bz1, err := store.SnapshotBytes(version)
+	require.NoError(t, err)
+	require.NotEmpty(t, bz1)
+	bz2, err := store.SnapshotBytes(version)
+	require.NoError(t, err)
+	require.Equal(t, bz1, bz2)
+
+	// identical state produces identical bytes
+	bz3, err := other.SnapshotBytes(version)
+	require.NoError(t, err)
+	require.Equal(t, bz1, bz3)
+
+	// an older height produces different bytes
+	bz4, err := store.SnapshotBytes(version - 1)
+	require.NoError(t, err)
+	require.NotEqual(t, bz1, bz4)
+
+	// the bytes can be restored from
+	target := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	reader := protoio.NewDelimitedReader(bytes.NewReader(bz1), 1e7)
+	_, err = target.Restore(version, snapshottypes.CurrentFormat, reader)
+	require.NoError(t, err)
+	require.Equal(t, store.LastCommitID(), target.LastCommitID())
+
+	_, err = store.SnapshotBytes(version + 1)
+	require.Error(t, err)
+}
+
+// withoutSnapshotStore returns the snapshot stream bz without the items of the
+// named store.
+func withoutSnapshotStore(t *testing.T, bz []byte, name string) []byte {
+	reader := protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7)
+	buf := &bytes.Buffer{}
+	writer := protoio.NewDelimitedWriter(buf)
+	skip := false
+	for {
+		item := snapshottypes.SnapshotItem{}
+		err := reader.ReadMsg(&item)
+		if err == io.EOF {
+			return buf.Bytes()
+		}
+		require.NoError(t, err)
+		if store := item.GetStore(); store != nil {
+			skip = store.Name == name
+		}
+		if !skip {
+			require.NoError(t, writer.WriteMsg(&item))
+		}
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	store := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	other := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	store.Commit(true)
+	other.GetStoreByName("iavl1").(types.KVStore).Set([]byte("d"), []byte{4})
+	other.Commit(true)
+
+	snapshot := func(s *rootmulti.Store, height uint64) []byte {
+		bz, err := s.SnapshotBytes(height)
+		require.NoError(t, err)
+		return bz
+	}
+
+	// only iavl1 differs between the two stores
+	added, removed, changed, err := rootmulti.DiffSnapshots(bytes.NewReader(snapshot(store, 4)), bytes.NewReader(snapshot(other, 4)))
+	require.NoError(t, err)
+	require.Empty(t, added)
+	require.Empty(t, removed)
+	require.Equal(t, []string{"iavl1"}, changed)
+
+	// only iavl2 was written between heights 2 and 3, and nothing at height 4
+	_, _, changed, err = rootmulti.DiffSnapshots(bytes.NewReader(snapshot(store, 2)), bytes.NewReader(snapshot(store, 3)))
+	require.NoError(t, err)
+	require.Equal(t, []string{"iavl2"}, changed)
+	added, removed, changed, err = rootmulti.DiffSnapshots(bytes.NewReader(snapshot(store, 3)), bytes.NewReader(snapshot(store, 4)))
+	require.NoError(t, err)
+	require.Empty(t, added)
+	require.Empty(t, removed)
+	require.Empty(t, changed)
+
+	// stores missing from either side are reported as added or removed
+	bz := snapshot(store, 4)
+	added, removed, changed, err = rootmulti.DiffSnapshots(bytes.NewReader(withoutSnapshotStore(t, bz, "iavl3")), bytes.NewReader(withoutSnapshotStore(t, bz, "iavl1")))
+	require.NoError(t, err)
+	require.Equal(t, []string{"iavl3"}, added)
+	require.Equal(t, []string{"iavl1"}, removed)
+	require.Empty(t, changed)
+
+	// node items must follow a store item
+	buf := &bytes.Buffer{}
+	require.NoError(t, protoio.NewDelimitedWriter(buf).WriteMsg(&snapshottypes.SnapshotItem{
+		Item: &snapshottypes.SnapshotItem_IAVL{IAVL: &snapshottypes.SnapshotIAVLItem{Key: []byte("a"), Value: []byte{1}, Version: 1}},
+	}))
+	_, _, _, err = rootmulti.DiffSnapshots(bytes.NewReader(bz), buf)
+	require.Error(t, err)
+}
+
+func TestMultistoreSnapshotRestoreVerification(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := uint64(source.LastCommitID().Version)
+	trusted := source.LastCommitInfo()
+	bz, err := source.SnapshotBytes(version)
+	require.NoError(t, err)
+
+	var targetDB dbm.DB
+	restore := func(bz []byte, trusted *types.CommitInfo) error {
+		targetDB = dbm.NewMemDB()
+		target := newMultiStoreWithMixedMounts(targetDB)
+		target.SetRestoreVerification(trusted)
+		_, err := target.Restore(version, snapshottypes.CurrentFormat, protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7))
+		return err
+	}
+
+	require.NoError(t, restore(bz, trusted))
+
+	// a leaf of iavl2 imported with another value yields another root
+	reader := protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7)
+	buf := &bytes.Buffer{}
+	writer := protoio.NewDelimitedWriter(buf)
+	storeName := ""
+	for {
+		item := snapshottypes.SnapshotItem{}
+		err := reader.ReadMsg(&item)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if store := item.GetStore(); store != nil {
+			storeName = store.Name
+		}
+		if node := item.GetIAVL(); node != nil && storeName == "iavl2" && node.Height == 0 {
+			node.Value = []byte("tampered")
+		}
+		require.NoError(t, writer.WriteMsg(&item))
+	}
+	err = restore(buf.Bytes(), trusted)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "do not match the trusted commit info: iavl2")
+	// the unverified height is not persisted
+	require.Zero(t, rootmulti.GetLatestVersion(targetDB))
+
+	// without verification the tampered restore succeeds
+	require.NoError(t, restore(buf.Bytes(), nil))
+
+	// the trusted commit info must be for the restored height
+	other := *trusted
+	other.Version++
+	require.Error(t, restore(bz, &other))
+}
+
+func TestMultistoreSnapshotStoreSetHash(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := uint64(source.LastCommitID().Version)
+	plain, err := source.SnapshotBytes(version)
+	require.NoError(t, err)
+	source.SetSnapshotStoreSetHash(true)
+	bz, err := source.SnapshotBytes(version)
+	require.NoError(t, err)
+	require.NotEqual(t, plain, bz)
+
+	restore := func(bz []byte, strict bool, extraStores ...string) (*rootmulti.Store, error) {
+		target := rootmulti.NewStore(dbm.NewMemDB(), log.NewNopLogger())
+		for _, name := range append([]string{"iavl1", "iavl2", "iavl3"}, extraStores...) {
+			target.MountStoreWithDB(types.NewKVStoreKey(name), types.StoreTypeIAVL, nil)
+		}
+		target.MountStoreWithDB(types.NewTransientStoreKey("trans1"), types.StoreTypeTransient, nil)
+		require.NoError(t, target.LoadLatestVersion())
+		target.SetStrictStoreSetCheck(strict)
+		_, err := target.Restore(version, snapshottypes.CurrentFormat, protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7))
+		return target, err
+	}
+
+	// the same store set restores, transient stores aside
+	target, err := restore(bz, true)
+	require.NoError(t, err)
+	require.Equal(t, source.LastCommitID(), target.LastCommitID())
+	assertStoresEqual(t, source.GetStoreByName("iavl1").(types.CommitKVStore), target.GetStoreByName("iavl1").(types.CommitKVStore))
+
+	// another store set fails in strict mode, before importing anything
+	target, err = restore(bz, true, "iavl4")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "snapshot store set does not match the mounted stores")
+	require.Equal(t, int64(0), target.LastCommitID().Version)
+	require.False(t, target.GetStoreByName("iavl1").(types.KVStore).Has([]byte("a")))
+
+	// and only warns otherwise
+	target, err = restore(bz, false, "iavl4")
+	require.NoError(t, err)
+	assertStoresEqual(t, source.GetStoreByName("iavl1").(types.CommitKVStore), target.GetStoreByName("iavl1").(types.CommitKVStore))
+
+	// snapshots without the hash are not checked
+	_, err = restore(plain, true, "iavl4")
+	require.NoError(t, err)
+
+	// the hash is not part of the compared contents
+	added, removed, changed, err := rootmulti.DiffSnapshots(bytes.NewReader(plain), bytes.NewReader(bz))
+	require.NoError(t, err)
+	require.Empty(t, added)
+	require.Empty(t, removed)
+	require.Empty(t, changed)
+}
+
+// blobSnapshotter is an extension snapshotter of in-memory blobs, written as one
+// payload item each.
+type blobSnapshotter struct {
+	blobs [][]byte
+}
+
+func (s *blobSnapshotter) Snapshot(_ uint64, protoWriter protoio.Writer) error {
+	for _, blob := range s.blobs {
+		err := protoWriter.WriteMsg(&snapshottypes.SnapshotItem{
+			Item: &snapshottypes.SnapshotItem_ExtensionPayload{
+				ExtensionPayload: &snapshottypes.SnapshotExtensionPayload{Payload: blob},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *blobSnapshotter) Restore(_ uint64, _ uint32, protoReader protoio.Reader) (snapshottypes.SnapshotItem, error) {
+	for {
+		item := snapshottypes.SnapshotItem{}
+		err := protoReader.ReadMsg(&item)
+		if err == io.EOF {
+			return snapshottypes.SnapshotItem{}, nil
+		} else if err != nil {
+			return snapshottypes.SnapshotItem{}, err
+		}
+		payload := item.GetExtensionPayload()
+		if payload == nil {
+			return item, nil
+		}
+		s.blobs = append(s.blobs, payload.Payload)
+	}
+}
+
+func (s *blobSnapshotter) SnapshotName() string { return "blobs" }
+
+func (s *blobSnapshotter) SnapshotFormat() uint32 { return 1 }
+
+func (s *blobSnapshotter) SupportedFormats() []uint32 { return []uint32{1} }
+
+func TestMultistoreSnapshotExtensions(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	blobs := &blobSnapshotter{blobs: [][]byte{[]byte("blob1"), []byte("blob2")}}
+	other := &blobSnapshotter{blobs: [][]byte{[]byte("other")}}
+	require.NoError(t, source.RegisterExtensionSnapshotter("blobs", blobs))
+	require.NoError(t, source.RegisterExtensionSnapshotter("other", other))
+	require.Error(t, source.RegisterExtensionSnapshotter("blobs", blobs))
+	version := uint64(source.LastCommitID().Version)
+	bz, err := source.SnapshotBytes(version)
+	require.NoError(t, err)
+
+	// the extensions follow the stores, sorted by name
+	var extensions []string
+	reader := protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7)
+	for {
+		item := snapshottypes.SnapshotItem{}
+		err := reader.ReadMsg(&item)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if ext := item.GetExtension(); ext != nil {
+			extensions = append(extensions, ext.Name)
+			require.Equal(t, uint32(1), ext.Format)
+		} else if len(extensions) > 0 {
+			require.NotNil(t, item.GetExtensionPayload())
+		}
+	}
+	require.Equal(t, []string{"blobs", "other"}, extensions)
+
+	// registered extensions are restored, and the others returned to the caller
+	target := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	restored := &blobSnapshotter{}
+	require.NoError(t, target.RegisterExtensionSnapshotter("blobs", restored))
+	next, err := target.Restore(version, snapshottypes.CurrentFormat, protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7))
+	require.NoError(t, err)
+	require.Equal(t, blobs.blobs, restored.blobs)
+	require.Equal(t, "other", next.GetExtension().GetName())
+	require.Equal(t, source.LastCommitID(), target.LastCommitID())
+
+	// unsupported extension formats are rejected
+	target = newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	require.NoError(t, target.RegisterExtensionSnapshotter("blobs", &formatSnapshotter{blobSnapshotter{}, 2}))
+	_, err = target.Restore(version, snapshottypes.CurrentFormat, protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7))
+	require.ErrorIs(t, err, snapshottypes.ErrUnknownFormat)
+}
+
+// formatSnapshotter is a blobSnapshotter using another format.
+type formatSnapshotter struct {
+	blobSnapshotter
+	format uint32
+}
+
+func (s *formatSnapshotter) SnapshotFormat() uint32 { return s.format }
+
+func (s *formatSnapshotter) SupportedFormats() []uint32 { return []uint32{s.format} }
+
+func TestMultistoreSnapshotExtensionStore(t *testing.T) {
+	store := rootmulti.NewStore(dbm.NewMemDB(), log.NewNopLogger())
+	store.MountStoreWithDB(types.NewKVStoreKey("iavl1"), types.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(types.NewKVStoreKey("blobs"), types.StoreTypeDB, nil)
+	require.NoError(t, store.LoadLatestVersion())
+	store.GetStoreByName("iavl1").(types.KVStore).Set([]byte("a"), []byte{1})
+	version := uint64(store.Commit(true).Version)
+
+	// non-IAVL stores cannot be snapshotted on their own
+	_, err := store.SnapshotBytes(version)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "don't know how to snapshot store \"blobs\"")
+
+	// but can be by an extension snapshotter of the same name
+	require.NoError(t, store.RegisterExtensionSnapshotter("blobs", &blobSnapshotter{blobs: [][]byte{[]byte("blob")}}))
+	_, err = store.SnapshotBytes(version)
+	require.NoError(t, err)
+}
+
+func TestSnapshotStoreNames(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := uint64(source.LastCommitID().Version)
+	require.NoError(t, source.RegisterExtensionSnapshotter("blobs", &blobSnapshotter{blobs: [][]byte{[]byte("blob1")}}))
+
+	for _, storeSetHash := range []bool{false, true} {
+		source.SetSnapshotStoreSetHash(storeSetHash)
+		bz, err := source.SnapshotBytes(version)
+		require.NoError(t, err)
+
+		names, err := rootmulti.SnapshotStoreNames(protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7))
+		require.NoError(t, err)
+		require.Equal(t, []string{"iavl1", "iavl2", "iavl3"}, names)
+	}
+
+	// an empty stream has no stores
+	names, err := rootmulti.SnapshotStoreNames(protoio.NewDelimitedReader(bytes.NewReader(nil), 1e7))
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func TestMultistoreSnapshotRateLimit(t *testing.T) {
+	store := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := uint64(store.LastCommitID().Version)
+
+	expected, err := store.SnapshotBytes(version)
+	require.NoError(t, err)
+
+	// limit the export to twice the snapshot size per second
+	store.SetSnapshotRateLimit(int64(2 * len(expected)))
+	start := time.Now()
+	actual, err := store.SnapshotBytes(version)
+	elapsed := time.Since(start)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	// the length prefixes are not rate limited, so allow for some slack
+	require.Greater(t, elapsed, 300*time.Millisecond)
+	require.Less(t, elapsed, 2*time.Second)
+}
+
+func TestMultistoreSnapshotProgress(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := uint64(source.LastCommitID().Version)
+	expected, err := source.SnapshotBytes(version)
+	require.NoError(t, err)
+
+	type progress struct{ done, total int64 }
+	recorder := func(calls map[string][]progress) rootmulti.SnapshotProgressFunc {
+		return func(storeName string, keysDone, keysTotal int64) {
+			if n := len(calls[storeName]); n > 0 {
+				require.GreaterOrEqual(t, keysDone, calls[storeName][n-1].done)
+			}
+			calls[storeName] = append(calls[storeName], progress{keysDone, keysTotal})
+		}
+	}
+
+	// the output is unaffected, and the export reports the total of every store
+	exported := map[string][]progress{}
+	source.SetSnapshotProgress(recorder(exported))
+	bz, err := source.SnapshotBytes(version)
+	require.NoError(t, err)
+	require.Equal(t, expected, bz)
+	require.Len(t, exported, 3)
+	for _, name := range []string{"iavl1", "iavl2", "iavl3"} {
+		calls := exported[name]
+		require.NotEmpty(t, calls, name)
+		last := calls[len(calls)-1]
+		require.Equal(t, last.total, last.done, name)
+		require.Equal(t, source.GetStoreByName(name).(*iavl.Store).LeafCount(), last.total, name)
+	}
+
+	// the import doesn't know the totals
+	imported := map[string][]progress{}
+	target := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	target.SetRestoreProgress(recorder(imported))
+	_, err = target.Restore(version, snapshottypes.CurrentFormat, protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7))
+	require.NoError(t, err)
+	require.Len(t, imported, 3)
+	for name, calls := range imported {
+		last := calls[len(calls)-1]
+		require.Equal(t, progress{exported[name][len(exported[name])-1].done, -1}, last, name)
+	}
+}
+
+func TestMultistoreSnapshotMetadata(t *testing.T) {
+	store := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+
+	for height := uint64(1); height <= 3; height++ {
+		meta, err := store.SnapshotMetadata(height)
+		require.NoError(t, err)
+		require.Equal(t, height, meta.Height)
+		require.Equal(t, snapshottypes.CurrentFormat, meta.Format)
+
+		// transient stores are not part of snapshots
+		names := []string{}
+		for _, s := range meta.Stores {
+			names = append(names, s.Name)
+		}
+		require.Equal(t, []string{"iavl1", "iavl2", "iavl3"}, names)
+
+		for _, s := range meta.Stores {
+			iavlStore, err := store.GetStoreByName(s.Name).(*iavl.Store).GetImmutable(int64(height))
+			require.NoError(t, err)
+			require.Equal(t, iavlStore.LastCommitID().Hash, s.RootHash, "store %s at height %d", s.Name, height)
+		}
+	}
+
+	// the roots match the commit info of the height
+	meta, err := store.SnapshotMetadata(3)
+	require.NoError(t, err)
+	roots := map[string][]byte{}
+	for _, si := range store.LastCommitInfo().StoreInfos {
+		roots[si.Name] = si.CommitId.Hash
+	}
+	for _, s := range meta.Stores {
+		require.Equal(t, roots[s.Name], s.RootHash, "store %s", s.Name)
+	}
+	require.EqualValues(t, 3, meta.Stores[0].Leaves)
+	require.EqualValues(t, 3, meta.Stores[1].Leaves)
+	require.Zero(t, meta.Stores[2].Leaves)
+
+	// the node counts match what a snapshot exports
+	bz, err := store.SnapshotBytes(3)
+	require.NoError(t, err)
+	reader := protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7)
+	nodes := int64(0)
+	for {
+		item := &snapshottypes.SnapshotItem{}
+		if err := reader.ReadMsg(item); err == io.EOF {
+			break
+		} else {
+			require.NoError(t, err)
+		}
+		if item.GetIAVL() != nil {
+			nodes++
+		}
+	}
+	require.Equal(t, nodes, meta.Nodes)
+
+	_, err = store.SnapshotMetadata(0)
+	require.Error(t, err)
+	_, err = store.SnapshotMetadata(4)
+	require.Error(t, err)
+}
+
 func TestMultistoreSnapshot_Errors(t *testing.T) {
 	store := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
 
@@ -223,6 +702,221 @@ func TestMultistoreSnapshotRestore(t *testing.T) {
 	}
 }
 
+func TestMultistoreSnapshotParallel(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	source.SetSnapshotStoreSetHash(true)
+	version := uint64(source.LastCommitID().Version)
+	expected, err := source.SnapshotBytes(version)
+	require.NoError(t, err)
+
+	shards := map[string]*bytes.Buffer{}
+	err = source.SnapshotParallel(version, func(storeName string) protoio.Writer {
+		require.NotContains(t, shards, storeName)
+		shards[storeName] = new(bytes.Buffer)
+		return protoio.NewDelimitedWriter(shards[storeName])
+	})
+	require.NoError(t, err)
+	require.Len(t, shards, 4)
+
+	// each shard holds a single store, led by its store item
+	for _, name := range []string{"iavl1", "iavl2", "iavl3"} {
+		reader := protoio.NewDelimitedReader(bytes.NewReader(shards[name].Bytes()), 1e7)
+		item := snapshottypes.SnapshotItem{}
+		require.NoError(t, reader.ReadMsg(&item))
+		require.Equal(t, name, item.GetStore().GetName())
+		for {
+			item = snapshottypes.SnapshotItem{}
+			err := reader.ReadMsg(&item)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			require.NotNil(t, item.GetIAVL())
+		}
+	}
+
+	// the shards concatenated in order give the single writer output
+	sharded := new(bytes.Buffer)
+	for _, name := range []string{"/store-set", "iavl1", "iavl2", "iavl3"} {
+		require.Contains(t, shards, name)
+		sharded.Write(shards[name].Bytes())
+	}
+	require.Equal(t, expected, sharded.Bytes())
+
+	target := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	_, err = target.Restore(version, snapshottypes.CurrentFormat, protoio.NewDelimitedReader(sharded, 1e7))
+	require.NoError(t, err)
+	require.Equal(t, source.LastCommitID(), target.LastCommitID())
+	for _, name := range []string{"iavl1", "iavl2", "iavl3"} {
+		assertStoresEqual(t, source.GetStoreByName(name).(types.CommitKVStore),
+			target.GetStoreByName(name).(types.CommitKVStore), "store %q not equal", name)
+	}
+}
+
+func TestMultistoreSnapshotRestoreUnknownFormat(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := uint64(source.LastCommitID().Version)
+	bz, err := source.SnapshotBytes(version)
+	require.NoError(t, err)
+
+	target := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	require.Equal(t, []uint32{1, 257, 513}, target.SupportedSnapshotFormats())
+	_, err = target.Restore(version, 2, protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7))
+	require.ErrorIs(t, err, snapshottypes.ErrUnknownFormat)
+	require.ErrorContains(t, err, "snapshot format 2, supported formats are [1 257 513]")
+	require.Zero(t, target.LastCommitID().Version)
+
+	_, err = target.Restore(version, snapshottypes.CurrentFormat, protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7))
+	require.NoError(t, err)
+	require.Equal(t, source.LastCommitID(), target.LastCommitID())
+}
+
+func TestMultistoreSnapshotCompression(t *testing.T) {
+	source := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	for i := 0; i < 100; i++ {
+		value := bytes.Repeat([]byte{byte(i)}, 1024)
+		source.GetStoreByName("iavl1").(types.KVStore).Set([]byte(fmt.Sprintf("key%03d", i)), value)
+	}
+	// empty values are compressed as well
+	source.GetStoreByName("iavl2").(types.KVStore).Set([]byte("empty"), []byte{})
+	source.Commit(true)
+	version := uint64(source.LastCommitID().Version)
+
+	plain, err := source.SnapshotBytes(version)
+	require.NoError(t, err)
+	require.Equal(t, snapshottypes.CurrentFormat, source.SnapshotFormat())
+
+	for _, compression := range []rootmulti.CompressionType{rootmulti.CompressionNone, rootmulti.CompressionGzip, rootmulti.CompressionZstd} {
+		source.SetSnapshotCompression(compression)
+		format := source.SnapshotFormat()
+		bz, err := source.SnapshotBytes(version)
+		require.NoError(t, err)
+		if compression == rootmulti.CompressionNone {
+			require.Equal(t, plain, bz)
+		} else {
+			require.NotEqual(t, snapshottypes.CurrentFormat, format)
+			require.Less(t, len(bz), len(plain)/4, "compression %d", compression)
+		}
+
+		target := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+		require.Contains(t, target.SupportedSnapshotFormats(), format)
+		_, err = target.Restore(version, format, protoio.NewDelimitedReader(bytes.NewReader(bz), 1e7))
+		require.NoError(t, err)
+		require.Equal(t, source.LastCommitID(), target.LastCommitID(), "compression %d", compression)
+		for _, name := range []string{"iavl1", "iavl2"} {
+			assertStoresEqual(t, source.GetStoreByName(name).(types.CommitKVStore),
+				target.GetStoreByName(name).(types.CommitKVStore), "store %q not equal", name)
+		}
+	}
+}
+
+func TestMultistoreSnapshotRestore_RecomputeEarliestVersion(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	target := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	version := uint64(source.LastCommitID().Version)
+
+	chunks := make(chan io.ReadCloser, 100)
+	go func() {
+		streamWriter := snapshots.NewStreamWriter(chunks)
+		defer streamWriter.Close()
+		require.NoError(t, source.Snapshot(version, streamWriter))
+	}()
+	streamReader, err := snapshots.NewStreamReader(chunks)
+	require.NoError(t, err)
+	_, err = target.Restore(version, snapshottypes.CurrentFormat, streamReader)
+	require.NoError(t, err)
+
+	// restoring does not prune, so the earliest version is stale
+	require.Zero(t, target.GetEarliestVersion())
+
+	earliest, err := target.RecomputeEarliestVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, version, earliest)
+	require.EqualValues(t, version, target.GetEarliestVersion())
+
+	// the source store still has its whole history
+	earliest, err = source.RecomputeEarliestVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, earliest)
+}
+
+// blockingWriter blocks the first write until it is unblocked.
+type blockingWriter struct {
+	started   chan struct{}
+	unblock   chan struct{}
+	startOnce sync.Once
+}
+
+func (w *blockingWriter) WriteMsg(proto.Message) error {
+	w.startOnce.Do(func() {
+		close(w.started)
+		<-w.unblock
+	})
+	return nil
+}
+
+func TestMultistoreSnapshot_ConcurrentPruning(t *testing.T) {
+	store := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	store.SetPruning(types.NewPruningOptions(0, 0, 1))
+	iavl1 := store.GetStoreByName("iavl1").(*iavl.Store)
+	height := store.LastCommitID().Version
+
+	writer := &blockingWriter{started: make(chan struct{}), unblock: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		done <- store.Snapshot(uint64(height), writer)
+	}()
+	<-writer.started
+
+	// commits drive pruning of the height being exported, which is deferred
+	for i := 0; i < 3; i++ {
+		store.Commit(true)
+	}
+	require.True(t, iavl1.VersionExists(height))
+	require.False(t, iavl1.VersionExists(height+1))
+
+	close(writer.unblock)
+	require.NoError(t, <-done)
+
+	// once the snapshot is done, the height is pruned on the next run
+	store.Commit(true)
+	require.False(t, iavl1.VersionExists(height))
+}
+
+func TestMultistoreSnapshot_ConcurrentAsyncPruning(t *testing.T) {
+	store := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	store.SetPruning(types.NewPruningOptions(0, 0, 1))
+	store.SetAsyncPruning(true)
+	iavl1 := store.GetStoreByName("iavl1").(*iavl.Store)
+	height := store.LastCommitID().Version
+
+	writer := &blockingWriter{started: make(chan struct{}), unblock: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		done <- store.Snapshot(uint64(height), writer)
+	}()
+	<-writer.started
+
+	// async prunes skip the height being exported and leave it queued
+	for i := 0; i < 3; i++ {
+		store.Commit(true)
+		store.WaitForPruning()
+	}
+	require.NoError(t, store.PruneStoresAsync(context.Background()))
+	store.WaitForPruning()
+	require.True(t, iavl1.VersionExists(height))
+	require.False(t, iavl1.VersionExists(height+1))
+	require.Equal(t, height, store.GetEarliestVersion())
+
+	close(writer.unblock)
+	require.NoError(t, <-done)
+
+	// once the snapshot is done, the next async prune deletes the height
+	require.NoError(t, store.PruneStoresAsync(context.Background()))
+	store.WaitForPruning()
+	require.False(t, iavl1.VersionExists(height))
+}
+
 func benchmarkMultistoreSnapshot(b *testing.B, stores uint8, storeKeys uint64) {
 	b.Skip("Noisy with slow setup time, please see https://github.com/cosmos/cosmos-sdk/issues/8855.")
 
@@ -1,19 +1,25 @@
 package rootmulti
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	stderrors "errors"
 	"fmt"
 	"io"
-	"math"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/armon/go-metrics"
 	"github.com/cosmos/cosmos-sdk/telemetry"
 	iavltree "github.com/cosmos/iavl"
 	protoio "github.com/gogo/protobuf/io"
 	gogotypes "github.com/gogo/protobuf/types"
+	"github.com/golang/snappy"
+	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/pkg/errors"
 	abci "github.com/tendermint/tendermint/abci/types"
 	"github.com/tendermint/tendermint/libs/log"
@@ -35,42 +41,146 @@ import (
 const (
 	latestVersionKey = "s/latest"
 	pruneHeightsKey  = "s/pruneheights"
-	commitInfoKeyFmt = "s/%d" // s/<version>
+	commitInfoKeyFmt = "s/%d"      // s/<version>
+	storeHashKeyFmt  = "s/c/%s/%d" // s/c/<store name>/<version>
 
 	proofsPath = "proofs"
 )
 
 const iavlDisablefastNodeDefault = true
 
+// Store lifecycle events reported to the StoreLifecycleHandler.
+const (
+	StoreEventLoaded   = "loaded"
+	StoreEventReloaded = "reloaded"
+	StoreEventAdded    = "upgraded-add"
+	StoreEventRenamed  = "upgraded-rename"
+	StoreEventDeleted  = "deleted"
+)
+
+// StoreLifecycleHandler is called with the name of a store and the lifecycle
+// event that happened to it.
+type StoreLifecycleHandler func(name string, event string)
+
 // Store is composed of many CommitStores. Name contrasts with
 // cacheMultiStore which is used for branching other MultiStores. It implements
 // the CommitMultiStore interface.
 type Store struct {
 	db                  dbm.DB
 	logger              log.Logger
-	archivalDb          dbm.DB
+	archivalSegments    []archivalSegment // sorted by version range
+	storeArchivalDbs    map[types.StoreKey]storeArchival
 	lastCommitInfo      *types.CommitInfo
 	lastCommitInfoMtx   sync.RWMutex
 	pruningOpts         types.PruningOptions
 	iavlCacheSize       int
+	iavlCacheSizes      map[types.StoreKey]int
 	iavlDisableFastNode bool
+	iavlNoFastNodes     map[types.StoreKey]bool
 	storesParams        map[types.StoreKey]storeParams
 	stores              map[types.StoreKey]types.CommitKVStore
 	keysByName          map[string]types.StoreKey
 	lazyLoading         bool
 	pruneHeights        []int64
+	pruneHeightsMtx     sync.Mutex    // guards pruneHeights, earliestVersion and the async prune state
+	pruneRun            chan struct{} // closed after the next PruneStores run
+	asyncPruning        bool
+	asyncPruneDone      chan struct{} // closed when the running async prune ends
+	asyncPruneHook      func(heights []int64)
 	initialVersion      int64
-	archivalVersion     int64
 	earliestVersion     int64
+	closed              bool
+	readOnly            bool
 	orphanOpts          *iavltree.Options
 
 	traceWriter       io.Writer
+	traceFormat       tracekv.TraceFormat
 	traceContext      types.TraceContext
 	traceContextMutex sync.Mutex
+	storeTraceWriters map[types.StoreKey]io.Writer
 
 	interBlockCache types.MultiStorePersistentCache
 
-	listeners map[types.StoreKey][]types.WriteListener
+	listeners           map[types.StoreKey][]types.WriteListener
+	listenersSuspended  atomic.Bool
+	listenerKeyEncoding types.KeyEncoding
+
+	pruneTimings []pruneTiming
+
+	commitTimings    []commitTiming
+	commitTimingsMtx sync.Mutex
+
+	historicalQuerySem      chan struct{}
+	historicalQueryFailFast bool
+
+	maxKeySize   int
+	maxValueSize int
+	maxStores    int
+
+	storeAccessHooks map[types.StoreKey]StoreAccessHook
+
+	snapshotRateLimit     int64
+	snapshotCompression   CompressionType
+	snapshotProgress      SnapshotProgressFunc
+	restoreProgress       SnapshotProgressFunc
+	extensionSnapshotters map[string]snapshottypes.ExtensionSnapshotter
+	snapshotStoreSetHash  bool
+	strictStoreSetCheck   bool
+
+	queryMaxRetries   int
+	queryRetryBackoff time.Duration
+	commitInfoCache   *lru.Cache[int64, *types.CommitInfo]
+
+	// snapshotHeights counts the in-progress snapshots per height. Those heights
+	// are excluded from pruning until the snapshots complete.
+	snapshotHeights    map[int64]int
+	snapshotHeightsMtx sync.Mutex
+
+	lifecycleHandler   StoreLifecycleHandler
+	commitPanicHandler CommitPanicHandler
+	commitHasher       CommitHasher
+
+	commitBarrier        CommitBarrier
+	commitBarrierPolicy  CommitBarrierPolicy
+	commitBarrierErr     error
+	commitBarrierVersion int64 // version the barrier failed for
+	commitBarrierMtx     sync.Mutex
+	commitHooks          []CommitHook
+
+	restoreTrustedCommitInfo *types.CommitInfo
+
+	continueOnStoreLoadError bool
+	failedStores             map[string]error
+	partialStores            map[string]bool // the stores loaded by LoadVersionPartial, nil if all were
+
+	// splitCommitInfo enables the split commit info layout. lastSplitCommitInfo
+	// is the last commit info flushed with it, used to only write the hashes
+	// of the stores that changed in the next version.
+	splitCommitInfo     bool
+	lastSplitCommitInfo *splitCommitInfo
+
+	commitInfoCompression bool
+	commitSpotCheck       int
+	commitParallelism     int
+
+	// lastMetadataWriteBytes is the size of the metadata written for the
+	// latest version.
+	lastMetadataWriteBytes int
+
+	// workingHash is the hash returned by the last GetWorkingHash call, kept
+	// until InvalidateWorkingHash if cacheWorkingHash is set.
+	cacheWorkingHash bool
+	workingHash      []byte
+	workingHashMtx   sync.Mutex
+
+	// metadataFlushInterval is the number of commits whose metadata is batched
+	// in pendingMetadata before being written. pendingCommitInfos holds the
+	// commit infos of the batch so that they can be read before the flush.
+	metadataFlushInterval int
+	pendingMetadata       dbm.Batch
+	pendingCommits        int
+	pendingCommitInfos    map[int64]*types.CommitInfo
+	pendingMetadataMtx    sync.RWMutex
 }
 
 var (
@@ -91,6 +201,12 @@ func keysForStoreKeyMap[V any](m map[types.StoreKey]V) []types.StoreKey {
 	return keys
 }
 
+// NewMemStore returns a new Store backed by an in-memory DB, e.g. for tests and
+// simulations. It is otherwise identical to NewStore.
+func NewMemStore(logger log.Logger) *Store {
+	return NewStore(dbm.NewMemDB(), logger)
+}
+
 // NewStore returns a reference to a new Store object with the provided DB. The
 // store will be created with a PruneNothing pruning strategy by default. After
 // a store is created, KVStores must be mounted and finally LoadLatestVersion or
@@ -107,20 +223,22 @@ func NewStore(db dbm.DB, logger log.Logger) *Store {
 		keysByName:          make(map[string]types.StoreKey),
 		pruneHeights:        make([]int64, 0),
 		listeners:           make(map[types.StoreKey][]types.WriteListener),
+		storeTraceWriters:   make(map[types.StoreKey]io.Writer),
+		snapshotHeights:     make(map[int64]int),
 	}
 }
 
+// NewStoreWithArchival returns a Store loading the versions below
+// archivalVersion from archivalDb. It is a shorthand for a single archival
+// segment, see AddArchivalSegment.
 func NewStoreWithArchival(db, archivalDb dbm.DB, archivalVersion int64, logger log.Logger) *Store {
 	store := NewStore(db, logger)
-	store.archivalDb = archivalDb
-	store.archivalVersion = archivalVersion
+	if archivalVersion > 0 {
+		store.AddArchivalSegment(0, archivalVersion-1, archivalDb)
+	}
 	return store
 }
 
-func (rs *Store) shouldUseArchivalDb(ver int64) bool {
-	return rs.archivalDb != nil && rs.archivalVersion > ver
-}
-
 // GetPruning fetches the pruning strategy from the root store.
 func (rs *Store) GetPruning() types.PruningOptions {
 	return rs.pruningOpts
@@ -137,10 +255,100 @@ func (rs *Store) SetIAVLCacheSize(cacheSize int) {
 	rs.iavlCacheSize = cacheSize
 }
 
+// SetIAVLCacheSizeForStore sets the IAVL cache size of the store with the given
+// key, overriding the one set by SetIAVLCacheSize for that store. It must be
+// called before loading.
+func (rs *Store) SetIAVLCacheSizeForStore(key types.StoreKey, cacheSize int) {
+	if rs.iavlCacheSizes == nil {
+		rs.iavlCacheSizes = make(map[types.StoreKey]int)
+	}
+	rs.iavlCacheSizes[key] = cacheSize
+}
+
+// iavlCacheSizeFor returns the IAVL cache size of the store with the given key.
+func (rs *Store) iavlCacheSizeFor(key types.StoreKey) int {
+	if cacheSize, ok := rs.iavlCacheSizes[key]; ok {
+		return cacheSize
+	}
+	return rs.iavlCacheSize
+}
+
 func (rs *Store) SetIAVLDisableFastNode(disableFastNode bool) {
 	rs.iavlDisableFastNode = disableFastNode
 }
 
+// SetIAVLDisableFastNodeForStore sets whether the IAVL fast node index of the
+// store with the given key is disabled, overriding SetIAVLDisableFastNode for
+// that store. It must be called before loading.
+func (rs *Store) SetIAVLDisableFastNodeForStore(key types.StoreKey, disableFastNode bool) {
+	if rs.iavlNoFastNodes == nil {
+		rs.iavlNoFastNodes = make(map[types.StoreKey]bool)
+	}
+	rs.iavlNoFastNodes[key] = disableFastNode
+}
+
+// iavlDisableFastNodeFor returns whether the IAVL fast node index of the store
+// with the given key is disabled.
+func (rs *Store) iavlDisableFastNodeFor(key types.StoreKey) bool {
+	if disableFastNode, ok := rs.iavlNoFastNodes[key]; ok {
+		return disableFastNode
+	}
+	return rs.iavlDisableFastNode
+}
+
+// SetReadOnly sets whether the store is read-only, e.g. for query-only nodes
+// that must never commit. A read-only store still serves queries, but the
+// KVStores returned from GetKVStore panic on writes, Commit and PruneStores log
+// and do nothing, and CommitWithError, RollbackToVersion, Restore and the
+// metadata writes return an error.
+func (rs *Store) SetReadOnly(readOnly bool) {
+	rs.readOnly = readOnly
+}
+
+// SetMaxKVSize sets the maximum key and value sizes, in bytes, accepted by the
+// KVStores returned from GetKVStore. Oversized writes panic before they reach
+// the underlying store. A zero value means unlimited, which is the default.
+func (rs *Store) SetMaxKVSize(maxKey, maxValue int) {
+	rs.maxKeySize = maxKey
+	rs.maxValueSize = maxValue
+}
+
+// SetMaxStores sets a soft limit on the number of stores that can be mounted.
+// MountStoreWithDB panics once the limit would be exceeded, which catches
+// wiring bugs early. A zero value means unlimited, which is the default.
+func (rs *Store) SetMaxStores(n int) {
+	rs.maxStores = n
+}
+
+// SetQueryRetryPolicy makes Query retry reading commit info up to maxRetries
+// times, waiting backoff between attempts, when the DB fails to read it. Missing
+// commit info is not retried. Queries are not retried by default.
+func (rs *Store) SetQueryRetryPolicy(maxRetries int, backoff time.Duration) {
+	rs.queryMaxRetries = maxRetries
+	rs.queryRetryBackoff = backoff
+}
+
+// SetSnapshotRateLimit limits the rate at which Snapshot writes to its writer to
+// the given number of bytes per second, so that exports don't starve block
+// processing of disk I/O. The snapshot output is unaffected. A zero value means
+// unlimited, which is the default.
+func (rs *Store) SetSnapshotRateLimit(bytesPerSec int64) {
+	rs.snapshotRateLimit = bytesPerSec
+}
+
+// SetStoreLifecycleHandler sets a handler notified of store lifecycle events,
+// such as a store being loaded or deleted by an upgrade. Events are reported
+// from the loading goroutine, so the handler should return quickly.
+func (rs *Store) SetStoreLifecycleHandler(handler StoreLifecycleHandler) {
+	rs.lifecycleHandler = handler
+}
+
+func (rs *Store) emitStoreEvent(name string, event string) {
+	if rs.lifecycleHandler != nil {
+		rs.lifecycleHandler(name, event)
+	}
+}
+
 // SetLazyLoading sets if the iavl store should be loaded lazily or not
 func (rs *Store) SetLazyLoading(lazyLoading bool) {
 	rs.lazyLoading = lazyLoading
@@ -162,6 +370,9 @@ func (rs *Store) MountStoreWithDB(key types.StoreKey, typ types.StoreType, db db
 	if _, ok := rs.keysByName[key.Name()]; ok {
 		panic(fmt.Sprintf("store duplicate store key name %v", key))
 	}
+	if rs.maxStores > 0 && len(rs.storesParams) >= rs.maxStores {
+		panic(fmt.Sprintf("cannot mount store %v: exceeds the maximum of %d stores", key, rs.maxStores))
+	}
 	rs.storesParams[key] = storeParams{
 		key: key,
 		typ: typ,
@@ -170,6 +381,119 @@ func (rs *Store) MountStoreWithDB(key types.StoreKey, typ types.StoreType, db db
 	rs.keysByName[key.Name()] = key
 }
 
+// MountStores mounts all the stores described by the given descriptors. The
+// descriptors are validated in one pass, and if any of them is invalid an error
+// listing all the problems is returned and none of the stores are mounted.
+func (rs *Store) MountStores(descriptors []types.StoreDescriptor) error {
+	var problems []string
+	keys := make(map[types.StoreKey]bool, len(descriptors))
+	names := make(map[string]bool, len(descriptors))
+	for i, d := range descriptors {
+		if d.Key == nil {
+			problems = append(problems, fmt.Sprintf("descriptor %d: key cannot be nil", i))
+			continue
+		}
+		if _, ok := rs.storesParams[d.Key]; ok || keys[d.Key] {
+			problems = append(problems, fmt.Sprintf("descriptor %d: duplicate store key for %s", i, d.Key.Name()))
+		} else if _, ok := rs.keysByName[d.Key.Name()]; ok || names[d.Key.Name()] {
+			problems = append(problems, fmt.Sprintf("descriptor %d: duplicate store key name %s", i, d.Key.Name()))
+		}
+		keys[d.Key] = true
+		names[d.Key.Name()] = true
+	}
+	if rs.maxStores > 0 && len(rs.storesParams)+len(keys) > rs.maxStores {
+		problems = append(problems, fmt.Sprintf("mounting %d stores exceeds the maximum of %d stores", len(keys), rs.maxStores))
+	}
+	if len(problems) > 0 {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "invalid store descriptors: %s", strings.Join(problems, "; "))
+	}
+
+	for _, d := range descriptors {
+		rs.MountStoreWithDB(d.Key, d.Type, d.DB)
+	}
+	return nil
+}
+
+// MountStoresWithDB is like MountStores, but panics if any descriptor is
+// invalid, like MountStoreWithDB. None of the stores are mounted then.
+func (rs *Store) MountStoresWithDB(descriptors []types.StoreDescriptor) {
+	if err := rs.MountStores(descriptors); err != nil {
+		panic(err.Error())
+	}
+}
+
+// MountStoresOfType mounts stores of the given type using the main DB for all
+// the given keys, panicking before mounting any of them if a key is invalid,
+// see MountStoresWithDB.
+func (rs *Store) MountStoresOfType(keys []types.StoreKey, typ types.StoreType) {
+	descriptors := make([]types.StoreDescriptor, len(keys))
+	for i, key := range keys {
+		descriptors[i] = types.StoreDescriptor{Key: key, Type: typ}
+	}
+	rs.MountStoresWithDB(descriptors)
+}
+
+// RenameStoreOnline renames a loaded store without copying its data, by moving
+// it and its listeners and tracer from oldKey to newKey. The next commit records
+// the store under its new name, while earlier commits keep the old one.
+//
+// This is only possible when the store's data does not live under a prefix
+// derived from its name: stores mounted with their own DB, and transient and
+// memory stores, which hold no persisted data. Stores persisted in the root DB
+// are prefixed by name, so renaming them requires a full copy through
+// StoreUpgrades instead. Stores wrapped in an inter-block cache, which is keyed
+// by store key, cannot be renamed online either.
+func (rs *Store) RenameStoreOnline(oldKey, newKey types.StoreKey) error {
+	if oldKey == nil || newKey == nil {
+		return sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "store keys cannot be nil")
+	}
+	params, ok := rs.storesParams[oldKey]
+	if !ok || rs.stores[oldKey] == nil {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "store %s is not loaded", oldKey.Name())
+	}
+	if _, ok := rs.storesParams[newKey]; ok {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "store key for %s is already mounted", newKey.Name())
+	}
+	if _, ok := rs.keysByName[newKey.Name()]; ok {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "store name %s is already mounted", newKey.Name())
+	}
+	if fmt.Sprintf("%T", oldKey) != fmt.Sprintf("%T", newKey) {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "cannot rename a %T to a %T", oldKey, newKey)
+	}
+
+	switch params.typ {
+	case types.StoreTypeTransient, types.StoreTypeMemory:
+	default:
+		if params.db == nil {
+			return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+				"store %s is persisted under a name-derived prefix; rename it with StoreUpgrades", oldKey.Name())
+		}
+		if rs.interBlockCache != nil {
+			return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+				"store %s is wrapped in an inter-block cache; rename it with StoreUpgrades", oldKey.Name())
+		}
+	}
+
+	params.key = newKey
+	rs.storesParams[newKey] = params
+	delete(rs.storesParams, oldKey)
+	rs.keysByName[newKey.Name()] = newKey
+	delete(rs.keysByName, oldKey.Name())
+	rs.stores[newKey] = rs.stores[oldKey]
+	delete(rs.stores, oldKey)
+	if ls, ok := rs.listeners[oldKey]; ok {
+		rs.listeners[newKey] = ls
+		delete(rs.listeners, oldKey)
+	}
+	if w, ok := rs.storeTraceWriters[oldKey]; ok {
+		rs.storeTraceWriters[newKey] = w
+		delete(rs.storeTraceWriters, oldKey)
+	}
+
+	rs.emitStoreEvent(newKey.Name(), StoreEventRenamed)
+	return nil
+}
+
 // GetCommitStore returns a mounted CommitStore for a given StoreKey. If the
 // store is wrapped in an inter-block cache, it will be unwrapped before returning.
 func (rs *Store) GetCommitStore(key types.StoreKey) types.CommitStore {
@@ -196,6 +520,16 @@ func (rs *Store) GetStores() map[types.StoreKey]types.CommitKVStore {
 	return rs.stores
 }
 
+// ForEachStore calls fn for each mounted store in order of store name, until fn
+// returns false. Unlike GetStores, it does not expose the map of stores.
+func (rs *Store) ForEachStore(fn func(name string, key types.StoreKey, store types.CommitKVStore) bool) {
+	for _, key := range keysForStoreKeyMap(rs.stores) {
+		if !fn(key.Name(), key, rs.stores[key]) {
+			return
+		}
+	}
+}
+
 // GetStores returns mounted stores
 func (rs *Store) GetEvents() []abci.Event {
 	panic("getevents should not be called on the root multi store")
@@ -207,6 +541,12 @@ func (rs *Store) ResetEvents() {
 
 // LoadLatestVersionAndUpgrade implements CommitMultiStore
 func (rs *Store) LoadLatestVersionAndUpgrade(upgrades *types.StoreUpgrades) error {
+	if err := rs.checkOpen(); err != nil {
+		return err
+	}
+	if err := rs.FlushMetadata(); err != nil {
+		return err
+	}
 	ver := GetLatestVersion(rs.db)
 	return rs.loadVersion(ver, upgrades)
 }
@@ -218,6 +558,12 @@ func (rs *Store) LoadVersionAndUpgrade(ver int64, upgrades *types.StoreUpgrades)
 
 // LoadLatestVersion implements CommitMultiStore.
 func (rs *Store) LoadLatestVersion() error {
+	if err := rs.checkOpen(); err != nil {
+		return err
+	}
+	if err := rs.FlushMetadata(); err != nil {
+		return err
+	}
 	ver := GetLatestVersion(rs.db)
 	err := rs.loadVersion(ver, nil)
 	return err
@@ -228,7 +574,40 @@ func (rs *Store) LoadVersion(ver int64) error {
 	return rs.loadVersion(ver, nil)
 }
 
+// LoadVersionPartial loads the given version of the named stores only, leaving
+// the other mounted stores unloaded, e.g. for tools that only read a few stores
+// of a large app. The unloaded stores are unavailable, and since committing
+// would compute a wrong commit info, the store is made read-only, see
+// SetReadOnly.
+func (rs *Store) LoadVersionPartial(ver int64, onlyStores []string) error {
+	only := make(map[string]bool, len(onlyStores))
+	for _, name := range onlyStores {
+		if _, ok := rs.keysByName[name]; !ok {
+			return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "store %s is not mounted", name)
+		}
+		only[name] = true
+	}
+	if err := rs.loadVersionOf(ver, nil, only); err != nil {
+		return err
+	}
+	rs.SetReadOnly(true)
+	return nil
+}
+
 func (rs *Store) loadVersion(ver int64, upgrades *types.StoreUpgrades) error {
+	return rs.loadVersionOf(ver, upgrades, nil)
+}
+
+// loadVersionOf loads the given version of the stores named in only, or of all
+// the mounted stores if only is nil.
+func (rs *Store) loadVersionOf(ver int64, upgrades *types.StoreUpgrades, only map[string]bool) error {
+	if err := rs.checkOpen(); err != nil {
+		return err
+	}
+	if err := rs.FlushMetadata(); err != nil {
+		return err
+	}
+	rs.InvalidateWorkingHash()
 	infos := make(map[string]types.StoreInfo)
 
 	cInfo := &types.CommitInfo{}
@@ -249,6 +628,7 @@ func (rs *Store) loadVersion(ver int64, upgrades *types.StoreUpgrades) error {
 
 	// load each Store (note this doesn't panic on unmounted keys now)
 	var newStores = make(map[types.StoreKey]types.CommitKVStore)
+	failedStores := make(map[string]error)
 
 	storesKeys := make([]types.StoreKey, 0, len(rs.storesParams))
 
@@ -265,6 +645,9 @@ func (rs *Store) loadVersion(ver int64, upgrades *types.StoreUpgrades) error {
 	}
 
 	for _, key := range storesKeys {
+		if only != nil && !only[key.Name()] {
+			continue
+		}
 		storeParams := rs.storesParams[key]
 		commitID := rs.getCommitID(infos, key.Name())
 
@@ -274,15 +657,28 @@ func (rs *Store) loadVersion(ver int64, upgrades *types.StoreUpgrades) error {
 		}
 
 		store, err := rs.loadCommitStoreFromParams(key, commitID, storeParams)
-		if err != nil {
+		if err != nil && rs.continueOnStoreLoadError {
+			rs.logger.Error("failed to load store, continuing without it", "store", key.Name(), "err", err)
+			failedStores[key.Name()] = err
+			continue
+		} else if err != nil {
 			return errors.Wrap(err, "failed to load store")
 		}
 
 		newStores[key] = store
+		if _, ok := rs.stores[key]; ok {
+			rs.emitStoreEvent(key.Name(), StoreEventReloaded)
+		} else {
+			rs.emitStoreEvent(key.Name(), StoreEventLoaded)
+		}
+		if upgrades.IsAdded(key.Name()) {
+			rs.emitStoreEvent(key.Name(), StoreEventAdded)
+		}
 
 		// If it was deleted, remove all data
 		if upgrades.IsDeleted(key.Name()) {
 			deleteKVStore(store.(types.KVStore))
+			rs.emitStoreEvent(key.Name(), StoreEventDeleted)
 		} else if oldName := upgrades.RenamedFrom(key.Name()); oldName != "" {
 			// handle renames specially
 			// make an unregistered key to satify loadCommitStore params
@@ -298,21 +694,42 @@ func (rs *Store) loadVersion(ver int64, upgrades *types.StoreUpgrades) error {
 
 			// move all data
 			moveKVStoreData(oldStore.(types.KVStore), store.(types.KVStore))
+			rs.emitStoreEvent(key.Name(), StoreEventRenamed)
 		}
 	}
 
 	rs.SetLastCommitInfo(cInfo)
 	rs.stores = newStores
+	rs.failedStores = failedStores
+	rs.partialStores = only
 
 	// load any pruned heights we missed from disk to be pruned on the next run
 	ph, err := getPruningHeights(rs.db)
 	if err == nil && len(ph) > 0 {
-		rs.pruneHeights = ph
+		rs.setPruneHeights(rs.reconcilePruneHeights(ph))
 	}
 
 	return nil
 }
 
+// SetContinueOnStoreLoadError sets whether loading a version carries on when a
+// store fails to load, leaving it unavailable, instead of failing. This lets a
+// partially corrupt DB be inspected. The failures are reported by FailedStores,
+// and the store cannot commit while any store is unavailable.
+func (rs *Store) SetContinueOnStoreLoadError(enabled bool) {
+	rs.continueOnStoreLoadError = enabled
+}
+
+// FailedStores returns the errors of the stores that failed to load in the last
+// load, by store name.
+func (rs *Store) FailedStores() map[string]error {
+	failed := make(map[string]error, len(rs.failedStores))
+	for name, err := range rs.failedStores {
+		failed[name] = err
+	}
+	return failed
+}
+
 func (rs *Store) getCommitID(infos map[string]types.StoreInfo, name string) types.CommitID {
 	info, ok := infos[name]
 	if !ok {
@@ -365,6 +782,35 @@ func (rs *Store) SetTracer(w io.Writer) types.MultiStore {
 	return rs
 }
 
+// SetTracerFormat sets the format operations are traced in by the KVStores
+// returned by GetKVStore, e.g. tracekv.TraceFormatJSON. Branches created with
+// CacheMultiStore keep using the default format.
+func (rs *Store) SetTracerFormat(format tracekv.TraceFormat) {
+	rs.traceFormat = format
+}
+
+// SetStoreTracer sets a dedicated trace writer for a single store. KVStores
+// returned by GetKVStore for that key are traced to w instead of the writer set
+// with SetTracer, which keeps being used for every other store. Passing a nil
+// writer removes the override. Branches created with CacheMultiStore only use
+// the global tracer.
+func (rs *Store) SetStoreTracer(key types.StoreKey, w io.Writer) {
+	if w == nil {
+		delete(rs.storeTraceWriters, key)
+		return
+	}
+	rs.storeTraceWriters[key] = w
+}
+
+// traceWriterFor returns the writer that operations on the given store should
+// be traced to, or nil if tracing is disabled for it.
+func (rs *Store) traceWriterFor(key types.StoreKey) io.Writer {
+	if w, ok := rs.storeTraceWriters[key]; ok {
+		return w
+	}
+	return rs.traceWriter
+}
+
 // SetTracingContext updates the tracing context for the MultiStore by merging
 // the given context with the existing context by key. Any existing keys will
 // be overwritten. It is implied that the caller should update the context when
@@ -413,8 +859,12 @@ func (rs *Store) AddListeners(key types.StoreKey, listeners []types.WriteListene
 	}
 }
 
-// ListeningEnabled returns if listening is enabled for a specific KVStore
+// ListeningEnabled returns if listening is enabled for a specific KVStore. It
+// returns false while listeners are suspended.
 func (rs *Store) ListeningEnabled(key types.StoreKey) bool {
+	if rs.listenersSuspended.Load() {
+		return false
+	}
 	if ls, ok := rs.listeners[key]; ok {
 		return len(ls) != 0
 	}
@@ -429,10 +879,48 @@ func (rs *Store) LastCommitID() types.CommitID {
 			Version: GetLatestVersion(rs.db),
 		}
 	}
-	return c.CommitID()
+	return types.CommitID{Version: c.Version, Hash: rs.commitHash(c)}
 }
 
+// GetWorkingHash returns the hash of the working state of the stores, i.e. the
+// hash the next commit would have. If the working hash cache is enabled, the
+// hash is computed once and then returned until InvalidateWorkingHash is called.
 func (rs *Store) GetWorkingHash() ([]byte, error) {
+	rs.workingHashMtx.Lock()
+	defer rs.workingHashMtx.Unlock()
+	if rs.workingHash != nil {
+		return rs.workingHash, nil
+	}
+
+	hash, err := rs.computeWorkingHash()
+	if err != nil {
+		return nil, err
+	}
+	if rs.cacheWorkingHash {
+		rs.workingHash = hash
+	}
+	return hash, nil
+}
+
+// SetWorkingHashCache sets whether GetWorkingHash caches the working hash, so
+// that repeated calls without writes in between don't recompute the hash of
+// every store. The store does not observe the writes to its stores, so the
+// caller must then call InvalidateWorkingHash after writing, e.g. when the
+// state of a block is written. It is disabled by default.
+func (rs *Store) SetWorkingHashCache(enabled bool) {
+	rs.cacheWorkingHash = enabled
+	rs.InvalidateWorkingHash()
+}
+
+// InvalidateWorkingHash clears the working hash cached by GetWorkingHash, which
+// is recomputed on the next call. Commit and loading a version invalidate it.
+func (rs *Store) InvalidateWorkingHash() {
+	rs.workingHashMtx.Lock()
+	defer rs.workingHashMtx.Unlock()
+	rs.workingHash = nil
+}
+
+func (rs *Store) computeWorkingHash() ([]byte, error) {
 	storeInfos := []types.StoreInfo{}
 	for key, store := range rs.stores {
 		if store.GetStoreType() == types.StoreTypeTransient {
@@ -450,11 +938,54 @@ func (rs *Store) GetWorkingHash() ([]byte, error) {
 		})
 	}
 	commitInfo := types.CommitInfo{StoreInfos: storeInfos}
-	return commitInfo.Hash(), nil
+	return rs.commitHash(&commitInfo), nil
 }
 
-// Commit implements Committer/CommitStore.
+// HasUncommittedChanges returns whether the working state of the stores differs
+// from the last commit, by comparing the working hash to the last commit hash.
+// A store that has been written to but ends up in its committed state, e.g. a
+// key set and then deleted again, reports no changes.
+func (rs *Store) HasUncommittedChanges() bool {
+	workingHash, err := rs.GetWorkingHash()
+	if err != nil {
+		panic(err)
+	}
+	return !bytes.Equal(workingHash, rs.LastCommitID().Hash)
+}
+
+// Commit implements Committer/CommitStore. It panics if stores failed to load, a
+// pre-commit hook or the commit spot check fails, or the metadata of the
+// version cannot be written, see CommitWithError. A panic swallowed by the commit panic handler returns the
+// previous commit ID.
 func (rs *Store) Commit(bumpVersion bool) types.CommitID {
+	if err := rs.checkWritable(); err != nil {
+		rs.logger.Error("skipping commit", "err", err)
+		return rs.LastCommitID()
+	}
+	cid, err := rs.CommitWithError(bumpVersion)
+	if err != nil && !stderrors.Is(err, errCommitPanicRecovered) {
+		panic(err)
+	}
+	return cid
+}
+
+// CommitWithError is like Commit, but returns an error rather than panicking if
+// stores failed to load or a pre-commit hook fails, in which case nothing is
+// committed, or if the metadata of the version cannot be written, e.g. on a
+// transient disk error. The stores are committed by then, and the in-memory
+// last commit info is at the new version, while the latest version on disk is
+// still the previous one, so the caller should retry writing the metadata by
+// committing again without bumping the version, or reload the store. A failed commit spot check or a
+// panic swallowed by the commit panic handler is returned as an error along
+// with the previous commit ID, and the store must be reloaded, as the stores
+// were committed without the version being recorded.
+func (rs *Store) CommitWithError(bumpVersion bool) (_ types.CommitID, err error) {
+	if err := rs.checkWritable(); err != nil {
+		return types.CommitID{}, err
+	}
+	rs.awaitCommitBarrier()
+	defer rs.InvalidateWorkingHash()
+
 	var previousHeight, version int64
 	c := rs.LastCommitInfo()
 	if c.GetVersion() == 0 && rs.initialVersion > 1 {
@@ -473,9 +1004,47 @@ func (rs *Store) Commit(bumpVersion bool) types.CommitID {
 	} else {
 		version = c.GetVersion()
 	}
+	if len(rs.failedStores) > 0 {
+		names := make([]string, 0, len(rs.failedStores))
+		for name := range rs.failedStores {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return types.CommitID{}, sdkerrors.Wrapf(sdkerrors.ErrNotFound, "cannot commit version %d, stores failed to load: %s", version, strings.Join(names, ", "))
+	}
+	if err := rs.runPreCommitHooks(version); err != nil {
+		return types.CommitID{}, err
+	}
 
-	rs.SetLastCommitInfo(commitStores(version, rs.stores, bumpVersion))
-	defer rs.flushMetadata(rs.db, version, rs.LastCommitInfo())
+	start := time.Now()
+	keys := rs.pendingWrites()
+	defer func() {
+		rs.recordCommitTiming(start, keys)
+		if telemetry.IsTelemetryEnabled() {
+			telemetry.MeasureSince(start, "store", "commit")
+		}
+	}()
+
+	cInfo, err := rs.commitStoresWithRecovery(version, bumpVersion)
+	if err != nil {
+		return rs.LastCommitID(), err
+	}
+	if rs.commitSpotCheck > 0 {
+		if err := rs.spotCheck(version, cInfo); err != nil {
+			rs.logger.Error("commit spot check failed", "version", version, "err", err)
+			return rs.LastCommitID(), sdkerrors.Wrapf(sdkerrors.ErrLogic, "commit spot check failed: %v", err)
+		}
+	}
+	rs.SetLastCommitInfo(cInfo)
+	rs.emitInterBlockCacheMetrics()
+	defer func() {
+		if err = rs.commitMetadata(version, cInfo); err != nil {
+			rs.logger.Error("failed to write commit metadata", "version", version, "err", err)
+			return
+		}
+		rs.runCommitBarrier(version)
+		rs.runPostCommitHooks(types.CommitID{Version: version, Hash: rs.commitHash(cInfo)})
+	}()
 
 	// Determine if pruneHeight height needs to be added to the list of heights to
 	// be pruned, where pruneHeight = (commitHeight - 1) - KeepRecent.
@@ -487,53 +1056,67 @@ func (rs *Store) Commit(bumpVersion bool) types.CommitID {
 		// - KeepEvery % (height - KeepRecent) != 0 as that means the height is not
 		// a 'snapshot' height.
 		if rs.pruningOpts.KeepEvery == 0 || pruneHeight%int64(rs.pruningOpts.KeepEvery) != 0 {
-			rs.pruneHeights = append(rs.pruneHeights, pruneHeight)
+			rs.appendPruneHeights(pruneHeight)
 		}
 	}
 
 	// batch prune if the current height is a pruning interval height
 	if rs.pruningOpts.Interval > 0 && version%int64(rs.pruningOpts.Interval) == 0 {
-		rs.PruneStores(true, nil)
+		if rs.asyncPruning {
+			_ = rs.PruneStoresAsync(context.Background())
+		} else {
+			rs.PruneStores(true, nil)
+		}
 	}
 
 	return types.CommitID{
 		Version: version,
-		Hash:    rs.LastCommitInfo().Hash(),
-	}
+		Hash:    rs.commitHash(rs.LastCommitInfo()),
+	}, nil
 }
 
 // PruneStores will batch delete a list of heights from each mounted sub-store.
 // If clearStorePruningHeihgts is true, store's pruneHeights is appended to the
-// pruningHeights and reset after finishing pruning.
+// pruningHeights and reset after finishing pruning. Heights that are being
+// snapshotted are not deleted, and are kept queued for the next run instead.
 func (rs *Store) PruneStores(clearStorePruningHeights bool, pruningHeights []int64) {
-	if clearStorePruningHeights {
-		pruningHeights = append(pruningHeights, rs.pruneHeights...)
+	if err := rs.checkWritable(); err != nil {
+		rs.logger.Error("skipping pruning", "err", err)
+		return
 	}
+	rs.WaitForPruning()
+	defer rs.notifyPruneRun()
 
-	if len(rs.pruneHeights) == 0 {
+	var queued []int64
+	if clearStorePruningHeights {
+		queued = rs.drainPruneHeights()
+		if len(queued) == 0 {
+			return
+		}
+		pruningHeights = append(pruningHeights, queued...)
+	} else if rs.PendingPruneCount() == 0 {
 		return
 	}
 
-	for key, store := range rs.stores {
-		if store.GetStoreType() == types.StoreTypeIAVL {
-			// If the store is wrapped with an inter-block cache, we must first unwrap
-			// it to get the underlying IAVL store.
-			store = rs.GetCommitKVStore(key)
-
-			if err := store.(*iavl.Store).DeleteVersions(pruningHeights...); err != nil {
-				if errCause := errors.Cause(err); errCause != nil && errCause != iavltree.ErrVersionDoesNotExist {
-					panic(err)
-				}
-			}
-		}
+	pruningHeights, deferred := rs.excludeSnapshotHeights(pruningHeights)
+	if len(deferred) > 0 {
+		rs.logger.Info("deferring pruning of heights being snapshotted", "heights", deferred)
 	}
-	if len(pruningHeights) > 0 {
-		rs.earliestVersion = pruningHeights[len(pruningHeights)-1]
+
+	start := time.Now()
+	if err := rs.deleteVersions(context.Background(), pruningHeights); err != nil {
+		rs.appendPruneHeights(queued...)
+		panic(err)
 	}
+	duration := time.Since(start)
 
+	rs.pruneHeightsMtx.Lock()
+	defer rs.pruneHeightsMtx.Unlock()
 	if clearStorePruningHeights {
-		rs.pruneHeights = make([]int64, 0)
+		rs.pruneHeights = append(rs.pruneHeights, deferred...)
 	}
+	rs.updateEarliestVersion(pruningHeights, deferred)
+	rs.recordPruneTiming(len(pruningHeights), duration)
 }
 
 // CacheWrap implements CacheWrapper/Store/CommitStore.
@@ -552,20 +1135,29 @@ func (rs *Store) CacheWrapWithListeners(storeKey types.StoreKey, _ []types.Write
 }
 
 // CacheMultiStore creates ephemeral branch of the multi-store and returns a CacheMultiStore.
-// It implements the MultiStore interface.
+// It implements the MultiStore interface. The size limits, access hooks and
+// read-only mode of the stores apply to the branch when it is written back.
 func (rs *Store) CacheMultiStore() types.CacheMultiStore {
 	stores := make(map[types.StoreKey]types.CacheWrapper)
 	for k, v := range rs.stores {
-		stores[k] = v
+		stores[k] = rs.guardKVStore(k, v)
 	}
-	return cachemulti.NewStore(rs.db, stores, rs.keysByName, rs.traceWriter, rs.getTracingContext(), rs.listeners)
+	return cachemulti.NewStore(rs.db, stores, rs.keysByName, rs.traceWriter, rs.getTracingContext(), rs.activeListeners())
 }
 
 // CacheMultiStoreWithVersion is analogous to CacheMultiStore except that it
 // attempts to load stores at a given version (height). An error is returned if
 // any store cannot be loaded. This should only be used for querying and
 // iterating at past heights.
+//
+// If a historical query concurrency limit is set, the returned store holds one
+// of the available slots until it is closed.
 func (rs *Store) CacheMultiStoreWithVersion(version int64) (types.CacheMultiStore, error) {
+	release, err := rs.acquireHistoricalQuerySlot()
+	if err != nil {
+		return nil, err
+	}
+
 	cachedStores := make(map[types.StoreKey]types.CacheWrapper)
 	for key, store := range rs.stores {
 		switch store.GetStoreType() {
@@ -578,6 +1170,7 @@ func (rs *Store) CacheMultiStoreWithVersion(version int64) (types.CacheMultiStor
 			// version does not exist or is pruned, an error should be returned.
 			iavlStore, err := store.(*iavl.Store).GetImmutable(version)
 			if err != nil {
+				release.Close()
 				return nil, err
 			}
 
@@ -588,7 +1181,9 @@ func (rs *Store) CacheMultiStoreWithVersion(version int64) (types.CacheMultiStor
 		}
 	}
 
-	return cachemulti.NewStore(rs.db, cachedStores, rs.keysByName, rs.traceWriter, rs.getTracingContext(), rs.listeners), nil
+	cms := cachemulti.NewStore(rs.db, cachedStores, rs.keysByName, rs.traceWriter, rs.getTracingContext(), rs.activeListeners())
+	cms.AddCloser(release)
+	return cms, nil
 }
 
 func (rs *Store) CacheMultiStoreForExport(version int64) (types.CacheMultiStore, error) {
@@ -610,29 +1205,102 @@ func (rs *Store) GetStore(key types.StoreKey) types.Store {
 	return store
 }
 
+// GetStoreSafe is like GetStore, but returns an error wrapping ErrNotFound
+// rather than panicking if no store is mounted for the key.
+func (rs *Store) GetStoreSafe(key types.StoreKey) (types.Store, error) {
+	store := rs.GetCommitKVStore(key)
+	if store == nil {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrNotFound, "store does not exist for key: %s", key.Name())
+	}
+
+	return store, nil
+}
+
 // GetKVStore returns a mounted KVStore for a given StoreKey. If tracing is
-// enabled on the KVStore, a wrapped TraceKVStore will be returned with the root
-// store's tracer, otherwise, the original KVStore will be returned.
+// enabled on the KVStore, a wrapped TraceKVStore will be returned with the
+// store's dedicated tracer if one was set with SetStoreTracer, or the root
+// store's tracer otherwise. If neither is set, the original KVStore will be
+// returned.
 //
 // NOTE: The returned KVStore may be wrapped in an inter-block cache if it is
 // set on the root store.
 func (rs *Store) GetKVStore(key types.StoreKey) types.KVStore {
 	s := rs.stores[key]
 	if s == nil {
-		panic(fmt.Sprintf("store does not exist for key: %s", key.Name()))
+		panic(rs.missingStoreMessage(key))
+	}
+	return rs.wrapKVStore(key, s.(types.KVStore))
+}
+
+// GetKVStoreSafe is like GetKVStore, but returns an error wrapping ErrNotFound
+// rather than panicking if no store is mounted for the key, or if it failed to
+// load.
+func (rs *Store) GetKVStoreSafe(key types.StoreKey) (types.KVStore, error) {
+	s := rs.stores[key]
+	if s == nil {
+		return nil, sdkerrors.Wrap(sdkerrors.ErrNotFound, rs.missingStoreMessage(key))
+	}
+	return rs.wrapKVStore(key, s.(types.KVStore)), nil
+}
+
+// missingStoreMessage describes why no store is available for the key.
+func (rs *Store) missingStoreMessage(key types.StoreKey) string {
+	if err, ok := rs.failedStores[key.Name()]; ok {
+		return fmt.Sprintf("store %s is unavailable, it failed to load: %v", key.Name(), err)
+	}
+	if _, ok := rs.storesParams[key]; ok && rs.partialStores != nil && !rs.partialStores[key.Name()] {
+		return fmt.Sprintf("store %s is unavailable, it was not loaded by LoadVersionPartial", key.Name())
 	}
-	store := s.(types.KVStore)
+	return fmt.Sprintf("store does not exist for key: %s", key.Name())
+}
 
-	if rs.TracingEnabled() {
-		store = tracekv.NewStore(store, rs.traceWriter, rs.getTracingContext())
+// wrapKVStore wraps a mounted store with the tracing, listening, size limits
+// and access hook configured for its key, and makes it read-only if the store
+// is.
+func (rs *Store) wrapKVStore(key types.StoreKey, store types.KVStore) types.KVStore {
+	if w := rs.traceWriterFor(key); w != nil {
+		store = tracekv.NewStoreWithFormat(store, w, rs.getTracingContext(), rs.traceFormat)
 	}
 	if rs.ListeningEnabled(key) {
-		store = listenkv.NewStore(store, key, rs.listeners[key])
+		store = listenkv.NewStore(store, key, rs.activeListeners()[key])
+	}
+	return rs.guardKVStore(key, store)
+}
+
+// guardKVStore wraps a mounted store with the size limits and access hook
+// configured for its key, and makes it read-only if the store is. Unlike
+// wrapKVStore, it leaves tracing and listening to the caller, for branches that
+// set them up themselves.
+func (rs *Store) guardKVStore(key types.StoreKey, store types.KVStore) types.KVStore {
+	if rs.maxKeySize > 0 || rs.maxValueSize > 0 {
+		store = sizeLimitedStore{KVStore: store, name: key.Name(), maxKey: rs.maxKeySize, maxValue: rs.maxValueSize}
+	}
+	if hook := rs.storeAccessHooks[key]; hook != nil {
+		store = accessHookStore{KVStore: store, hook: hook}
+	}
+	if rs.readOnly {
+		store = readOnlyStore{KVStore: store, name: key.Name()}
 	}
 
 	return store
 }
 
+// SetStoreAccessHook sets a hook called on every Get, Has, Set, Delete and
+// iteration of the store of the given key, through the KVStores returned by
+// GetKVStore, e.g. to account for the accesses of each module. The hook is
+// called synchronously on the access path, so it should be cheap. A nil hook
+// removes it.
+func (rs *Store) SetStoreAccessHook(key types.StoreKey, hook StoreAccessHook) {
+	if hook == nil {
+		delete(rs.storeAccessHooks, key)
+		return
+	}
+	if rs.storeAccessHooks == nil {
+		rs.storeAccessHooks = make(map[types.StoreKey]StoreAccessHook)
+	}
+	rs.storeAccessHooks[key] = hook
+}
+
 // GetStoreByName performs a lookup of a StoreKey given a store name typically
 // provided in a path. The StoreKey is then used to perform a lookup and return
 // a Store. If the Store is wrapped in an inter-block cache, it will be unwrapped
@@ -652,25 +1320,54 @@ func (rs *Store) GetStoreByName(name string) types.Store {
 // Special case: if `req.Path` is `/proofs`, the commit hash is included
 // as response value. In addition, proofs of every store are appended to the response for
 // the requested height
+// A negative `req.Height` is relative to the latest height, e.g. -1 queries the
+// height before the latest one.
 func (rs *Store) Query(req abci.RequestQuery) abci.ResponseQuery {
-	path := req.Path
-	firstPath, subpath, err := parsePath(path)
+	firstPath, subpath, err := parsePath(req.Path)
 	if err != nil {
 		return sdkerrors.QueryResult(err)
 	}
 
-	if firstPath == proofsPath {
-		return rs.doProofsQuery(req)
+	var queryable types.Queryable
+	if firstPath != proofsPath {
+		if queryable, err = rs.queryableStore(firstPath); err != nil {
+			return sdkerrors.QueryResult(err)
+		}
 	}
+	return rs.queryStore(req, firstPath, subpath, queryable, nil)
+}
 
-	store := rs.GetStoreByName(firstPath)
+// queryableStore returns the store of the given name to query.
+func (rs *Store) queryableStore(storeName string) (types.Queryable, error) {
+	if err, ok := rs.failedStores[storeName]; ok {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store %s is unavailable, it failed to load: %v", storeName, err)
+	}
+	store := rs.GetStoreByName(storeName)
 	if store == nil {
-		return sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "no such store: %s", firstPath))
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "no such store: %s", storeName)
 	}
 
 	queryable, ok := store.(types.Queryable)
 	if !ok {
-		return sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store %s (type %T) doesn't support queries", firstPath, store))
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store %s (type %T) doesn't support queries", storeName, store)
+	}
+	return queryable, nil
+}
+
+// queryStore queries the store named firstPath, resolved to queryable, with
+// the subpath of the request, or the proofs of all the stores if firstPath is
+// proofsPath. The commit infos read for proofs are memoized in commitInfos if
+// it is not nil.
+func (rs *Store) queryStore(req abci.RequestQuery, firstPath, subpath string, queryable types.Queryable, commitInfos map[int64]*types.CommitInfo) abci.ResponseQuery {
+	if req.Height < 0 {
+		var err error
+		if req.Height, err = rs.resolveRelativeHeight(req.Height); err != nil {
+			return sdkerrors.QueryResult(err)
+		}
+	}
+
+	if firstPath == proofsPath {
+		return rs.doProofsQuery(req, commitInfos)
 	}
 
 	// trim the path and make the query
@@ -685,19 +1382,14 @@ func (rs *Store) Query(req abci.RequestQuery) abci.ResponseQuery {
 		return sdkerrors.QueryResult(sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "proof is unexpectedly empty; ensure height has not been pruned"))
 	}
 
-	// If the request's height is the latest height we've committed, then utilize
-	// the store's lastCommitInfo as this commit info may not be flushed to disk.
-	// Otherwise, we query for the commit info from disk.
-	var commitInfo *types.CommitInfo
-
-	c := rs.LastCommitInfo()
-	if res.Height == c.Version {
-		commitInfo = c
-	} else {
-		commitInfo, err = getCommitInfo(rs.db, res.Height)
-		if err != nil {
-			return sdkerrors.QueryResult(err)
-		}
+	commitInfo, err := rs.proofCommitInfo(res.Height, commitInfos)
+	if stderrors.Is(err, errCommitInfoNotFound) {
+		return sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight,
+			"commit info for height %d is pruned; earliest available is %d", res.Height, rs.GetEarliestVersion()))
+	} else if isReadError(err) {
+		return sdkerrors.QueryResult(err)
+	} else if err != nil {
+		return sdkerrors.QueryResult(sdkerrors.Wrapf(err, "failed to load commit info for height %d", res.Height))
 	}
 
 	// Restore origin path and append proof op.
@@ -706,10 +1398,49 @@ func (rs *Store) Query(req abci.RequestQuery) abci.ResponseQuery {
 	return res
 }
 
+// proofCommitInfo returns the commit info of a height to prove a query with,
+// memoizing the commit infos read from disk in commitInfos if it is not nil.
+func (rs *Store) proofCommitInfo(height int64, commitInfos map[int64]*types.CommitInfo) (*types.CommitInfo, error) {
+	// If the request's height is the latest height we've committed, then utilize
+	// the store's lastCommitInfo as this commit info may not be flushed to disk.
+	// Otherwise, we query for the commit info from disk.
+	if c := rs.LastCommitInfo(); c != nil && height == c.Version {
+		return c, nil
+	}
+	if commitInfo, ok := commitInfos[height]; ok {
+		return commitInfo, nil
+	}
+	commitInfo, err := rs.queryCommitInfo(height)
+	if err != nil {
+		return nil, err
+	}
+	if commitInfos != nil {
+		commitInfos[height] = commitInfo
+	}
+	return commitInfo, nil
+}
+
+// resolveRelativeHeight returns the height the given number of heights before
+// the latest one, or an error if it is not available.
+func (rs *Store) resolveRelativeHeight(offset int64) (int64, error) {
+	height := rs.LastCommitID().Version + offset
+	if earliest := rs.GetEarliestVersion(); height < 1 || height < earliest {
+		return 0, sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight,
+			"relative height %d resolves to height %d; earliest available is %d", offset, height, earliest)
+	}
+	return height, nil
+}
+
 // SetInitialVersion sets the initial version of the IAVL tree. It is used when
-// starting a new chain at an arbitrary height.
-// NOTE: this never errors. Can we fix the function signature ?
+// starting a new chain at an arbitrary height. It returns an error if a store
+// already has commits, as the initial version only applies to the first commit.
 func (rs *Store) SetInitialVersion(version int64) error {
+	for _, key := range keysForStoreKeyMap(rs.stores) {
+		if committed := rs.GetCommitKVStore(key).LastCommitID().Version; committed > 0 {
+			return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+				"cannot set initial version %d: store %s is already at version %d", version, key.Name(), committed)
+		}
+	}
 	rs.initialVersion = version
 
 	// Loop through all the stores, if it's an IAVL store, then set initial
@@ -749,8 +1480,31 @@ func parsePath(path string) (storeName string, subpath string, err error) {
 // Snapshot implements snapshottypes.Snapshotter. The snapshot output for a given format must be
 // identical across nodes such that chunks from different sources fit together. If the output for a
 // given format changes (at the byte level), the snapshot format must be bumped - see
-// TestMultistoreSnapshot_Checksum test.
+// TestMultistoreSnapshot_Checksum test. The output is of format SnapshotFormat, which depends on
+// the snapshot compression.
 func (rs *Store) Snapshot(height uint64, protoWriter protoio.Writer) error {
+	return rs.snapshot(height, func(string) protoio.Writer { return protoWriter }, false)
+}
+
+// SnapshotParallel exports the snapshot of the given height like Snapshot, but
+// writes the items of each IAVL store to the writer returned by writerFor for
+// its name, exporting the stores concurrently. Each writer receives the leading
+// SnapshotStoreItem of its store followed by its nodes, in the same order as
+// Snapshot. The store set item, if enabled, is written to the writer of its
+// reserved name and the extensions to the writers of their names, after the
+// stores. writerFor is called once per name before exporting, and must return
+// a distinct writer for each store.
+//
+// Concatenating the outputs in the order of Snapshot (the store set, the stores
+// sorted by name, then the extensions sorted by name) gives the same stream as
+// Snapshot.
+func (rs *Store) SnapshotParallel(height uint64, writerFor func(storeName string) protoio.Writer) error {
+	return rs.snapshot(height, writerFor, true)
+}
+
+// snapshot exports the snapshot of the given height to the writers returned by
+// writerFor, exporting the IAVL stores concurrently if parallel is set.
+func (rs *Store) snapshot(height uint64, writerFor func(storeName string) protoio.Writer, parallel bool) error {
 	if height == 0 {
 		return sdkerrors.Wrap(sdkerrors.ErrLogic, "cannot snapshot height 0")
 	}
@@ -758,11 +1512,20 @@ func (rs *Store) Snapshot(height uint64, protoWriter protoio.Writer) error {
 		return sdkerrors.Wrapf(sdkerrors.ErrLogic, "cannot snapshot future height %v", height)
 	}
 
-	// Collect stores to snapshot (only IAVL stores are supported)
-	type namedStore struct {
-		*iavl.Store
-		name string
+	// Make sure the height is not pruned while it is being exported.
+	release := rs.holdSnapshotHeight(int64(height))
+	defer release()
+
+	// All the writers share the same rate limit.
+	if rs.snapshotRateLimit > 0 {
+		limiter := newRateLimiter(rs.snapshotRateLimit)
+		unlimited := writerFor
+		writerFor = func(storeName string) protoio.Writer {
+			return newRateLimitedWriter(unlimited(storeName), limiter)
+		}
 	}
+
+	// Collect stores to snapshot (only IAVL stores are supported)
 	stores := []namedStore{}
 	for key := range rs.stores {
 		switch store := rs.GetCommitKVStore(key).(type) {
@@ -772,6 +1535,10 @@ func (rs *Store) Snapshot(height uint64, protoWriter protoio.Writer) error {
 			// Non-persisted stores shouldn't be snapshotted
 			continue
 		default:
+			if _, ok := rs.extensionSnapshotters[key.Name()]; ok {
+				// snapshotted by its extension snapshotter
+				continue
+			}
 			return sdkerrors.Wrapf(sdkerrors.ErrLogic,
 				"don't know how to snapshot store %q of type %T", key.Name(), store)
 		}
@@ -780,86 +1547,150 @@ func (rs *Store) Snapshot(height uint64, protoWriter protoio.Writer) error {
 		return strings.Compare(stores[i].name, stores[j].name) == -1
 	})
 
+	if rs.snapshotStoreSetHash {
+		names := make([]string, len(stores))
+		for i, store := range stores {
+			names[i] = store.name
+		}
+		if err := writeSnapshotStoreSet(writerFor(snapshotStoreSetItemName), height, names); err != nil {
+			return err
+		}
+	}
+
 	// Export each IAVL store. Stores are serialized as a stream of SnapshotItem Protobuf
 	// messages. The first item contains a SnapshotStore with store metadata (i.e. name),
 	// and the following messages contain a SnapshotNode (i.e. an ExportNode). Store changes
 	// are demarcated by new SnapshotStore items.
-	for _, store := range stores {
-		totalKeyBytes := int64(0)
-		totalValueBytes := int64(0)
-		totalNumKeys := int64(0)
-		exporter, err := store.Export(int64(height))
-		if err != nil {
-			return err
-		}
-		defer exporter.Close()
-		err = protoWriter.WriteMsg(&snapshottypes.SnapshotItem{
-			Item: &snapshottypes.SnapshotItem_Store{
-				Store: &snapshottypes.SnapshotStoreItem{
-					Name: store.name,
-				},
-			},
-		})
-		if err != nil {
-			return err
+	writers := make([]protoio.Writer, len(stores))
+	for i, store := range stores {
+		writers[i] = writerFor(store.name)
+	}
+	if parallel {
+		errs := make([]error, len(stores))
+		wg := sync.WaitGroup{}
+		for i := range stores {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = rs.snapshotStore(height, stores[i], writers[i])
+			}(i)
 		}
-		rs.logger.Info(fmt.Sprintf("Exporting snapshot for store %s", store.name))
-		for {
-			node, err := exporter.Next()
-			if err == iavltree.ExportDone {
-				break
-			} else if err != nil {
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
 				return err
 			}
-			err = protoWriter.WriteMsg(&snapshottypes.SnapshotItem{
-				Item: &snapshottypes.SnapshotItem_IAVL{
-					IAVL: &snapshottypes.SnapshotIAVLItem{
-						Key:     node.Key,
-						Value:   node.Value,
-						Height:  int32(node.Height),
-						Version: node.Version,
-					},
-				},
-			})
-			if err != nil {
+		}
+	} else {
+		for i, store := range stores {
+			if err := rs.snapshotStore(height, store, writers[i]); err != nil {
 				return err
 			}
-			totalKeyBytes += int64(len(node.Key))
-			totalValueBytes += int64(len(node.Value))
-			totalNumKeys += 1
 		}
-		telemetry.SetGaugeWithLabels(
-			[]string{"iavl", "store", "total_num_keys"},
-			float32(totalNumKeys),
-			[]metrics.Label{telemetry.NewLabel("store_name", store.name)},
-		)
-		telemetry.SetGaugeWithLabels(
-			[]string{"iavl", "store", "total_key_bytes"},
-			float32(totalKeyBytes),
-			[]metrics.Label{telemetry.NewLabel("store_name", store.name)},
-		)
-		telemetry.SetGaugeWithLabels(
-			[]string{"iavl", "store", "total_value_bytes"},
-			float32(totalValueBytes),
-			[]metrics.Label{telemetry.NewLabel("store_name", store.name)},
-		)
-		rs.logger.Info(fmt.Sprintf("Exported snapshot for store %s, with total number of keys %d, total key bytes %d, total value bytes %d",
-			store.name, totalNumKeys, totalKeyBytes, totalValueBytes))
-		exporter.Close()
 	}
 
+	return rs.snapshotExtensions(height, writerFor)
+}
+
+// namedStore is an IAVL store with the name of its key.
+type namedStore struct {
+	*iavl.Store
+	name string
+}
+
+// snapshotStore exports an IAVL store at the given height to protoWriter, as a
+// SnapshotStoreItem followed by its nodes.
+func (rs *Store) snapshotStore(height uint64, store namedStore, protoWriter protoio.Writer) error {
+	totalKeyBytes := int64(0)
+	totalValueBytes := int64(0)
+	totalNumKeys := int64(0)
+	progress, err := rs.newExportProgress(height, store)
+	if err != nil {
+		return err
+	}
+	err = protoWriter.WriteMsg(&snapshottypes.SnapshotItem{
+		Item: &snapshottypes.SnapshotItem_Store{
+			Store: &snapshottypes.SnapshotStoreItem{
+				Name: store.name,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	rs.logger.Info(fmt.Sprintf("Exporting snapshot for store %s", store.name))
+	_, err = exportStoreNodes(store.Store, int64(height), func(node *iavltree.ExportNode) error {
+		value := node.Value
+		if node.Height == 0 {
+			var err error
+			if value, err = rs.snapshotCompression.compress(value); err != nil {
+				return err
+			}
+		}
+		err := protoWriter.WriteMsg(&snapshottypes.SnapshotItem{
+			Item: &snapshottypes.SnapshotItem_IAVL{
+				IAVL: &snapshottypes.SnapshotIAVLItem{
+					Key:     node.Key,
+					Value:   value,
+					Height:  int32(node.Height),
+					Version: node.Version,
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		totalKeyBytes += int64(len(node.Key))
+		totalValueBytes += int64(len(node.Value))
+		totalNumKeys += 1
+		if node.Height == 0 {
+			progress.add()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	progress.done()
+	telemetry.SetGaugeWithLabels(
+		[]string{"iavl", "store", "total_num_keys"},
+		float32(totalNumKeys),
+		[]metrics.Label{telemetry.NewLabel("store_name", store.name)},
+	)
+	telemetry.SetGaugeWithLabels(
+		[]string{"iavl", "store", "total_key_bytes"},
+		float32(totalKeyBytes),
+		[]metrics.Label{telemetry.NewLabel("store_name", store.name)},
+	)
+	telemetry.SetGaugeWithLabels(
+		[]string{"iavl", "store", "total_value_bytes"},
+		float32(totalValueBytes),
+		[]metrics.Label{telemetry.NewLabel("store_name", store.name)},
+	)
+	rs.logger.Info(fmt.Sprintf("Exported snapshot for store %s, with total number of keys %d, total key bytes %d, total value bytes %d",
+		store.name, totalNumKeys, totalKeyBytes, totalValueBytes))
 	return nil
 }
 
 // Restore implements snapshottypes.Snapshotter.
-// returns next snapshot item and error.
+// returns next snapshot item and error. The format must be one of
+// SupportedSnapshotFormats, otherwise an error wrapping ErrUnknownFormat is
+// returned before anything is read.
 func (rs *Store) Restore(
 	height uint64, format uint32, protoReader protoio.Reader,
 ) (snapshottypes.SnapshotItem, error) {
+	if err := rs.checkWritable(); err != nil {
+		return snapshottypes.SnapshotItem{}, err
+	}
+	decodeNode, err := rs.snapshotNodeDecoderFor(format)
+	if err != nil {
+		return snapshottypes.SnapshotItem{}, err
+	}
 	// Import nodes into stores. The first item is expected to be a SnapshotItem containing
 	// a SnapshotStoreItem, telling us which store to import into. The following items will contain
 	// SnapshotNodeItem (i.e. ExportNode) until we reach the next SnapshotStoreItem or EOF.
 	var importer *iavltree.Importer
+	var progress *snapshotProgress
 	var snapshotItem snapshottypes.SnapshotItem
 loop:
 	for {
@@ -873,12 +1704,23 @@ loop:
 
 		switch item := snapshotItem.Item.(type) {
 		case *snapshottypes.SnapshotItem_Store:
+			if item.Store.Name == snapshotStoreSetItemName {
+				hash, err := readSnapshotStoreSetHash(protoReader)
+				if err != nil {
+					return snapshottypes.SnapshotItem{}, err
+				}
+				if err := rs.checkSnapshotStoreSet(hash); err != nil {
+					return snapshottypes.SnapshotItem{}, err
+				}
+				continue
+			}
 			if importer != nil {
 				err = importer.Commit()
 				if err != nil {
 					return snapshottypes.SnapshotItem{}, sdkerrors.Wrap(err, "IAVL commit failed")
 				}
 				importer.Close()
+				progress.done()
 			}
 			store, ok := rs.GetStoreByName(item.Store.Name).(*iavl.Store)
 			if !ok || store == nil {
@@ -889,33 +1731,23 @@ loop:
 				return snapshottypes.SnapshotItem{}, sdkerrors.Wrap(err, "import failed")
 			}
 			defer importer.Close()
+			progress = &snapshotProgress{notify: rs.restoreProgress, name: item.Store.Name, total: -1}
 
 		case *snapshottypes.SnapshotItem_IAVL:
 			if importer == nil {
 				return snapshottypes.SnapshotItem{}, sdkerrors.Wrap(sdkerrors.ErrLogic, "received IAVL node item before store item")
 			}
-			if item.IAVL.Height > math.MaxInt8 {
-				return snapshottypes.SnapshotItem{}, sdkerrors.Wrapf(sdkerrors.ErrLogic, "node height %v cannot exceed %v",
-					item.IAVL.Height, math.MaxInt8)
-			}
-			node := &iavltree.ExportNode{
-				Key:     item.IAVL.Key,
-				Value:   item.IAVL.Value,
-				Height:  int8(item.IAVL.Height),
-				Version: item.IAVL.Version,
-			}
-			// Protobuf does not differentiate between []byte{} as nil, but fortunately IAVL does
-			// not allow nil keys nor nil values for leaf nodes, so we can always set them to empty.
-			if node.Key == nil {
-				node.Key = []byte{}
-			}
-			if node.Height == 0 && node.Value == nil {
-				node.Value = []byte{}
+			node, err := decodeNode(item.IAVL)
+			if err != nil {
+				return snapshottypes.SnapshotItem{}, err
 			}
-			err := importer.Add(node)
+			err = importer.Add(node)
 			if err != nil {
 				return snapshottypes.SnapshotItem{}, sdkerrors.Wrap(err, "IAVL node import failed")
 			}
+			if node.Height == 0 {
+				progress.add()
+			}
 
 		default:
 			break loop
@@ -928,25 +1760,39 @@ loop:
 			return snapshottypes.SnapshotItem{}, sdkerrors.Wrap(err, "IAVL commit failed")
 		}
 		importer.Close()
+		progress.done()
 	}
 
-	rs.flushMetadata(rs.db, int64(height), rs.buildCommitInfo(int64(height)))
-	return snapshotItem, rs.LoadLatestVersion()
+	// the imported roots are verified before the restored height is persisted,
+	// so that a mismatch leaves no unverified state as the latest version
+	cInfo := rs.buildCommitInfo(int64(height))
+	if rs.restoreTrustedCommitInfo != nil {
+		if err := verifyRestoredStores(cInfo, rs.restoreTrustedCommitInfo); err != nil {
+			return snapshotItem, err
+		}
+	}
+	if err := rs.FlushMetadata(); err != nil {
+		return snapshottypes.SnapshotItem{}, err
+	}
+	if err := rs.flushMetadata(rs.db, int64(height), cInfo); err != nil {
+		return snapshottypes.SnapshotItem{}, err
+	}
+	if err := rs.LoadLatestVersion(); err != nil {
+		return snapshotItem, err
+	}
+	return rs.restoreExtensions(height, snapshotItem, protoReader)
 }
 
 func (rs *Store) loadCommitStoreFromParams(key types.StoreKey, id types.CommitID, params storeParams) (types.CommitKVStore, error) {
-	var db dbm.DB
-	if params.db != nil {
-		db = dbm.NewPrefixDB(params.db, []byte("s/_/"))
-	} else if rs.shouldUseArchivalDb(id.Version) {
-		prefix := make([]byte, 8)
-		binary.BigEndian.PutUint64(prefix, uint64(id.Version))
-		prefix = append(prefix, []byte("s/k:"+params.key.Name()+"/")...)
-		db = dbm.NewPrefixDB(rs.archivalDb, prefix)
-		params.typ = types.StoreTypeDB
-	} else {
-		prefix := "s/k:" + params.key.Name() + "/"
-		db = dbm.NewPrefixDB(rs.db, []byte(prefix))
+	db := rs.storeDB(params)
+	if params.db == nil {
+		if archivalDb := rs.archivalDbFor(key, id.Version); archivalDb != nil {
+			prefix := make([]byte, 8)
+			binary.BigEndian.PutUint64(prefix, uint64(id.Version))
+			prefix = append(prefix, []byte("s/k:"+params.key.Name()+"/")...)
+			db = dbm.NewPrefixDB(archivalDb, prefix)
+			params.typ = types.StoreTypeDB
+		}
 	}
 
 	switch params.typ {
@@ -958,9 +1804,9 @@ func (rs *Store) loadCommitStoreFromParams(key types.StoreKey, id types.CommitID
 		var err error
 
 		if params.initialVersion == 0 {
-			store, err = iavl.LoadStore(db, rs.logger, key, id, rs.lazyLoading, rs.iavlCacheSize, rs.iavlDisableFastNode, rs.orphanOpts)
+			store, err = iavl.LoadStore(db, rs.logger, key, id, rs.lazyLoading, rs.iavlCacheSizeFor(key), rs.iavlDisableFastNodeFor(key), rs.orphanOpts)
 		} else {
-			store, err = iavl.LoadStoreWithInitialVersion(db, rs.logger, key, id, rs.lazyLoading, params.initialVersion, rs.iavlCacheSize, rs.iavlDisableFastNode, rs.orphanOpts)
+			store, err = iavl.LoadStoreWithInitialVersion(db, rs.logger, key, id, rs.lazyLoading, params.initialVersion, rs.iavlCacheSizeFor(key), rs.iavlDisableFastNodeFor(key), rs.orphanOpts)
 		}
 
 		if err != nil {
@@ -999,6 +1845,15 @@ func (rs *Store) loadCommitStoreFromParams(key types.StoreKey, id types.CommitID
 	}
 }
 
+// storeDB returns the DB a store with the given params persists its data to,
+// which is prefixed in either its own DB or the multistore one.
+func (rs *Store) storeDB(params storeParams) dbm.DB {
+	if params.db != nil {
+		return dbm.NewPrefixDB(params.db, []byte("s/_/"))
+	}
+	return dbm.NewPrefixDB(rs.db, []byte("s/k:"+params.key.Name()+"/"))
+}
+
 func (rs *Store) buildCommitInfo(version int64) *types.CommitInfo {
 	keys := keysForStoreKeyMap(rs.stores)
 	storeInfos := []types.StoreInfo{}
@@ -1012,6 +1867,7 @@ func (rs *Store) buildCommitInfo(version int64) *types.CommitInfo {
 			CommitId: store.LastCommitID(),
 		})
 	}
+	sortStoreInfos(storeInfos)
 	return &types.CommitInfo{
 		Version:    version,
 		StoreInfos: storeInfos,
@@ -1019,9 +1875,14 @@ func (rs *Store) buildCommitInfo(version int64) *types.CommitInfo {
 }
 
 // RollbackToVersion delete the versions after `target` and update the latest version.
+// Every IAVL store must have `target`, otherwise an error is returned before
+// any store is rolled back.
 func (rs *Store) RollbackToVersion(target int64) error {
-	if target <= 0 {
-		return fmt.Errorf("invalid rollback height target: %d", target)
+	if err := rs.checkWritable(); err != nil {
+		return err
+	}
+	if _, err := rs.RollbackToVersionDryRun(target); err != nil {
+		return err
 	}
 
 	fmt.Printf("Target Version=%d\n", target)
@@ -1037,23 +1898,32 @@ func (rs *Store) RollbackToVersion(target int64) error {
 			fmt.Printf("Reset key=%s to height=%d\n", key.Name(), latestVersion)
 		}
 	}
-	rs.SetLastCommitInfo(commitStores(target, rs.stores, false))
-	rs.flushMetadata(rs.db, target, rs.LastCommitInfo())
+	if err := rs.FlushMetadata(); err != nil {
+		return err
+	}
+	if rs.commitInfoCache != nil {
+		rs.commitInfoCache.Purge()
+	}
+	rs.SetLastCommitInfo(commitStores(target, rs.stores, false, rs.commitParallelism))
+	if err := rs.flushMetadata(rs.db, target, rs.LastCommitInfo()); err != nil {
+		return err
+	}
 	return rs.LoadLatestVersion()
 }
 
-func (rs *Store) flushMetadata(db dbm.DB, version int64, cInfo *types.CommitInfo) {
+func (rs *Store) flushMetadata(db dbm.DB, version int64, cInfo *types.CommitInfo) error {
+	if err := rs.checkWritable(); err != nil {
+		return err
+	}
 	batch := db.NewBatch()
 	defer batch.Close()
-	if cInfo != nil {
-		flushCommitInfo(batch, version, cInfo)
-	}
-	flushLatestVersion(batch, version)
-	flushPruningHeights(batch, rs.pruneHeights)
+	split := rs.writeMetadata(batch, version, cInfo)
 	if err := batch.WriteSync(); err != nil {
-		panic(fmt.Errorf("error on batch write %w", err))
+		return fmt.Errorf("error on batch write %w", err)
 	}
+	rs.lastSplitCommitInfo = split
 	rs.logger.Info("App State Saved height=%d hash=%X\n", cInfo.CommitID().Version, cInfo.CommitID().Hash)
+	return nil
 }
 
 func (rs *Store) SetOrphanConfig(opts *iavltree.Options) {
@@ -1096,22 +1966,39 @@ func GetLatestVersion(db dbm.DB) int64 {
 	return latestVersion
 }
 
-// Commits each store and returns a new commitInfo.
-func commitStores(version int64, storeMap map[types.StoreKey]types.CommitKVStore, bumpVersion bool) *types.CommitInfo {
-	storeInfos := make([]types.StoreInfo, 0, len(storeMap))
-
-	for key, store := range storeMap {
-		commitID := store.Commit(bumpVersion)
+// commitStores commits the stores, on up to parallelism goroutines, and returns
+// the commit info of the version. The stores are independent, so the commit
+// info is the same whatever the parallelism. The commit time of each
+// non-transient store is reported as a gauge when telemetry is enabled.
+func commitStores(version int64, storeMap map[types.StoreKey]types.CommitKVStore, bumpVersion bool, parallelism int) *types.CommitInfo {
+	keys := keysForStoreKeyMap(storeMap)
+	commitIDs := make([]types.CommitID, len(keys))
+	durations := make([]time.Duration, len(keys))
+	forEachParallel(len(keys), parallelism, func(i int) {
+		start := time.Now()
+		commitIDs[i] = storeMap[keys[i]].Commit(bumpVersion)
+		durations[i] = time.Since(start)
+	})
 
-		if store.GetStoreType() == types.StoreTypeTransient {
+	storeInfos := make([]types.StoreInfo, 0, len(storeMap))
+	for i, key := range keys {
+		if storeMap[key].GetStoreType() == types.StoreTypeTransient {
 			continue
 		}
+		if telemetry.IsTelemetryEnabled() {
+			telemetry.SetGaugeWithLabels(
+				[]string{"store", "commit", "store_duration_ms"},
+				float32(durations[i].Microseconds())/1000,
+				[]metrics.Label{telemetry.NewLabel("store_name", key.Name())},
+			)
+		}
 
 		si := types.StoreInfo{}
 		si.Name = key.Name()
-		si.CommitId = commitID
+		si.CommitId = commitIDs[i]
 		storeInfos = append(storeInfos, si)
 	}
+	sortStoreInfos(storeInfos)
 
 	return &types.CommitInfo{
 		Version:    version,
@@ -1119,8 +2006,65 @@ func commitStores(version int64, storeMap map[types.StoreKey]types.CommitKVStore
 	}
 }
 
-func (rs *Store) doProofsQuery(req abci.RequestQuery) abci.ResponseQuery {
-	commitInfo, err := getCommitInfo(rs.db, req.Height)
+// forEachParallel calls fn with each index below n, on up to parallelism
+// goroutines. A panic of fn is raised again in the caller once all the calls
+// returned. With a parallelism of 1 or less, fn is called in order by the
+// caller.
+func forEachParallel(n, parallelism int, fn func(i int)) {
+	if parallelism <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		panicked bool
+		panicVal interface{}
+	)
+	indexes := make(chan int)
+	for w := 0; w < parallelism && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							mtx.Lock()
+							if !panicked {
+								panicked, panicVal = true, r
+							}
+							mtx.Unlock()
+						}
+					}()
+					fn(i)
+				}()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	if panicked {
+		panic(panicVal)
+	}
+}
+
+// sortStoreInfos sorts store infos by name, so that commit infos are laid out
+// deterministically regardless of map iteration order.
+func sortStoreInfos(storeInfos []types.StoreInfo) {
+	sort.Slice(storeInfos, func(i, j int) bool {
+		return storeInfos[i].Name < storeInfos[j].Name
+	})
+}
+
+func (rs *Store) doProofsQuery(req abci.RequestQuery, commitInfos map[int64]*types.CommitInfo) abci.ResponseQuery {
+	commitInfo, err := rs.proofCommitInfo(req.Height, commitInfos)
 	if err != nil {
 		return sdkerrors.QueryResult(err)
 	}
@@ -1137,15 +2081,32 @@ func (rs *Store) doProofsQuery(req abci.RequestQuery) abci.ResponseQuery {
 	return res
 }
 
+// errCommitInfoNotFound is returned by getCommitInfo when no commit info is
+// persisted for a version.
+var errCommitInfoNotFound = errors.New("no commit info found")
+
 // Gets commitInfo from disk.
 func getCommitInfo(db dbm.DB, ver int64) (*types.CommitInfo, error) {
 	cInfoKey := fmt.Sprintf(commitInfoKeyFmt, ver)
 
 	bz, err := db.Get([]byte(cInfoKey))
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to get commit info")
+		return nil, readError{errors.Wrap(err, "failed to get commit info")}
 	} else if bz == nil {
-		return nil, errors.New("no commit info found")
+		return nil, errCommitInfoNotFound
+	}
+
+	if len(bz) > 1 && bz[0] == commitInfoLayoutMarker {
+		switch bz[1] {
+		case commitInfoLayoutSplit:
+			return getSplitCommitInfo(db, ver, bz[2:])
+		case commitInfoLayoutSnappy:
+			if bz, err = snappy.Decode(nil, bz[2:]); err != nil {
+				return nil, errors.Wrap(err, "failed to decompress commit info")
+			}
+		default:
+			return nil, fmt.Errorf("unknown commit info layout %d", bz[1])
+		}
 	}
 
 	cInfo := &types.CommitInfo{}
@@ -1176,11 +2137,16 @@ func getPruningHeights(db dbm.DB) ([]int64, error) {
 	return prunedHeights, nil
 }
 
-func flushCommitInfo(batch dbm.Batch, version int64, cInfo *types.CommitInfo) {
+// flushCommitInfo writes the protobuf encoded cInfo, compressed with snappy if
+// compress is set. Hashes are always computed on the uncompressed commit info.
+func flushCommitInfo(batch dbm.Batch, version int64, cInfo *types.CommitInfo, compress bool) {
 	bz, err := cInfo.Marshal()
 	if err != nil {
 		panic(err)
 	}
+	if compress {
+		bz = append([]byte{commitInfoLayoutMarker, commitInfoLayoutSnappy}, snappy.Encode(nil, bz)...)
+	}
 
 	cInfoKey := fmt.Sprintf(commitInfoKeyFmt, version)
 	batch.Set([]byte(cInfoKey), bz)
@@ -1206,8 +2172,58 @@ func flushPruningHeights(batch dbm.Batch, pruneHeights []int64) {
 	batch.Set([]byte(pruneHeightsKey), bz)
 }
 
+// Close waits for pruning, flushes the pending metadata and closes the DB. The
+// stores, the inter-block cache and the archival DBs are closed too if they
+// implement io.Closer, and all the errors are returned joined. The store cannot
+// be loaded again once closed.
 func (rs *Store) Close() error {
-	return rs.db.Close()
+	if err := rs.checkOpen(); err != nil {
+		return err
+	}
+	rs.WaitForPruning()
+	if err := rs.FlushMetadata(); err != nil {
+		return err
+	}
+	rs.closed = true
+
+	var errs []error
+	for _, key := range keysForStoreKeyMap(rs.stores) {
+		if closer, ok := rs.stores[key].(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, errors.Wrapf(err, "failed to close store %s", key.Name()))
+			}
+		}
+	}
+	if closer, ok := rs.interBlockCache.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, errors.Wrap(err, "failed to close inter-block cache"))
+		}
+	}
+	for _, db := range rs.archivalDbs() {
+		if err := db.Close(); err != nil {
+			errs = append(errs, errors.Wrap(err, "failed to close archival DB"))
+		}
+	}
+	if err := rs.db.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return stderrors.Join(errs...)
+}
+
+// checkOpen returns an error if the store has been closed.
+func (rs *Store) checkOpen() error {
+	if rs.closed {
+		return sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "store is closed")
+	}
+	return nil
+}
+
+// checkWritable returns an error if the store is read-only.
+func (rs *Store) checkWritable() error {
+	if rs.readOnly {
+		return sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "store is read-only")
+	}
+	return nil
 }
 
 func (rs *Store) SetKVStores(handler func(key types.StoreKey, s types.KVStore) types.CacheWrap) types.MultiStore {
@@ -1222,6 +2238,10 @@ func (rs *Store) StoreKeys() []types.StoreKey {
 	return res
 }
 
+// GetEarliestVersion returns the lowest version that has not been pruned, or
+// zero if it is unknown, e.g. before any pruning.
 func (rs *Store) GetEarliestVersion() int64 {
+	rs.pruneHeightsMtx.Lock()
+	defer rs.pruneHeightsMtx.Unlock()
 	return rs.earliestVersion
 }
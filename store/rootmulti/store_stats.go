@@ -0,0 +1,72 @@
+package rootmulti
+
+import (
+	iavltree "github.com/cosmos/iavl"
+
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// StoreStat is the size of the contents of an IAVL store at a version.
+type StoreStat struct {
+	// NumKeys is the number of keys of the store.
+	NumKeys int64
+	// KeyBytes and ValueBytes are the total sizes of the keys and of the values.
+	KeyBytes   int64
+	ValueBytes int64
+}
+
+// StoreStats returns the size of each IAVL store at a version, by store name.
+// The stores are walked like Snapshot exports them, counting the leaf nodes
+// only, so the stats are those of the keys and values of the store rather than
+// of its tree. Non-IAVL stores, such as transient and memory stores, are left
+// out. An error is returned if the version of a store was pruned or never
+// committed.
+func (rs *Store) StoreStats(version int64) (map[string]StoreStat, error) {
+	stats := make(map[string]StoreStat)
+	for _, key := range keysForStoreKeyMap(rs.stores) {
+		store, ok := rs.GetCommitKVStore(key).(*iavl.Store)
+		if !ok {
+			continue
+		}
+		if !store.VersionExists(version) {
+			return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight,
+				"version %d of store %s is not available, it was pruned or never committed", version, key.Name())
+		}
+		stat, err := exportStoreNodes(store, version, func(*iavltree.ExportNode) error { return nil })
+		if err != nil {
+			return nil, sdkerrors.Wrapf(err, "failed to compute the stats of store %s", key.Name())
+		}
+		stats[key.Name()] = stat
+	}
+	return stats, nil
+}
+
+// exportStoreNodes exports the given version of an IAVL store, passing each
+// node to fn in export order, and returns the stats of its leaf nodes. It stops
+// at the first error returned by fn.
+func exportStoreNodes(store *iavl.Store, version int64, fn func(node *iavltree.ExportNode) error) (StoreStat, error) {
+	exporter, err := store.Export(version)
+	if err != nil {
+		return StoreStat{}, err
+	}
+	defer exporter.Close()
+
+	var stat StoreStat
+	for {
+		node, err := exporter.Next()
+		if err == iavltree.ExportDone {
+			return stat, nil
+		} else if err != nil {
+			return StoreStat{}, err
+		}
+		if node.Height == 0 {
+			stat.NumKeys++
+			stat.KeyBytes += int64(len(node.Key))
+			stat.ValueBytes += int64(len(node.Value))
+		}
+		if err := fn(node); err != nil {
+			return StoreStat{}, err
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package rootmulti
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	"github.com/cosmos/cosmos-sdk/store/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+func TestStoreStats(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	ms.MountStoreWithDB(types.NewTransientStoreKey("transient"), types.StoreTypeTransient, nil)
+	ms.MountStoreWithDB(types.NewMemoryStoreKey("memory"), types.StoreTypeMemory, nil)
+	require.NoError(t, ms.LoadLatestVersion())
+	store1 := ms.GetKVStore(testStoreKey1)
+	for i := 0; i < 20; i++ {
+		store1.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value-%d", i*i)))
+	}
+	ms.GetKVStore(testStoreKey2).Set(testKey1, testValue1)
+	version := ms.Commit(true).Version
+
+	// later writes are not part of the stats of the version
+	store1.Set([]byte("key99"), []byte("value99"))
+	ms.Commit(true)
+
+	stats, err := ms.StoreStats(version)
+	require.NoError(t, err)
+	require.Len(t, stats, 3)
+
+	immutable, err := ms.GetCommitKVStore(testStoreKey1).(*iavl.Store).GetImmutable(version)
+	require.NoError(t, err)
+	var expected StoreStat
+	it := immutable.Iterator(nil, nil)
+	for ; it.Valid(); it.Next() {
+		expected.NumKeys++
+		expected.KeyBytes += int64(len(it.Key()))
+		expected.ValueBytes += int64(len(it.Value()))
+	}
+	require.NoError(t, it.Close())
+	require.Equal(t, int64(20), expected.NumKeys)
+	require.Equal(t, expected, stats["store1"])
+
+	require.Equal(t, StoreStat{NumKeys: 1, KeyBytes: int64(len(testKey1)), ValueBytes: int64(len(testValue1))}, stats["store2"])
+	require.Equal(t, StoreStat{}, stats["store3"])
+
+	require.NoError(t, ms.GetCommitKVStore(testStoreKey1).(*iavl.Store).DeleteVersions(version))
+	_, err = ms.StoreStats(version)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidHeight)
+}
@@ -2,10 +2,22 @@ package rootmulti
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/stretchr/testify/require"
 	abci "github.com/tendermint/tendermint/abci/types"
 	"github.com/tendermint/tendermint/libs/log"
@@ -17,7 +29,9 @@ import (
 	"github.com/cosmos/cosmos-sdk/store/iavl"
 	sdkmaps "github.com/cosmos/cosmos-sdk/store/internal/maps"
 	"github.com/cosmos/cosmos-sdk/store/listenkv"
+	"github.com/cosmos/cosmos-sdk/store/tracekv"
 	"github.com/cosmos/cosmos-sdk/store/types"
+	"github.com/cosmos/cosmos-sdk/telemetry"
 	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
 )
 
@@ -44,6 +58,30 @@ func TestGetCommitKVStore(t *testing.T) {
 	require.IsType(t, &iavl.Store{}, store2)
 }
 
+func TestForEachStore(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	ms.MountStoreWithDB(types.NewTransientStoreKey("a_transient"), types.StoreTypeTransient, nil)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	var names []string
+	ms.ForEachStore(func(name string, key types.StoreKey, store types.CommitKVStore) bool {
+		require.Equal(t, key.Name(), name)
+		require.Equal(t, ms.GetCommitKVStore(key), store)
+		names = append(names, name)
+		return true
+	})
+	require.Equal(t, []string{"a_transient", "store1", "store2", "store3"}, names)
+
+	// iteration stops once fn returns false
+	names = nil
+	ms.ForEachStore(func(name string, _ types.StoreKey, store types.CommitKVStore) bool {
+		names = append(names, name)
+		return store.GetStoreType() == types.StoreTypeTransient
+	})
+	require.Equal(t, []string{"a_transient", "store1"}, names)
+}
+
 func TestStoreMount(t *testing.T) {
 	db := dbm.NewMemDB()
 	store := NewStore(db, log.NewNopLogger())
@@ -60,6 +98,149 @@ func TestStoreMount(t *testing.T) {
 	require.Panics(t, func() { store.MountStoreWithDB(dup1, types.StoreTypeIAVL, db) })
 }
 
+func TestStoreMountMaxStores(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewStore(db, log.NewNopLogger())
+	store.SetMaxStores(2)
+
+	require.NotPanics(t, func() { store.MountStoreWithDB(types.NewKVStoreKey("store1"), types.StoreTypeIAVL, nil) })
+	require.NotPanics(t, func() { store.MountStoreWithDB(types.NewKVStoreKey("store2"), types.StoreTypeIAVL, nil) })
+	require.Panics(t, func() { store.MountStoreWithDB(types.NewKVStoreKey("store3"), types.StoreTypeIAVL, nil) })
+
+	// unlimited by default
+	store = NewStore(db, log.NewNopLogger())
+	for i := 0; i < 100; i++ {
+		store.MountStoreWithDB(types.NewKVStoreKey(fmt.Sprintf("store%d", i)), types.StoreTypeIAVL, nil)
+	}
+}
+
+func TestStoreMountStores(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewStore(db, log.NewNopLogger())
+
+	key1 := types.NewKVStoreKey("store1")
+	key2 := types.NewKVStoreKey("store2")
+	tkey := types.NewTransientStoreKey("transient")
+	require.NoError(t, store.MountStores([]types.StoreDescriptor{
+		{Key: key1, Type: types.StoreTypeIAVL},
+		{Key: key2, Type: types.StoreTypeIAVL, DB: dbm.NewMemDB()},
+		{Key: tkey, Type: types.StoreTypeTransient},
+	}))
+	require.NoError(t, store.LoadLatestVersion())
+	require.IsType(t, &iavl.Store{}, store.GetCommitKVStore(key1))
+	require.IsType(t, &iavl.Store{}, store.GetCommitKVStore(key2))
+	require.NotNil(t, store.GetCommitKVStore(tkey))
+
+	// all problems are reported at once, and nothing is mounted
+	store = NewStore(db, log.NewNopLogger())
+	store.MountStoreWithDB(key1, types.StoreTypeIAVL, nil)
+	key3 := types.NewKVStoreKey("store3")
+	err := store.MountStores([]types.StoreDescriptor{
+		{Key: key3, Type: types.StoreTypeIAVL},
+		{Key: key1, Type: types.StoreTypeIAVL},
+		{Key: types.NewKVStoreKey("store3"), Type: types.StoreTypeIAVL},
+		{Key: nil, Type: types.StoreTypeIAVL},
+	})
+	require.Error(t, err)
+	require.True(t, sdkerrors.ErrInvalidRequest.Is(err))
+	require.Contains(t, err.Error(), "descriptor 1: duplicate store key for store1")
+	require.Contains(t, err.Error(), "descriptor 2: duplicate store key name store3")
+	require.Contains(t, err.Error(), "descriptor 3: key cannot be nil")
+	require.Len(t, store.storesParams, 1)
+	require.NotContains(t, store.keysByName, "store3")
+
+	// the store limit applies to the whole set
+	store = NewStore(db, log.NewNopLogger())
+	store.SetMaxStores(1)
+	err = store.MountStores([]types.StoreDescriptor{
+		{Key: key1, Type: types.StoreTypeIAVL},
+		{Key: key2, Type: types.StoreTypeIAVL},
+	})
+	require.Error(t, err)
+	require.Empty(t, store.storesParams)
+}
+
+func TestStoreMountStoresWithDB(t *testing.T) {
+	db := dbm.NewMemDB()
+	key1 := types.NewKVStoreKey("store1")
+	key2 := types.NewKVStoreKey("store2")
+
+	store := NewStore(db, log.NewNopLogger())
+	store.MountStoresOfType([]types.StoreKey{key1, key2}, types.StoreTypeIAVL)
+	store.MountStoresWithDB([]types.StoreDescriptor{{Key: types.NewTransientStoreKey("transient"), Type: types.StoreTypeTransient}})
+	require.NoError(t, store.LoadLatestVersion())
+	require.IsType(t, &iavl.Store{}, store.GetCommitKVStore(key1))
+	require.IsType(t, &iavl.Store{}, store.GetCommitKVStore(key2))
+	require.NotNil(t, store.GetStoreByName("transient"))
+
+	// a duplicate name panics before any store is mounted
+	store = NewStore(db, log.NewNopLogger())
+	require.PanicsWithValue(t, "invalid store descriptors: descriptor 2: duplicate store key name store1: invalid request", func() {
+		store.MountStoresOfType([]types.StoreKey{key1, key2, types.NewKVStoreKey("store1")}, types.StoreTypeIAVL)
+	})
+	require.Empty(t, store.storesParams)
+	require.Empty(t, store.keysByName)
+}
+
+func TestRenameStoreOnline(t *testing.T) {
+	db, storeDB := dbm.NewMemDB(), dbm.NewMemDB()
+	oldKey := types.NewKVStoreKey("old")
+	newKey := types.NewKVStoreKey("new")
+	prefixedKey := types.NewKVStoreKey("prefixed")
+	transientKey := types.NewTransientStoreKey("transient")
+
+	ms := NewStore(db, log.NewNopLogger())
+	ms.MountStoreWithDB(oldKey, types.StoreTypeIAVL, storeDB)
+	ms.MountStoreWithDB(prefixedKey, types.StoreTypeIAVL, nil)
+	ms.MountStoreWithDB(transientKey, types.StoreTypeTransient, nil)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	ms.GetKVStore(oldKey).Set(testKey1, testValue1)
+	ms.Commit(true)
+
+	var events []string
+	ms.SetStoreLifecycleHandler(func(name, event string) {
+		events = append(events, name+":"+event)
+	})
+	require.NoError(t, ms.RenameStoreOnline(oldKey, newKey))
+	require.Equal(t, []string{"new:" + StoreEventRenamed}, events)
+
+	// the data is preserved under the new name, the old one no longer resolves
+	require.Equal(t, testValue1, ms.GetKVStore(newKey).Get(testKey1))
+	require.Nil(t, ms.GetStoreByName("old"))
+	require.NotNil(t, ms.GetStoreByName("new"))
+	require.Panics(t, func() { ms.GetKVStore(oldKey) })
+
+	ms.GetKVStore(newKey).Set(testKey2, testValue2)
+	cid := ms.Commit(true)
+	checkContains(t, ms.LastCommitInfo().StoreInfos, []string{"new", "prefixed"})
+
+	// the store reloads under its new name
+	ms = NewStore(db, log.NewNopLogger())
+	ms.MountStoreWithDB(newKey, types.StoreTypeIAVL, storeDB)
+	ms.MountStoreWithDB(prefixedKey, types.StoreTypeIAVL, nil)
+	ms.MountStoreWithDB(transientKey, types.StoreTypeTransient, nil)
+	require.NoError(t, ms.LoadLatestVersion())
+	require.Equal(t, cid, ms.LastCommitID())
+	require.Equal(t, testValue1, ms.GetKVStore(newKey).Get(testKey1))
+	require.Equal(t, testValue2, ms.GetKVStore(newKey).Get(testKey2))
+
+	// stores without persisted data can be renamed as well
+	require.NoError(t, ms.RenameStoreOnline(transientKey, types.NewTransientStoreKey("transient2")))
+	require.Nil(t, ms.GetStoreByName("transient"))
+
+	// stores prefixed by name in the root DB need a full copy
+	err := ms.RenameStoreOnline(prefixedKey, types.NewKVStoreKey("prefixed2"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "StoreUpgrades")
+	require.NotNil(t, ms.GetStoreByName("prefixed"))
+
+	// the new name must be free and the old store loaded
+	require.Error(t, ms.RenameStoreOnline(newKey, types.NewKVStoreKey("prefixed")))
+	require.Error(t, ms.RenameStoreOnline(oldKey, types.NewKVStoreKey("other")))
+	require.Error(t, ms.RenameStoreOnline(newKey, types.NewTransientStoreKey("other")))
+}
+
 func TestCacheMultiStore(t *testing.T) {
 	var db dbm.DB = dbm.NewMemDB()
 	ms := newMultiStoreWithMounts(db, types.PruneNothing)
@@ -105,6 +286,64 @@ func TestCacheMultiStoreWithVersion(t *testing.T) {
 	})
 }
 
+func TestCacheMultiStoreWithVersionConcurrencyLimit(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.Commit(true)
+
+	ms.SetHistoricalQueryConcurrency(2)
+	ms.SetHistoricalQueryFailFast(true)
+
+	cms1, err := ms.CacheMultiStoreWithVersion(1)
+	require.NoError(t, err)
+	cms2, err := ms.CacheMultiStoreWithVersion(1)
+	require.NoError(t, err)
+
+	// the limit has been reached
+	_, err = ms.CacheMultiStoreWithVersion(1)
+	require.Error(t, err)
+
+	// closing a branch frees up a slot, closing it twice does not free another
+	cms1.Close()
+	cms1.Close()
+	cms3, err := ms.CacheMultiStoreWithVersion(1)
+	require.NoError(t, err)
+	_, err = ms.CacheMultiStoreWithVersion(1)
+	require.Error(t, err)
+
+	// in blocking mode, the call waits until a slot is released
+	ms.SetHistoricalQueryFailFast(false)
+	acquired := make(chan types.CacheMultiStore)
+	go func() {
+		cms, err := ms.CacheMultiStoreWithVersion(1)
+		require.NoError(t, err)
+		acquired <- cms
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("historical branch acquired above the concurrency limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cms2.Close()
+	select {
+	case cms := <-acquired:
+		cms.Close()
+	case <-time.After(time.Second):
+		t.Fatal("historical branch was not acquired after a slot was released")
+	}
+	cms3.Close()
+
+	// removing the limit allows any number of branches
+	ms.SetHistoricalQueryConcurrency(0)
+	for i := 0; i < 5; i++ {
+		_, err = ms.CacheMultiStoreWithVersion(1)
+		require.NoError(t, err)
+	}
+}
+
 func TestHashStableWithEmptyCommit(t *testing.T) {
 	var db dbm.DB = dbm.NewMemDB()
 	ms := newMultiStoreWithMounts(db, types.PruneNothing)
@@ -134,458 +373,2982 @@ func TestHashStableWithEmptyCommit(t *testing.T) {
 	require.Equal(t, hash, cID.Hash)
 }
 
-func TestMultistoreCommitLoad(t *testing.T) {
-	var db dbm.DB = dbm.NewMemDB()
-	store := newMultiStoreWithMounts(db, types.PruneNothing)
-	err := store.LoadLatestVersion()
-	require.Nil(t, err)
-
-	// New store has empty last commit.
-	commitID := types.CommitID{}
-	checkStore(t, store, commitID, commitID)
+func TestHasUncommittedChanges(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	ms.MountStoreWithDB(types.NewMemoryStoreKey("mem"), types.StoreTypeMemory, nil)
+	ms.MountStoreWithDB(types.NewTransientStoreKey("transient"), types.StoreTypeTransient, nil)
+	require.NoError(t, ms.LoadLatestVersion())
+	store1 := ms.GetStoreByName("store1").(types.KVStore)
 
-	// Make sure we can get stores by name.
-	s1 := store.GetStoreByName("store1")
-	require.NotNil(t, s1)
-	s3 := store.GetStoreByName("store3")
-	require.NotNil(t, s3)
-	s77 := store.GetStoreByName("store77")
-	require.Nil(t, s77)
+	store1.Set(testKey1, testValue1)
+	require.True(t, ms.HasUncommittedChanges())
+	ms.Commit(true)
+	require.False(t, ms.HasUncommittedChanges())
 
-	// Make a few commits and check them.
-	nCommits := int64(3)
-	for i := int64(0); i < nCommits; i++ {
-		commitID = store.Commit(true)
-		expectedCommitID := getExpectedCommitID(store, i+1)
-		checkStore(t, store, expectedCommitID, commitID)
-	}
+	// empty commits leave nothing pending either
+	ms.Commit(true)
+	require.False(t, ms.HasUncommittedChanges())
 
-	// Load the latest multistore again and check version.
-	store = newMultiStoreWithMounts(db, types.PruneNothing)
-	err = store.LoadLatestVersion()
-	require.Nil(t, err)
-	commitID = getExpectedCommitID(store, nCommits)
-	checkStore(t, store, commitID, commitID)
+	store1.Set(testKey2, testValue2)
+	require.True(t, ms.HasUncommittedChanges())
 
-	// Commit and check version.
-	commitID = store.Commit(true)
-	expectedCommitID := getExpectedCommitID(store, nCommits+1)
-	checkStore(t, store, expectedCommitID, commitID)
+	// reverting the write restores the committed state
+	store1.Delete(testKey2)
+	require.False(t, ms.HasUncommittedChanges())
 
-	// Load an older multistore and check version.
-	ver := nCommits - 1
-	store = newMultiStoreWithMounts(db, types.PruneNothing)
-	err = store.LoadVersion(ver)
-	require.Nil(t, err)
-	commitID = getExpectedCommitID(store, ver)
-	checkStore(t, store, commitID, commitID)
+	// transient stores are not committed
+	ms.GetStoreByName("transient").(types.KVStore).Set(testKey1, testValue1)
+	require.False(t, ms.HasUncommittedChanges())
 }
 
-func TestMultistoreLoadWithUpgrade(t *testing.T) {
-	var db dbm.DB = dbm.NewMemDB()
-	store := newMultiStoreWithMounts(db, types.PruneNothing)
-	err := store.LoadLatestVersion()
-	require.Nil(t, err)
-
-	// write some data in all stores
-	k1, v1 := []byte("first"), []byte("store")
-	s1, _ := store.GetStoreByName("store1").(types.KVStore)
-	require.NotNil(t, s1)
-	s1.Set(k1, v1)
+// workingHashCountingStore counts the working hash computations of a store.
+type workingHashCountingStore struct {
+	types.CommitKVStore
+	count *int
+}
 
-	k2, v2 := []byte("second"), []byte("restore")
-	s2, _ := store.GetStoreByName("store2").(types.KVStore)
-	require.NotNil(t, s2)
-	s2.Set(k2, v2)
+func (s workingHashCountingStore) GetWorkingHash() ([]byte, error) {
+	*s.count++
+	return s.CommitKVStore.GetWorkingHash()
+}
 
-	k3, v3 := []byte("third"), []byte("dropped")
-	s3, _ := store.GetStoreByName("store3").(types.KVStore)
-	require.NotNil(t, s3)
-	s3.Set(k3, v3)
+func TestWorkingHashCache(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	computed := 0
+	for key, store := range ms.stores {
+		ms.stores[key] = workingHashCountingStore{CommitKVStore: store, count: &computed}
+	}
+	store1 := ms.GetKVStore(testStoreKey1)
+	store1.Set(testKey1, testValue1)
 
-	s4, _ := store.GetStoreByName("store4").(types.KVStore)
-	require.Nil(t, s4)
+	// without the cache, every call computes the hash
+	hash, err := ms.GetWorkingHash()
+	require.NoError(t, err)
+	_, err = ms.GetWorkingHash()
+	require.NoError(t, err)
+	require.Equal(t, 6, computed)
 
-	// do one commit
-	commitID := store.Commit(true)
-	expectedCommitID := getExpectedCommitID(store, 1)
-	checkStore(t, store, expectedCommitID, commitID)
+	// with the cache, consecutive calls return the same bytes
+	ms.SetWorkingHashCache(true)
+	computed = 0
+	first, err := ms.GetWorkingHash()
+	require.NoError(t, err)
+	second, err := ms.GetWorkingHash()
+	require.NoError(t, err)
+	require.Equal(t, hash, first)
+	require.Same(t, &first[0], &second[0])
+	require.Equal(t, 3, computed)
 
-	ci, err := getCommitInfo(db, 1)
+	// writes are only reflected once the hash is invalidated
+	store1.Set(testKey2, testValue2)
+	stale, err := ms.GetWorkingHash()
 	require.NoError(t, err)
-	require.Equal(t, int64(1), ci.Version)
-	require.Equal(t, 3, len(ci.StoreInfos))
-	checkContains(t, ci.StoreInfos, []string{"store1", "store2", "store3"})
+	require.Equal(t, hash, stale)
+	ms.InvalidateWorkingHash()
+	updated, err := ms.GetWorkingHash()
+	require.NoError(t, err)
+	require.NotEqual(t, hash, updated)
+	require.Equal(t, 6, computed)
+
+	// commits invalidate the hash
+	cid := ms.Commit(true)
+	require.Equal(t, updated, cid.Hash)
+	store1.Set(testKey1, testValue2)
+	afterCommit, err := ms.GetWorkingHash()
+	require.NoError(t, err)
+	require.NotEqual(t, cid.Hash, afterCommit)
+}
 
-	// Load without changes and make sure it is sensible
-	store = newMultiStoreWithMounts(db, types.PruneNothing)
+func TestCommitInfoStoreInfosSorted(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := NewStore(db, log.NewNopLogger())
+	names := []string{"zeta", "alpha", "mu", "beta", "omega", "kappa", "delta", "gamma"}
+	for _, name := range names {
+		ms.MountStoreWithDB(types.NewKVStoreKey(name), types.StoreTypeIAVL, nil)
+	}
+	require.NoError(t, ms.LoadLatestVersion())
 
-	err = store.LoadLatestVersion()
-	require.Nil(t, err)
-	commitID = getExpectedCommitID(store, 1)
-	checkStore(t, store, commitID, commitID)
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	storeInfoNames := func(cInfo *types.CommitInfo) []string {
+		res := []string{}
+		for _, si := range cInfo.StoreInfos {
+			res = append(res, si.Name)
+		}
+		return res
+	}
 
-	// let's query data to see it was saved properly
-	s2, _ = store.GetStoreByName("store2").(types.KVStore)
-	require.NotNil(t, s2)
-	require.Equal(t, v2, s2.Get(k2))
+	for i := 0; i < 5; i++ {
+		ms.Commit(true)
+		require.Equal(t, sorted, storeInfoNames(ms.LastCommitInfo()))
+		require.Equal(t, sorted, storeInfoNames(ms.buildCommitInfo(ms.LastCommitID().Version)))
+	}
 
-	// now, let's load with upgrades...
-	restore, upgrades := newMultiStoreWithModifiedMounts(db, types.PruneNothing)
-	err = restore.LoadLatestVersionAndUpgrade(upgrades)
-	require.Nil(t, err)
+	// the persisted layout is sorted as well, and survives a restart
+	cInfo, err := getCommitInfo(db, 5)
+	require.NoError(t, err)
+	require.Equal(t, sorted, storeInfoNames(cInfo))
 
-	// s1 was not changed
-	s1, _ = restore.GetStoreByName("store1").(types.KVStore)
-	require.NotNil(t, s1)
-	require.Equal(t, v1, s1.Get(k1))
+	ms = NewStore(db, log.NewNopLogger())
+	for _, name := range names {
+		ms.MountStoreWithDB(types.NewKVStoreKey(name), types.StoreTypeIAVL, nil)
+	}
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.Commit(true)
+	require.Equal(t, sorted, storeInfoNames(ms.LastCommitInfo()))
+}
 
-	// store3 is mounted, but data deleted are gone
-	s3, _ = restore.GetStoreByName("store3").(types.KVStore)
-	require.NotNil(t, s3)
-	require.Nil(t, s3.Get(k3)) // data was deleted
+func TestSplitCommitInfoLayout(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, multi.LoadLatestVersion())
 
-	// store4 is mounted, with empty data
-	s4, _ = restore.GetStoreByName("store4").(types.KVStore)
-	require.NotNil(t, s4)
+	// versions flushed before enabling the layout stay readable
+	multi.GetStoreByName("store1").(types.KVStore).Set(testKey1, testValue1)
+	multi.Commit(true)
+	multi.SetSplitCommitInfo(true)
 
-	iterator := s4.Iterator(nil, nil)
+	expected := map[int64]*types.CommitInfo{1: multi.LastCommitInfo()}
+	for i := 0; i < 4; i++ {
+		// only store2 changes after version 3
+		if i < 2 {
+			multi.GetStoreByName("store1").(types.KVStore).Set([]byte(fmt.Sprint(i)), testValue1)
+		}
+		multi.GetStoreByName("store2").(types.KVStore).Set([]byte(fmt.Sprint(i)), testValue2)
+		cid := multi.Commit(true)
+		expected[cid.Version] = multi.LastCommitInfo()
+	}
+	for version, cInfo := range expected {
+		stored, err := getCommitInfo(db, version)
+		require.NoError(t, err)
+		require.Equal(t, cInfo, stored)
+		require.Equal(t, cInfo.Hash(), stored.Hash())
+	}
 
-	values := 0
-	for ; iterator.Valid(); iterator.Next() {
-		values += 1
+	hashVersions := func(name string) []int64 {
+		res := []int64{}
+		for version := int64(1); version <= 6; version++ {
+			if ok, _ := db.Has([]byte(fmt.Sprintf(storeHashKeyFmt, name, version))); ok {
+				res = append(res, version)
+			}
+		}
+		return res
 	}
-	require.Zero(t, values)
+	require.Equal(t, []int64{2, 3}, hashVersions("store1"))
+	require.Equal(t, []int64{2, 3, 4, 5}, hashVersions("store2"))
+	require.Equal(t, []int64{2}, hashVersions("store3"))
 
-	require.NoError(t, iterator.Close())
+	// the layout is reassembled when loading, and the first flush after a
+	// restart writes every hash again
+	multi = newMultiStoreWithMounts(db, types.PruneNothing)
+	multi.SetSplitCommitInfo(true)
+	require.NoError(t, multi.LoadLatestVersion())
+	require.Equal(t, expected[5].CommitID(), multi.LastCommitID())
+	cid := multi.Commit(true)
+	require.Equal(t, []int64{2, 6}, hashVersions("store3"))
+	stored, err := getCommitInfo(db, cid.Version)
+	require.NoError(t, err)
+	require.Equal(t, multi.LastCommitInfo(), stored)
 
-	// write something inside store4
-	k4, v4 := []byte("fourth"), []byte("created")
-	s4.Set(k4, v4)
+	// proofs are served from the reassembled commit info
+	res := multi.Query(abci.RequestQuery{Path: "/store1/key", Data: testKey1, Height: 3, Prove: true})
+	require.Zero(t, res.Code, res.Log)
+	require.NoError(t, DefaultProofRuntime().VerifyValue(res.ProofOps, expected[3].Hash(), "/store1/"+string(testKey1), testValue1))
 
-	// store2 is no longer mounted
-	st2 := restore.GetStoreByName("store2")
-	require.Nil(t, st2)
+	// missing hashes are reported
+	require.NoError(t, db.Delete([]byte(fmt.Sprintf(storeHashKeyFmt, "store3", 2))))
+	_, err = getCommitInfo(db, 4)
+	require.Error(t, err)
+}
 
-	// restore2 has the old data
-	rs2, _ := restore.GetStoreByName("restore2").(types.KVStore)
-	require.NotNil(t, rs2)
-	require.Equal(t, v2, rs2.Get(k2))
+func TestLastMetadataWriteBytes(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(1, 0, 10))
+	require.NoError(t, ms.LoadLatestVersion())
+	require.Zero(t, ms.LastMetadataWriteBytes())
 
-	// store this migrated data, and load it again without migrations
-	migratedID := restore.Commit(true)
-	require.Equal(t, migratedID.Version, int64(2))
+	for i := 0; i < 4; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		ms.Commit(true)
+	}
 
-	reload, _ := newMultiStoreWithModifiedMounts(db, types.PruneNothing)
-	err = reload.LoadLatestVersion()
-	require.Nil(t, err)
-	require.Equal(t, migratedID, reload.LastCommitID())
+	// the commit info, the latest version and the two queued prune heights
+	version := ms.LastCommitID().Version
+	cInfoKey := fmt.Sprintf(commitInfoKeyFmt, version)
+	cInfo, err := db.Get([]byte(cInfoKey))
+	require.NoError(t, err)
+	latest, err := db.Get([]byte(latestVersionKey))
+	require.NoError(t, err)
+	pruneHeights, err := db.Get([]byte(pruneHeightsKey))
+	require.NoError(t, err)
+	require.Len(t, pruneHeights, 2*8)
+	expected := len(cInfoKey) + len(cInfo) + len(latestVersionKey) + len(latest) + len(pruneHeightsKey) + len(pruneHeights)
+	require.Equal(t, expected, ms.LastMetadataWriteBytes())
 
-	// query this new store
-	rl1, _ := reload.GetStoreByName("store1").(types.KVStore)
-	require.NotNil(t, rl1)
-	require.Equal(t, v1, rl1.Get(k1))
+	// the split layout writes less for an unchanged store set
+	ms.SetSplitCommitInfo(true)
+	ms.Commit(true)
+	ms.GetKVStore(testStoreKey1).Set(testKey2, testValue2)
+	ms.Commit(true)
+	require.Less(t, ms.LastMetadataWriteBytes(), expected)
+}
 
-	rl2, _ := reload.GetStoreByName("restore2").(types.KVStore)
-	require.NotNil(t, rl2)
-	require.Equal(t, v2, rl2.Get(k2))
+func TestCommitInfoCompression(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, multi.LoadLatestVersion())
 
-	rl4, _ := reload.GetStoreByName("store4").(types.KVStore)
-	require.NotNil(t, rl4)
+	multi.GetStoreByName("store1").(types.KVStore).Set(testKey1, testValue1)
+	legacy := multi.Commit(true)
+	multi.SetCommitInfoCompression(true)
+	multi.GetStoreByName("store2").(types.KVStore).Set(testKey2, testValue2)
+	compressed := multi.Commit(true)
+
+	// only the value flushed with compression enabled has the layout prefix
+	bz, err := db.Get([]byte(fmt.Sprintf(commitInfoKeyFmt, legacy.Version)))
+	require.NoError(t, err)
+	require.NotEqual(t, byte(commitInfoLayoutMarker), bz[0])
+	bz, err = db.Get([]byte(fmt.Sprintf(commitInfoKeyFmt, compressed.Version)))
+	require.NoError(t, err)
+	require.Equal(t, []byte{commitInfoLayoutMarker, commitInfoLayoutSnappy}, bz[:2])
+
+	// both load, with the hash of the uncompressed commit info
+	for _, cid := range []types.CommitID{legacy, compressed} {
+		cInfo, err := getCommitInfo(db, cid.Version)
+		require.NoError(t, err)
+		require.Equal(t, cid, cInfo.CommitID())
+	}
+	cInfo, err := getCommitInfo(db, compressed.Version)
+	require.NoError(t, err)
+	require.Equal(t, multi.LastCommitInfo(), cInfo)
+
+	multi = newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, multi.LoadLatestVersion())
+	require.Equal(t, compressed, multi.LastCommitID())
+	require.Equal(t, testValue2, multi.GetStoreByName("store2").(types.KVStore).Get(testKey2))
+
+	// corrupt compressed values are reported
+	require.NoError(t, db.Set([]byte(fmt.Sprintf(commitInfoKeyFmt, compressed.Version)), append(bz[:2:2], 0xff, 0xff)))
+	_, err = getCommitInfo(db, compressed.Version)
+	require.Error(t, err)
+}
+
+func TestMetadataFlushInterval(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, multi.LoadLatestVersion())
+	multi.SetMetadataFlushInterval(3)
+	store1 := multi.GetStoreByName("store1").(types.KVStore)
+
+	// the metadata is only written every third commit
+	var cids []types.CommitID
+	for i := 0; i < 4; i++ {
+		store1.Set(testKey1, []byte{byte(i)})
+		cids = append(cids, multi.Commit(true))
+		expected := int64(0)
+		if i >= 2 {
+			expected = 3
+		}
+		require.Equal(t, expected, GetLatestVersion(db), "commit %d", i+1)
+	}
+	_, err := getCommitInfo(db, 4)
+	require.Error(t, err)
+
+	// batched commit infos are readable before the flush
+	res := multi.Query(abci.RequestQuery{Path: "/store1/key", Data: testKey1, Height: 4, Prove: true})
+	require.True(t, res.IsOK(), res.Log)
+	require.Equal(t, []byte{3}, res.Value)
+	cInfo, err := multi.commitInfoAt(4)
+	require.NoError(t, err)
+	require.Equal(t, cids[3], cInfo.CommitID())
+
+	// a crash loses the unflushed commits from the metadata
+	crashed := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, crashed.LoadLatestVersion())
+	require.Equal(t, cids[2], crashed.LastCommitID())
+
+	// closing forces a flush
+	require.NoError(t, multi.Close())
+	require.Equal(t, int64(4), GetLatestVersion(db))
+	cInfo, err = getCommitInfo(db, 4)
+	require.NoError(t, err)
+	require.Equal(t, cids[3], cInfo.CommitID())
+	reloaded := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, reloaded.LoadLatestVersion())
+	require.Equal(t, cids[3], reloaded.LastCommitID())
+
+	// as does FlushMetadata, and resetting the interval
+	reloaded.SetMetadataFlushInterval(2)
+	reloaded.GetStoreByName("store1").(types.KVStore).Set(testKey1, testValue1)
+	cid := reloaded.Commit(true)
+	require.Equal(t, int64(4), GetLatestVersion(db))
+	require.NoError(t, reloaded.FlushMetadata())
+	require.Equal(t, cid.Version, GetLatestVersion(db))
+	cid = reloaded.Commit(true)
+	reloaded.SetMetadataFlushInterval(1)
+	require.Equal(t, cid.Version, GetLatestVersion(db))
+	cid = reloaded.Commit(true)
+	require.Equal(t, cid.Version, GetLatestVersion(db))
+}
+
+// countingDB counts the bytes of the keys and values written through its
+// batches.
+type countingDB struct {
+	dbm.DB
+	written int
+}
+
+func (db *countingDB) NewBatch() dbm.Batch {
+	return &countingBatch{Batch: db.DB.NewBatch(), db: db}
+}
+
+type countingBatch struct {
+	dbm.Batch
+	db *countingDB
+}
+
+func (b *countingBatch) Set(key, value []byte) error {
+	b.db.written += len(key) + len(value)
+	return b.Batch.Set(key, value)
+}
+
+// BenchmarkFlushCommitInfo compares the bytes written per block by the
+// commit info layouts, for an app with many stores of which few change.
+func BenchmarkFlushCommitInfo(b *testing.B) {
+	const numStores, numChanged = 500, 5
+	for _, split := range []bool{false, true} {
+		b.Run(fmt.Sprintf("split=%t", split), func(b *testing.B) {
+			db := &countingDB{DB: dbm.NewMemDB()}
+			rs := NewStore(db, log.NewNopLogger())
+			rs.SetSplitCommitInfo(split)
+
+			cInfo := &types.CommitInfo{StoreInfos: make([]types.StoreInfo, numStores)}
+			for i := range cInfo.StoreInfos {
+				cInfo.StoreInfos[i].Name = fmt.Sprintf("store%03d", i)
+				cInfo.StoreInfos[i].CommitId.Hash = make([]byte, 32)
+			}
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				version := int64(n + 1)
+				next := &types.CommitInfo{Version: version, StoreInfos: make([]types.StoreInfo, numStores)}
+				for i, storeInfo := range cInfo.StoreInfos {
+					storeInfo.CommitId.Version = version
+					if i%(numStores/numChanged) == n%(numStores/numChanged) {
+						hash := append([]byte{}, storeInfo.CommitId.Hash...)
+						binary.BigEndian.PutUint64(hash, uint64(version))
+						storeInfo.CommitId.Hash = hash
+					}
+					next.StoreInfos[i] = storeInfo
+				}
+				cInfo = next
+				if err := rs.flushMetadata(db, version, cInfo); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(db.written)/float64(b.N), "written-bytes/op")
+		})
+	}
+}
+
+func TestGetCommitInfo(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	ms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+	cid1 := ms.Commit(true)
+	ms.GetKVStore(testStoreKey2).Set(testKey2, testValue2)
+	ms.Commit(true)
+
+	cInfo, err := ms.GetCommitInfo(2)
+	require.NoError(t, err)
+	require.Equal(t, ms.LastCommitInfo(), cInfo)
+
+	cInfo, err = ms.GetCommitInfo(1)
+	require.NoError(t, err)
+	require.Equal(t, cid1, cInfo.CommitID())
+	require.Len(t, cInfo.StoreInfos, 3)
+
+	_, err = ms.GetCommitInfo(3)
+	require.Error(t, err)
+}
+
+func TestCommitInfoCache(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.SetCommitInfoCacheSize(2)
+	for i := 0; i < 5; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		ms.Commit(true)
+	}
+
+	query := func(height int64) {
+		res := ms.Query(abci.RequestQuery{Path: "/store1/key", Data: testKey1, Height: height, Prove: true})
+		require.EqualValues(t, 0, res.Code, res.Log)
+		require.Equal(t, []byte{byte(height - 1)}, res.Value)
+	}
+	query(2)
+	query(3)
+	require.Equal(t, []int64{2, 3}, ms.commitInfoCache.Keys())
+	// the latest version is served from memory
+	query(5)
+	require.Equal(t, []int64{2, 3}, ms.commitInfoCache.Keys())
+	query(4)
+	require.Equal(t, []int64{3, 4}, ms.commitInfoCache.Keys())
+
+	ms.pruneHeights = []int64{3}
+	ms.PruneStores(true, nil)
+	require.Equal(t, []int64{4}, ms.commitInfoCache.Keys())
+}
+
+// BenchmarkQueryCommitInfoCache measures proven queries over past heights,
+// with and without the commit info cache.
+func BenchmarkQueryCommitInfoCache(b *testing.B) {
+	const numVersions = 100
+	for _, size := range []int{0, numVersions} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			ms := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+			require.NoError(b, ms.LoadLatestVersion())
+			ms.SetCommitInfoCacheSize(size)
+			for i := 0; i < numVersions; i++ {
+				ms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+				ms.Commit(true)
+			}
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				height := int64(n%(numVersions-1)) + 1
+				res := ms.Query(abci.RequestQuery{Path: "/store1/key", Data: testKey1, Height: height, Prove: true})
+				if res.Code != 0 {
+					b.Fatal(res.Log)
+				}
+			}
+		})
+	}
+}
+
+// panickingStore is a CommitKVStore whose Commit panics.
+type panickingStore struct {
+	types.CommitKVStore
+}
+
+func (panickingStore) Commit(bool) types.CommitID {
+	panic("commit failed")
+}
+
+func TestCommitParallelism(t *testing.T) {
+	newStore := func(parallelism int) *Store {
+		ms := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+		ms.MountStoreWithDB(types.NewKVStoreKey("store4"), types.StoreTypeIAVL, nil)
+		ms.MountStoreWithDB(types.NewTransientStoreKey("transient"), types.StoreTypeTransient, nil)
+		ms.SetCommitParallelism(parallelism)
+		require.NoError(t, ms.LoadLatestVersion())
+		return ms
+	}
+	serial, parallel := newStore(1), newStore(4)
+
+	for version := int64(1); version <= 5; version++ {
+		for _, ms := range []*Store{serial, parallel} {
+			for _, name := range []string{"store1", "store2", "store4"} {
+				store := ms.GetStoreByName(name).(types.KVStore)
+				for i := int64(0); i < version*10; i++ {
+					store.Set([]byte(fmt.Sprintf("%s/%d/%d", name, version, i)), []byte(fmt.Sprintf("value%d", i)))
+				}
+			}
+			ms.GetStoreByName("store3").(types.KVStore).Delete([]byte(fmt.Sprintf("store3/%d", version-1)))
+			ms.GetStoreByName("store3").(types.KVStore).Set([]byte(fmt.Sprintf("store3/%d", version)), testValue1)
+		}
+
+		serialID, parallelID := serial.Commit(true), parallel.Commit(true)
+		require.Equal(t, version, parallelID.Version)
+		require.Equal(t, serialID, parallelID)
+		require.Equal(t, serial.LastCommitInfo(), parallel.LastCommitInfo())
+	}
+
+	// a panic of a store committed on another goroutine reaches the caller
+	healthy := parallel.stores
+	parallel.stores = map[types.StoreKey]types.CommitKVStore{}
+	for key, store := range healthy {
+		parallel.stores[key] = panickingStore{CommitKVStore: store}
+	}
+	require.PanicsWithValue(t, "commit failed", func() { parallel.Commit(true) })
+}
+
+func TestCommitPanicRecovery(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	cid := ms.Commit(true)
+
+	key := ms.keysByName["store2"]
+	healthy := ms.stores[key]
+	ms.stores[key] = panickingStore{CommitKVStore: healthy}
+
+	// without a handler, the panic propagates
+	require.PanicsWithValue(t, "commit failed", func() { ms.Commit(true) })
+
+	// the handler receives the panic and the version, and can re-panic
+	var recovered []interface{}
+	var versions []int64
+	handled := false
+	ms.SetCommitPanicRecovery(func(r interface{}, version int64) bool {
+		recovered = append(recovered, r)
+		versions = append(versions, version)
+		return handled
+	})
+	require.PanicsWithValue(t, "commit failed", func() { ms.Commit(true) })
+	require.Equal(t, []interface{}{"commit failed"}, recovered)
+	require.Equal(t, []int64{cid.Version + 1}, versions)
+
+	// or swallow it, in which case no new version is recorded
+	handled = true
+	require.NotPanics(t, func() {
+		require.Equal(t, cid, ms.Commit(true))
+	})
+	require.Len(t, recovered, 2)
+	require.Equal(t, cid, ms.LastCommitID())
+	require.Equal(t, cid.Version, GetLatestVersion(db))
+
+	// CommitWithError reports the swallowed panic
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.stores[key] = panickingStore{CommitKVStore: ms.stores[key]}
+	got, err := ms.CommitWithError(true)
+	require.ErrorContains(t, err, "commit failed")
+	require.Equal(t, cid, got)
+	require.Len(t, recovered, 3)
+
+	// healthy commits are unaffected by the handler
+	ms.stores[key] = healthy
+	require.NoError(t, ms.LoadLatestVersion())
+	require.Equal(t, cid.Version+1, ms.Commit(true).Version)
+	require.Len(t, recovered, 3)
+}
+
+func TestCommitBarrier(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	// the barrier runs once the version has been flushed
+	var versions []int64
+	ms.SetCommitBarrier(func(version int64) error {
+		require.Equal(t, version, GetLatestVersion(db))
+		versions = append(versions, version)
+		return nil
+	})
+	ms.Commit(true)
+	ms.Commit(true)
+	require.Equal(t, []int64{1, 2}, versions)
+
+	// by default, failures are recorded but do not block the next commit
+	barrierErr := errors.New("indexer is behind")
+	ms.SetCommitBarrier(func(version int64) error { return barrierErr })
+	ms.Commit(true)
+	version, err := ms.CommitBarrierError()
+	require.Equal(t, int64(3), version)
+	require.ErrorIs(t, err, barrierErr)
+	require.Equal(t, int64(4), ms.Commit(true).Version)
+	version, err = ms.CommitBarrierError()
+	require.Equal(t, int64(4), version)
+	require.ErrorIs(t, err, barrierErr)
+
+	// a successful run clears the error
+	ms.SetCommitBarrier(func(int64) error { return nil })
+	ms.Commit(true)
+	_, err = ms.CommitBarrierError()
+	require.NoError(t, err)
+}
+
+func TestCommitBarrierBlock(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.SetCommitBarrierPolicy(CommitBarrierBlock)
+
+	var caughtUp atomic.Bool
+	var retries atomic.Int64
+	ms.SetCommitBarrier(func(version int64) error {
+		if version == 1 && !caughtUp.Load() {
+			retries.Add(1)
+			return errors.New("indexer is behind")
+		}
+		return nil
+	})
+	require.Equal(t, int64(1), ms.Commit(true).Version)
+
+	done := make(chan types.CommitID)
+	go func() {
+		done <- ms.Commit(true)
+	}()
+
+	// the next commit is blocked while the barrier keeps failing
+	require.Eventually(t, func() bool { return retries.Load() > 2 }, time.Second, 10*time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("commit was not blocked by the failed barrier")
+	default:
+	}
+	require.Equal(t, int64(1), GetLatestVersion(db))
+
+	// and released once it succeeds for the failed version
+	caughtUp.Store(true)
+	select {
+	case cid := <-done:
+		require.Equal(t, int64(2), cid.Version)
+	case <-time.After(time.Second):
+		t.Fatal("commit was not released by the barrier")
+	}
+	_, err := ms.CommitBarrierError()
+	require.NoError(t, err)
+}
+
+// droppingDB is a DB whose batches silently drop the first write of an IAVL node
+// once armed.
+type droppingDB struct {
+	dbm.DB
+	armed *atomic.Bool
+}
+
+func (db droppingDB) NewBatch() dbm.Batch {
+	return droppingBatch{Batch: db.DB.NewBatch(), armed: db.armed}
+}
+
+type droppingBatch struct {
+	dbm.Batch
+	armed *atomic.Bool
+}
+
+func (b droppingBatch) Set(key, value []byte) error {
+	if bytes.HasPrefix(key, []byte("s/_/n")) && b.armed.CompareAndSwap(true, false) {
+		return nil
+	}
+	return b.Batch.Set(key, value)
+}
+
+func TestCommitSpotCheck(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	droppingKey := types.NewKVStoreKey("dropping")
+	dropping := droppingDB{DB: dbm.NewMemDB(), armed: &atomic.Bool{}}
+	ms.MountStoreWithDB(droppingKey, types.StoreTypeIAVL, dropping)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.SetCommitSpotCheck(50)
+
+	// healthy commits pass, including empty stores
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 5; j++ {
+			key := []byte(fmt.Sprintf("key%d-%d", i, j))
+			ms.GetKVStore(testStoreKey1).Set(key, testValue1)
+			ms.GetKVStore(droppingKey).Set(key, testValue2)
+		}
+		require.NotPanics(t, func() { ms.Commit(true) })
+	}
+
+	// without the check, a node lost on its way to disk goes unnoticed
+	ms.SetCommitSpotCheck(0)
+	dropping.armed.Store(true)
+	ms.GetKVStore(droppingKey).Set([]byte("lost1"), testValue1)
+	require.NotPanics(t, func() { ms.Commit(true) })
+	require.False(t, dropping.armed.Load())
+
+	// with it, it is caught by the commit that wrote it
+	ms.SetCommitSpotCheck(50)
+	dropping.armed.Store(true)
+	ms.GetKVStore(droppingKey).Set([]byte("lost2"), testValue1)
+	cid, err := ms.CommitWithError(true)
+	require.ErrorContains(t, err, "commit spot check failed: failed to read store dropping at version 5")
+	require.Equal(t, int64(4), cid.Version)
+	require.Equal(t, int64(4), ms.LastCommitID().Version)
+
+	// Commit panics on it
+	require.NoError(t, ms.LoadLatestVersion())
+	dropping.armed.Store(true)
+	ms.GetKVStore(droppingKey).Set([]byte("lost3"), testValue1)
+	require.Panics(t, func() { ms.Commit(true) })
+}
+
+// failingMetadataDB is a DB whose batches writing the latest version fail to
+// be written while failing is set.
+type failingMetadataDB struct {
+	dbm.DB
+	failing *atomic.Bool
+}
+
+func (db failingMetadataDB) NewBatch() dbm.Batch {
+	return &failingMetadataBatch{Batch: db.DB.NewBatch(), failing: db.failing}
+}
+
+type failingMetadataBatch struct {
+	dbm.Batch
+	failing  *atomic.Bool
+	metadata bool
+}
+
+func (b *failingMetadataBatch) Set(key, value []byte) error {
+	if string(key) == latestVersionKey {
+		b.metadata = true
+	}
+	return b.Batch.Set(key, value)
+}
+
+func (b *failingMetadataBatch) Write() error {
+	if b.metadata && b.failing.Load() {
+		return errors.New("disk full")
+	}
+	return b.Batch.Write()
+}
+
+func (b *failingMetadataBatch) WriteSync() error {
+	if b.metadata && b.failing.Load() {
+		return errors.New("disk full")
+	}
+	return b.Batch.WriteSync()
+}
+
+func TestCommitWithErrorMetadataWriteFailure(t *testing.T) {
+	db := failingMetadataDB{DB: dbm.NewMemDB(), failing: &atomic.Bool{}}
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+	cid, err := ms.CommitWithError(true)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), cid.Version)
+
+	db.failing.Store(true)
+	ms.GetKVStore(testStoreKey1).Set(testKey2, testValue2)
+	_, err = ms.CommitWithError(true)
+	require.ErrorContains(t, err, "disk full")
+	require.Equal(t, int64(1), GetLatestVersion(db))
+
+	require.Panics(t, func() { ms.Commit(true) })
+	require.ErrorContains(t, ms.RollbackToVersion(1), "disk full")
+
+	// once the disk recovers, the metadata is written again
+	db.failing.Store(false)
+	require.NoError(t, ms.RollbackToVersion(1))
+	require.Equal(t, int64(1), GetLatestVersion(db))
+}
+
+func TestFlushMetadataWriteFailure(t *testing.T) {
+	db := failingMetadataDB{DB: dbm.NewMemDB(), failing: &atomic.Bool{}}
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	ms.SetSplitCommitInfo(true)
+	ms.SetMetadataFlushInterval(2)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	expected := map[int64]*types.CommitInfo{}
+	commit := func(i int) error {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		cid, err := ms.CommitWithError(true)
+		expected[cid.Version] = ms.LastCommitInfo()
+		return err
+	}
+	require.NoError(t, commit(1))
+	db.failing.Store(true)
+	require.ErrorContains(t, commit(2), "disk full")
+	require.ErrorContains(t, ms.FlushMetadata(), "disk full")
+	require.Zero(t, GetLatestVersion(db))
+
+	// the batched metadata is kept, and written once the disk recovers
+	for version := int64(1); version <= 2; version++ {
+		cInfo, ok := ms.pendingCommitInfo(version)
+		require.True(t, ok)
+		require.Equal(t, expected[version], cInfo)
+	}
+	db.failing.Store(false)
+	require.NoError(t, ms.FlushMetadata())
+	require.Equal(t, int64(2), GetLatestVersion(db))
+
+	// later split commit infos build on the flushed ones
+	require.NoError(t, commit(3))
+	require.NoError(t, commit(4))
+	for version, cInfo := range expected {
+		stored, err := getCommitInfo(db, version)
+		require.NoError(t, err)
+		require.Equal(t, cInfo, stored)
+	}
+}
+
+func TestGetVersions(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(2, 3, 1))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	versions, err := ms.GetVersions()
+	require.NoError(t, err)
+	require.Empty(t, versions)
+	require.NotNil(t, versions)
+
+	for i := 0; i < 10; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		ms.Commit(true)
+	}
+	versions, err = ms.GetVersions()
+	require.NoError(t, err)
+	require.Equal(t, []int64{3, 6, 8, 9, 10}, versions)
+
+	// pruned versions read as empty stores
+	for v := int64(1); v <= 10; v++ {
+		cms, err := ms.CacheMultiStoreWithVersion(v)
+		require.NoError(t, err)
+		value := cms.GetKVStore(testStoreKey1).Get(testKey1)
+		require.Equal(t, containsVersion(versions, v), bytes.Equal(value, []byte{byte(v - 1)}), "version %d", v)
+	}
+
+	// a version missing from a single store is not available
+	require.NoError(t, ms.GetCommitKVStore(testStoreKey2).(*iavl.Store).DeleteVersions(3))
+	versions, err = ms.GetVersions()
+	require.NoError(t, err)
+	require.Equal(t, []int64{6, 8, 9, 10}, versions)
+
+	// a commit info that cannot be read fails the call
+	require.NoError(t, db.Set([]byte(fmt.Sprintf(commitInfoKeyFmt, 5)), []byte("corrupt")))
+	_, err = ms.GetVersions()
+	require.ErrorContains(t, err, "failed to read commit info at version 5")
+}
+
+func TestGetVersionsAfterStoreUpgrade(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	for i := 0; i < 3; i++ {
+		ms.Commit(true)
+	}
+
+	// a store added by an upgrade only has the versions since the upgrade
+	ms = newMultiStoreWithMounts(db, types.PruneNothing)
+	key4 := types.NewKVStoreKey("store4")
+	ms.MountStoreWithDB(key4, types.StoreTypeIAVL, nil)
+	require.NoError(t, ms.LoadLatestVersionAndUpgrade(&types.StoreUpgrades{Added: []string{"store4"}}))
+	for i := 0; i < 2; i++ {
+		ms.GetKVStore(key4).Set(testKey1, []byte{byte(i)})
+		ms.Commit(true)
+	}
+	require.Equal(t, []int{4, 5}, ms.GetCommitKVStore(key4).(*iavl.Store).GetAllVersions())
+
+	versions, err := ms.GetVersions()
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2, 3, 4, 5}, versions)
+
+	cms, version, err := ms.CacheMultiStoreAtOrBefore(2)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	require.Nil(t, cms.GetKVStore(key4).Get(testKey1))
+}
+
+func TestCacheMultiStoreAtOrBefore(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(2, 3, 1))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	_, _, err := ms.CacheMultiStoreAtOrBefore(1)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidHeight)
+
+	for i := 0; i < 10; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		ms.Commit(true)
+	}
+	// the versions are [3 6 8 9 10], see TestGetVersions
+	for requested, expected := range map[int64]int64{3: 3, 4: 3, 5: 3, 6: 6, 7: 6, 8: 8, 10: 10, 12: 10} {
+		cms, version, err := ms.CacheMultiStoreAtOrBefore(requested)
+		require.NoError(t, err)
+		require.Equal(t, expected, version, "version %d", requested)
+		require.Equal(t, []byte{byte(expected - 1)}, cms.GetKVStore(testStoreKey1).Get(testKey1), "version %d", requested)
+	}
+
+	_, _, err = ms.CacheMultiStoreAtOrBefore(2)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidHeight)
+	require.ErrorContains(t, err, "no version at or before 2 is available")
+}
+
+func containsVersion(versions []int64, version int64) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// recordingCommitHook records the calls it gets, failing the pre-commit of
+// failVersion.
+type recordingCommitHook struct {
+	name        string
+	calls       *[]string
+	failVersion int64
+}
+
+func (h recordingCommitHook) PreCommit(version int64) error {
+	*h.calls = append(*h.calls, fmt.Sprintf("%s pre %d", h.name, version))
+	if version == h.failVersion {
+		return errors.New("wal unavailable")
+	}
+	return nil
+}
+
+func (h recordingCommitHook) PostCommit(cid types.CommitID) error {
+	*h.calls = append(*h.calls, fmt.Sprintf("%s post %d %X", h.name, cid.Version, cid.Hash))
+	return errors.New("metrics unavailable")
+}
+
+func TestRegisterCommitHook(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	var calls []string
+	ms.RegisterCommitHook(recordingCommitHook{name: "first", calls: &calls})
+	ms.RegisterCommitHook(recordingCommitHook{name: "second", calls: &calls, failVersion: 2})
+
+	// post-commit errors do not fail the commit
+	ms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+	cid, err := ms.CommitWithError(true)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"first pre 1",
+		"second pre 1",
+		fmt.Sprintf("first post 1 %X", cid.Hash),
+		fmt.Sprintf("second post 1 %X", cid.Hash),
+	}, calls)
+	require.Equal(t, int64(1), GetLatestVersion(db))
+
+	// a failing pre-commit aborts the commit
+	calls = nil
+	ms.GetKVStore(testStoreKey1).Set(testKey2, testValue2)
+	_, err = ms.CommitWithError(true)
+	require.ErrorContains(t, err, "pre-commit hook failed for version 2: wal unavailable")
+	require.Equal(t, []string{"first pre 2", "second pre 2"}, calls)
+	require.Equal(t, cid, ms.LastCommitID())
+	require.Equal(t, int64(1), GetLatestVersion(db))
+	require.Panics(t, func() { ms.Commit(true) })
+}
+
+func TestRollbackToVersionDryRun(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	for i := 0; i < 5; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		ms.Commit(true)
+	}
+	require.NoError(t, ms.GetCommitKVStore(testStoreKey3).(*iavl.Store).DeleteVersions(2))
+	lastCommitInfo := ms.LastCommitInfo()
+
+	plan, err := ms.RollbackToVersionDryRun(3)
+	require.NoError(t, err)
+	require.Equal(t, RollbackPlan{
+		Target: 3,
+		Stores: []RollbackStorePlan{
+			{Name: "store1", CurrentVersion: 5, DeletedVersions: 2, TargetExists: true},
+			{Name: "store2", CurrentVersion: 5, DeletedVersions: 2, TargetExists: true},
+			{Name: "store3", CurrentVersion: 5, DeletedVersions: 2, TargetExists: true},
+		},
+	}, plan)
+
+	// stores without the target are reported
+	plan, err = ms.RollbackToVersionDryRun(2)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidHeight)
+	require.Contains(t, err.Error(), "version 2 does not exist in stores: store3")
+	require.Len(t, plan.Stores, 3)
+	require.True(t, plan.Stores[0].TargetExists)
+	require.False(t, plan.Stores[2].TargetExists)
+	require.Equal(t, 3, plan.Stores[2].DeletedVersions)
+
+	_, err = ms.RollbackToVersionDryRun(0)
+	require.Error(t, err)
+
+	// nothing was touched
+	require.Equal(t, lastCommitInfo, ms.LastCommitInfo())
+	require.Equal(t, int64(5), GetLatestVersion(db))
+	require.Equal(t, []byte{4}, ms.GetKVStore(testStoreKey1).Get(testKey1))
+	for _, key := range []types.StoreKey{testStoreKey1, testStoreKey2, testStoreKey3} {
+		require.True(t, ms.GetCommitKVStore(key).(*iavl.Store).VersionExists(5))
+	}
+
+	// the rollback does what the plan says
+	require.NoError(t, ms.RollbackToVersion(3))
+	require.Equal(t, int64(3), GetLatestVersion(db))
+	for _, key := range []types.StoreKey{testStoreKey1, testStoreKey2, testStoreKey3} {
+		store := ms.GetCommitKVStore(key).(*iavl.Store)
+		require.Equal(t, int64(3), store.LastCommitID().Version)
+		require.False(t, store.VersionExists(4))
+	}
+}
+
+func TestRollbackToVersionPreflight(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	for i := 0; i < 5; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		ms.Commit(true)
+	}
+	// store3 is behind the other stores
+	_, err := ms.GetCommitKVStore(testStoreKey3).(*iavl.Store).LoadVersionForOverwriting(3)
+	require.NoError(t, err)
+
+	err = ms.RollbackToVersion(4)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidHeight)
+	require.ErrorContains(t, err, "version 4 does not exist in stores: store3")
+
+	// no store was rolled back
+	require.Equal(t, int64(5), GetLatestVersion(db))
+	for _, key := range []types.StoreKey{testStoreKey1, testStoreKey2} {
+		store := ms.GetCommitKVStore(key).(*iavl.Store)
+		require.Equal(t, int64(5), store.LastCommitID().Version)
+		require.True(t, store.VersionExists(5))
+	}
+	require.Equal(t, int64(3), ms.GetCommitKVStore(testStoreKey3).(*iavl.Store).LastCommitID().Version)
+
+	// a target every store has succeeds
+	require.NoError(t, ms.RollbackToVersion(3))
+	require.Equal(t, int64(3), GetLatestVersion(db))
+	require.Equal(t, []byte{2}, ms.GetKVStore(testStoreKey1).Get(testKey1))
+}
+
+// dumpableCache is an inter-block cache whose entries can be dumped and loaded.
+type dumpableCache struct {
+	entries map[string]string
+}
+
+func (c *dumpableCache) GetStoreCache(_ types.StoreKey, store types.CommitKVStore) types.CommitKVStore {
+	return store
+}
+
+func (c *dumpableCache) Unwrap(types.StoreKey) types.CommitKVStore { return nil }
+
+func (c *dumpableCache) Reset() { c.entries = map[string]string{} }
+
+func (c *dumpableCache) Dump(w io.Writer) error {
+	return json.NewEncoder(w).Encode(c.entries)
+}
+
+func (c *dumpableCache) Load(r io.Reader) error {
+	return json.NewDecoder(r).Decode(&c.entries)
+}
+
+// plainCache is an inter-block cache that cannot be dumped.
+type plainCache struct{}
+
+func (plainCache) GetStoreCache(_ types.StoreKey, store types.CommitKVStore) types.CommitKVStore {
+	return store
+}
+
+func (plainCache) Unwrap(types.StoreKey) types.CommitKVStore { return nil }
+
+func (plainCache) Reset() {}
+
+func TestDumpInterBlockCache(t *testing.T) {
+	ms := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	cache := &dumpableCache{entries: map[string]string{"store1/a": "1", "store2/b": "2"}}
+	ms.SetInterBlockCache(cache)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, ms.DumpInterBlockCache(buf))
+
+	// the contents are restored into the cache of a restarted store
+	restarted := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	restartedCache := &dumpableCache{}
+	restarted.SetInterBlockCache(restartedCache)
+	require.NoError(t, restarted.LoadLatestVersion())
+	require.NoError(t, restarted.LoadInterBlockCache(buf))
+	require.Equal(t, cache.entries, restartedCache.entries)
+
+	// load errors of the cache are reported
+	require.Error(t, restarted.LoadInterBlockCache(strings.NewReader("not json")))
+
+	// caches that cannot be dumped, or no cache, are unsupported
+	ms.SetInterBlockCache(plainCache{})
+	err := ms.DumpInterBlockCache(buf)
+	require.ErrorIs(t, err, sdkerrors.ErrNotSupported)
+	require.ErrorIs(t, ms.LoadInterBlockCache(buf), sdkerrors.ErrNotSupported)
+	ms.SetInterBlockCache(nil)
+	require.ErrorIs(t, ms.DumpInterBlockCache(buf), sdkerrors.ErrInvalidRequest)
+}
+
+// statsCache is an inter-block cache which records the lookups of the stores it
+// wraps, counting a lookup of a key already looked up as a hit.
+type statsCache struct {
+	seen   map[string]bool
+	hits   uint64
+	misses uint64
+}
+
+func (c *statsCache) GetStoreCache(key types.StoreKey, store types.CommitKVStore) types.CommitKVStore {
+	return statsCacheStore{CommitKVStore: store, name: key.Name(), cache: c}
+}
+
+func (c *statsCache) Unwrap(types.StoreKey) types.CommitKVStore { return nil }
+
+func (c *statsCache) Reset() {}
+
+func (c *statsCache) Stats() (hits, misses uint64) { return c.hits, c.misses }
+
+type statsCacheStore struct {
+	types.CommitKVStore
+	name  string
+	cache *statsCache
+}
+
+func (s statsCacheStore) Get(key []byte) []byte {
+	if k := s.name + "/" + string(key); s.cache.seen[k] {
+		s.cache.hits++
+	} else {
+		s.cache.seen[k] = true
+		s.cache.misses++
+	}
+	return s.CommitKVStore.Get(key)
+}
+
+func TestInterBlockCacheMetrics(t *testing.T) {
+	ms := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	_, _, err := ms.InterBlockCacheMetrics()
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidRequest)
+
+	cache := &statsCache{seen: map[string]bool{}}
+	ms.SetInterBlockCache(cache)
+	require.NoError(t, ms.LoadLatestVersion())
+	hits, misses, err := ms.InterBlockCacheMetrics()
+	require.NoError(t, err)
+	require.Zero(t, hits)
+	require.Zero(t, misses)
+
+	ms.GetKVStore(testStoreKey1).Get(testKey1)
+	ms.GetKVStore(testStoreKey1).Get(testKey1)
+	ms.GetKVStore(testStoreKey2).Get(testKey1)
+	ms.Commit(true)
+	hits, misses, err = ms.InterBlockCacheMetrics()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), hits)
+	require.Equal(t, uint64(2), misses)
+
+	// caches that do not count lookups are unsupported
+	ms.SetInterBlockCache(plainCache{})
+	_, _, err = ms.InterBlockCacheMetrics()
+	require.ErrorIs(t, err, sdkerrors.ErrNotSupported)
+}
+
+func TestCommitHashVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.Equal(t, uint32(1), ms.CommitHashVersion())
+
+	// the version does not depend on the state
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+	ms.Commit(true)
+	require.Equal(t, uint32(1), ms.CommitHashVersion())
+	require.Equal(t, ms.CommitHashVersion(), NewStore(dbm.NewMemDB(), log.NewNopLogger()).CommitHashVersion())
+
+	// a custom hasher reports its own version and computes the app hash
+	ms.SetCommitHasher(sha256CommitHasher{})
+	require.Equal(t, uint32(2), ms.CommitHashVersion())
+	ms.GetKVStore(testStoreKey1).Set(testKey2, testValue2)
+	workingHash, err := ms.GetWorkingHash()
+	require.NoError(t, err)
+	cid := ms.Commit(true)
+	expected := sha256CommitHasher{}.Hash(ms.LastCommitInfo())
+	require.Equal(t, expected, cid.Hash)
+	require.Equal(t, expected, workingHash)
+	require.Equal(t, expected, ms.LastCommitID().Hash)
+	require.NotEqual(t, ms.LastCommitInfo().Hash(), cid.Hash)
+
+	ms.SetCommitHasher(nil)
+	require.Equal(t, uint32(1), ms.CommitHashVersion())
+	require.Equal(t, ms.LastCommitInfo().Hash(), ms.LastCommitID().Hash)
+}
+
+// sha256CommitHasher hashes the store hashes of a commit info, concatenated in
+// store name order.
+type sha256CommitHasher struct{}
+
+func (sha256CommitHasher) Hash(cInfo *types.CommitInfo) []byte {
+	storeInfos := append([]types.StoreInfo(nil), cInfo.StoreInfos...)
+	sort.Slice(storeInfos, func(i, j int) bool { return storeInfos[i].Name < storeInfos[j].Name })
+	h := sha256.New()
+	for _, storeInfo := range storeInfos {
+		h.Write(storeInfo.CommitId.Hash)
+	}
+	return h.Sum(nil)
+}
+
+func (sha256CommitHasher) Version() uint32 {
+	return 2
+}
+
+func TestCommitNonMonotonicVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	for i := 0; i < 3; i++ {
+		ms.GetStoreByName("store1").(types.KVStore).Set(testKey1, []byte(fmt.Sprint(i)))
+		ms.Commit(true)
+	}
+
+	commitPanic := func(ms *Store) (msg string) {
+		defer func() { msg = fmt.Sprint(recover()) }()
+		ms.Commit(true)
+		return ""
+	}
+
+	// the latest version metadata is moved back behind the store data
+	batch := db.NewBatch()
+	flushLatestVersion(batch, 1)
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+
+	ms = newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	require.Equal(t, int64(1), ms.LastCommitID().Version)
+	require.Contains(t, commitPanic(ms), "non-monotonic version: cannot commit version 2")
+	require.Equal(t, int64(1), GetLatestVersion(db))
+
+	// stores past the version being committed are detected as well
+	ms = newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadVersion(3))
+	ms.SetLastCommitInfo(&types.CommitInfo{Version: 1})
+	require.Contains(t, commitPanic(ms), "is at version 3")
+}
+
+func TestCommitReplaysUnrecordedVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.Commit(true)
+
+	// the stores commit version 2, but the node crashes before the metadata is
+	// written
+	ms.GetStoreByName("store1").(types.KVStore).Set(testKey1, testValue1)
+	crashed := map[string]types.CommitID{}
+	for _, key := range keysForStoreKeyMap(ms.stores) {
+		crashed[key.Name()] = ms.GetCommitKVStore(key).Commit(true)
+	}
+	require.Equal(t, int64(1), GetLatestVersion(db))
+
+	// replaying the block after a restart commits the same version again
+	ms = newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.GetStoreByName("store1").(types.KVStore).Set(testKey1, testValue1)
+	require.NotPanics(t, func() { ms.Commit(true) })
+	require.Equal(t, int64(2), GetLatestVersion(db))
+	for _, storeInfo := range ms.LastCommitInfo().StoreInfos {
+		require.Equal(t, crashed[storeInfo.Name], storeInfo.CommitId, storeInfo.Name)
+	}
+}
+
+func TestContinueOnStoreLoadError(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.GetStoreByName("store1").(types.KVStore).Set(testKey1, testValue1)
+	ms.GetStoreByName("store2").(types.KVStore).Set(testKey2, testValue2)
+	ms.Commit(true)
+
+	// wipe the data of store2, so its committed version cannot be loaded
+	prefixDB := dbm.NewPrefixDB(db, []byte("s/k:store2/"))
+	it, err := prefixDB.Iterator(nil, nil)
+	require.NoError(t, err)
+	var keys [][]byte
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	require.NoError(t, it.Close())
+	require.NotEmpty(t, keys)
+	for _, key := range keys {
+		require.NoError(t, prefixDB.Delete(key))
+	}
+
+	// strict mode fails the whole load
+	ms = newMultiStoreWithMounts(db, types.PruneNothing)
+	require.Error(t, ms.LoadLatestVersion())
+	require.Empty(t, ms.FailedStores())
+
+	// lenient mode loads the healthy stores
+	ms = newMultiStoreWithMounts(db, types.PruneNothing)
+	ms.SetContinueOnStoreLoadError(true)
+	require.NoError(t, ms.LoadLatestVersion())
+	failed := ms.FailedStores()
+	require.Len(t, failed, 1)
+	require.Error(t, failed["store2"])
+
+	require.Equal(t, testValue1, ms.GetKVStore(testStoreKey1).Get(testKey1))
+	res := ms.Query(abci.RequestQuery{Path: "/store1/key", Data: testKey1})
+	require.Zero(t, res.Code, res.Log)
+	require.Equal(t, testValue1, res.Value)
+
+	// the failed store is unavailable
+	res = ms.Query(abci.RequestQuery{Path: "/store2/key", Data: testKey2})
+	require.NotZero(t, res.Code)
+	require.Contains(t, res.Log, "store store2 is unavailable, it failed to load")
+	require.PanicsWithValue(t, fmt.Sprintf("store store2 is unavailable, it failed to load: %v", failed["store2"]), func() {
+		ms.GetKVStore(testStoreKey2)
+	})
+	_, err = ms.GetKVStoreSafe(testStoreKey2)
+	require.ErrorIs(t, err, sdkerrors.ErrNotFound)
+	require.ErrorContains(t, err, "store store2 is unavailable, it failed to load")
+
+	// committing without the failed store is refused
+	_, err = ms.CommitWithError(true)
+	require.ErrorIs(t, err, sdkerrors.ErrNotFound)
+	require.ErrorContains(t, err, "stores failed to load: store2")
+	require.Panics(t, func() { ms.Commit(true) })
+}
+
+func TestNewMemStore(t *testing.T) {
+	ms := NewMemStore(log.NewNopLogger())
+	ms.MountStoreWithDB(testStoreKey1, types.StoreTypeIAVL, nil)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+	cid := ms.Commit(true)
+	require.Equal(t, int64(1), cid.Version)
+
+	// the state survives reloading until the store is closed
+	require.NoError(t, ms.LoadLatestVersion())
+	require.Equal(t, cid, ms.LastCommitID())
+	require.Equal(t, testValue1, ms.GetKVStore(testStoreKey1).Get(testKey1))
+
+	require.NoError(t, ms.Close())
+	err := ms.LoadLatestVersion()
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidRequest)
+	require.ErrorContains(t, err, "store is closed")
+	require.ErrorContains(t, ms.LoadVersion(1), "store is closed")
+	require.ErrorContains(t, ms.LoadLatestVersionAndUpgrade(nil), "store is closed")
+	require.ErrorContains(t, ms.Close(), "store is closed")
+}
+
+// closingDB records that it was closed, failing with err if set.
+type closingDB struct {
+	dbm.DB
+	closed int
+	err    error
+}
+
+func (db *closingDB) Close() error {
+	db.closed++
+	if db.err != nil {
+		return db.err
+	}
+	return db.DB.Close()
+}
+
+// closingStore records that it was closed.
+type closingStore struct {
+	types.CommitKVStore
+	closed int
+}
+
+func (s *closingStore) Close() error {
+	s.closed++
+	return nil
+}
+
+// closingCache is an inter-block cache wrapping the stores in closingStores,
+// and recording that it was closed.
+type closingCache struct {
+	plainCache
+	stores []*closingStore
+	closed int
+}
+
+func (c *closingCache) GetStoreCache(_ types.StoreKey, store types.CommitKVStore) types.CommitKVStore {
+	wrapped := &closingStore{CommitKVStore: store}
+	c.stores = append(c.stores, wrapped)
+	return wrapped
+}
+
+func (c *closingCache) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestCloseClosesStoresAndArchivalDBs(t *testing.T) {
+	db := &closingDB{DB: dbm.NewMemDB()}
+	archivalDb := &closingDB{DB: dbm.NewMemDB()}
+	storeArchivalDb := &closingDB{DB: dbm.NewMemDB(), err: errors.New("disk failure")}
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	// the archival DBs don't hold the loaded version, so that the stores are IAVL
+	ms.AddArchivalSegment(10, 19, archivalDb)
+	ms.AddArchivalSegment(30, 39, archivalDb)
+	ms.SetStoreArchivalDB(testStoreKey2, storeArchivalDb, 0)
+	cache := &closingCache{}
+	ms.SetInterBlockCache(cache)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.Commit(true)
+	require.Len(t, cache.stores, 3)
+
+	// every resource is closed once, even though one of them fails
+	err := ms.Close()
+	require.ErrorContains(t, err, "disk failure")
+	require.ErrorContains(t, err, "failed to close archival DB")
+	require.Equal(t, 1, db.closed)
+	require.Equal(t, 1, archivalDb.closed)
+	require.Equal(t, 1, storeArchivalDb.closed)
+	require.Equal(t, 1, cache.closed)
+	for _, store := range cache.stores {
+		require.Equal(t, 1, store.closed)
+	}
+}
+
+func TestMultistoreCommitLoad(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	err := store.LoadLatestVersion()
+	require.Nil(t, err)
+
+	// New store has empty last commit.
+	commitID := types.CommitID{}
+	checkStore(t, store, commitID, commitID)
+
+	// Make sure we can get stores by name.
+	s1 := store.GetStoreByName("store1")
+	require.NotNil(t, s1)
+	s3 := store.GetStoreByName("store3")
+	require.NotNil(t, s3)
+	s77 := store.GetStoreByName("store77")
+	require.Nil(t, s77)
+
+	// Make a few commits and check them.
+	nCommits := int64(3)
+	for i := int64(0); i < nCommits; i++ {
+		commitID = store.Commit(true)
+		expectedCommitID := getExpectedCommitID(store, i+1)
+		checkStore(t, store, expectedCommitID, commitID)
+	}
+
+	// Load the latest multistore again and check version.
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	err = store.LoadLatestVersion()
+	require.Nil(t, err)
+	commitID = getExpectedCommitID(store, nCommits)
+	checkStore(t, store, commitID, commitID)
+
+	// Commit and check version.
+	commitID = store.Commit(true)
+	expectedCommitID := getExpectedCommitID(store, nCommits+1)
+	checkStore(t, store, expectedCommitID, commitID)
+
+	// Load an older multistore and check version.
+	ver := nCommits - 1
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	err = store.LoadVersion(ver)
+	require.Nil(t, err)
+	commitID = getExpectedCommitID(store, ver)
+	checkStore(t, store, commitID, commitID)
+}
+
+func TestMultistoreLoadWithUpgrade(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	err := store.LoadLatestVersion()
+	require.Nil(t, err)
+
+	// write some data in all stores
+	k1, v1 := []byte("first"), []byte("store")
+	s1, _ := store.GetStoreByName("store1").(types.KVStore)
+	require.NotNil(t, s1)
+	s1.Set(k1, v1)
+
+	k2, v2 := []byte("second"), []byte("restore")
+	s2, _ := store.GetStoreByName("store2").(types.KVStore)
+	require.NotNil(t, s2)
+	s2.Set(k2, v2)
+
+	k3, v3 := []byte("third"), []byte("dropped")
+	s3, _ := store.GetStoreByName("store3").(types.KVStore)
+	require.NotNil(t, s3)
+	s3.Set(k3, v3)
+
+	s4, _ := store.GetStoreByName("store4").(types.KVStore)
+	require.Nil(t, s4)
+
+	// do one commit
+	commitID := store.Commit(true)
+	expectedCommitID := getExpectedCommitID(store, 1)
+	checkStore(t, store, expectedCommitID, commitID)
+
+	ci, err := getCommitInfo(db, 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), ci.Version)
+	require.Equal(t, 3, len(ci.StoreInfos))
+	checkContains(t, ci.StoreInfos, []string{"store1", "store2", "store3"})
+
+	// Load without changes and make sure it is sensible
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+
+	err = store.LoadLatestVersion()
+	require.Nil(t, err)
+	commitID = getExpectedCommitID(store, 1)
+	checkStore(t, store, commitID, commitID)
+
+	// let's query data to see it was saved properly
+	s2, _ = store.GetStoreByName("store2").(types.KVStore)
+	require.NotNil(t, s2)
+	require.Equal(t, v2, s2.Get(k2))
+
+	// now, let's load with upgrades...
+	restore, upgrades := newMultiStoreWithModifiedMounts(db, types.PruneNothing)
+	err = restore.LoadLatestVersionAndUpgrade(upgrades)
+	require.Nil(t, err)
+
+	// s1 was not changed
+	s1, _ = restore.GetStoreByName("store1").(types.KVStore)
+	require.NotNil(t, s1)
+	require.Equal(t, v1, s1.Get(k1))
+
+	// store3 is mounted, but data deleted are gone
+	s3, _ = restore.GetStoreByName("store3").(types.KVStore)
+	require.NotNil(t, s3)
+	require.Nil(t, s3.Get(k3)) // data was deleted
+
+	// store4 is mounted, with empty data
+	s4, _ = restore.GetStoreByName("store4").(types.KVStore)
+	require.NotNil(t, s4)
+
+	iterator := s4.Iterator(nil, nil)
+
+	values := 0
+	for ; iterator.Valid(); iterator.Next() {
+		values += 1
+	}
+	require.Zero(t, values)
+
+	require.NoError(t, iterator.Close())
+
+	// write something inside store4
+	k4, v4 := []byte("fourth"), []byte("created")
+	s4.Set(k4, v4)
+
+	// store2 is no longer mounted
+	st2 := restore.GetStoreByName("store2")
+	require.Nil(t, st2)
+
+	// restore2 has the old data
+	rs2, _ := restore.GetStoreByName("restore2").(types.KVStore)
+	require.NotNil(t, rs2)
+	require.Equal(t, v2, rs2.Get(k2))
+
+	// store this migrated data, and load it again without migrations
+	migratedID := restore.Commit(true)
+	require.Equal(t, migratedID.Version, int64(2))
+
+	reload, _ := newMultiStoreWithModifiedMounts(db, types.PruneNothing)
+	err = reload.LoadLatestVersion()
+	require.Nil(t, err)
+	require.Equal(t, migratedID, reload.LastCommitID())
+
+	// query this new store
+	rl1, _ := reload.GetStoreByName("store1").(types.KVStore)
+	require.NotNil(t, rl1)
+	require.Equal(t, v1, rl1.Get(k1))
+
+	rl2, _ := reload.GetStoreByName("restore2").(types.KVStore)
+	require.NotNil(t, rl2)
+	require.Equal(t, v2, rl2.Get(k2))
+
+	rl4, _ := reload.GetStoreByName("store4").(types.KVStore)
+	require.NotNil(t, rl4)
 	require.Equal(t, v4, rl4.Get(k4))
 
-	// check commitInfo in storage
-	ci, err = getCommitInfo(db, 2)
+	// check commitInfo in storage
+	ci, err = getCommitInfo(db, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), ci.Version)
+	require.Equal(t, 4, len(ci.StoreInfos), ci.StoreInfos)
+	checkContains(t, ci.StoreInfos, []string{"store1", "restore2", "store3", "store4"})
+}
+
+func TestStoreLifecycleHandler(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	var events []string
+	handler := func(name string, event string) {
+		events = append(events, name+":"+event)
+	}
+
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	store.SetStoreLifecycleHandler(handler)
+	require.NoError(t, store.LoadLatestVersion())
+	require.ElementsMatch(t, []string{"store1:loaded", "store2:loaded", "store3:loaded"}, events)
+	store.Commit(true)
+
+	events = nil
+	require.NoError(t, store.LoadLatestVersion())
+	require.ElementsMatch(t, []string{"store1:reloaded", "store2:reloaded", "store3:reloaded"}, events)
+
+	// upgrades are applied in sorted store name order
+	events = nil
+	restore, upgrades := newMultiStoreWithModifiedMounts(db, types.PruneNothing)
+	restore.SetStoreLifecycleHandler(handler)
+	require.NoError(t, restore.LoadLatestVersionAndUpgrade(upgrades))
+	require.Equal(t, []string{
+		"restore2:loaded", "restore2:upgraded-rename",
+		"store1:loaded",
+		"store3:loaded", "store3:deleted",
+		"store4:loaded", "store4:upgraded-add",
+	}, events)
+}
+
+func TestParsePath(t *testing.T) {
+	_, _, err := parsePath("foo")
+	require.Error(t, err)
+
+	store, subpath, err := parsePath("/foo")
+	require.NoError(t, err)
+	require.Equal(t, store, "foo")
+	require.Equal(t, subpath, "")
+
+	store, subpath, err = parsePath("/fizz/bang/baz")
+	require.NoError(t, err)
+	require.Equal(t, store, "fizz")
+	require.Equal(t, subpath, "/bang/baz")
+
+	substore, subsubpath, err := parsePath(subpath)
+	require.NoError(t, err)
+	require.Equal(t, substore, "bang")
+	require.Equal(t, subsubpath, "/baz")
+
+}
+
+func TestMultiStoreRestart(t *testing.T) {
+	db := dbm.NewMemDB()
+	pruning := types.PruningOptions{
+		KeepRecent: 2,
+		KeepEvery:  3,
+		Interval:   1,
+	}
+	multi := newMultiStoreWithMounts(db, pruning)
+	err := multi.LoadLatestVersion()
+	require.Nil(t, err)
+
+	initCid := multi.LastCommitID()
+
+	k, v := "wind", "blows"
+	k2, v2 := "water", "flows"
+	k3, v3 := "fire", "burns"
+
+	for i := 1; i < 3; i++ {
+		// Set and commit data in one store.
+		store1 := multi.GetStoreByName("store1").(types.KVStore)
+		store1.Set([]byte(k), []byte(fmt.Sprintf("%s:%d", v, i)))
+
+		// ... and another.
+		store2 := multi.GetStoreByName("store2").(types.KVStore)
+		store2.Set([]byte(k2), []byte(fmt.Sprintf("%s:%d", v2, i)))
+
+		// ... and another.
+		store3 := multi.GetStoreByName("store3").(types.KVStore)
+		store3.Set([]byte(k3), []byte(fmt.Sprintf("%s:%d", v3, i)))
+
+		multi.Commit(true)
+
+		cinfo, err := getCommitInfo(multi.db, int64(i))
+		require.NoError(t, err)
+		require.Equal(t, int64(i), cinfo.Version)
+	}
+
+	// Set and commit data in one store.
+	store1 := multi.GetStoreByName("store1").(types.KVStore)
+	store1.Set([]byte(k), []byte(fmt.Sprintf("%s:%d", v, 3)))
+
+	// ... and another.
+	store2 := multi.GetStoreByName("store2").(types.KVStore)
+	store2.Set([]byte(k2), []byte(fmt.Sprintf("%s:%d", v2, 3)))
+
+	multi.Commit(true)
+
+	flushedCinfo, err := getCommitInfo(multi.db, 3)
+	require.Nil(t, err)
+	require.NotEqual(t, initCid, flushedCinfo, "CID is different after flush to disk")
+
+	// ... and another.
+	store3 := multi.GetStoreByName("store3").(types.KVStore)
+	store3.Set([]byte(k3), []byte(fmt.Sprintf("%s:%d", v3, 3)))
+
+	multi.Commit(true)
+
+	postFlushCinfo, err := getCommitInfo(multi.db, 4)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), postFlushCinfo.Version, "Commit changed after in-memory commit")
+
+	multi = newMultiStoreWithMounts(db, pruning)
+	err = multi.LoadLatestVersion()
+	require.Nil(t, err)
+
+	reloadedCid := multi.LastCommitID()
+	require.Equal(t, int64(4), reloadedCid.Version, "Reloaded CID is not the same as last flushed CID")
+
+	// Check that store1 and store2 retained date from 3rd commit
+	store1 = multi.GetStoreByName("store1").(types.KVStore)
+	val := store1.Get([]byte(k))
+	require.Equal(t, []byte(fmt.Sprintf("%s:%d", v, 3)), val, "Reloaded value not the same as last flushed value")
+
+	store2 = multi.GetStoreByName("store2").(types.KVStore)
+	val2 := store2.Get([]byte(k2))
+	require.Equal(t, []byte(fmt.Sprintf("%s:%d", v2, 3)), val2, "Reloaded value not the same as last flushed value")
+
+	// Check that store3 still has data from last commit even though update happened on 2nd commit
+	store3 = multi.GetStoreByName("store3").(types.KVStore)
+	val3 := store3.Get([]byte(k3))
+	require.Equal(t, []byte(fmt.Sprintf("%s:%d", v3, 3)), val3, "Reloaded value not the same as last flushed value")
+}
+
+func TestMultiStoreQuery(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	err := multi.LoadLatestVersion()
+	require.Nil(t, err)
+
+	k, v := []byte("wind"), []byte("blows")
+	k2, v2 := []byte("water"), []byte("flows")
+	// v3 := []byte("is cold")
+
+	cid1 := multi.Commit(true)
+
+	// Make sure we can get by name.
+	garbage := multi.GetStoreByName("bad-name")
+	require.Nil(t, garbage)
+
+	// Set and commit data in one store.
+	store1 := multi.GetStoreByName("store1").(types.KVStore)
+	store1.Set(k, v)
+
+	// ... and another.
+	store2 := multi.GetStoreByName("store2").(types.KVStore)
+	store2.Set(k2, v2)
+
+	// Commit the multistore.
+	cid2 := multi.Commit(true)
+	ver := cid2.Version
+
+	// Reload multistore from database
+	multi = newMultiStoreWithMounts(db, types.PruneNothing)
+	err = multi.LoadLatestVersion()
+	require.Nil(t, err)
+
+	// Test bad path.
+	query := abci.RequestQuery{Path: "/key", Data: k, Height: ver}
+	qres := multi.Query(query)
+	require.EqualValues(t, sdkerrors.ErrUnknownRequest.ABCICode(), qres.Code)
+	require.EqualValues(t, sdkerrors.ErrUnknownRequest.Codespace(), qres.Codespace)
+
+	query.Path = "h897fy32890rf63296r92"
+	qres = multi.Query(query)
+	require.EqualValues(t, sdkerrors.ErrUnknownRequest.ABCICode(), qres.Code)
+	require.EqualValues(t, sdkerrors.ErrUnknownRequest.Codespace(), qres.Codespace)
+
+	// Test invalid store name.
+	query.Path = "/garbage/key"
+	qres = multi.Query(query)
+	require.EqualValues(t, sdkerrors.ErrUnknownRequest.ABCICode(), qres.Code)
+	require.EqualValues(t, sdkerrors.ErrUnknownRequest.Codespace(), qres.Codespace)
+
+	// Test valid query with data.
+	query.Path = "/store1/key"
+	qres = multi.Query(query)
+	require.EqualValues(t, 0, qres.Code)
+	require.Equal(t, v, qres.Value)
+
+	// Test valid but empty query.
+	query.Path = "/store2/key"
+	query.Prove = true
+	qres = multi.Query(query)
+	require.EqualValues(t, 0, qres.Code)
+	require.Nil(t, qres.Value)
+
+	// Test store2 data.
+	query.Data = k2
+	qres = multi.Query(query)
+	require.EqualValues(t, 0, qres.Code)
+	require.Equal(t, v2, qres.Value)
+
+	// Test proofs latest height
+	query.Path = fmt.Sprintf("/%s", proofsPath)
+	qres = multi.Query(query)
+	require.EqualValues(t, 0, qres.Code)
+	require.NotNil(t, qres.ProofOps)
+	require.Equal(t, []byte(proofsPath), qres.Key)
+	require.Equal(t, cid2.Hash, qres.Value)
+	require.Equal(t, cid2.Version, qres.Height)
+	require.Equal(t, 3, len(qres.ProofOps.Ops)) // 3 mounted stores
+
+	// Test proofs second latest height
+	query.Height = query.Height - 1
+	qres = multi.Query(query)
+	require.EqualValues(t, 0, qres.Code)
+	require.NotNil(t, qres.ProofOps)
+	require.Equal(t, []byte(proofsPath), qres.Key)
+	require.Equal(t, cid1.Hash, qres.Value)
+	require.Equal(t, cid1.Version, qres.Height)
+	require.Equal(t, 3, len(qres.ProofOps.Ops)) // 3 mounted stores
+}
+
+func TestMultiStoreQueryRelativeHeight(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, multi.LoadLatestVersion())
+
+	k := []byte("key")
+	store1 := multi.GetStoreByName("store1").(types.KVStore)
+	for i := 1; i <= 4; i++ {
+		store1.Set(k, []byte(fmt.Sprintf("value%d", i)))
+		multi.Commit(true)
+	}
+
+	// relative heights are resolved against the latest height, 4
+	for _, path := range []string{"/store1/key", "/" + proofsPath} {
+		for offset := int64(-3); offset < 0; offset++ {
+			relative := multi.Query(abci.RequestQuery{Path: path, Data: k, Height: offset, Prove: true})
+			require.EqualValues(t, 0, relative.Code, relative.Log)
+			absolute := multi.Query(abci.RequestQuery{Path: path, Data: k, Height: 4 + offset, Prove: true})
+			require.Equal(t, absolute, relative)
+			require.Equal(t, 4+offset, relative.Height)
+		}
+	}
+
+	// heights before the first or the earliest available one are rejected
+	qres := multi.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Height: -4})
+	require.EqualValues(t, sdkerrors.ErrInvalidHeight.ABCICode(), qres.Code)
+	require.Contains(t, qres.Log, "relative height -4 resolves to height 0")
+
+	multi.earliestVersion = 2
+	qres = multi.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Height: -3})
+	require.EqualValues(t, sdkerrors.ErrInvalidHeight.ABCICode(), qres.Code)
+	require.Contains(t, qres.Log, "earliest available is 2")
+	qres = multi.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Height: -2})
+	require.EqualValues(t, 0, qres.Code)
+	require.Equal(t, []byte("value2"), qres.Value)
+}
+
+func TestMultiStoreQueryMulti(t *testing.T) {
+	db := &flakyCommitInfoDB{DB: dbm.NewMemDB()}
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, multi.LoadLatestVersion())
+
+	k := []byte("key")
+	for i := 1; i <= 3; i++ {
+		multi.GetStoreByName("store1").(types.KVStore).Set(k, []byte(fmt.Sprintf("store1-%d", i)))
+		multi.GetStoreByName("store2").(types.KVStore).Set(k, []byte(fmt.Sprintf("store2-%d", i)))
+		multi.Commit(true)
+	}
+
+	reqs := []abci.RequestQuery{
+		{Path: "/store2/key", Data: k, Height: 1, Prove: true},
+		{Path: "/store1/key", Data: k, Height: 3, Prove: true},
+		{Path: "/garbage/key", Data: k, Height: 1},
+		{Path: "/store1/key", Data: k, Height: 1, Prove: true},
+		{Path: "/" + proofsPath, Height: 1},
+		{Path: "invalid", Height: 1},
+		{Path: "/store2/key", Data: k, Height: 2, Prove: true},
+		{Path: "/store2/key", Data: k, Height: -2},
+	}
+	db.reads = 0
+	responses := multi.QueryMulti(reqs)
+	require.Len(t, responses, len(reqs))
+
+	// the commit infos of heights 1 and 2 are read once, the latest one is in
+	// memory
+	require.Equal(t, 2, db.reads)
+
+	// the responses are in the order of the requests, and match single queries
+	for i, req := range reqs {
+		require.Equal(t, multi.Query(req), responses[i], "request %d", i)
+	}
+	require.Equal(t, []byte("store2-1"), responses[0].Value)
+	require.Equal(t, []byte("store1-3"), responses[1].Value)
+	require.EqualValues(t, sdkerrors.ErrUnknownRequest.ABCICode(), responses[2].Code)
+	require.Equal(t, []byte("store1-1"), responses[3].Value)
+	require.Equal(t, int64(1), responses[4].Height)
+	require.Len(t, responses[4].ProofOps.Ops, 3)
+	require.EqualValues(t, sdkerrors.ErrUnknownRequest.ABCICode(), responses[5].Code)
+	require.Equal(t, []byte("store2-2"), responses[6].Value)
+	require.Equal(t, []byte("store2-1"), responses[7].Value)
+
+	require.Empty(t, multi.QueryMulti(nil))
+}
+
+func TestMultiStoreQueryPrunedCommitInfo(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, multi.LoadLatestVersion())
+
+	k, v := []byte("wind"), []byte("blows")
+	multi.GetStoreByName("store1").(types.KVStore).Set(k, v)
+	multi.Commit(true) // 1
+	multi.Commit(true) // 2
+	multi.Commit(true) // 3
+
+	// the commit info of height 1 is gone while its tree version is still around
+	require.NoError(t, db.Delete([]byte(fmt.Sprintf(commitInfoKeyFmt, 1))))
+	multi.earliestVersion = 2
+
+	qres := multi.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Height: 1, Prove: true})
+	require.EqualValues(t, sdkerrors.ErrInvalidHeight.ABCICode(), qres.Code)
+	require.EqualValues(t, sdkerrors.ErrInvalidHeight.Codespace(), qres.Codespace)
+	require.Contains(t, qres.Log, "commit info for height 1 is pruned; earliest available is 2")
+
+	// proofs at available heights are unaffected
+	qres = multi.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Height: 2, Prove: true})
+	require.EqualValues(t, 0, qres.Code)
+	require.Equal(t, v, qres.Value)
+
+	// a corrupted commit info is not reported as pruned
+	require.NoError(t, db.Set([]byte(fmt.Sprintf(commitInfoKeyFmt, 2)), []byte{commitInfoLayoutMarker, 0xff}))
+	qres = multi.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Height: 2, Prove: true})
+	require.NotEqualValues(t, 0, qres.Code)
+	require.NotContains(t, qres.Log, "is pruned")
+	require.Contains(t, qres.Log, "unknown commit info layout 255")
+}
+
+// flakyCommitInfoDB fails the given number of commit info reads before
+// delegating to the wrapped DB.
+type flakyCommitInfoDB struct {
+	dbm.DB
+	failures int
+	reads    int
+}
+
+func (db *flakyCommitInfoDB) Get(key []byte) ([]byte, error) {
+	var version int64
+	if _, err := fmt.Sscanf(string(key), commitInfoKeyFmt, &version); err == nil {
+		db.reads++
+		if db.failures > 0 {
+			db.failures--
+			return nil, errors.New("temporary read failure")
+		}
+	}
+	return db.DB.Get(key)
+}
+
+func TestMultiStoreQueryRetryPolicy(t *testing.T) {
+	db := &flakyCommitInfoDB{DB: dbm.NewMemDB()}
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, multi.LoadLatestVersion())
+
+	k, v := []byte("wind"), []byte("blows")
+	multi.GetStoreByName("store1").(types.KVStore).Set(k, v)
+	multi.Commit(true) // 1
+	multi.Commit(true) // 2
+
+	query := abci.RequestQuery{Path: "/store1/key", Data: k, Height: 1, Prove: true}
+
+	// no retries by default
+	db.failures = 1
+	qres := multi.Query(query)
+	require.NotEqualValues(t, 0, qres.Code)
+	require.Contains(t, qres.Log, "temporary read failure")
+
+	// transient failures are retried
+	multi.SetQueryRetryPolicy(3, time.Millisecond)
+	db.failures, db.reads = 3, 0
+	qres = multi.Query(query)
+	require.EqualValues(t, 0, qres.Code, qres.Log)
+	require.Equal(t, v, qres.Value)
+	require.Equal(t, 4, db.reads)
+
+	// but not beyond the maximum
+	db.failures, db.reads = 4, 0
+	qres = multi.Query(query)
+	require.NotEqualValues(t, 0, qres.Code)
+	require.Equal(t, 4, db.reads)
+
+	// missing commit info is not retried
+	require.NoError(t, db.Delete([]byte(fmt.Sprintf(commitInfoKeyFmt, 1))))
+	db.failures, db.reads = 0, 0
+	qres = multi.Query(query)
+	require.EqualValues(t, sdkerrors.ErrInvalidHeight.ABCICode(), qres.Code)
+	require.Equal(t, 1, db.reads)
+}
+
+func TestMultiStore_Pruning(t *testing.T) {
+	testCases := []struct {
+		name        string
+		numVersions int64
+		po          types.PruningOptions
+		deleted     []int64
+		saved       []int64
+	}{
+		{"prune nothing", 10, types.PruneNothing, nil, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{"prune everything", 10, types.PruneEverything, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9}, []int64{10}},
+		{"prune some; no batch", 10, types.NewPruningOptions(2, 3, 1), []int64{1, 2, 4, 5, 7}, []int64{3, 6, 8, 9, 10}},
+		{"prune some; small batch", 10, types.NewPruningOptions(2, 3, 3), []int64{1, 2, 4, 5}, []int64{3, 6, 7, 8, 9, 10}},
+		{"prune some; large batch", 10, types.NewPruningOptions(2, 3, 11), nil, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			db := dbm.NewMemDB()
+			ms := newMultiStoreWithMounts(db, tc.po)
+			require.NoError(t, ms.LoadLatestVersion())
+
+			for i := int64(0); i < tc.numVersions; i++ {
+				ms.Commit(true)
+			}
+
+			for _, v := range tc.saved {
+				_, err := ms.CacheMultiStoreWithVersion(v)
+				require.NoError(t, err, "expected error when loading height: %d", v)
+			}
+
+			for _, v := range tc.deleted {
+				_, err := ms.CacheMultiStoreWithVersion(v)
+				require.NoError(t, err, "expected error when loading height: %d", v)
+			}
+		})
+	}
+}
+
+func TestMultiStore_PruningRestart(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(2, 3, 11))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	// Commit enough to build up heights to prune, where on the next block we should
+	// batch delete.
+	for i := int64(0); i < 10; i++ {
+		ms.Commit(true)
+	}
+
+	pruneHeights := []int64{1, 2, 4, 5, 7}
+
+	// ensure we've persisted the current batch of heights to prune to the store's DB
+	ph, err := getPruningHeights(ms.db)
+	require.NoError(t, err)
+	require.Equal(t, pruneHeights, ph)
+
+	// "restart"
+	ms = newMultiStoreWithMounts(db, types.NewPruningOptions(2, 3, 11))
+	err = ms.LoadLatestVersion()
+	require.NoError(t, err)
+	require.Equal(t, pruneHeights, ms.pruneHeights)
+
+	// commit one more block and ensure the heights have been pruned
+	ms.Commit(true)
+	require.Empty(t, ms.pruneHeights)
+
+	for _, v := range pruneHeights {
+		_, err := ms.CacheMultiStoreWithVersion(v)
+		require.NoError(t, err, "expected error when loading height: %d", v)
+	}
+}
+
+func TestMultiStore_PruningRestartReconcilesQueue(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(2, 3, 11))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	for i := int64(0); i < 10; i++ {
+		ms.Commit(true)
+	}
+	require.Equal(t, []int64{1, 2, 4, 5, 7}, ms.pruneHeights)
+
+	// simulate a prune interrupted before the queue was flushed: heights 1 and 2
+	// are gone from every store, height 4 only from some of them
+	for _, name := range []string{"store1", "store2", "store3"} {
+		store := ms.GetCommitKVStore(ms.keysByName[name]).(*iavl.Store)
+		require.NoError(t, store.DeleteVersions(1, 2))
+		if name == "store1" {
+			require.NoError(t, store.DeleteVersions(4))
+		}
+	}
+
+	// "restart"
+	ms = newMultiStoreWithMounts(db, types.NewPruningOptions(2, 3, 11))
+	require.NoError(t, ms.LoadLatestVersion())
+	require.Equal(t, []int64{4, 5, 7}, ms.pruneHeights)
+
+	// the remaining heights are pruned on the next run
+	ms.Commit(true)
+	require.Empty(t, ms.pruneHeights)
+	for _, name := range []string{"store1", "store2", "store3"} {
+		store := ms.GetCommitKVStore(ms.keysByName[name]).(*iavl.Store)
+		for _, v := range []int64{4, 5, 7} {
+			require.False(t, store.VersionExists(v), "version %d of %s", v, name)
+		}
+	}
+}
+
+func TestEstimatePruneBacklog(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	// no timing history yet, so no estimate can be made
+	ms.pruneHeights = []int64{1, 2, 3}
+	heights, est := ms.EstimatePruneBacklog()
+	require.Equal(t, 3, heights)
+	require.Zero(t, est)
+
+	// 40ms spent pruning 4 heights averages out to 10ms per height
+	ms.recordPruneTiming(2, 30*time.Millisecond)
+	ms.recordPruneTiming(2, 10*time.Millisecond)
+	heights, est = ms.EstimatePruneBacklog()
+	require.Equal(t, 3, heights)
+	require.Equal(t, 30*time.Millisecond, est)
+
+	// only the most recent runs are taken into account
+	for i := 0; i < pruneTimingWindow; i++ {
+		ms.recordPruneTiming(1, time.Millisecond)
+	}
+	require.Len(t, ms.pruneTimings, pruneTimingWindow)
+	_, est = ms.EstimatePruneBacklog()
+	require.Equal(t, 3*time.Millisecond, est)
+}
+
+func TestPendingPruneHeights(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(1, 0, 5))
+	require.NoError(t, ms.LoadLatestVersion())
+	require.Empty(t, ms.PendingPruneHeights())
+
+	// reads are safe while committing
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			require.LessOrEqual(t, len(ms.PendingPruneHeights()), 2)
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		ms.Commit(true)
+	}
+	<-done
+	require.Equal(t, []int64{1, 2}, ms.PendingPruneHeights())
+	require.Equal(t, 2, ms.PendingPruneCount())
+
+	// the returned heights are a copy
+	ms.PendingPruneHeights()[0] = 10
+	require.Equal(t, []int64{1, 2}, ms.PendingPruneHeights())
+
+	// the queue is emptied at the pruning interval
+	ms.Commit(true)
+	require.Empty(t, ms.PendingPruneHeights())
+	require.Zero(t, ms.PendingPruneCount())
+}
+
+// TestPruneStateConcurrentAccess is meant to be run with the race detector.
+func TestPruneStateConcurrentAccess(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(2, 0, 3))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	done := make(chan struct{})
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		for i := 0; i < 50; i++ {
+			ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+			ms.Commit(true)
+		}
+	}()
+	go func() {
+		defer close(done)
+		var earliest int64
+		for {
+			select {
+			case <-committed:
+				return
+			default:
+			}
+			// the earliest version only moves forward
+			current := ms.GetEarliestVersion()
+			require.GreaterOrEqual(t, current, earliest)
+			earliest = current
+			for _, height := range ms.PendingPruneHeights() {
+				require.GreaterOrEqual(t, height, earliest)
+			}
+			ms.EstimatePruneBacklog()
+		}
+	}()
+	<-done
+
+	require.Equal(t, int64(46), ms.GetEarliestVersion())
+	require.Equal(t, []int64{46, 47}, ms.PendingPruneHeights())
+}
+
+func TestCommitThroughput(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	commitsPerSec, keysPerSec := ms.CommitThroughput()
+	require.Zero(t, commitsPerSec)
+	require.Zero(t, keysPerSec)
+
+	// 5 commits of 3 writes each, at most one every 20ms
+	store1 := ms.GetStoreByName("store1").(types.KVStore)
+	store2 := ms.GetStoreByName("store2").(types.KVStore)
+	for i := 0; i < 5; i++ {
+		if i > 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		store1.Set([]byte(fmt.Sprintf("key%d", i)), testValue1)
+		store2.Set([]byte(fmt.Sprintf("key%d", i)), testValue2)
+		store1.Delete(testKey1)
+		ms.Commit(true)
+	}
+
+	commitsPerSec, keysPerSec = ms.CommitThroughput()
+	require.Greater(t, commitsPerSec, 0.0)
+	require.LessOrEqual(t, commitsPerSec, 5/0.08)
+	require.InDelta(t, 3*commitsPerSec, keysPerSec, 1e-9)
+
+	// only the most recent commits are taken into account
+	for i := 0; i < commitTimingWindow; i++ {
+		ms.Commit(true)
+	}
+	require.Len(t, ms.commitTimings, commitTimingWindow)
+	_, keysPerSec = ms.CommitThroughput()
+	require.Zero(t, keysPerSec)
+}
+
+// gaugeSink is a metrics sink recording the labels of the gauges and the
+// samples emitted, by metric name.
+type gaugeSink struct {
+	metrics.BlackholeSink
+	gauges  map[string][][]metrics.Label
+	samples map[string]int
+}
+
+func (s *gaugeSink) SetGaugeWithLabels(key []string, _ float32, labels []metrics.Label) {
+	name := strings.Join(key, ".")
+	s.gauges[name] = append(s.gauges[name], labels)
+}
+
+func (s *gaugeSink) AddSampleWithLabels(key []string, _ float32, _ []metrics.Label) {
+	s.samples[strings.Join(key, ".")]++
+}
+
+func TestCommitMetrics(t *testing.T) {
+	_, err := telemetry.New(telemetry.Config{Enabled: true, ServiceName: "test"})
+	require.NoError(t, err)
+	conf := metrics.DefaultConfig("test")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	sink := &gaugeSink{gauges: map[string][][]metrics.Label{}, samples: map[string]int{}}
+	_, err = metrics.NewGlobal(conf, sink)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = metrics.NewGlobal(conf, &metrics.BlackholeSink{})
+	})
+
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	ms.MountStoreWithDB(types.NewTransientStoreKey("transient"), types.StoreTypeTransient, nil)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.Commit(true)
+
+	require.Equal(t, 1, sink.samples["test.store.commit"])
+	var storeNames []string
+	for _, labels := range sink.gauges["test.store.commit.store_duration_ms"] {
+		for _, label := range labels {
+			if label.Name == "store_name" {
+				storeNames = append(storeNames, label.Value)
+			}
+		}
+	}
+	require.ElementsMatch(t, []string{"store1", "store2", "store3"}, storeNames)
+}
+
+func TestEstimatePruneBacklogRecordsPruneTimings(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(0, 0, 5))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	for i := 0; i < 4; i++ {
+		ms.Commit(true)
+	}
+	heights, _ := ms.EstimatePruneBacklog()
+	require.Equal(t, 3, heights)
+	require.Empty(t, ms.pruneTimings)
+
+	ms.Commit(true)
+	heights, _ = ms.EstimatePruneBacklog()
+	require.Zero(t, heights)
+	require.Len(t, ms.pruneTimings, 1)
+	require.Equal(t, 4, ms.pruneTimings[0].heights)
+}
+
+func TestEstimatePruneBacklogConcurrentWithCommit(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(0, 0, 1))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			ms.Commit(true)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			_, est := ms.EstimatePruneBacklog()
+			require.Zero(t, est)
+			return
+		default:
+			ms.EstimatePruneBacklog()
+		}
+	}
+}
+
+func TestWaitForPruneBacklog(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(0, 0, 5))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	for i := 0; i < 4; i++ {
+		ms.Commit(true)
+	}
+
+	// the backlog of 3 heights is already within the threshold
+	require.NoError(t, ms.WaitForPruneBacklog(context.Background(), 3))
+
+	done := make(chan error)
+	go func() {
+		done <- ms.WaitForPruneBacklog(context.Background(), 0)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("wait returned before pruning: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// the next commit is at the pruning interval and drains the backlog
+	ms.Commit(true)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait did not return after pruning")
+	}
+}
+
+func TestWaitForPruneBacklogCanceled(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(0, 0, 5))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	for i := 0; i < 4; i++ {
+		ms.Commit(true)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, ms.WaitForPruneBacklog(ctx, 0), context.Canceled)
+
+	// runs that leave the backlog above the threshold keep waiting
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ms.Commit(true)
+	ms.Commit(true)
+	require.ErrorIs(t, ms.WaitForPruneBacklog(ctx, 0), context.DeadlineExceeded)
+}
+
+func TestPruneStoresAsync(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(2, 0, 1))
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.SetAsyncPruning(true)
+
+	// prunes are slow enough for commits to happen while one is running
+	var running, overlaps, runs atomic.Int64
+	pruned := make(map[int64]int)
+	ms.asyncPruneHook = func(heights []int64) {
+		if !running.CompareAndSwap(0, 1) {
+			overlaps.Add(1)
+		}
+		runs.Add(1)
+		for _, h := range heights {
+			pruned[h]++
+		}
+		time.Sleep(5 * time.Millisecond)
+		running.Store(0)
+	}
+
+	const commits = 50
+	for i := 0; i < commits; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		ms.Commit(true)
+	}
+	ms.WaitForPruning()
+	require.NoError(t, ms.PruneStoresAsync(context.Background()))
+	ms.WaitForPruning()
+
+	require.Zero(t, overlaps.Load())
+	require.Less(t, runs.Load(), int64(commits-3), "heights should have been queued while pruning")
+	backlog, _ := ms.EstimatePruneBacklog()
+	require.Zero(t, backlog)
+
+	// every height but the recent ones was pruned exactly once
+	store := ms.GetCommitKVStore(testStoreKey1).(*iavl.Store)
+	for h := int64(1); h <= commits; h++ {
+		if h <= commits-3 {
+			require.Equal(t, 1, pruned[h], "height %d", h)
+			require.False(t, store.VersionExists(h), "height %d", h)
+		} else {
+			require.Zero(t, pruned[h], "height %d", h)
+			require.True(t, store.VersionExists(h), "height %d", h)
+		}
+	}
+	require.Equal(t, int64(commits-2), ms.GetEarliestVersion())
+}
+
+func TestPruneStoresAsyncCanceled(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(0, 0, 10))
+	require.NoError(t, ms.LoadLatestVersion())
+	for i := 0; i < 4; i++ {
+		ms.Commit(true)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, ms.PruneStoresAsync(ctx), context.Canceled)
+
+	// heights of a prune canceled while running are queued again
+	ctx, cancel = context.WithCancel(context.Background())
+	ms.asyncPruneHook = func([]int64) { cancel() }
+	require.NoError(t, ms.PruneStoresAsync(ctx))
+	ms.WaitForPruning()
+	require.Equal(t, []int64{1, 2, 3}, ms.pruneHeights)
+	require.True(t, ms.GetCommitKVStore(testStoreKey1).(*iavl.Store).VersionExists(1))
+
+	ms.asyncPruneHook = nil
+	require.NoError(t, ms.PruneStoresAsync(context.Background()))
+	require.NoError(t, ms.Close())
+	require.Empty(t, ms.pruneHeights)
+	require.False(t, ms.GetCommitKVStore(testStoreKey1).(*iavl.Store).VersionExists(1))
+}
+
+type reclaimEstimatingStore struct {
+	types.CommitKVStore
+	bytesPerVersion int64
+	err             error
+}
+
+func (s reclaimEstimatingStore) EstimatePruneReclaim(versions []int64) (int64, error) {
+	return s.bytesPerVersion * int64(len(versions)), s.err
+}
+
+func TestEstimatePruneReclaim(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	ms.MountStoreWithDB(types.NewTransientStoreKey("transient"), types.StoreTypeTransient, nil)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	ms.stores[testStoreKey1] = reclaimEstimatingStore{CommitKVStore: ms.stores[testStoreKey1], bytesPerVersion: 100}
+	ms.stores[testStoreKey2] = reclaimEstimatingStore{CommitKVStore: ms.stores[testStoreKey2], bytesPerVersion: 7}
+
+	res, err := ms.EstimatePruneReclaim([]int64{1, 2, 3})
+	require.NoError(t, err)
+	require.Equal(t, map[string]PruneReclaim{
+		"store1": {Bytes: 300, Supported: true},
+		"store2": {Bytes: 21, Supported: true},
+		"store3": {},
+	}, res)
+
+	ms.stores[testStoreKey2] = reclaimEstimatingStore{CommitKVStore: ms.stores[testStoreKey2], err: fmt.Errorf("boom")}
+	_, err = ms.EstimatePruneReclaim([]int64{1})
+	require.ErrorContains(t, err, "store2")
+}
+
+func TestRecomputeEarliestVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(0, 0, 1))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	// nothing committed yet
+	earliest, err := ms.RecomputeEarliestVersion()
 	require.NoError(t, err)
-	require.Equal(t, int64(2), ci.Version)
-	require.Equal(t, 4, len(ci.StoreInfos), ci.StoreInfos)
-	checkContains(t, ci.StoreInfos, []string{"store1", "restore2", "store3", "store4"})
+	require.Zero(t, earliest)
+
+	for i := 0; i < 12; i++ {
+		ms.GetStoreByName("store1").(types.KVStore).Set([]byte("k"), []byte(fmt.Sprint(i)))
+		ms.Commit(true)
+	}
+
+	// commit infos of pruned versions are kept, but their versions are gone
+	versions, err := getCommitInfoVersions(db)
+	require.NoError(t, err)
+	require.Len(t, versions, 12)
+	require.Equal(t, int64(1), versions[0])
+	require.Equal(t, int64(12), versions[11])
+
+	ms.earliestVersion = 0
+	earliest, err = ms.RecomputeEarliestVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(12), earliest)
+	require.Equal(t, int64(12), ms.GetEarliestVersion())
 }
 
-func TestParsePath(t *testing.T) {
-	_, _, err := parsePath("foo")
-	require.Error(t, err)
+func TestVersionGaps(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
 
-	store, subpath, err := parsePath("/foo")
+	// nothing committed yet
+	gaps, err := ms.VersionGaps()
 	require.NoError(t, err)
-	require.Equal(t, store, "foo")
-	require.Equal(t, subpath, "")
+	require.Empty(t, gaps)
 
-	store, subpath, err = parsePath("/fizz/bang/baz")
+	for i := 0; i < 10; i++ {
+		ms.GetStoreByName("store1").(types.KVStore).Set([]byte("k"), []byte(fmt.Sprint(i)))
+		ms.Commit(true)
+	}
+	gaps, err = ms.VersionGaps()
 	require.NoError(t, err)
-	require.Equal(t, store, "fizz")
-	require.Equal(t, subpath, "/bang/baz")
+	require.Empty(t, gaps)
 
-	substore, subsubpath, err := parsePath(subpath)
+	// holes in the commit infos, and a version deleted from a single store
+	for _, version := range []int64{3, 4, 8} {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf(commitInfoKeyFmt, version))))
+	}
+	require.NoError(t, ms.GetCommitKVStore(testStoreKey1).(*iavl.Store).DeleteVersions(6))
+
+	gaps, err = ms.VersionGaps()
 	require.NoError(t, err)
-	require.Equal(t, substore, "bang")
-	require.Equal(t, subsubpath, "/baz")
+	require.Equal(t, [][2]int64{{3, 4}, {6, 6}, {8, 8}}, gaps)
+
+	// the scan starts at the earliest version
+	ms.earliestVersion = 4
+	gaps, err = ms.VersionGaps()
+	require.NoError(t, err)
+	require.Equal(t, [][2]int64{{4, 4}, {6, 6}, {8, 8}}, gaps)
 
+	// and at the lowest commit info when the earliest version is unknown
+	require.NoError(t, db.Delete([]byte(fmt.Sprintf(commitInfoKeyFmt, 1))))
+	ms.earliestVersion = 0
+	gaps, err = ms.VersionGaps()
+	require.NoError(t, err)
+	require.Equal(t, [][2]int64{{3, 4}, {6, 6}, {8, 8}}, gaps)
 }
 
-func TestMultiStoreRestart(t *testing.T) {
+func TestEarliestVersionIsLowestAvailable(t *testing.T) {
 	db := dbm.NewMemDB()
-	pruning := types.PruningOptions{
-		KeepRecent: 2,
-		KeepEvery:  3,
-		Interval:   1,
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(2, 0, 1))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	for i := 0; i < 10; i++ {
+		ms.GetStoreByName("store1").(types.KVStore).Set([]byte("k"), []byte(fmt.Sprint(i)))
+		ms.Commit(true)
 	}
-	multi := newMultiStoreWithMounts(db, pruning)
-	err := multi.LoadLatestVersion()
-	require.Nil(t, err)
+	earliest := ms.GetEarliestVersion()
+	require.Greater(t, earliest, int64(1))
+	store := ms.GetCommitKVStore(testStoreKey1).(*iavl.Store)
+	require.True(t, store.VersionExists(earliest))
+	require.False(t, store.VersionExists(earliest-1))
+
+	// pruning and a rescan agree, and the earliest version is not a gap
+	recomputed, err := ms.RecomputeEarliestVersion()
+	require.NoError(t, err)
+	require.Equal(t, earliest, recomputed)
+	gaps, err := ms.VersionGaps()
+	require.NoError(t, err)
+	require.Empty(t, gaps)
+}
 
-	initCid := multi.LastCommitID()
+func TestPruneStoresSkipsSnapshotHeights(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(0, 0, 1))
+	require.NoError(t, ms.LoadLatestVersion())
+	iavlStore := ms.GetCommitKVStore(testStoreKey1).(*iavl.Store)
 
-	k, v := "wind", "blows"
-	k2, v2 := "water", "flows"
-	k3, v3 := "fire", "burns"
+	ms.Commit(true)
+	ms.Commit(true)
+	release := ms.holdSnapshotHeight(2)
+	releaseAgain := ms.holdSnapshotHeight(2)
 
-	for i := 1; i < 3; i++ {
-		// Set and commit data in one store.
-		store1 := multi.GetStoreByName("store1").(types.KVStore)
-		store1.Set([]byte(k), []byte(fmt.Sprintf("%s:%d", v, i)))
+	// height 2 is held by a snapshot and kept queued
+	ms.Commit(true)
+	ms.Commit(true)
+	require.Equal(t, []int64{2}, ms.pruneHeights)
+	require.True(t, iavlStore.VersionExists(2))
+	require.False(t, iavlStore.VersionExists(3))
+	require.Equal(t, int64(2), ms.GetEarliestVersion())
+
+	// the height stays held until every snapshot of it is done
+	release()
+	release()
+	ms.Commit(true)
+	require.Equal(t, []int64{2}, ms.pruneHeights)
+	require.True(t, iavlStore.VersionExists(2))
 
-		// ... and another.
-		store2 := multi.GetStoreByName("store2").(types.KVStore)
-		store2.Set([]byte(k2), []byte(fmt.Sprintf("%s:%d", v2, i)))
+	releaseAgain()
+	ms.Commit(true)
+	require.Empty(t, ms.pruneHeights)
+	require.False(t, iavlStore.VersionExists(2))
+	require.Empty(t, ms.snapshotHeights)
+	require.Equal(t, int64(6), ms.GetEarliestVersion())
+}
 
-		// ... and another.
-		store3 := multi.GetStoreByName("store3").(types.KVStore)
-		store3.Set([]byte(k3), []byte(fmt.Sprintf("%s:%d", v3, i)))
+func TestDumpMetadata(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(1, 0, 10))
+	ms.MountStoreWithDB(types.NewTransientStoreKey("transient"), types.StoreTypeTransient, nil)
 
-		multi.Commit(true)
+	// no version is loaded yet
+	buf := new(bytes.Buffer)
+	require.NoError(t, ms.DumpMetadata(buf))
+	require.Contains(t, buf.String(), "latest commit info: none\n")
 
-		cinfo, err := getCommitInfo(multi.db, int64(i))
-		require.NoError(t, err)
-		require.Equal(t, int64(i), cinfo.Version)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.GetStoreByName("store1").(types.KVStore).Set(testKey1, testValue1)
+	for i := 0; i < 4; i++ {
+		ms.Commit(true)
 	}
 
-	// Set and commit data in one store.
-	store1 := multi.GetStoreByName("store1").(types.KVStore)
-	store1.Set([]byte(k), []byte(fmt.Sprintf("%s:%d", v, 3)))
+	buf.Reset()
+	require.NoError(t, ms.DumpMetadata(buf))
+	dump := buf.String()
+
+	require.Contains(t, dump, "latest version: 4\n")
+	require.Contains(t, dump, "earliest version: 0\n")
+	require.Contains(t, dump, "pending prune heights: [1 2]\n")
+	require.Contains(t, dump, "pruning options: keep-recent=1 keep-every=0 interval=10\n")
+	require.Contains(t, dump, "mounted stores:\n  store1: StoreTypeIAVL\n  store2: StoreTypeIAVL\n  store3: StoreTypeIAVL\n  transient: StoreTypeTransient\n")
+	require.Contains(t, dump, fmt.Sprintf("latest commit info: hash=%X\n", ms.LastCommitID().Hash))
+	store1Hash := ms.GetStoreByName("store1").(types.CommitKVStore).LastCommitID().Hash
+	require.Contains(t, dump, fmt.Sprintf("  store1: version=4 hash=%X\n", store1Hash))
+}
 
-	// ... and another.
-	store2 := multi.GetStoreByName("store2").(types.KVStore)
-	store2.Set([]byte(k2), []byte(fmt.Sprintf("%s:%d", v2, 3)))
+func TestSetInitialVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
 
-	multi.Commit(true)
+	require.NoError(t, multi.LoadLatestVersion())
 
-	flushedCinfo, err := getCommitInfo(multi.db, 3)
-	require.Nil(t, err)
-	require.NotEqual(t, initCid, flushedCinfo, "CID is different after flush to disk")
+	require.NoError(t, multi.SetInitialVersion(5))
+	require.Equal(t, int64(5), multi.initialVersion)
 
-	// ... and another.
-	store3 := multi.GetStoreByName("store3").(types.KVStore)
-	store3.Set([]byte(k3), []byte(fmt.Sprintf("%s:%d", v3, 3)))
+	multi.Commit(true)
+	require.Equal(t, int64(5), multi.LastCommitID().Version)
+
+	ckvs := multi.GetCommitKVStore(multi.keysByName["store1"])
+	iavlStore, ok := ckvs.(*iavl.Store)
+	require.True(t, ok)
+	require.True(t, iavlStore.VersionExists(5))
+}
 
+func TestSetInitialVersionAfterCommit(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, multi.LoadLatestVersion())
 	multi.Commit(true)
 
-	postFlushCinfo, err := getCommitInfo(multi.db, 4)
-	require.NoError(t, err)
-	require.Equal(t, int64(4), postFlushCinfo.Version, "Commit changed after in-memory commit")
+	err := multi.SetInitialVersion(5)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidRequest)
+	require.Zero(t, multi.initialVersion)
 
-	multi = newMultiStoreWithMounts(db, pruning)
-	err = multi.LoadLatestVersion()
-	require.Nil(t, err)
+	// the store keeps committing from its latest version
+	require.Equal(t, int64(2), multi.Commit(true).Version)
+}
 
-	reloadedCid := multi.LastCommitID()
-	require.Equal(t, int64(4), reloadedCid.Version, "Reloaded CID is not the same as last flushed CID")
+func TestGenesisCommitInfo(t *testing.T) {
+	t.Run("default initial version", func(t *testing.T) {
+		db := dbm.NewMemDB()
+		multi := newMultiStoreWithMounts(db, types.PruneNothing)
+		require.NoError(t, multi.LoadLatestVersion())
 
-	// Check that store1 and store2 retained date from 3rd commit
-	store1 = multi.GetStoreByName("store1").(types.KVStore)
-	val := store1.Get([]byte(k))
-	require.Equal(t, []byte(fmt.Sprintf("%s:%d", v, 3)), val, "Reloaded value not the same as last flushed value")
+		// nothing has been committed yet
+		_, err := multi.GenesisCommitInfo()
+		require.Error(t, err)
 
-	store2 = multi.GetStoreByName("store2").(types.KVStore)
-	val2 := store2.Get([]byte(k2))
-	require.Equal(t, []byte(fmt.Sprintf("%s:%d", v2, 3)), val2, "Reloaded value not the same as last flushed value")
+		multi.Commit(true)
+		genesis, err := multi.GenesisCommitInfo()
+		require.NoError(t, err)
+		require.Equal(t, multi.LastCommitInfo(), genesis)
 
-	// Check that store3 still has data from last commit even though update happened on 2nd commit
-	store3 = multi.GetStoreByName("store3").(types.KVStore)
-	val3 := store3.Get([]byte(k3))
-	require.Equal(t, []byte(fmt.Sprintf("%s:%d", v3, 3)), val3, "Reloaded value not the same as last flushed value")
-}
+		multi.GetStoreByName("store1").(types.KVStore).Set([]byte("k"), []byte("v"))
+		multi.Commit(true)
+		multi.Commit(true)
 
-func TestMultiStoreQuery(t *testing.T) {
-	db := dbm.NewMemDB()
-	multi := newMultiStoreWithMounts(db, types.PruneNothing)
-	err := multi.LoadLatestVersion()
-	require.Nil(t, err)
+		genesis, err = multi.GenesisCommitInfo()
+		require.NoError(t, err)
+		require.Equal(t, int64(1), genesis.Version)
+		expected, err := getCommitInfo(db, 1)
+		require.NoError(t, err)
+		require.Equal(t, expected, genesis)
+	})
 
-	k, v := []byte("wind"), []byte("blows")
-	k2, v2 := []byte("water"), []byte("flows")
-	// v3 := []byte("is cold")
+	t.Run("custom initial version", func(t *testing.T) {
+		db := dbm.NewMemDB()
+		multi := newMultiStoreWithMounts(db, types.PruneNothing)
+		require.NoError(t, multi.LoadLatestVersion())
+		require.NoError(t, multi.SetInitialVersion(5))
 
-	cid1 := multi.Commit(true)
+		multi.Commit(true)
+		multi.Commit(true)
 
-	// Make sure we can get by name.
-	garbage := multi.GetStoreByName("bad-name")
-	require.Nil(t, garbage)
+		genesis, err := multi.GenesisCommitInfo()
+		require.NoError(t, err)
+		require.Equal(t, int64(5), genesis.Version)
+		expected, err := getCommitInfo(db, 5)
+		require.NoError(t, err)
+		require.Equal(t, expected, genesis)
+	})
 
-	// Set and commit data in one store.
-	store1 := multi.GetStoreByName("store1").(types.KVStore)
-	store1.Set(k, v)
+	t.Run("pruned", func(t *testing.T) {
+		db := dbm.NewMemDB()
+		multi := newMultiStoreWithMounts(db, types.PruneEverything)
+		require.NoError(t, multi.LoadLatestVersion())
 
-	// ... and another.
+		for i := 0; i < 12; i++ {
+			multi.Commit(true)
+		}
+		require.Greater(t, multi.GetEarliestVersion(), int64(1))
+
+		_, err := multi.GenesisCommitInfo()
+		require.Error(t, err)
+	})
+}
+
+func TestChangedStoresBetween(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, multi.LoadLatestVersion())
+
+	store1 := multi.GetStoreByName("store1").(types.KVStore)
 	store2 := multi.GetStoreByName("store2").(types.KVStore)
-	store2.Set(k2, v2)
+	store3 := multi.GetStoreByName("store3").(types.KVStore)
 
-	// Commit the multistore.
-	cid2 := multi.Commit(true)
-	ver := cid2.Version
+	store1.Set([]byte("a"), []byte("1"))
+	store2.Set([]byte("b"), []byte("1"))
+	multi.Commit(true) // 1
 
-	// Reload multistore from database
-	multi = newMultiStoreWithMounts(db, types.PruneNothing)
-	err = multi.LoadLatestVersion()
-	require.Nil(t, err)
+	store1.Set([]byte("a"), []byte("2"))
+	multi.Commit(true) // 2
 
-	// Test bad path.
-	query := abci.RequestQuery{Path: "/key", Data: k, Height: ver}
-	qres := multi.Query(query)
-	require.EqualValues(t, sdkerrors.ErrUnknownRequest.ABCICode(), qres.Code)
-	require.EqualValues(t, sdkerrors.ErrUnknownRequest.Codespace(), qres.Codespace)
+	store3.Set([]byte("c"), []byte("1"))
+	multi.Commit(true) // 3
 
-	query.Path = "h897fy32890rf63296r92"
-	qres = multi.Query(query)
-	require.EqualValues(t, sdkerrors.ErrUnknownRequest.ABCICode(), qres.Code)
-	require.EqualValues(t, sdkerrors.ErrUnknownRequest.Codespace(), qres.Codespace)
+	changed, err := multi.ChangedStoresBetween(1, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"store1"}, changed)
 
-	// Test invalid store name.
-	query.Path = "/garbage/key"
-	qres = multi.Query(query)
-	require.EqualValues(t, sdkerrors.ErrUnknownRequest.ABCICode(), qres.Code)
-	require.EqualValues(t, sdkerrors.ErrUnknownRequest.Codespace(), qres.Codespace)
+	changed, err = multi.ChangedStoresBetween(1, 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"store1", "store3"}, changed)
 
-	// Test valid query with data.
-	query.Path = "/store1/key"
-	qres = multi.Query(query)
-	require.EqualValues(t, 0, qres.Code)
-	require.Equal(t, v, qres.Value)
+	changed, err = multi.ChangedStoresBetween(3, 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"store1", "store3"}, changed)
 
-	// Test valid but empty query.
-	query.Path = "/store2/key"
-	query.Prove = true
-	qres = multi.Query(query)
-	require.EqualValues(t, 0, qres.Code)
-	require.Nil(t, qres.Value)
+	changed, err = multi.ChangedStoresBetween(2, 2)
+	require.NoError(t, err)
+	require.Empty(t, changed)
 
-	// Test store2 data.
-	query.Data = k2
-	qres = multi.Query(query)
-	require.EqualValues(t, 0, qres.Code)
-	require.Equal(t, v2, qres.Value)
+	_, err = multi.ChangedStoresBetween(1, 4)
+	require.Error(t, err)
 
-	// Test proofs latest height
-	query.Path = fmt.Sprintf("/%s", proofsPath)
-	qres = multi.Query(query)
-	require.EqualValues(t, 0, qres.Code)
-	require.NotNil(t, qres.ProofOps)
-	require.Equal(t, []byte(proofsPath), qres.Key)
-	require.Equal(t, cid2.Hash, qres.Value)
-	require.Equal(t, cid2.Version, qres.Height)
-	require.Equal(t, 3, len(qres.ProofOps.Ops)) // 3 mounted stores
+	// stores added by an upgrade are reported as changed
+	restore, upgrades := newMultiStoreWithModifiedMounts(db, types.PruneNothing)
+	require.NoError(t, restore.LoadLatestVersionAndUpgrade(upgrades))
+	restore.Commit(true) // 4
 
-	// Test proofs second latest height
-	query.Height = query.Height - 1
-	qres = multi.Query(query)
-	require.EqualValues(t, 0, qres.Code)
-	require.NotNil(t, qres.ProofOps)
-	require.Equal(t, []byte(proofsPath), qres.Key)
-	require.Equal(t, cid1.Hash, qres.Value)
-	require.Equal(t, cid1.Version, qres.Height)
-	require.Equal(t, 3, len(qres.ProofOps.Ops)) // 3 mounted stores
+	changed, err = restore.ChangedStoresBetween(3, 4)
+	require.NoError(t, err)
+	require.Equal(t, []string{"restore2", "store2", "store3", "store4"}, changed)
 }
 
-func TestMultiStore_Pruning(t *testing.T) {
-	testCases := []struct {
-		name        string
-		numVersions int64
-		po          types.PruningOptions
-		deleted     []int64
-		saved       []int64
-	}{
-		{"prune nothing", 10, types.PruneNothing, nil, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
-		{"prune everything", 10, types.PruneEverything, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9}, []int64{10}},
-		{"prune some; no batch", 10, types.NewPruningOptions(2, 3, 1), []int64{1, 2, 4, 5, 7}, []int64{3, 6, 8, 9, 10}},
-		{"prune some; small batch", 10, types.NewPruningOptions(2, 3, 3), []int64{1, 2, 4, 5}, []int64{3, 6, 7, 8, 9, 10}},
-		{"prune some; large batch", 10, types.NewPruningOptions(2, 3, 11), nil, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
-	}
+func TestQueryableStores(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := NewStore(db, log.NewNopLogger())
+	ms.MountStoreWithDB(types.NewKVStoreKey("iavl2"), types.StoreTypeIAVL, nil)
+	ms.MountStoreWithDB(types.NewKVStoreKey("iavl1"), types.StoreTypeIAVL, nil)
+	ms.MountStoreWithDB(types.NewKVStoreKey("db"), types.StoreTypeDB, nil)
+	ms.MountStoreWithDB(types.NewTransientStoreKey("transient"), types.StoreTypeTransient, nil)
+	ms.MountStoreWithDB(types.NewMemoryStoreKey("memory"), types.StoreTypeMemory, nil)
 
-	for _, tc := range testCases {
-		tc := tc
+	// nothing is queryable until the stores are loaded
+	require.Empty(t, ms.QueryableStores())
+
+	require.NoError(t, ms.LoadLatestVersion())
+	require.Equal(t, []string{"iavl1", "iavl2"}, ms.QueryableStores())
+}
 
-		t.Run(tc.name, func(t *testing.T) {
-			db := dbm.NewMemDB()
-			ms := newMultiStoreWithMounts(db, tc.po)
-			require.NoError(t, ms.LoadLatestVersion())
+// setArchivalValue writes a value of the store at the given version to an
+// archival DB.
+func setArchivalValue(t *testing.T, db dbm.DB, version int64, name string, key, value []byte) {
+	prefix := make([]byte, 8)
+	binary.BigEndian.PutUint64(prefix, uint64(version))
+	prefix = append(prefix, []byte("s/k:"+name+"/")...)
+	require.NoError(t, db.Set(append(prefix, key...), value))
+}
 
-			for i := int64(0); i < tc.numVersions; i++ {
-				ms.Commit(true)
-			}
+func TestSetStoreArchivalDB(t *testing.T) {
+	globalDb, archivalDb1, archivalDb2 := dbm.NewMemDB(), dbm.NewMemDB(), dbm.NewMemDB()
+	setArchivalValue(t, globalDb, 0, "store1", testKey1, []byte("global"))
+	setArchivalValue(t, globalDb, 0, "store2", testKey1, []byte("global"))
+	setArchivalValue(t, globalDb, 0, "store3", testKey1, []byte("global"))
+	setArchivalValue(t, archivalDb1, 0, "store1", testKey1, []byte("archival1"))
+	setArchivalValue(t, archivalDb2, 0, "store2", testKey1, []byte("archival2"))
+
+	ms := NewStoreWithArchival(dbm.NewMemDB(), globalDb, 10, log.NewNopLogger())
+	ms.MountStoreWithDB(testStoreKey1, types.StoreTypeIAVL, nil)
+	ms.MountStoreWithDB(testStoreKey2, types.StoreTypeIAVL, nil)
+	ms.MountStoreWithDB(testStoreKey3, types.StoreTypeIAVL, nil)
+	ms.SetStoreArchivalDB(testStoreKey1, archivalDb1, 10)
+	ms.SetStoreArchivalDB(testStoreKey2, archivalDb2, 10)
+	require.NoError(t, ms.LoadLatestVersion())
 
-			for _, v := range tc.saved {
-				_, err := ms.CacheMultiStoreWithVersion(v)
-				require.NoError(t, err, "expected error when loading height: %d", v)
-			}
+	require.Equal(t, []byte("archival1"), ms.GetKVStore(testStoreKey1).Get(testKey1))
+	require.Equal(t, []byte("archival2"), ms.GetKVStore(testStoreKey2).Get(testKey1))
+	// stores without their own archival DB fall back to the global one
+	require.Equal(t, []byte("global"), ms.GetKVStore(testStoreKey3).Get(testKey1))
 
-			for _, v := range tc.deleted {
-				_, err := ms.CacheMultiStoreWithVersion(v)
-				require.NoError(t, err, "expected error when loading height: %d", v)
-			}
-		})
-	}
+	// versions at or above the store archival version use the main DB, even
+	// when the global archival version is higher
+	ms = NewStoreWithArchival(dbm.NewMemDB(), globalDb, 10, log.NewNopLogger())
+	ms.MountStoreWithDB(testStoreKey1, types.StoreTypeIAVL, nil)
+	ms.SetStoreArchivalDB(testStoreKey1, archivalDb1, 0)
+	require.NoError(t, ms.LoadLatestVersion())
+	require.IsType(t, &iavl.Store{}, ms.GetCommitKVStore(testStoreKey1))
+	require.Nil(t, ms.GetKVStore(testStoreKey1).Get(testKey1))
 }
 
-func TestMultiStore_PruningRestart(t *testing.T) {
+func TestSetIAVLCacheSizeForStore(t *testing.T) {
 	db := dbm.NewMemDB()
-	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(2, 3, 11))
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	ms.SetIAVLCacheSize(100)
+	ms.SetIAVLCacheSizeForStore(testStoreKey1, 5000)
+	ms.SetIAVLCacheSizeForStore(testStoreKey2, 0)
 	require.NoError(t, ms.LoadLatestVersion())
 
-	// Commit enough to build up heights to prune, where on the next block we should
-	// batch delete.
-	for i := int64(0); i < 10; i++ {
-		ms.Commit(true)
-	}
+	require.Equal(t, 5000, ms.iavlCacheSizeFor(testStoreKey1))
+	require.Equal(t, 0, ms.iavlCacheSizeFor(testStoreKey2))
+	// stores without an override use the global size
+	require.Equal(t, 100, ms.iavlCacheSizeFor(testStoreKey3))
 
-	pruneHeights := []int64{1, 2, 4, 5, 7}
+	for _, key := range []types.StoreKey{testStoreKey1, testStoreKey2, testStoreKey3} {
+		ms.GetKVStore(key).Set(testKey1, testValue1)
+	}
+	ms.Commit(true)
+	require.NoError(t, ms.LoadLatestVersion())
+	for _, key := range []types.StoreKey{testStoreKey1, testStoreKey2, testStoreKey3} {
+		require.Equal(t, testValue1, ms.GetKVStore(key).Get(testKey1))
+	}
+}
 
-	// ensure we've persisted the current batch of heights to prune to the store's DB
-	ph, err := getPruningHeights(ms.db)
-	require.NoError(t, err)
-	require.Equal(t, pruneHeights, ph)
+func TestSetIAVLDisableFastNodeForStore(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	ms.SetIAVLDisableFastNode(true)
+	ms.SetIAVLDisableFastNodeForStore(testStoreKey1, false)
+	ms.SetIAVLDisableFastNodeForStore(testStoreKey2, true)
+	require.NoError(t, ms.LoadLatestVersion())
 
-	// "restart"
-	ms = newMultiStoreWithMounts(db, types.NewPruningOptions(2, 3, 11))
-	err = ms.LoadLatestVersion()
-	require.NoError(t, err)
-	require.Equal(t, pruneHeights, ms.pruneHeights)
+	require.False(t, ms.iavlDisableFastNodeFor(testStoreKey1))
+	require.True(t, ms.iavlDisableFastNodeFor(testStoreKey2))
+	// stores without an override use the global setting
+	require.True(t, ms.iavlDisableFastNodeFor(testStoreKey3))
 
-	// commit one more block and ensure the heights have been pruned
+	for _, key := range []types.StoreKey{testStoreKey1, testStoreKey2, testStoreKey3} {
+		ms.GetKVStore(key).Set(testKey1, testValue1)
+	}
 	ms.Commit(true)
-	require.Empty(t, ms.pruneHeights)
+	require.NoError(t, ms.LoadLatestVersion())
 
-	for _, v := range pruneHeights {
-		_, err := ms.CacheMultiStoreWithVersion(v)
-		require.NoError(t, err, "expected error when loading height: %d", v)
+	// only the store with fast nodes enabled was upgraded to the fast storage
+	for key, upgraded := range map[types.StoreKey]bool{testStoreKey1: true, testStoreKey2: false, testStoreKey3: false} {
+		storageVersion, err := dbm.NewPrefixDB(db, []byte("s/k:"+key.Name()+"/")).Get([]byte("mstorage_version"))
+		require.NoError(t, err)
+		require.Equal(t, upgraded, bytes.HasPrefix(storageVersion, []byte("1.1.0")), key.Name())
+		require.Equal(t, testValue1, ms.GetKVStore(key).Get(testKey1))
 	}
 }
 
-func TestSetInitialVersion(t *testing.T) {
+func TestAddArchivalSegment(t *testing.T) {
 	db := dbm.NewMemDB()
-	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	for i := 0; i < 20; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte("main"))
+		ms.Commit(true)
+	}
 
-	require.NoError(t, multi.LoadLatestVersion())
+	segment1, segment2 := dbm.NewMemDB(), dbm.NewMemDB()
+	setArchivalValue(t, segment1, 5, "store1", testKey1, []byte("segment1"))
+	setArchivalValue(t, segment2, 15, "store1", testKey1, []byte("segment2"))
+
+	load := func(version int64) *Store {
+		ms := newMultiStoreWithMounts(db, types.PruneNothing)
+		// added out of order on purpose
+		ms.AddArchivalSegment(10, 19, segment2)
+		ms.AddArchivalSegment(0, 9, segment1)
+		require.NoError(t, ms.LoadVersion(version))
+		return ms
+	}
+	require.Equal(t, []byte("segment1"), load(5).GetKVStore(testStoreKey1).Get(testKey1))
+	require.Equal(t, []byte("segment2"), load(15).GetKVStore(testStoreKey1).Get(testKey1))
+	// versions past the last segment are loaded from the main DB
+	latest := load(20)
+	require.IsType(t, &iavl.Store{}, latest.GetCommitKVStore(testStoreKey1))
+	require.Equal(t, []byte("main"), latest.GetKVStore(testStoreKey1).Get(testKey1))
+
+	require.PanicsWithValue(t, "archival segment [5, 12] overlaps segment [0, 9]", func() {
+		latest.AddArchivalSegment(5, 12, dbm.NewMemDB())
+	})
+	require.PanicsWithValue(t, "archival segment [8, 10] overlaps segment [0, 9]", func() {
+		latest.AddArchivalSegment(8, 10, dbm.NewMemDB())
+	})
+	require.PanicsWithValue(t, "invalid archival segment versions [3, 2]", func() {
+		latest.AddArchivalSegment(3, 2, dbm.NewMemDB())
+	})
+}
 
-	multi.SetInitialVersion(5)
-	require.Equal(t, int64(5), multi.initialVersion)
+func TestStoreChecksums(t *testing.T) {
+	db1, db2 := dbm.NewMemDB(), dbm.NewMemDB()
+	ms1 := newMultiStoreWithMounts(db1, types.PruneNothing)
+	ms2 := newMultiStoreWithMounts(db2, types.PruneNothing)
+	require.NoError(t, ms1.LoadLatestVersion())
+	require.NoError(t, ms2.LoadLatestVersion())
+
+	for _, ms := range []*Store{ms1, ms2} {
+		ms.GetStoreByName("store1").(types.KVStore).Set(testKey1, testValue1)
+		ms.Commit(true) // 1
+		ms.GetStoreByName("store2").(types.KVStore).Set(testKey2, testValue2)
+		ms.Commit(true) // 2
+	}
 
-	multi.Commit(true)
-	require.Equal(t, int64(5), multi.LastCommitID().Version)
+	// the latest version is served from the in-memory commit info
+	checksums1, err := ms1.StoreChecksums(2)
+	require.NoError(t, err)
+	checksums2, err := ms2.StoreChecksums(2)
+	require.NoError(t, err)
+	require.Len(t, checksums1, 3)
+	require.Equal(t, checksums1, checksums2)
+	require.Equal(t, ms1.GetStoreByName("store1").(types.CommitKVStore).LastCommitID().Hash, checksums1["store1"])
 
-	ckvs := multi.GetCommitKVStore(multi.keysByName["store1"])
-	iavlStore, ok := ckvs.(*iavl.Store)
-	require.True(t, ok)
-	require.True(t, iavlStore.VersionExists(5))
+	// older versions are read from disk
+	old1, err := ms1.StoreChecksums(1)
+	require.NoError(t, err)
+	old2, err := ms2.StoreChecksums(1)
+	require.NoError(t, err)
+	require.Equal(t, old1, old2)
+	require.Equal(t, checksums1["store1"], old1["store1"])
+	require.NotEqual(t, checksums1["store2"], old1["store2"])
+
+	// replicas diverge once their state does
+	ms2.GetStoreByName("store3").(types.KVStore).Set(testKey1, testValue1)
+	ms1.Commit(true)
+	ms2.Commit(true)
+	checksums1, err = ms1.StoreChecksums(3)
+	require.NoError(t, err)
+	checksums2, err = ms2.StoreChecksums(3)
+	require.NoError(t, err)
+	require.Equal(t, checksums1["store1"], checksums2["store1"])
+	require.NotEqual(t, checksums1["store3"], checksums2["store3"])
+
+	_, err = ms1.StoreChecksums(4)
+	require.Error(t, err)
 }
 
 func TestAddListenersAndListeningEnabled(t *testing.T) {
@@ -693,6 +3456,329 @@ func TestGetListenWrappedKVStore(t *testing.T) {
 	require.Equal(t, []byte{}, kvPairDelete3Bytes)
 }
 
+func TestGetKVStoreMaxKVSize(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	// unlimited by default
+	store := ms.GetKVStore(testStoreKey1)
+	require.IsType(t, &iavl.Store{}, store)
+	require.NotPanics(t, func() { store.Set(make([]byte, 64), make([]byte, 1024)) })
+
+	ms.SetMaxKVSize(4, 8)
+	store = ms.GetKVStore(testStoreKey1)
+	require.NotPanics(t, func() { store.Set([]byte("keyA"), []byte("value123")) })
+	require.Equal(t, []byte("value123"), store.Get([]byte("keyA")))
+
+	require.PanicsWithValue(t, "key size 5 exceeds maximum of 4 bytes in store store1", func() {
+		store.Set([]byte("keyAB"), []byte("v"))
+	})
+	require.PanicsWithValue(t, "value size 9 exceeds maximum of 8 bytes in store store1", func() {
+		store.Set([]byte("k"), []byte("value1234"))
+	})
+	require.Nil(t, store.Get([]byte("keyAB")))
+	require.Nil(t, store.Get([]byte("k")))
+
+	// a zero limit only disables that limit
+	ms.SetMaxKVSize(0, 8)
+	store = ms.GetKVStore(testStoreKey1)
+	require.NotPanics(t, func() { store.Set(make([]byte, 64), []byte("v")) })
+	require.Panics(t, func() { store.Set([]byte("k"), make([]byte, 9)) })
+
+	// oversized writes of branches are refused when written back
+	cms := ms.CacheMultiStore()
+	cms.GetKVStore(testStoreKey1).Set([]byte("k"), make([]byte, 9))
+	require.PanicsWithValue(t, "value size 9 exceeds maximum of 8 bytes in store store1", cms.Write)
+}
+
+func TestGetKVStoreSafe(t *testing.T) {
+	ms := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.SetTracer(io.Discard)
+
+	kvStore, err := ms.GetKVStoreSafe(testStoreKey1)
+	require.NoError(t, err)
+	require.IsType(t, &tracekv.Store{}, kvStore)
+	kvStore.Set(testKey1, testValue1)
+	require.Equal(t, testValue1, ms.GetKVStore(testStoreKey1).Get(testKey1))
+
+	store, err := ms.GetStoreSafe(testStoreKey1)
+	require.NoError(t, err)
+	require.Equal(t, ms.GetStore(testStoreKey1), store)
+
+	unknown := types.NewKVStoreKey("unknown")
+	_, err = ms.GetKVStoreSafe(unknown)
+	require.ErrorIs(t, err, sdkerrors.ErrNotFound)
+	require.ErrorContains(t, err, "store does not exist for key: unknown")
+	_, err = ms.GetStoreSafe(unknown)
+	require.ErrorIs(t, err, sdkerrors.ErrNotFound)
+	require.ErrorContains(t, err, "store does not exist for key: unknown")
+}
+
+func TestGetKVStoreAccessHook(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	// unhooked by default
+	require.IsType(t, &iavl.Store{}, ms.GetKVStore(testStoreKey1))
+
+	type access struct {
+		op  string
+		key string
+	}
+	var accesses []access
+	ms.SetStoreAccessHook(testStoreKey1, func(op string, key []byte) {
+		accesses = append(accesses, access{op, string(key)})
+	})
+
+	store := ms.GetKVStore(testStoreKey1)
+	store.Set([]byte("a"), []byte("1"))
+	require.Equal(t, []byte("1"), store.Get([]byte("a")))
+	require.True(t, store.Has([]byte("a")))
+	store.Delete([]byte("a"))
+	store.Iterator([]byte("b"), nil).Close()
+	store.ReverseIterator(nil, []byte("c")).Close()
+	require.Equal(t, []access{
+		{StoreAccessSet, "a"},
+		{StoreAccessGet, "a"},
+		{StoreAccessHas, "a"},
+		{StoreAccessDelete, "a"},
+		{StoreAccessIterate, "b"},
+		{StoreAccessReverseIterate, ""},
+	}, accesses)
+
+	// branches report their reads from the store and their writes back to it
+	accesses = nil
+	branch := store.CacheWrap(testStoreKey1).(types.CacheKVStore)
+	branch.Set([]byte("b"), []byte("2"))
+	require.Nil(t, branch.Get([]byte("c")))
+	require.Equal(t, []access{{StoreAccessGet, "c"}}, accesses)
+	branch.Write()
+	require.Equal(t, []access{{StoreAccessGet, "c"}, {StoreAccessSet, "b"}}, accesses)
+
+	// as do the stores of multistore branches, including at past versions
+	accesses = nil
+	cms := ms.CacheMultiStore()
+	require.Equal(t, []byte("2"), cms.GetKVStore(testStoreKey1).Get([]byte("b")))
+	require.Equal(t, []access{{StoreAccessGet, "b"}}, accesses)
+	ms.Commit(true)
+	past, err := ms.CacheMultiStore().CacheMultiStoreWithVersion(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), past.GetKVStore(testStoreKey1).Get([]byte("b")))
+	require.Len(t, accesses, 2)
+
+	// other stores are not hooked
+	accesses = nil
+	ms.GetKVStore(testStoreKey2).Set([]byte("a"), []byte("1"))
+	require.Empty(t, accesses)
+
+	// a nil hook removes it
+	ms.SetStoreAccessHook(testStoreKey1, nil)
+	require.IsType(t, &iavl.Store{}, ms.GetKVStore(testStoreKey1))
+}
+
+func TestGetKVStorePerStoreTracer(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	global, dedicated := &bytes.Buffer{}, &bytes.Buffer{}
+
+	// a dedicated tracer works without a global one
+	ms.SetStoreTracer(testStoreKey1, dedicated)
+	require.False(t, ms.TracingEnabled())
+	ms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+	ms.GetKVStore(testStoreKey2).Set(testKey1, testValue1)
+	require.NotZero(t, dedicated.Len())
+	require.IsType(t, &iavl.Store{}, ms.GetKVStore(testStoreKey2))
+	dedicated.Reset()
+
+	// the dedicated tracer takes precedence over the global one
+	ms.SetTracer(global)
+	ms.GetKVStore(testStoreKey1).Set(testKey2, testValue2)
+	require.NotZero(t, dedicated.Len())
+	require.Zero(t, global.Len())
+	dedicated.Reset()
+
+	// unconfigured stores use the global tracer
+	ms.GetKVStore(testStoreKey2).Set(testKey2, testValue2)
+	require.NotZero(t, global.Len())
+	require.Zero(t, dedicated.Len())
+	global.Reset()
+
+	// removing the override falls back to the global tracer
+	ms.SetStoreTracer(testStoreKey1, nil)
+	ms.GetKVStore(testStoreKey1).Delete(testKey2)
+	require.NotZero(t, global.Len())
+	require.Zero(t, dedicated.Len())
+}
+
+func TestListenerIntrospection(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.Empty(t, ms.AllListenerKeys())
+	require.Nil(t, ms.Listeners(testStoreKey1))
+
+	listener1, listener2, listener3 := &MockListener{}, &MockListener{}, &MockListener{}
+	ms.AddListeners(testStoreKey3, []types.WriteListener{listener3})
+	ms.AddListeners(testStoreKey1, []types.WriteListener{listener1})
+	ms.AddListeners(testStoreKey1, []types.WriteListener{listener2})
+	ms.AddListeners(testStoreKey2, nil)
+
+	require.Equal(t, []types.StoreKey{testStoreKey1, testStoreKey3}, ms.AllListenerKeys())
+	require.Equal(t, []types.WriteListener{listener1, listener2}, ms.Listeners(testStoreKey1))
+	require.Equal(t, []types.WriteListener{listener3}, ms.Listeners(testStoreKey3))
+	require.Nil(t, ms.Listeners(testStoreKey2))
+
+	// the returned listeners are a copy
+	ms.Listeners(testStoreKey1)[0] = listener3
+	require.Equal(t, []types.WriteListener{listener1, listener2}, ms.Listeners(testStoreKey1))
+
+	// suspended listeners are still registered
+	ms.SuspendListeners()
+	require.Equal(t, []types.WriteListener{listener3}, ms.Listeners(testStoreKey3))
+}
+
+func TestGetKVStoreJSONTraceFormat(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	buf := &bytes.Buffer{}
+	ms.SetTracer(buf)
+	ms.SetTracerFormat(tracekv.TraceFormatJSON)
+	ms.SetTracingContext(types.TraceContext{"blockHeight": 64})
+
+	store := ms.GetKVStore(testStoreKey1)
+	store.Set(testKey1, testValue1)
+	require.Equal(t, testValue1, store.Get(testKey1))
+	store.Delete(testKey1)
+
+	type traceLine struct {
+		Op       string                 `json:"op"`
+		Key      string                 `json:"key"`
+		Value    string                 `json:"value"`
+		Metadata map[string]interface{} `json:"metadata"`
+	}
+	var lines []traceLine
+	for _, raw := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var line traceLine
+		require.NoError(t, json.Unmarshal([]byte(raw), &line), raw)
+		lines = append(lines, line)
+	}
+	metadata := map[string]interface{}{"blockHeight": float64(64)}
+	key, value := hex.EncodeToString(testKey1), hex.EncodeToString(testValue1)
+	require.Equal(t, []traceLine{
+		{Op: "write", Key: key, Value: value, Metadata: metadata},
+		{Op: "read", Key: key, Value: value, Metadata: metadata},
+		{Op: "delete", Key: key, Metadata: metadata},
+	}, lines)
+}
+
+func TestSuspendListeners(t *testing.T) {
+	buf := new(bytes.Buffer)
+	var db dbm.DB = dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.AddListeners(testStoreKey1, []types.WriteListener{types.NewStoreKVPairWriteListener(buf, testMarshaller)})
+	require.True(t, ms.ListeningEnabled(testStoreKey1))
+
+	ms.SuspendListeners()
+	require.False(t, ms.ListeningEnabled(testStoreKey1))
+
+	// bulk writes through the store and through a branch fire no events
+	store := ms.GetKVStore(testStoreKey1)
+	require.IsType(t, &iavl.Store{}, store)
+	for i := 0; i < 10; i++ {
+		store.Set([]byte(fmt.Sprintf("key%d", i)), testValue1)
+	}
+	cms := ms.CacheMultiStore()
+	cms.GetKVStore(testStoreKey1).Set(testKey2, testValue2)
+	cms.Write()
+	require.Zero(t, buf.Len())
+
+	ms.ResumeListeners()
+	require.True(t, ms.ListeningEnabled(testStoreKey1))
+
+	ms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+	expected, err := testMarshaller.MarshalLengthPrefixed(&types.StoreKVPair{
+		Key:      testKey1,
+		Value:    testValue1,
+		StoreKey: testStoreKey1.Name(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, expected, buf.Bytes())
+	buf.Reset()
+
+	cms = ms.CacheMultiStore()
+	cms.GetKVStore(testStoreKey1).Set(testKey2, testValue2)
+	cms.Write()
+	require.NotZero(t, buf.Len())
+}
+
+func TestSuspendListenersConcurrentAccess(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.AddListeners(testStoreKey1, []types.WriteListener{types.NewStoreKVPairWriteListener(new(bytes.Buffer), testMarshaller)})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			ms.SuspendListeners()
+			ms.ResumeListeners()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		ms.ListeningEnabled(testStoreKey1)
+		ms.CacheMultiStore()
+	}
+	<-done
+	require.True(t, ms.ListeningEnabled(testStoreKey1))
+}
+
+func TestSetListenerKeyEncoding(t *testing.T) {
+	testCases := []struct {
+		name        string
+		encoding    types.KeyEncoding
+		expectedKey []byte
+		expectedVal []byte
+	}{
+		{"raw", types.KeyEncodingRaw, testKey1, testValue1},
+		{"hex", types.KeyEncodingHex, []byte(hex.EncodeToString(testKey1)), []byte(hex.EncodeToString(testValue1))},
+		{"base64", types.KeyEncodingBase64, []byte(base64.StdEncoding.EncodeToString(testKey1)), []byte(base64.StdEncoding.EncodeToString(testValue1))},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			ms := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+			require.NoError(t, ms.LoadLatestVersion())
+			ms.AddListeners(testStoreKey1, []types.WriteListener{types.NewStoreKVPairWriteListener(buf, testMarshaller)})
+			ms.SetListenerKeyEncoding(tc.encoding)
+
+			expected, err := testMarshaller.MarshalLengthPrefixed(&types.StoreKVPair{
+				Key:      tc.expectedKey,
+				Value:    tc.expectedVal,
+				StoreKey: testStoreKey1.Name(),
+			})
+			require.NoError(t, err)
+
+			ms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+			require.Equal(t, expected, buf.Bytes())
+			buf.Reset()
+
+			// branches apply the encoding as well
+			cms := ms.CacheMultiStore()
+			cms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+			cms.Write()
+			require.Equal(t, expected, buf.Bytes())
+		})
+	}
+}
+
 func TestCacheWraps(t *testing.T) {
 	db := dbm.NewMemDB()
 	multi := newMultiStoreWithMounts(db, types.PruneNothing)
@@ -854,6 +3940,137 @@ func (tl *MockListener) OnWrite(storeKey types.StoreKey, key []byte, value []byt
 	return nil
 }
 
+func TestExportKVStore(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	store := ms.GetKVStore(testStoreKey1)
+	for i := 0; i < 50; i++ {
+		store.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	ms.Commit(true)
+	// later writes are not part of version 1
+	store.Set([]byte("key99"), []byte("value99"))
+	store.Delete([]byte("key00"))
+	ms.Commit(true)
+
+	var expected []types.KVPair
+	immutable, err := ms.GetCommitKVStore(testStoreKey1).(*iavl.Store).GetImmutable(1)
+	require.NoError(t, err)
+	it := immutable.Iterator(nil, nil)
+	for ; it.Valid(); it.Next() {
+		expected = append(expected, types.KVPair{Key: it.Key(), Value: it.Value()})
+	}
+	require.NoError(t, it.Close())
+	require.Len(t, expected, 50)
+
+	var exported []types.KVPair
+	require.NoError(t, ms.ExportKVStore("store1", 1, func(key, value []byte) error {
+		exported = append(exported, types.KVPair{Key: key, Value: value})
+		return nil
+	}))
+	require.Equal(t, expected, exported)
+
+	// an error of w aborts the export
+	errStop := errors.New("stop")
+	count := 0
+	err = ms.ExportKVStore("store1", 1, func(key, value []byte) error {
+		count++
+		if count == 10 {
+			return errStop
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, errStop)
+	require.Equal(t, 10, count)
+
+	err = ms.ExportKVStore("unknown", 1, func(key, value []byte) error { return nil })
+	require.ErrorIs(t, err, sdkerrors.ErrUnknownRequest)
+
+	require.NoError(t, ms.GetCommitKVStore(testStoreKey1).(*iavl.Store).DeleteVersions(1))
+	err = ms.ExportKVStore("store1", 1, func(key, value []byte) error { return nil })
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidHeight)
+}
+
+func TestDiffStore(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	store := ms.GetKVStore(testStoreKey1)
+	store.Set([]byte("a"), []byte("1"))
+	store.Set([]byte("b"), []byte("1"))
+	store.Set([]byte("c"), []byte("1"))
+	store.Set([]byte("e"), []byte("1"))
+	ms.Commit(true)
+
+	store.Set([]byte("0"), []byte("1"))
+	store.Set([]byte("b"), []byte("2"))
+	store.Set([]byte("c"), []byte("1"))
+	store.Delete([]byte("e"))
+	store.Set([]byte("d"), []byte("1"))
+	store.Delete([]byte("a"))
+	store.Set([]byte("f"), []byte("1"))
+	ms.Commit(true)
+
+	added, changed, removed, err := ms.DiffStore("store1", 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("0"), []byte("d"), []byte("f")}, added)
+	require.Equal(t, [][]byte{[]byte("b")}, changed)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("e")}, removed)
+
+	// the diff is symmetric
+	added, changed, removed, err = ms.DiffStore("store1", 2, 1)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("e")}, added)
+	require.Equal(t, [][]byte{[]byte("b")}, changed)
+	require.Equal(t, [][]byte{[]byte("0"), []byte("d"), []byte("f")}, removed)
+
+	added, changed, removed, err = ms.DiffStore("store2", 1, 2)
+	require.NoError(t, err)
+	require.Empty(t, added)
+	require.Empty(t, changed)
+	require.Empty(t, removed)
+
+	_, _, _, err = ms.DiffStore("unknown", 1, 2)
+	require.ErrorIs(t, err, sdkerrors.ErrUnknownRequest)
+
+	require.NoError(t, ms.GetCommitKVStore(testStoreKey1).(*iavl.Store).DeleteVersions(1))
+	_, _, _, err = ms.DiffStore("store1", 1, 2)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidHeight)
+}
+
+func TestReplayState(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	store := ms.GetKVStore(testStoreKey1)
+	for i := 0; i < 50; i++ {
+		store.Set([]byte(fmt.Sprintf("key%02d", i)), []byte{byte(i)})
+	}
+	ms.Commit(true)
+	store.Delete([]byte("key00"))
+	store.Set([]byte("key01"), []byte("updated"))
+	ms.Commit(true)
+
+	listener := &MockListener{}
+	require.NoError(t, ms.ReplayState(testStoreKey1, listener, 2))
+	require.Len(t, listener.stateCache, 49)
+	seen := map[string]bool{}
+	for _, pair := range listener.stateCache {
+		require.Equal(t, "store1", pair.StoreKey)
+		require.False(t, pair.Delete)
+		require.False(t, seen[string(pair.Key)], "key %s replayed twice", pair.Key)
+		seen[string(pair.Key)] = true
+		require.Equal(t, store.Get(pair.Key), pair.Value)
+	}
+	require.False(t, seen["key00"])
+
+	// a pruned version cannot be replayed
+	require.NoError(t, ms.GetCommitKVStore(testStoreKey1).(*iavl.Store).DeleteVersions(1))
+	err := ms.ReplayState(testStoreKey1, &MockListener{}, 1)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidHeight)
+}
+
 func TestStateListeners(t *testing.T) {
 	var db dbm.DB = dbm.NewMemDB()
 	ms := newMultiStoreWithMounts(db, types.NewPruningOptionsFromString(types.PruningOptionNothing))
@@ -888,3 +4105,147 @@ func TestStateListeners(t *testing.T) {
 	cacheMulti.Write()
 	require.Equal(t, 1, len(listener.stateCache))
 }
+
+func TestVerifyVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	for i := 0; i < 3; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		ms.GetKVStore(testStoreKey2).Set(testKey2, []byte{byte(i)})
+		ms.Commit(true)
+	}
+
+	// a clean store passes at every version
+	for version := int64(1); version <= 3; version++ {
+		require.NoError(t, ms.VerifyVersion(version))
+	}
+	require.Error(t, ms.VerifyVersion(4))
+
+	// point store2 at version 3 to the root of version 1
+	storeDB := dbm.NewPrefixDB(db, []byte("s/k:store2/"))
+	rootKey := func(version int64) []byte {
+		key := make([]byte, 9)
+		key[0] = 'r'
+		binary.BigEndian.PutUint64(key[1:], uint64(version))
+		return key
+	}
+	root, err := storeDB.Get(rootKey(1))
+	require.NoError(t, err)
+	require.NoError(t, storeDB.Set(rootKey(3), root))
+
+	err = ms.VerifyVersion(3)
+	require.ErrorIs(t, err, sdkerrors.ErrLogic)
+	require.ErrorContains(t, err, "store store2 hash at version 3")
+	require.NoError(t, ms.VerifyVersion(2))
+}
+
+func TestSetReadOnly(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	for i := 0; i < 3; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		ms.Commit(true)
+	}
+
+	ms = newMultiStoreWithMounts(db, types.PruneNothing)
+	ms.SetReadOnly(true)
+	require.NoError(t, ms.LoadLatestVersion())
+	last := ms.LastCommitID()
+
+	// queries are served
+	require.Equal(t, []byte{2}, ms.GetKVStore(testStoreKey1).Get(testKey1))
+	res := ms.Query(abci.RequestQuery{Path: "/store1/key", Data: testKey1, Height: 2})
+	require.EqualValues(t, 0, res.Code, res.Log)
+	require.Equal(t, []byte{1}, res.Value)
+
+	// writes are refused
+	require.PanicsWithValue(t, "cannot write to read-only store store1", func() {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+	})
+	require.PanicsWithValue(t, "cannot delete from read-only store store1", func() {
+		ms.GetKVStore(testStoreKey1).Delete(testKey1)
+	})
+	cms := ms.CacheMultiStore()
+	cms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+	require.Equal(t, testValue1, cms.GetKVStore(testStoreKey1).Get(testKey1))
+	require.PanicsWithValue(t, "cannot write to read-only store store1", cms.Write)
+	require.Equal(t, []byte{2}, ms.GetKVStore(testStoreKey1).Get(testKey1))
+	require.Equal(t, last, ms.Commit(true))
+	_, err := ms.CommitWithError(true)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidRequest)
+	require.ErrorIs(t, ms.RollbackToVersion(2), sdkerrors.ErrInvalidRequest)
+	ms.PruneStores(false, []int64{1})
+	require.True(t, ms.GetCommitKVStore(testStoreKey1).(*iavl.Store).VersionExists(1))
+	require.Equal(t, last, ms.LastCommitID())
+	require.Equal(t, int64(3), GetLatestVersion(db))
+
+	// writes are accepted again once writable
+	ms.SetReadOnly(false)
+	ms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+	require.Equal(t, int64(4), ms.Commit(true).Version)
+}
+
+func TestHas(t *testing.T) {
+	ms := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	ms.GetKVStore(testStoreKey1).Set(testKey1, testValue1)
+	ms.Commit(true)
+
+	has, err := ms.Has("store1", testKey1)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// absent keys, including in other stores
+	has, err = ms.Has("store1", testKey2)
+	require.NoError(t, err)
+	require.False(t, has)
+	has, err = ms.Has("store2", testKey1)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// uncommitted writes are seen
+	ms.GetKVStore(testStoreKey2).Set(testKey2, testValue2)
+	has, err = ms.Has("store2", testKey2)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	_, err = ms.Has("store4", testKey1)
+	require.ErrorIs(t, err, sdkerrors.ErrUnknownRequest)
+	require.ErrorContains(t, err, "no such store: store4")
+}
+
+func TestLoadVersionPartial(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	for i := 0; i < 3; i++ {
+		ms.GetKVStore(testStoreKey1).Set(testKey1, []byte{byte(i)})
+		ms.GetKVStore(testStoreKey2).Set(testKey2, []byte{byte(i)})
+		ms.Commit(true)
+	}
+	last := ms.LastCommitID()
+
+	ms = newMultiStoreWithMounts(db, types.PruneNothing)
+	require.ErrorIs(t, ms.LoadVersionPartial(2, []string{"store4"}), sdkerrors.ErrInvalidRequest)
+	require.NoError(t, ms.LoadVersionPartial(2, []string{"store2"}))
+
+	// only the named store is loaded, at the requested version
+	require.Equal(t, []byte{1}, ms.GetKVStore(testStoreKey2).Get(testKey2))
+	_, err := ms.GetKVStoreSafe(testStoreKey1)
+	require.ErrorIs(t, err, sdkerrors.ErrNotFound)
+	require.ErrorContains(t, err, "store store1 is unavailable, it was not loaded by LoadVersionPartial")
+	require.Panics(t, func() { ms.GetKVStore(testStoreKey3) })
+
+	// committing is blocked
+	_, err = ms.CommitWithError(true)
+	require.ErrorIs(t, err, sdkerrors.ErrInvalidRequest)
+	require.Equal(t, int64(2), ms.Commit(true).Version)
+	require.Equal(t, last.Version, GetLatestVersion(db))
+
+	// a full load makes every store available again
+	require.NoError(t, ms.LoadLatestVersion())
+	require.Equal(t, []byte{2}, ms.GetKVStore(testStoreKey1).Get(testKey1))
+	require.Equal(t, last, ms.LastCommitID())
+}
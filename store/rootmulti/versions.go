@@ -0,0 +1,217 @@
+package rootmulti
+
+import (
+	stderrors "errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	"github.com/cosmos/cosmos-sdk/store/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// GetVersions returns the sorted versions persisted in the IAVL stores, which
+// can be queried. Unlike the range given by GetEarliestVersion and the latest
+// version, it accounts for the heights removed by pruning, so the versions need
+// not be contiguous. A version is available when every IAVL store holds it,
+// except the stores added by an upgrade after it. Such a store is told apart
+// from a pruned one by its absence from the commit info preceding its first
+// version. An error is returned if that commit info exists but cannot be read.
+func (rs *Store) GetVersions() ([]int64, error) {
+	var held []map[int64]bool
+	var since []int64
+	candidates := map[int64]bool{}
+	for name, key := range rs.keysByName {
+		store, ok := rs.GetCommitKVStore(key).(*iavl.Store)
+		if !ok {
+			continue
+		}
+		available := store.GetAllVersions()
+		if len(available) == 0 {
+			continue
+		}
+		versions := make(map[int64]bool, len(available))
+		first := int64(available[0])
+		for _, v := range available {
+			versions[int64(v)] = true
+			candidates[int64(v)] = true
+			if int64(v) < first {
+				first = int64(v)
+			}
+		}
+		addedAt, err := rs.storeAddedAt(name, first)
+		if err != nil {
+			return nil, err
+		}
+		held = append(held, versions)
+		since = append(since, addedAt)
+	}
+
+	versions := []int64{}
+	for v := range candidates {
+		available := true
+		for i := range held {
+			if v >= since[i] && !held[i][v] {
+				available = false
+				break
+			}
+		}
+		if available {
+			versions = append(versions, v)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+// storeAddedAt returns first if the store with the given name was added at that
+// version, as the commit info of the previous version does not list it, and
+// zero otherwise, including when there is no such commit info, e.g. after a
+// state sync. An error is returned if the commit info cannot be read.
+func (rs *Store) storeAddedAt(name string, first int64) (int64, error) {
+	if first <= 1 {
+		return 0, nil
+	}
+	cInfo, err := rs.commitInfoAt(first - 1)
+	if stderrors.Is(err, errCommitInfoNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, sdkerrors.Wrapf(err, "failed to read commit info at version %d", first-1)
+	}
+	for _, storeInfo := range cInfo.StoreInfos {
+		if storeInfo.Name == name {
+			return 0, nil
+		}
+	}
+	return first, nil
+}
+
+// DumpMetadata writes a human-readable report of the store's commit and pruning
+// metadata to w, for inclusion in support bundles. It covers the latest and
+// earliest versions, the heights pending pruning, the pruning options, the
+// mounted stores and the per-store hashes of the latest commit.
+func (rs *Store) DumpMetadata(w io.Writer) error {
+	var b strings.Builder
+	cInfo := rs.LastCommitInfo()
+
+	fmt.Fprintf(&b, "latest version: %d\n", cInfo.GetVersion())
+	fmt.Fprintf(&b, "earliest version: %d\n", rs.GetEarliestVersion())
+	fmt.Fprintf(&b, "pending prune heights: %v\n", rs.PendingPruneHeights())
+	fmt.Fprintf(&b, "pruning options: keep-recent=%d keep-every=%d interval=%d\n",
+		rs.pruningOpts.KeepRecent, rs.pruningOpts.KeepEvery, rs.pruningOpts.Interval)
+
+	names := make([]string, 0, len(rs.keysByName))
+	for name := range rs.keysByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(&b, "mounted stores:\n")
+	for _, name := range names {
+		params := rs.storesParams[rs.keysByName[name]]
+		fmt.Fprintf(&b, "  %s: %s\n", name, params.typ)
+	}
+
+	if cInfo == nil {
+		fmt.Fprintf(&b, "latest commit info: none\n")
+	} else {
+		storeInfos := append([]types.StoreInfo(nil), cInfo.StoreInfos...)
+		sort.Slice(storeInfos, func(i, j int) bool {
+			return storeInfos[i].Name < storeInfos[j].Name
+		})
+		fmt.Fprintf(&b, "latest commit info: hash=%X\n", cInfo.Hash())
+		for _, si := range storeInfos {
+			fmt.Fprintf(&b, "  %s: version=%d hash=%X\n", si.Name, si.CommitId.Version, si.CommitId.Hash)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// RecomputeEarliestVersion scans the persisted commit infos for the lowest
+// version whose IAVL stores are all still available, and sets the earliest
+// version accordingly. Since the earliest version is otherwise only updated by
+// pruning, this keeps it accurate after a store has been rebuilt, e.g. from a
+// snapshot. Zero is returned if no version is available.
+func (rs *Store) RecomputeEarliestVersion() (int64, error) {
+	versions, err := getCommitInfoVersions(rs.db)
+	if err != nil {
+		return 0, err
+	}
+
+	var earliest int64
+	for _, version := range versions {
+		available, err := rs.versionAvailable(version)
+		if err != nil {
+			return 0, err
+		}
+		if available {
+			earliest = version
+			break
+		}
+	}
+
+	rs.setEarliestVersion(earliest)
+	return earliest, nil
+}
+
+// VersionGaps returns the inclusive ranges of versions missing between the
+// earliest and the latest version, in ascending order. A version is missing
+// when its commit info is not persisted, or when one of its IAVL stores no
+// longer has it, e.g. after pruning specific heights. When the earliest version
+// is unknown, the scan starts at the lowest persisted commit info.
+func (rs *Store) VersionGaps() ([][2]int64, error) {
+	versions, err := getCommitInfoVersions(rs.db)
+	if err != nil {
+		return nil, err
+	}
+	persisted := make(map[int64]bool, len(versions))
+	for _, version := range versions {
+		persisted[version] = true
+	}
+
+	start, latest := rs.GetEarliestVersion(), GetLatestVersion(rs.db)
+	if start <= 0 && len(versions) > 0 {
+		start = versions[0]
+	}
+
+	gaps := [][2]int64{}
+	for version := start; version > 0 && version <= latest; version++ {
+		available := persisted[version]
+		if available {
+			if available, err = rs.versionAvailable(version); err != nil {
+				return nil, err
+			}
+		}
+		if available {
+			continue
+		}
+		if n := len(gaps); n > 0 && gaps[n-1][1] == version-1 {
+			gaps[n-1][1] = version
+		} else {
+			gaps = append(gaps, [2]int64{version, version})
+		}
+	}
+	return gaps, nil
+}
+
+// versionAvailable returns whether every IAVL store committed at the given
+// version still has that version.
+func (rs *Store) versionAvailable(version int64) (bool, error) {
+	cInfo, err := rs.commitInfoAt(version)
+	if err != nil {
+		return false, err
+	}
+	for _, storeInfo := range cInfo.StoreInfos {
+		key, ok := rs.keysByName[storeInfo.Name]
+		if !ok {
+			continue
+		}
+		if store, ok := rs.GetCommitKVStore(key).(*iavl.Store); ok && !store.VersionExists(version) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
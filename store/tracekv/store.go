@@ -2,6 +2,7 @@ package tracekv
 
 import (
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 
@@ -17,6 +18,19 @@ const (
 	iterValueOp operation = "iterValue"
 )
 
+// TraceFormat is the format operations are traced in.
+type TraceFormat int
+
+const (
+	// TraceFormatDefault traces each operation as a JSON object with the
+	// operation, base64 encoded key and value, and metadata.
+	TraceFormatDefault TraceFormat = iota
+	// TraceFormatJSON traces each operation as a JSON object with the op, hex
+	// encoded key and value, and the trace context as metadata, for consumers
+	// which do not want to decode base64.
+	TraceFormatJSON
+)
+
 type (
 	// Store implements the KVStore interface with tracing enabled.
 	// Operations are traced on each core KVStore call and written to the
@@ -28,6 +42,7 @@ type (
 		parent  types.KVStore
 		writer  io.Writer
 		context types.TraceContext
+		format  TraceFormat
 	}
 
 	// operation represents an IO operation
@@ -40,6 +55,14 @@ type (
 		Value     string                 `json:"value"`
 		Metadata  map[string]interface{} `json:"metadata"`
 	}
+
+	// jsonTraceOperation is a traced KVStore operation in TraceFormatJSON
+	jsonTraceOperation struct {
+		Op       operation              `json:"op"`
+		Key      string                 `json:"key"`
+		Value    string                 `json:"value"`
+		Metadata map[string]interface{} `json:"metadata"`
+	}
 )
 
 // NewStore returns a reference to a new traceKVStore given a parent
@@ -48,6 +71,12 @@ func NewStore(parent types.KVStore, writer io.Writer, tc types.TraceContext) *St
 	return &Store{parent: parent, writer: writer, context: tc}
 }
 
+// NewStoreWithFormat is like NewStore, but traces operations in the given
+// format.
+func NewStoreWithFormat(parent types.KVStore, writer io.Writer, tc types.TraceContext, format TraceFormat) *Store {
+	return &Store{parent: parent, writer: writer, context: tc, format: format}
+}
+
 func (tkv *Store) GetWorkingHash() ([]byte, error) {
 	return tkv.parent.GetWorkingHash()
 }
@@ -57,7 +86,7 @@ func (tkv *Store) GetWorkingHash() ([]byte, error) {
 func (tkv *Store) Get(key []byte) []byte {
 	value := tkv.parent.Get(key)
 
-	writeOperation(tkv.writer, readOp, tkv.context, key, value)
+	writeOperation(tkv.writer, tkv.format, readOp, tkv.context, key, value)
 	return value
 }
 
@@ -65,14 +94,14 @@ func (tkv *Store) Get(key []byte) []byte {
 // delegates the Set call to the parent KVStore.
 func (tkv *Store) Set(key []byte, value []byte) {
 	types.AssertValidKey(key)
-	writeOperation(tkv.writer, writeOp, tkv.context, key, value)
+	writeOperation(tkv.writer, tkv.format, writeOp, tkv.context, key, value)
 	tkv.parent.Set(key, value)
 }
 
 // Delete implements the KVStore interface. It traces a write operation and
 // delegates the Delete call to the parent KVStore.
 func (tkv *Store) Delete(key []byte) {
-	writeOperation(tkv.writer, deleteOp, tkv.context, key, nil)
+	writeOperation(tkv.writer, tkv.format, deleteOp, tkv.context, key, nil)
 	tkv.parent.Delete(key)
 }
 
@@ -105,17 +134,18 @@ func (tkv *Store) iterator(start, end []byte, ascending bool) types.Iterator {
 		parent = tkv.parent.ReverseIterator(start, end)
 	}
 
-	return newTraceIterator(tkv.writer, parent, tkv.context)
+	return newTraceIterator(tkv.writer, parent, tkv.context, tkv.format)
 }
 
 type traceIterator struct {
 	parent  types.Iterator
 	writer  io.Writer
 	context types.TraceContext
+	format  TraceFormat
 }
 
-func newTraceIterator(w io.Writer, parent types.Iterator, tc types.TraceContext) types.Iterator {
-	return &traceIterator{writer: w, parent: parent, context: tc}
+func newTraceIterator(w io.Writer, parent types.Iterator, tc types.TraceContext, format TraceFormat) types.Iterator {
+	return &traceIterator{writer: w, parent: parent, context: tc, format: format}
 }
 
 // Domain implements the Iterator interface.
@@ -137,7 +167,7 @@ func (ti *traceIterator) Next() {
 func (ti *traceIterator) Key() []byte {
 	key := ti.parent.Key()
 
-	writeOperation(ti.writer, iterKeyOp, ti.context, key, nil)
+	writeOperation(ti.writer, ti.format, iterKeyOp, ti.context, key, nil)
 	return key
 }
 
@@ -145,7 +175,7 @@ func (ti *traceIterator) Key() []byte {
 func (ti *traceIterator) Value() []byte {
 	value := ti.parent.Value()
 
-	writeOperation(ti.writer, iterValueOp, ti.context, nil, value)
+	writeOperation(ti.writer, ti.format, iterValueOp, ti.context, nil, value)
 	return value
 }
 
@@ -195,16 +225,27 @@ func (tkv *Store) GetAllKeyStrsInRange(start, end []byte) []string {
 }
 
 // writeOperation writes a KVStore operation to the underlying io.Writer as
-// JSON-encoded data where the key/value pair is base64 encoded.
-func writeOperation(w io.Writer, op operation, tc types.TraceContext, key, value []byte) {
-	traceOp := traceOperation{
-		Operation: op,
-		Key:       base64.StdEncoding.EncodeToString(key),
-		Value:     base64.StdEncoding.EncodeToString(value),
-	}
-
-	if tc != nil {
-		traceOp.Metadata = tc
+// JSON-encoded data where the key/value pair is base64 encoded, or hex encoded
+// in TraceFormatJSON.
+func writeOperation(w io.Writer, format TraceFormat, op operation, tc types.TraceContext, key, value []byte) {
+	var traceOp interface{}
+	if format == TraceFormatJSON {
+		traceOp = jsonTraceOperation{
+			Op:       op,
+			Key:      hex.EncodeToString(key),
+			Value:    hex.EncodeToString(value),
+			Metadata: tc,
+		}
+	} else {
+		defaultOp := traceOperation{
+			Operation: op,
+			Key:       base64.StdEncoding.EncodeToString(key),
+			Value:     base64.StdEncoding.EncodeToString(value),
+		}
+		if tc != nil {
+			defaultOp.Metadata = tc
+		}
+		traceOp = defaultOp
 	}
 
 	raw, err := json.Marshal(traceOp)
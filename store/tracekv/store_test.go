@@ -270,6 +270,22 @@ func TestTestTraceKVStoreReverseIterator(t *testing.T) {
 	require.NoError(t, iterator.Close())
 }
 
+func TestTraceKVStoreJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	memDB := dbadapter.Store{DB: dbm.NewMemDB()}
+	tc := types.TraceContext(map[string]interface{}{"blockHeight": 64})
+	store := tracekv.NewStoreWithFormat(memDB, &buf, tc, tracekv.TraceFormatJSON)
+
+	store.Set([]byte("key"), []byte("value"))
+	store.Get([]byte("key"))
+	store.Delete([]byte("key"))
+
+	expectedOut := "{\"op\":\"write\",\"key\":\"6b6579\",\"value\":\"76616c7565\",\"metadata\":{\"blockHeight\":64}}\n" +
+		"{\"op\":\"read\",\"key\":\"6b6579\",\"value\":\"76616c7565\",\"metadata\":{\"blockHeight\":64}}\n" +
+		"{\"op\":\"delete\",\"key\":\"6b6579\",\"value\":\"\",\"metadata\":{\"blockHeight\":64}}\n"
+	require.Equal(t, expectedOut, buf.String())
+}
+
 func TestTraceKVStorePrefix(t *testing.T) {
 	store := newEmptyTraceKVStore(nil)
 	pStore := prefix.NewStore(store, []byte("trace_prefix"))
@@ -1,6 +1,8 @@
 package types
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"io"
 
 	"github.com/cosmos/cosmos-sdk/codec"
@@ -45,3 +47,58 @@ func (wl *StoreKVPairWriteListener) OnWrite(storeKey StoreKey, key []byte, value
 	}
 	return nil
 }
+
+// KeyEncoding defines how the keys and values of write events are encoded
+// before being passed to listeners.
+type KeyEncoding int
+
+const (
+	// KeyEncodingRaw passes keys and values through unchanged.
+	KeyEncodingRaw KeyEncoding = iota
+	// KeyEncodingHex hex-encodes keys and values.
+	KeyEncodingHex
+	// KeyEncodingBase64 encodes keys and values with standard base64.
+	KeyEncodingBase64
+)
+
+// Encode returns bz encoded with the encoding. A nil slice stays nil, so that
+// deletes keep reporting a nil value.
+func (e KeyEncoding) Encode(bz []byte) []byte {
+	if bz == nil {
+		return nil
+	}
+	switch e {
+	case KeyEncodingHex:
+		out := make([]byte, hex.EncodedLen(len(bz)))
+		hex.Encode(out, bz)
+		return out
+	case KeyEncodingBase64:
+		out := make([]byte, base64.StdEncoding.EncodedLen(len(bz)))
+		base64.StdEncoding.Encode(out, bz)
+		return out
+	default:
+		return bz
+	}
+}
+
+// EncodingWriteListener wraps a WriteListener, encoding the keys and values of
+// the write events before passing them on.
+type EncodingWriteListener struct {
+	listener WriteListener
+	encoding KeyEncoding
+}
+
+// NewEncodingWriteListener returns a WriteListener encoding the keys and values
+// passed to listener with the given encoding.
+func NewEncodingWriteListener(listener WriteListener, encoding KeyEncoding) *EncodingWriteListener {
+	return &EncodingWriteListener{
+		listener: listener,
+		encoding: encoding,
+	}
+}
+
+// OnWrite satisfies the WriteListener interface by passing the encoded key and
+// value to the wrapped listener.
+func (l *EncodingWriteListener) OnWrite(storeKey StoreKey, key []byte, value []byte, delete bool) error {
+	return l.listener.OnWrite(storeKey, l.encoding.Encode(key), l.encoding.Encode(value), delete)
+}
@@ -64,3 +64,39 @@ func TestOnWrite(t *testing.T) {
 	testMarshaller.UnmarshalLengthPrefixed(outputBytes, outputKVPair)
 	require.EqualValues(t, expectedOutputKVPair, outputKVPair)
 }
+
+func TestEncodingWriteListener(t *testing.T) {
+	testStoreKey := NewKVStoreKey("test_key")
+	testKey := []byte{0x01, 0xff}
+	testValue := []byte("value")
+
+	testCases := []struct {
+		encoding      KeyEncoding
+		expectedKey   []byte
+		expectedValue []byte
+	}{
+		{KeyEncodingRaw, testKey, testValue},
+		{KeyEncodingHex, []byte("01ff"), []byte("76616c7565")},
+		{KeyEncodingBase64, []byte("Af8="), []byte("dmFsdWU=")},
+	}
+	for _, tc := range testCases {
+		testWriter := new(bytes.Buffer)
+		testMarshaller := codec.NewProtoCodec(types.NewInterfaceRegistry())
+		wl := NewEncodingWriteListener(NewStoreKVPairWriteListener(testWriter, testMarshaller), tc.encoding)
+
+		require.NoError(t, wl.OnWrite(testStoreKey, testKey, testValue, false))
+		outputKVPair := new(StoreKVPair)
+		require.NoError(t, testMarshaller.UnmarshalLengthPrefixed(testWriter.Bytes(), outputKVPair))
+		require.Equal(t, tc.expectedKey, outputKVPair.Key)
+		require.Equal(t, tc.expectedValue, outputKVPair.Value)
+		testWriter.Reset()
+
+		// deletes keep a nil value
+		require.NoError(t, wl.OnWrite(testStoreKey, testKey, nil, true))
+		outputKVPair = new(StoreKVPair)
+		require.NoError(t, testMarshaller.UnmarshalLengthPrefixed(testWriter.Bytes(), outputKVPair))
+		require.Equal(t, tc.expectedKey, outputKVPair.Key)
+		require.Empty(t, outputKVPair.Value)
+		require.True(t, outputKVPair.Delete)
+	}
+}
@@ -40,6 +40,14 @@ type Queryable interface {
 	Query(abci.RequestQuery) abci.ResponseQuery
 }
 
+// VersionedKVStore allows a KVStore to load a read-only view of one of its
+// past versions, e.g. to branch a CacheMultiStore at a version.
+//
+// This is an optional extension to any KVStore
+type VersionedKVStore interface {
+	KVStoreAtVersion(version int64) (KVStore, error)
+}
+
 //----------------------------------------
 // MultiStore
 
@@ -65,6 +73,14 @@ type StoreRename struct {
 	NewKey string `json:"new_key"`
 }
 
+// StoreDescriptor describes a store to be mounted on a multistore. DB is
+// optional; when nil the store is backed by the multistore's database.
+type StoreDescriptor struct {
+	Key  StoreKey
+	Type StoreType
+	DB   dbm.DB
+}
+
 // IsDeleted returns true if the given key should be added
 func (s *StoreUpgrades) IsAdded(key string) bool {
 	if s == nil {
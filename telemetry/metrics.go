@@ -16,6 +16,15 @@ import (
 // metrics emitted using the telemetry package function wrappers.
 var globalLabels = []metrics.Label{}
 
+// globalTelemetryEnabled is set once telemetry has been enabled by New, so that
+// callers can skip computing metrics that would be discarded.
+var globalTelemetryEnabled = false
+
+// IsTelemetryEnabled returns whether telemetry has been enabled.
+func IsTelemetryEnabled() bool {
+	return globalTelemetryEnabled
+}
+
 // Metrics supported format types.
 const (
 	FormatDefault    = ""
@@ -106,6 +115,7 @@ func New(cfg Config) (*Metrics, error) {
 	if _, err := metrics.NewGlobal(metricsConf, fanout); err != nil {
 		return nil, err
 	}
+	globalTelemetryEnabled = true
 
 	return m, nil
 }